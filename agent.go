@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// shellStartup is typed into every shell interactiveShell opens, e.g. to
+// point SSH_AUTH_SOCK to the forwarded agent with ssh -A.
+var shellStartup string
+
+// agentListenScript accepts a connection on the unix socket at path, in a
+// directory only the user can access, with socat or with the OpenBSD nc.
+func agentListenScript(socket string) string {
+	return fmt.Sprintf(`mkdir -p -m 700 %[1]s; rm -f %[2]s; if command -v socat >/dev/null 2>&1; then exec socat UNIX-LISTEN:%[2]s,umask=077 STDIO; else exec nc -lU %[2]s; fi`, path.Dir(socket), socket)
+}
+
+// forwardAgent forwards the local SSH agent to a unix socket on the
+// machine, and returns the path of the socket. Like remote port forwards,
+// the agent answers one connection at a time.
+func forwardAgent(machine string) (string, error) {
+	local := os.Getenv("SSH_AUTH_SOCK")
+	if local == "" {
+		return "", fmt.Errorf("no SSH agent to forward, SSH_AUTH_SOCK is not set")
+	}
+	socket := "/tmp/mist-agent-" + strings.ToLower(randomMarker()[4:20]) + "/agent"
+	relayRemote(machine, agentListenScript(socket), "forward the SSH agent to", func() (net.Conn, error) {
+		return net.Dial("unix", local)
+	})
+	return socket, nil
+}
+
+// remoteKeyPath returns where a key is copied to on a machine, relative to
+// the home directory of the user unless it is absolute.
+func remoteKeyPath(name, dest string) string {
+	if dest == "" {
+		return ".ssh/" + name
+	}
+	return strings.TrimPrefix(dest, "~/")
+}
+
+func cpKeyCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "cp-key KEY MACHINE",
+		Short: "Copy the private key of a key to a machine",
+		Long: `Copy the private key of a key in Mist to a machine, readable only by the
+user, to connect from the machine to other hosts with it. The key is
+written to ~/.ssh/KEY on the machine, or to --path. Existing files are kept
+unless --force is given, and --remove deletes the copy again.
+
+To use keys without leaving copies of them on machines, forward the local
+SSH agent with ssh -A instead.`,
+		Example: `  mist cp-key deploy bastion
+  mist cp-key deploy bastion --path .ssh/id_ed25519 --force
+  mist cp-key deploy bastion --remove`,
+		Args: cobra.ExactArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			switch len(args) {
+			case 0:
+				return keyAutocomplete(cmd, args, toComplete)
+			case 1:
+				return sshAutocomplete(cmd, nil, toComplete)
+			}
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			machine := resolveArg("machine", args[1])
+			remotePath := remoteKeyPath(args[0], params.GetString("path"))
+			shell, err := openRemoteShell(machine)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			defer shell.Close()
+			if params.GetBool("remove") {
+				if _, err := shell.Output("rm -f " + shellQuote(remotePath)); err != nil {
+					logger.Fatalf("Could not remove %s: %s", remotePath, err)
+				}
+				fmt.Printf("Removed %s from %s\n", remotePath, args[1])
+				return
+			}
+			getParams := viper.New()
+			getParams.Set("private", true)
+			_, decoded, _, err := MistApiV2GetKey(args[0], getParams)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			data, _ := decoded["data"].(map[string]interface{})
+			private, _ := data["private"].(string)
+			if private == "" {
+				logger.Fatalf("Key %s has no private key to copy", args[0])
+			}
+			if !strings.HasSuffix(private, "\n") {
+				private += "\n"
+			}
+			write := ">"
+			if !params.GetBool("force") {
+				write = "set -C; >"
+			}
+			command := fmt.Sprintf("umask 077; mkdir -p %s && (%s %s) && printf '%%s' '%s' | base64 -d > %[3]s && chmod 600 %[3]s",
+				shellQuote(path.Dir(remotePath)), write, shellQuote(remotePath), base64.StdEncoding.EncodeToString([]byte(private)))
+			if _, err := shell.Output(command); err != nil {
+				logger.Fatalf("Could not copy the key to %s, use --force to replace an existing one: %s", remotePath, err)
+			}
+			fmt.Printf("Key %s copied to %s on %s\n", args[0], remotePath, args[1])
+		},
+	}
+	cmd.Flags().String("path", "", "Where to write the key on the machine, relative to the home directory, .ssh/KEY by default")
+	cmd.Flags().Bool("force", false, "Replace an existing file")
+	cmd.Flags().Bool("remove", false, "Remove the copied key from the machine")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// Aliases are stored in the config file under aliases, as a map from alias
+// name to the command line it expands to. They are expanded before the
+// arguments are parsed, so "mist lsm -o json" runs the expansion of lsm
+// followed by -o json.
+
+// aliasAnnotation marks the commands standing for aliases, which only
+// exist so that aliases are listed in help and completed.
+const aliasAnnotation = "alias"
+
+// aliasPlaceholder matches the $1, $2... of expansions, replaced by the
+// arguments given after the alias.
+var aliasPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+func savedAliases() map[string]string {
+	return viper.GetStringMapString("aliases")
+}
+
+// writeAliases replaces the aliases of the config file. The file is
+// rewritten from its settings, since setting a map in viper keeps the keys
+// it had when read.
+func writeAliases(aliases map[string]string) error {
+	filename, err := configFilePath()
+	if err != nil {
+		return err
+	}
+	file, err := readConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	settings := file.AllSettings()
+	settings["aliases"] = aliases
+	if len(aliases) == 0 {
+		delete(settings, "aliases")
+	}
+	out := viper.New()
+	out.SetConfigType(configFileType(filename))
+	out.SetConfigPermissions(0600)
+	for key, value := range settings {
+		out.Set(key, value)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return out.WriteConfigAs(filename)
+}
+
+// splitCommandLine splits a command line into words like a shell would,
+// honoring single and double quotes and backslash escapes.
+func splitCommandLine(line string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord, escaped := false, false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", line)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expandAlias returns the command line the alias runs with the arguments
+// given after it: they replace the $1, $2... of the expansion, and those
+// not referred to are appended.
+func expandAlias(expansion string, args []string) ([]string, error) {
+	words, err := splitCommandLine(expansion)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[int]bool)
+	expanded := []string{}
+	for _, word := range words {
+		var missing error
+		word = aliasPlaceholder.ReplaceAllStringFunc(word, func(placeholder string) string {
+			n, _ := strconv.Atoi(placeholder[1:])
+			if n < 1 || n > len(args) {
+				missing = fmt.Errorf("alias expects argument %s", placeholder)
+				return placeholder
+			}
+			used[n] = true
+			return args[n-1]
+		})
+		if missing != nil {
+			return nil, missing
+		}
+		expanded = append(expanded, word)
+	}
+	for i, arg := range args {
+		if !used[i+1] {
+			expanded = append(expanded, arg)
+		}
+	}
+	return expanded, nil
+}
+
+// builtinCommand returns whether name is one of the commands of mist or
+// their aliases, which aliases can't shadow.
+func builtinCommand(name string) bool {
+	if name == "help" || name == "completion" {
+		return true
+	}
+	for _, cmd := range cli.Root.Commands() {
+		if _, ok := cmd.Annotations[aliasAnnotation]; !ok && (cmd.Name() == name || cmd.HasAlias(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAlias checks that the alias doesn't shadow a command and expands to
+// a command of mist. Names are lower case, since viper folds the keys of
+// the config file and the alias would otherwise be saved under another name.
+func checkAlias(name, expansion string) error {
+	if name == "" || strings.ContainsAny(name, ". \t") || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("alias names can't be empty, start with a dash or contain dots or spaces")
+	}
+	if name != strings.ToLower(name) {
+		return fmt.Errorf("alias names must be lower case, like %s", strings.ToLower(name))
+	}
+	if builtinCommand(name) {
+		return fmt.Errorf("%s is already a command", name)
+	}
+	words, err := splitCommandLine(expansion)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 || !builtinCommand(words[0]) {
+		return fmt.Errorf("the expansion must start with a command, like get")
+	}
+	return nil
+}
+
+func aliasAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for name, expansion := range savedAliases() {
+		names = append(names, name+"\t"+expansion)
+	}
+	sort.Strings(names)
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// initAliases adds a command for each alias, so that aliases show in help
+// and complete, and expands the alias being run in os.Args. Aliases
+// shadowing commands are ignored.
+func initAliases() {
+	aliases := savedAliases()
+	for name, expansion := range aliases {
+		if builtinCommand(name) {
+			continue
+		}
+		name := name
+		cli.Root.AddCommand(&cobra.Command{
+			Use:                name,
+			Short:              "Alias for " + expansion,
+			Annotations:        map[string]string{aliasAnnotation: expansion},
+			DisableFlagParsing: true,
+			Run: func(cmd *cobra.Command, args []string) {
+				logger.Fatalf("Alias %s could not be expanded, give flags after it", name)
+			},
+		})
+	}
+	if len(aliases) == 0 || len(os.Args) < 2 {
+		return
+	}
+	args := os.Args[1:]
+	offset := 1
+	if args[0] == cobra.ShellCompRequestCmd || args[0] == cobra.ShellCompNoDescRequestCmd {
+		// The last argument is the word being completed, which is only
+		// expanded once complete.
+		if len(args) < 3 {
+			return
+		}
+		args, offset = args[1:len(args)-1], 2
+	}
+	cmd, _, err := cli.Root.Find(args)
+	if err != nil || cmd.Annotations[aliasAnnotation] == "" {
+		return
+	}
+	for i, arg := range args {
+		if arg != cmd.Name() {
+			continue
+		}
+		expanded, err := expandAlias(cmd.Annotations[aliasAnnotation], args[i+1:])
+		if err != nil {
+			logger.Fatalf("Error expanding alias %s: %s", arg, err)
+		}
+		expanded = append(append([]string{}, os.Args[:offset+i]...), expanded...)
+		os.Args = append(expanded, os.Args[offset+len(args):]...)
+		return
+	}
+}
+
+func aliasSetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set NAME EXPANSION",
+		Short: "Create or change an alias",
+		Long: `Create or change an alias, running the command line it expands to. The
+arguments given after the alias replace the $1, $2... of the expansion, and
+those it doesn't refer to are appended to it. Aliases can't shadow
+commands, and their names are lower case.`,
+		Example: `  mist alias set lsm 'get machines --only name,state'
+  mist alias set lease 'machine extend $1 --by 24h'
+  mist lsm -o json`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+			if err := checkAlias(name, args[1]); err != nil {
+				logger.Fatalf("Invalid alias: %s", err)
+			}
+			aliases := savedAliases()
+			_, changed := aliases[name]
+			aliases[name] = args[1]
+			if err := writeAliases(aliases); err != nil {
+				logger.Fatalf("Error saving alias: %s", err.Error())
+			}
+			if changed {
+				fmt.Printf("Alias %s changed to %s\n", name, args[1])
+				return
+			}
+			fmt.Printf("Alias %s added for %s\n", name, args[1])
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func aliasListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List aliases",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			aliases := savedAliases()
+			names := make([]string, 0, len(aliases))
+			for name := range aliases {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			rows := []interface{}{}
+			for _, name := range names {
+				rows = append(rows, map[string]interface{}{"name": name, "expansion": aliases[name]})
+			}
+			columns := []string{"name", "expansion"}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func aliasDeleteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "delete NAME",
+		Short:             "Delete an alias",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: aliasAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			name := strings.ToLower(args[0])
+			aliases := savedAliases()
+			if _, ok := aliases[name]; !ok {
+				logger.Fatalf("Alias %s not found", args[0])
+			}
+			delete(aliases, name)
+			if err := writeAliases(aliases); err != nil {
+				logger.Fatalf("Error deleting alias: %s", err.Error())
+			}
+			fmt.Printf("Alias %s deleted\n", name)
+		},
+	}
+	return cmd
+}
+
+func aliasCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "alias",
+		Short: "Create shortcuts for command lines",
+		Long: `Create shortcuts for command lines, run like commands of mist.
+
+Aliases are saved in the config file and expanded before the arguments
+are parsed, so flags given after an alias are added to its expansion.`,
+	}
+	cmd.AddCommand(aliasSetCmd())
+	cmd.AddCommand(aliasListCmd())
+	cmd.AddCommand(aliasDeleteCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{"", []string{}, false},
+		{"get machines", []string{"get", "machines"}, false},
+		{"  get\tmachines \n", []string{"get", "machines"}, false},
+		{`get machines --only 'name,state'`, []string{"get", "machines", "--only", "name,state"}, false},
+		{`exec web "uptime -p"`, []string{"exec", "web", "uptime -p"}, false},
+		{`echo 'a "b"'`, []string{"echo", `a "b"`}, false},
+		{`echo "a 'b'"`, []string{"echo", "a 'b'"}, false},
+		{`echo a\ b`, []string{"echo", "a b"}, false},
+		{`echo '\n'`, []string{"echo", `\n`}, false},
+		{`echo ""`, []string{"echo", ""}, false},
+		{`echo 'unterminated`, nil, true},
+		{`echo trailing\`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := splitCommandLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitCommandLine(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitCommandLine(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandAlias(t *testing.T) {
+	tests := []struct {
+		name      string
+		expansion string
+		args      []string
+		want      []string
+		wantErr   bool
+	}{
+		{"no arguments", "get machines", nil, []string{"get", "machines"}, false},
+		{"appended", "get machines", []string{"-o", "json"}, []string{"get", "machines", "-o", "json"}, false},
+		{"placeholder", "machine extend $1 --by 24h", []string{"web"}, []string{"machine", "extend", "web", "--by", "24h"}, false},
+		{"placeholder and rest", "machine extend $1", []string{"web", "--by", "1h"}, []string{"machine", "extend", "web", "--by", "1h"}, false},
+		{"reordered", "tag $2 $1", []string{"a", "b"}, []string{"tag", "b", "a"}, false},
+		{"repeated", "echo $1-$1", []string{"x"}, []string{"echo", "x-x"}, false},
+		{"quoted", `exec $1 'uptime -p'`, []string{"web"}, []string{"exec", "web", "uptime -p"}, false},
+		{"missing argument", "machine extend $1", nil, nil, true},
+		{"zero placeholder", "echo $0", []string{"x"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandAlias(tt.expansion, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandAlias(%q, %q) error = %v, wantErr %v", tt.expansion, tt.args, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandAlias(%q, %q) = %q, want %q", tt.expansion, tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAlias(t *testing.T) {
+	root := cli.Root
+	defer func() { cli.Root = root }()
+	cli.Root = &cobra.Command{Use: "mist"}
+	cli.Root.AddCommand(&cobra.Command{Use: "get", Aliases: []string{"list"}})
+
+	tests := []struct {
+		name      string
+		alias     string
+		expansion string
+		wantErr   bool
+	}{
+		{"valid", "lsm", "get machines", false},
+		{"empty name", "", "get machines", true},
+		{"dash", "-x", "get machines", true},
+		{"dot", "a.b", "get machines", true},
+		{"space", "a b", "get machines", true},
+		{"upper case", "LSM", "get machines", true},
+		{"shadows command", "get", "get machines", true},
+		{"shadows command alias", "list", "get machines", true},
+		{"shadows help", "help", "get machines", true},
+		{"unknown command", "lsm", "machines", true},
+		{"empty expansion", "lsm", "", true},
+		{"unterminated quote", "lsm", "get 'machines", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkAlias(tt.alias, tt.expansion); (err != nil) != tt.wantErr {
+				t.Errorf("checkAlias(%q, %q) error = %v, wantErr %v", tt.alias, tt.expansion, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// manifestKindRank orders kinds that do not reference each other explicitly,
+// so that e.g. clouds are always handled before the machines placed in them.
+var manifestKindRank = map[string]int{
+	"cloud":    0,
+	"key":      1,
+	"network":  1,
+	"script":   1,
+	"secret":   1,
+	"zone":     1,
+	"cluster":  2,
+	"volume":   2,
+	"machine":  3,
+	"rule":     4,
+	"schedule": 4,
+}
+
+// manifestReferences maps each kind's fields to the kind of resource they
+// refer to by name or id.
+var manifestReferences = map[string]map[string]string{
+	"cluster": {"cloud": "cloud"},
+	"machine": {"cloud": "cloud", "key": "key", "networks": "network", "volumes": "volume"},
+	"network": {"cloud": "cloud"},
+	"volume":  {"cloud": "cloud"},
+	"zone":    {"cloud": "cloud"},
+}
+
+var resourceCreateControllersMap map[string]func(params *viper.Viper, body string) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error) = map[string]func(params *viper.Viper, body string) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error){
+	"cloud":    MistApiV2AddCloud,
+	"cluster":  MistApiV2CreateCluster,
+	"key":      MistApiV2AddKey,
+	"machine":  MistApiV2CreateMachine,
+	"network":  MistApiV2CreateNetwork,
+	"rule":     MistApiV2AddRule,
+	"schedule": MistApiV2AddSchedule,
+	"script":   MistApiV2AddScript,
+	"secret":   MistApiV2CreateSecret,
+	"volume":   MistApiV2CreateVolume,
+	"zone":     MistApiV2CreateZone,
+}
+
+var resourceEditControllersMap map[string]func(param string, params *viper.Viper, body string) error = map[string]func(param string, params *viper.Viper, body string) error{
+	"cloud": func(param string, params *viper.Viper, body string) error {
+		_, _, _, err := MistApiV2EditCloud(param, params, body)
+		return err
+	},
+	"machine": func(param string, params *viper.Viper, body string) error {
+		_, _, _, err := MistApiV2EditMachine(param, params, body)
+		return err
+	},
+	"rule": func(param string, params *viper.Viper, body string) error {
+		_, _, _, err := MistApiV2EditRule(param, params, body)
+		return err
+	},
+	"schedule": func(param string, params *viper.Viper, body string) error {
+		_, _, _, err := MistApiV2EditSchedule(param, params, body)
+		return err
+	},
+	"secret": func(param string, params *viper.Viper, body string) error {
+		_, _, _, err := MistApiV2EditSecret(param, params, body)
+		return err
+	},
+}
+
+var resourceDeleteControllersMap map[string]func(param string, params *viper.Viper) error = map[string]func(param string, params *viper.Viper) error{
+	"cloud": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2RemoveCloud(param, params)
+		return err
+	},
+	"cluster": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DestroyCluster(param, params)
+		return err
+	},
+	"key": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DeleteKey(param, params)
+		return err
+	},
+	"machine": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DestroyMachine(param, params)
+		return err
+	},
+	"network": func(param string, params *viper.Viper) error {
+		_, decoded, _, err := MistApiV2GetNetwork(param, viper.New())
+		if err != nil {
+			return err
+		}
+		cloud, _ := jmespath.Search("data.cloud", decoded)
+		_, _, _, err = MistApiV2DeleteNetwork(param, fmt.Sprintf("%v", cloud), params)
+		return err
+	},
+	"rule": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DeleteRule(param, params)
+		return err
+	},
+	"schedule": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DeleteSchedule(param, params)
+		return err
+	},
+	"script": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DeleteScript(param, params)
+		return err
+	},
+	"secret": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DeleteSecret(param, params)
+		return err
+	},
+	"volume": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DeleteVolume(param, params)
+		return err
+	},
+	"zone": func(param string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DeleteZone(param, params)
+		return err
+	},
+}
+
+// manifestEditableFields lists the fields of an existing resource that can
+// be updated in place. Resources of other kinds are left untouched.
+var manifestEditableFields = map[string][]string{
+	"cloud":    {"credentials"},
+	"machine":  {"expiration"},
+	"rule":     {"queries", "window", "frequency", "trigger_after", "actions", "selectors"},
+	"schedule": {"description", "enabled", "action", "selectors", "schedule_type", "schedule_entry", "start_after", "expires", "max_run_count"},
+	"secret":   {"secret"},
+}
+
+type manifestResource struct {
+	Kind string
+	Name string
+	Spec map[string]interface{}
+	deps []*manifestResource
+	pos  int
+}
+
+func (r *manifestResource) String() string {
+	return r.Kind + "/" + r.Name
+}
+
+type planStep struct {
+	Action   string
+	Resource *manifestResource
+	ID       string
+	// Changes lists the fields an update changes.
+	Changes []string
+}
+
+func normalizeManifestKind(kind string) (string, error) {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if _, ok := manifestKindRank[kind]; ok {
+		return kind, nil
+	}
+	if _, ok := manifestKindRank[strings.TrimSuffix(kind, "s")]; ok {
+		return strings.TrimSuffix(kind, "s"), nil
+	}
+	return "", fmt.Errorf("unsupported resource kind %q", kind)
+}
+
+// normalizeYAML converts the map[interface{}]interface{} values produced by
+// the yaml decoder into map[string]interface{} so they can be marshalled
+// into JSON request bodies.
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprintf("%v", k)] = normalizeYAML(val)
+		}
+		return m
+	case map[string]interface{}:
+		for k, val := range t {
+			t[k] = normalizeYAML(val)
+		}
+		return t
+	case []interface{}:
+		for i, val := range t {
+			t[i] = normalizeYAML(val)
+		}
+		return t
+	}
+	return v
+}
+
+func parseManifestDocument(doc interface{}) ([]interface{}, error) {
+	switch t := doc.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		return t, nil
+	case map[string]interface{}:
+		if items, ok := t["resources"]; ok {
+			list, ok := items.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("resources must be a list")
+			}
+			return list, nil
+		}
+		return []interface{}{t}, nil
+	}
+	return nil, fmt.Errorf("unexpected manifest document of type %T", doc)
+}
+
+// readManifest parses a YAML or JSON manifest. A manifest is either a list
+// of resources, a map with a `resources` list, or a stream of YAML
+// documents each describing a single resource. Every resource has a `kind`
+// and a `name`; all remaining fields are passed to the API as is.
+func readManifest(filename string) ([]*manifestResource, error) {
+	var raw []byte
+	var err error
+	if filename == "-" {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resources := []*manifestResource{}
+	seen := make(map[string]bool)
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse manifest: %s", err)
+		}
+		items, err := parseManifestDocument(normalizeYAML(doc))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			spec, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("resource #%d is not a map", len(resources)+1)
+			}
+			rawKind, _ := spec["kind"].(string)
+			kind, err := normalizeManifestKind(rawKind)
+			if err != nil {
+				return nil, fmt.Errorf("resource #%d: %s", len(resources)+1, err)
+			}
+			name, _ := spec["name"].(string)
+			if name == "" {
+				return nil, fmt.Errorf("resource #%d: missing name", len(resources)+1)
+			}
+			delete(spec, "kind")
+			r := &manifestResource{Kind: kind, Name: name, Spec: spec, pos: len(resources)}
+			if seen[r.String()] {
+				return nil, fmt.Errorf("resource %s is defined more than once", r)
+			}
+			seen[r.String()] = true
+			resources = append(resources, r)
+		}
+	}
+	return resources, nil
+}
+
+func referencedNames(value interface{}) []string {
+	switch t := value.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		names := []string{}
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				names = append(names, s)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// resolveManifestDependencies links every resource to the manifest
+// resources it references by name.
+func resolveManifestDependencies(resources []*manifestResource) {
+	byName := make(map[string]*manifestResource)
+	for _, r := range resources {
+		byName[r.String()] = r
+	}
+	for _, r := range resources {
+		for field, kind := range manifestReferences[r.Kind] {
+			for _, name := range referencedNames(r.Spec[field]) {
+				if dep, ok := byName[kind+"/"+name]; ok {
+					r.deps = append(r.deps, dep)
+				}
+			}
+		}
+		sort.Slice(r.deps, func(i, j int) bool { return r.deps[i].pos < r.deps[j].pos })
+	}
+}
+
+// orderManifest returns the resources sorted so that every resource comes
+// after its dependencies. Independent resources are ordered by kind and then
+// by their position in the manifest.
+func orderManifest(resources []*manifestResource) ([]*manifestResource, error) {
+	resolveManifestDependencies(resources)
+	pending := make(map[*manifestResource]int)
+	dependents := make(map[*manifestResource][]*manifestResource)
+	for _, r := range resources {
+		pending[r] = len(r.deps)
+		for _, dep := range r.deps {
+			dependents[dep] = append(dependents[dep], r)
+		}
+	}
+	less := func(a, b *manifestResource) bool {
+		if manifestKindRank[a.Kind] != manifestKindRank[b.Kind] {
+			return manifestKindRank[a.Kind] < manifestKindRank[b.Kind]
+		}
+		return a.pos < b.pos
+	}
+	ready := []*manifestResource{}
+	for _, r := range resources {
+		if pending[r] == 0 {
+			ready = append(ready, r)
+		}
+	}
+	ordered := []*manifestResource{}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool { return less(ready[i], ready[j]) })
+		r := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, r)
+		for _, dependent := range dependents[r] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(ordered) != len(resources) {
+		cycle := []string{}
+		for _, r := range resources {
+			if pending[r] > 0 {
+				cycle = append(cycle, r.String())
+			}
+		}
+		return nil, fmt.Errorf("circular references between %s", strings.Join(cycle, ", "))
+	}
+	return ordered, nil
+}
+
+// lookupResource fetches a resource by name or id, returning nil when it does
+// not exist.
+func lookupResource(kind, name string) (map[string]interface{}, error) {
+	get, ok := resourceGetControllersMap[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported resource kind %q", kind)
+	}
+	resp, decoded, _, err := get(name, viper.New())
+	if err != nil {
+		if resp != nil && resp.StatusCode == 404 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data, _ := decoded["data"].(map[string]interface{})
+	return data, nil
+}
+
+func planManifest(resources []*manifestResource, prune bool) ([]planStep, error) {
+	ordered, err := orderManifest(resources)
+	if err != nil {
+		return nil, err
+	}
+	steps := []planStep{}
+	for _, r := range ordered {
+		live, err := lookupResource(r.Kind, r.Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up %s: %s", r, err)
+		}
+		step := planStep{Action: "create", Resource: r}
+		if live != nil {
+			step.Action = "update"
+			step.ID, _ = live["id"].(string)
+			step.Changes = changedFields(r, live)
+			if len(step.Changes) == 0 {
+				step.Action = "unchanged"
+			}
+		}
+		steps = append(steps, step)
+	}
+	if prune {
+		deletions, err := planPrune(resources)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, deletions...)
+	}
+	return steps, nil
+}
+
+// changedFields returns the editable fields of the resource whose value in
+// the manifest differs from the live one.
+func changedFields(r *manifestResource, live map[string]interface{}) []string {
+	changed := []string{}
+	for field, value := range updateBody(r) {
+		want, _ := json.Marshal(value)
+		have, _ := json.Marshal(live[field])
+		if _, ok := live[field]; !ok || !bytes.Equal(want, have) {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// planPrune returns the deletion of the live resources which are missing
+// from the manifest. Only kinds present in the manifest are considered, and
+// resources are deleted before the ones they may depend on.
+func planPrune(resources []*manifestResource) ([]planStep, error) {
+	wanted := make(map[string]bool)
+	kinds := []string{}
+	for _, r := range resources {
+		if _, ok := resourceDeleteControllersMap[r.Kind]; !ok {
+			continue
+		}
+		if !wanted[r.Kind] {
+			kinds = append(kinds, r.Kind)
+		}
+		wanted[r.Kind] = true
+		wanted[r.String()] = true
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if manifestKindRank[kinds[i]] != manifestKindRank[kinds[j]] {
+			return manifestKindRank[kinds[i]] > manifestKindRank[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	steps := []planStep{}
+	for _, kind := range kinds {
+		params := viper.New()
+		params.Set("only", "id,name")
+		params.Set("limit", 1000)
+		_, decoded, _, err := resourceListControllersMap[kind](params)
+		if err != nil {
+			return nil, fmt.Errorf("could not list %ss: %s", kind, err)
+		}
+		items, _ := decoded["data"].([]interface{})
+		for _, item := range items {
+			live, _ := item.(map[string]interface{})
+			name, _ := live["name"].(string)
+			id, _ := live["id"].(string)
+			r := &manifestResource{Kind: kind, Name: name}
+			if id == "" || wanted[r.String()] {
+				continue
+			}
+			steps = append(steps, planStep{Action: "delete", Resource: r, ID: id})
+		}
+	}
+	return steps, nil
+}
+
+// updateBody returns the editable subset of the resource's spec.
+func updateBody(r *manifestResource) map[string]interface{} {
+	body := make(map[string]interface{})
+	if _, ok := resourceEditControllersMap[r.Kind]; !ok {
+		return body
+	}
+	for _, field := range manifestEditableFields[r.Kind] {
+		if value, ok := r.Spec[field]; ok {
+			body[field] = value
+		}
+	}
+	return body
+}
+
+// resolveReferences returns a copy of the resource's spec where references
+// to other manifest resources are replaced by their ids.
+func resolveReferences(r *manifestResource, ids map[string]string) map[string]interface{} {
+	spec := make(map[string]interface{}, len(r.Spec))
+	for field, value := range r.Spec {
+		spec[field] = value
+	}
+	for field, kind := range manifestReferences[r.Kind] {
+		switch value := spec[field].(type) {
+		case string:
+			if id, ok := ids[kind+"/"+value]; ok {
+				spec[field] = id
+			}
+		case []interface{}:
+			resolved := make([]interface{}, len(value))
+			for i, item := range value {
+				resolved[i] = item
+				if name, ok := item.(string); ok {
+					if id, ok := ids[kind+"/"+name]; ok {
+						resolved[i] = id
+					}
+				}
+			}
+			spec[field] = resolved
+		}
+	}
+	return spec
+}
+
+func responseID(decoded interface{}) string {
+	for _, path := range []string{"id", "data.id"} {
+		value, err := jmespath.Search(path, decoded)
+		if id, ok := value.(string); err == nil && ok && id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// executeStep runs a single step of the plan, recording the id of created
+// resources so later steps can refer to them.
+func executeStep(i int, step planStep, ids map[string]string, params *viper.Viper) error {
+	r := step.Resource
+	switch step.Action {
+	case "create":
+		body, err := json.Marshal(resolveReferences(r, ids))
+		if err != nil {
+			return fmt.Errorf("could not marshal %s: %s", r, err)
+		}
+		_, decoded, _, err := resourceCreateControllersMap[r.Kind](params, string(body))
+		if err != nil {
+			return fmt.Errorf("step %d: could not create %s: %s", i+1, r, err)
+		}
+		id := responseID(decoded)
+		if id == "" {
+			live, err := lookupResource(r.Kind, r.Name)
+			if err == nil && live != nil {
+				id, _ = live["id"].(string)
+			}
+		}
+		if id != "" {
+			ids[r.String()] = id
+		}
+		fmt.Printf(" * %s created\n", r)
+	case "update":
+		spec := resolveReferences(&manifestResource{Kind: r.Kind, Spec: updateBody(r)}, ids)
+		body, err := json.Marshal(spec)
+		if err != nil {
+			return fmt.Errorf("could not marshal %s: %s", r, err)
+		}
+		if err := resourceEditControllersMap[r.Kind](step.ID, params, string(body)); err != nil {
+			return fmt.Errorf("step %d: could not update %s: %s", i+1, r, err)
+		}
+		fmt.Printf(" * %s updated\n", r)
+	case "delete":
+		if err := resourceDeleteControllersMap[r.Kind](step.ID, params); err != nil {
+			return fmt.Errorf("step %d: could not delete %s: %s", i+1, r, err)
+		}
+		fmt.Printf(" * %s deleted\n", r)
+	default:
+		fmt.Printf(" * %s unchanged\n", r)
+	}
+	return nil
+}
+
+// executePlan runs the steps in order, stopping at the first failure. The
+// outcome of every step is recorded in result.
+func executePlan(steps []planStep, params *viper.Viper, result *operationResult) error {
+	ids := make(map[string]string)
+	for _, step := range steps {
+		if step.ID != "" {
+			ids[step.Resource.String()] = step.ID
+		}
+	}
+	for i, step := range steps {
+		if err := executeStep(i, step, ids, params); err != nil {
+			result.fail(step.Resource.String(), err)
+			for _, skipped := range steps[i+1:] {
+				result.skip(skipped.Resource.String())
+			}
+			return err
+		}
+		if step.Action == "unchanged" {
+			result.skip(step.Resource.String())
+		} else {
+			result.succeed(step.Resource.String())
+		}
+	}
+	return nil
+}
+
+// printPlanChanges prints what applying the plan would change.
+func printPlanChanges(steps []planStep) {
+	counts := make(map[string]int)
+	for _, step := range steps {
+		counts[step.Action]++
+		switch step.Action {
+		case "create":
+			fmt.Printf(" + %s\n", step.Resource)
+		case "update":
+			fmt.Printf(" ~ %s (%s)\n", step.Resource, strings.Join(step.Changes, ", "))
+		case "delete":
+			fmt.Printf(" - %s\n", step.Resource)
+		}
+	}
+	fmt.Printf("%d to create, %d to update, %d to delete, %d unchanged\n", counts["create"], counts["update"], counts["delete"], counts["unchanged"])
+}
+
+func formatPlan(steps []planStep, params *viper.Viper) {
+	data := map[string]interface{}{"data": []interface{}{}}
+	for i, step := range steps {
+		deps := []string{}
+		for _, dep := range step.Resource.deps {
+			deps = append(deps, dep.String())
+		}
+		data["data"] = append(data["data"].([]interface{}), map[string]interface{}{
+			"step":       strconv.Itoa(i + 1),
+			"action":     step.Action,
+			"kind":       step.Resource.Kind,
+			"name":       step.Resource.Name,
+			"depends_on": strings.Join(deps, ","),
+			"changes":    strings.Join(step.Changes, ","),
+		})
+	}
+	columns := []string{"step", "action", "kind", "name", "depends_on", "changes"}
+	if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+}
+
+func applyCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "apply -f FILENAME",
+		Short: "Apply a manifest of resources",
+		Long: `Apply a YAML or JSON manifest describing resources.
+
+A manifest is a list of resources, each with a kind, a name and the fields
+accepted by the corresponding create operation. Resources may refer to each
+other by name, e.g. a machine may set "cloud" to a cloud defined in the same
+manifest. Resources are created in dependency order and references are
+resolved to the ids of the resources they point to.
+
+Resources which already exist are compared with the manifest and updated
+when their editable fields differ. With --prune, resources of the kinds in
+the manifest which are not in it are deleted. Use --dry-run to see what
+would change.`,
+		Args: cobra.ExactValidArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			filename := params.GetString("filename")
+			if filename == "" {
+				logger.Fatal("A manifest is required, use -f to specify one")
+			}
+			result := newOperationResult()
+			resources, err := readManifest(filename)
+			if err != nil {
+				result.write(params.GetString("result-file"), 1)
+				logger.Fatalf("Could not read manifest: %s", err.Error())
+			}
+			steps, err := planManifest(resources, params.GetBool("prune"))
+			if err != nil {
+				result.write(params.GetString("result-file"), 1)
+				logger.Fatalf("Could not plan manifest: %s", err.Error())
+			}
+			if params.GetBool("explain-plan") {
+				formatPlan(steps, params)
+				return
+			}
+			if params.GetBool("dry-run") {
+				printPlanChanges(steps)
+				return
+			}
+			if err := executePlan(steps, params, result); err != nil {
+				result.write(params.GetString("result-file"), 1)
+				logger.Fatalf("Apply failed: %s", err.Error())
+			}
+			result.write(params.GetString("result-file"), 0)
+		},
+	}
+	cmd.Flags().StringP("filename", "f", "", "Manifest file, or - for stdin")
+	cmd.Flags().Bool("explain-plan", false, "Print the ordered operations without executing them")
+	cmd.Flags().Bool("dry-run", false, "Print the changes that would be made without making them")
+	cmd.Flags().Bool("prune", false, "Delete the resources of the kinds in the manifest which are not in it")
+	cmd.Flags().String("result-file", "", "Write a JSON summary of the outcome of every resource to a file")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// findUser returns the id of the member of the organization with the email
+// or id.
+func findUser(ref string) (string, error) {
+	params := viper.New()
+	params.Set("limit", 1000)
+	_, decoded, _, err := MistApiV2ListUsers(params)
+	if err != nil {
+		return "", err
+	}
+	for _, user := range responseItems(decoded) {
+		id, _ := user["id"].(string)
+		email, _ := user["email"].(string)
+		if id == ref || strings.EqualFold(email, ref) {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("user %s is not a member of the organization", ref)
+}
+
+// transferOwnership makes the user the owner of the resources, by kind.
+func transferOwnership(userID string, resources map[string][]string) error {
+	return apiV1Request("POST", "ownership", map[string]interface{}{"user_id": userID, "resources": resources}, nil)
+}
+
+// grantTeam adds rules allowing the team every action on the resources of
+// the kind to the front of its policy, as the first rule matching an
+// action decides. It returns the number of rules added.
+func grantTeam(org rbacOrg, team, kind string, ids []string) (int, error) {
+	for _, t := range org.Teams {
+		if t.ID != team && !strings.EqualFold(t.Name, team) {
+			continue
+		}
+		rules := []rbacRule{}
+		for _, id := range ids {
+			granted := false
+			for _, rule := range t.Policy.Rules {
+				granted = granted || strings.EqualFold(rule.Operator, "allow") && rule.Action == "" && rule.Rtype == kind && rule.Rid == id
+			}
+			if !granted {
+				rules = append(rules, rbacRule{Operator: "allow", Rtype: kind, Rid: id})
+			}
+		}
+		if len(rules) == 0 {
+			return 0, nil
+		}
+		policy := map[string]interface{}{"operator": t.Policy.Operator, "rules": append(rules, t.Policy.Rules...)}
+		return len(rules), apiV1Request("PUT", fmt.Sprintf("org/%s/teams/%s/policy", org.ID, t.ID), map[string]interface{}{"policy": policy}, nil)
+	}
+	return 0, fmt.Errorf("team %s not found in organization %s", team, org.Name)
+}
+
+// assignCmd returns the command assigning resources of the kind, or of the
+// kind given as the first argument if kind is empty.
+func assignCmd(kind string) *cobra.Command {
+	params := viper.New()
+	use, example := "assign KIND [NAME...]", `  mist assign machine web-1 web-2 --owner alice@example.com
+  mist assign volume --search 'tag:team=web' --team web
+  mist assign machine --search 'tag:env=prod' --owner ops@example.com --team ops`
+	if kind != "" {
+		use, example = "assign [NAME...]", fmt.Sprintf(`  mist %[1]s assign web-1 --owner alice@example.com
+  mist %[1]s assign --search 'tag:team=web' --team web`, kind)
+	}
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: "Assign resources to an owner or a team",
+		Long: fmt.Sprintf(`Transfer the ownership of resources to a member of the organization, given
+by email or id, with --owner, and give a team every permission on them
+with --team, by adding rules for them to the front of the policy of the
+team. Resources are given by name or id, or are all the resources matching
+--search.
+
+Resources can be of kind %s.`, strings.Join(taggableResources, ", ")),
+		Example: example,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if kind != "" {
+				return nil
+			}
+			if len(args) == 0 {
+				return fmt.Errorf("give the kind of resources to assign")
+			}
+			if _, ok := resourceListControllersMap[args[0]]; !ok {
+				return fmt.Errorf("resources of kind %s can't be assigned, expected one of %s", args[0], strings.Join(taggableResources, ", "))
+			}
+			return nil
+		},
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if kind == "" && len(args) == 0 {
+				return taggableResources, cobra.ShellCompDirectiveNoFileComp
+			}
+			k := kind
+			if k == "" {
+				k = args[0]
+			}
+			return completeResourceFlag(k)(cmd, args, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			k := kind
+			if k == "" {
+				k, args = args[0], args[1:]
+			}
+			owner, team := params.GetString("owner"), params.GetString("team")
+			if owner == "" && team == "" {
+				logger.Fatal("Give --owner, --team or both")
+			}
+			resources, err := resolveResources(k, args, params.GetString("search"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if len(resources) == 0 {
+				logger.Fatalf("No %ss given, give their names or use --search", k)
+			}
+			ids := []string{}
+			for _, resource := range resources {
+				ids = append(ids, resource.id)
+				fmt.Printf(" * %s (%s)\n", resource.name, resource.id)
+			}
+			if !params.GetBool("yes") && !confirmAction("Assign", len(resources), k) {
+				fmt.Println("Cancelled")
+				return
+			}
+			if owner != "" {
+				userID, err := findUser(owner)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				if err := transferOwnership(userID, map[string][]string{k: ids}); err != nil {
+					logger.Fatalf("Could not transfer the ownership: %s", err)
+				}
+				fmt.Printf("%d %ss now owned by %s\n", len(ids), k, owner)
+			}
+			if team != "" {
+				var org rbacOrg
+				if err := apiV1Get("org", &org); err != nil {
+					logger.Fatalf("Could not read the teams of the organization: %s", err)
+				}
+				added, err := grantTeam(org, team, k, ids)
+				if err != nil {
+					logger.Fatalf("Could not update the policy of team %s: %s", team, err)
+				}
+				fmt.Printf("%d %ss assigned to team %s, %d rules added\n", len(ids), k, team, added)
+			}
+		},
+	}
+	cmd.Flags().String("owner", "", "Member to transfer the ownership to, by email or id")
+	cmd.Flags().String("team", "", "Team to give every permission on the resources, by name or id")
+	cmd.Flags().String("search", "", "Assign the resources matching the search query")
+	cmd.Flags().BoolP("yes", "y", false, "Assign without asking for confirmation")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// auditFilter selects events by user, given by email or id, action and
+// type. The API is asked to filter too, but it ignores filters it doesn't
+// know, so events are also filtered here.
+type auditFilter struct {
+	user      string
+	action    string
+	eventType string
+}
+
+func (f auditFilter) matches(event map[string]interface{}) bool {
+	if f.user != "" {
+		email, _ := event["email"].(string)
+		userID, _ := event["user_id"].(string)
+		if !strings.EqualFold(email, f.user) && userID != f.user {
+			return false
+		}
+	}
+	if f.action != "" && event["action"] != f.action {
+		return false
+	}
+	return f.eventType == "" || event["type"] == f.eventType
+}
+
+// auditEvents fetches the events between start and end matching the filter,
+// newest first, up to limit unless it is 0. Events are returned newest
+// first, so pages are fetched by moving the end of the period to the time
+// of the oldest event received.
+func auditEvents(start, end time.Time, filter auditFilter, limit int) ([]map[string]interface{}, error) {
+	events := []map[string]interface{}{}
+	seen := map[string]bool{}
+	stop := float64(end.UnixNano()) / float64(time.Second)
+	for {
+		query := url.Values{}
+		query.Set("start", strconv.FormatInt(start.Unix(), 10))
+		query.Set("stop", strconv.FormatFloat(stop, 'f', -1, 64))
+		query.Set("limit", strconv.Itoa(logsPageSize))
+		if filter.action != "" {
+			query.Set("action", filter.action)
+		}
+		if filter.eventType != "" {
+			query.Set("event_type", filter.eventType)
+		}
+		var decoded interface{}
+		if err := apiV1Get("logs?"+query.Encode(), &decoded); err != nil {
+			return nil, err
+		}
+		if data, ok := decoded.(map[string]interface{}); ok {
+			decoded = data["data"]
+		}
+		page, _ := decoded.([]interface{})
+		added := 0
+		for _, item := range page {
+			event, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// The event at the end of a page starts the next one too.
+			key, _ := json.Marshal(event)
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			added++
+			if t, ok := event["time"].(float64); ok && t < stop {
+				stop = t
+			}
+			if filter.matches(event) {
+				events = append(events, event)
+				if limit > 0 && len(events) == limit {
+					return events, nil
+				}
+			}
+		}
+		if len(page) < logsPageSize || added == 0 {
+			return events, nil
+		}
+	}
+}
+
+// auditRow flattens an event to the columns of the audit log, keeping the
+// fields of the event for the wide and exported output.
+func auditRow(event map[string]interface{}) map[string]interface{} {
+	row := map[string]interface{}{}
+	for key, value := range event {
+		row[key] = value
+	}
+	row["resource"], row["error"] = "", ""
+	for key, value := range logRow(event) {
+		row[key] = value
+	}
+	return row
+}
+
+// exportAuditEvents writes the rows to a file, as CSV or JSON by the
+// extension of its name.
+func exportAuditEvents(path string, rows []interface{}, columns []string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return writeCSV(f, map[string]interface{}{"data": rows}, nil, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}})
+	case ".json":
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+	return fmt.Errorf("can't export to %s, name it .csv or .json", path)
+}
+
+func auditCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Query the audit log",
+		Long: `Query the audit log of the organization, newest events first, filtered by
+user, given by email or id, action and type of event.
+
+The period starts --since ago, or at the given timestamp, and ends --until
+ago, or now. At most --limit events are shown, or all of them with
+--limit 0. With --export the events are also written to a file, as CSV or
+JSON by its extension, e.g. for compliance reports.`,
+		Example: `  mist audit --user alice@example.com --since 24h
+  mist audit --action create_machine --since 7d -o wide
+  mist audit --since 2024-05-01T00:00:00Z --until 2024-06-01T00:00:00Z --limit 0 --export may.csv`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			now := time.Now().UTC()
+			start, err := parseSince(params.GetString("since"), now)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			end := now
+			if until := params.GetString("until"); until != "" {
+				if end, err = parseSince(until, now); err != nil {
+					logger.Fatal(err)
+				}
+			}
+			if !end.After(start) {
+				logger.Fatal("--until must be after --since")
+			}
+			limit := params.GetInt("limit")
+			if limit < 0 {
+				logger.Fatal("--limit can't be negative")
+			}
+			filter := auditFilter{
+				user:      params.GetString("user"),
+				action:    params.GetString("action"),
+				eventType: params.GetString("type"),
+			}
+			events, err := auditEvents(start, end, filter, limit)
+			if err != nil {
+				logger.Fatalf("Could not read the audit log: %s", err)
+			}
+			rows := []interface{}{}
+			for _, event := range events {
+				rows = append(rows, auditRow(event))
+			}
+			columns := []string{"time", "user", "action", "resource", "error"}
+			wideColumns := []string{"time", "user", "type", "action", "resource", "ip", "session_id", "error"}
+			if path := params.GetString("export"); path != "" {
+				if err := exportAuditEvents(path, rows, wideColumns); err != nil {
+					logger.Fatalf("Could not export the audit log: %s", err)
+				}
+				fmt.Fprintf(os.Stderr, "Exported %d events to %s\n", len(rows), path)
+			}
+			data := map[string]interface{}{"data": rows}
+			if err := formatReport(data, cli.CLIOutputOptions{columns, wideColumns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("user", "", "Only show the events of the user, by email or id")
+	cmd.Flags().String("action", "", "Only show the events of the action, e.g. create_machine")
+	cmd.Flags().String("type", "", "Only show the events of the type, e.g. request, job or session")
+	cmd.Flags().String("since", "24h", "Start of the period, a duration before now <24h | 7d> or a timestamp <rfc3339 | unix_timestamp>")
+	cmd.Flags().String("until", "", "End of the period, like --since, now by default")
+	cmd.Flags().Int("limit", 100, "Maximum number of events to show, 0 for all")
+	cmd.Flags().String("export", "", "Also write the events to a .csv or .json file")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
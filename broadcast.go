@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// broadcastIdle is how long a partial line of output, like a prompt, is
+// held back waiting for the rest of it.
+const broadcastIdle = 300 * time.Millisecond
+
+// openBroadcastShell opens a shell on the machine which doesn't echo its
+// input, so that commands sent to every machine aren't repeated by each,
+// skipping the banner of the login shell.
+func openBroadcastShell(machine string) (*remoteShell, error) {
+	s, err := dialRemoteShell(machine)
+	if err != nil {
+		return nil, err
+	}
+	marker := randomMarker()
+	half := len(marker) / 2
+	if err := s.write(fmt.Sprintf("stty -echo; printf '%%s%%s\\n' %s %s\n", marker[:half], marker[half:])); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.readUntil(marker+"\n", ioutil.Discard); err != nil {
+		s.terminate()
+		return nil, err
+	}
+	return s, nil
+}
+
+// showBroadcastOutput prints the output of the shell, every line prefixed
+// with the machine, until the shell is closed. Partial lines are printed
+// once no more output follows them for a while.
+func showBroadcastOutput(s *remoteShell, w *prefixWriter) {
+	chunks := make(chan []byte)
+	go func() {
+		defer close(chunks)
+		for {
+			data, err := s.read()
+			if err != nil {
+				return
+			}
+			chunks <- data
+		}
+	}()
+	for {
+		select {
+		case data, ok := <-chunks:
+			if !ok {
+				w.flush()
+				w.writeLine([]byte("connection closed\n"))
+				return
+			}
+			w.Write([]byte(strings.Replace(string(data), "\r\n", "\n", -1)))
+		case <-time.After(broadcastIdle):
+			w.flush()
+		}
+	}
+}
+
+// broadcastShell opens a shell on every machine and sends every line typed
+// to all of them, showing their output prefixed with the machine it came
+// from, until stdin is closed or every shell exits. Ctrl-C is sent to the
+// shells instead of stopping mist.
+func broadcastShell(machines []string) {
+	width := 0
+	for _, machine := range machines {
+		if len(machine) > width {
+			width = len(machine)
+		}
+	}
+	shells := make([]*remoteShell, len(machines))
+	var wg sync.WaitGroup
+	for i, machine := range machines {
+		wg.Add(1)
+		go func(i int, machine string) {
+			defer wg.Done()
+			s, err := openBroadcastShell(machine)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not connect to %s: %s\n", machine, err)
+				return
+			}
+			shells[i] = s
+		}(i, machine)
+	}
+	wg.Wait()
+
+	var outputMutex sync.Mutex
+	var outputs sync.WaitGroup
+	connected := []*remoteShell{}
+	for i, s := range shells {
+		if s == nil {
+			continue
+		}
+		connected = append(connected, s)
+		w := &prefixWriter{w: os.Stdout, mutex: &outputMutex, prefix: fmt.Sprintf("%-*s | ", width, machines[i])}
+		outputs.Add(1)
+		go func(s *remoteShell) {
+			defer outputs.Done()
+			showBroadcastOutput(s, w)
+		}(s)
+	}
+	if len(connected) == 0 {
+		logger.Fatal("Could not connect to any of the machines")
+	}
+	fmt.Fprintf(os.Stderr, "Broadcasting to %d of %d machines, press Ctrl-D to exit\n", len(connected), len(machines))
+
+	send := func(input string) {
+		for _, s := range connected {
+			s.write(input)
+		}
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	defer signal.Stop(sigc)
+	go func() {
+		for range sigc {
+			send("\x03")
+		}
+	}()
+	closed := make(chan struct{})
+	go func() {
+		outputs.Wait()
+		close(closed)
+	}()
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				send(line)
+			}
+			if err != nil {
+				for _, s := range connected {
+					s.Close()
+				}
+				return
+			}
+		}
+	}()
+	<-closed
+}
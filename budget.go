@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// Budgets are stored in the credentials file with the context, as a list of
+// maps of scope and monthly amount. Scopes are all, cloud:NAME, tag:KEY or
+// tag:KEY=VALUE.
+
+type budget struct {
+	Scope  string  `json:"scope"`
+	Amount float64 `json:"amount"`
+}
+
+func budgetsKey() string {
+	return "contexts." + viper.GetString("context") + ".budgets"
+}
+
+func savedBudgets() []budget {
+	budgets := []budget{}
+	items, _ := cli.Creds.Get(budgetsKey()).([]interface{})
+	for _, item := range items {
+		entry, ok := normalizeYAML(item).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		scope, _ := entry["scope"].(string)
+		amount, _ := strconv.ParseFloat(fmt.Sprintf("%v", entry["amount"]), 64)
+		budgets = append(budgets, budget{Scope: scope, Amount: amount})
+	}
+	sort.Slice(budgets, func(i, j int) bool { return budgets[i].Scope < budgets[j].Scope })
+	return budgets
+}
+
+func writeBudgets(budgets []budget) error {
+	items := []interface{}{}
+	for _, b := range budgets {
+		items = append(items, map[string]interface{}{"scope": b.Scope, "amount": b.Amount})
+	}
+	cli.Creds.Set(budgetsKey(), items)
+	return cli.Creds.WriteConfig()
+}
+
+func validBudgetScope(scope string) error {
+	switch {
+	case scope == "all":
+	case strings.HasPrefix(scope, "cloud:") && len(scope) > len("cloud:"):
+	case strings.HasPrefix(scope, "tag:") && len(scope) > len("tag:"):
+	default:
+		return fmt.Errorf("invalid scope %q, expected all, cloud:NAME, tag:KEY or tag:KEY=VALUE", scope)
+	}
+	return nil
+}
+
+// inBudgetScope reports whether the machine counts against the budget.
+func inBudgetScope(machine map[string]interface{}, scope string, names referenceNames) bool {
+	switch {
+	case scope == "all":
+		return true
+	case strings.HasPrefix(scope, "cloud:"):
+		cloud, _ := machine["cloud"].(string)
+		want := strings.TrimPrefix(scope, "cloud:")
+		return cloud != "" && (cloud == want || names.lookup("cloud", cloud) == want)
+	case strings.HasPrefix(scope, "tag:"):
+		key := strings.TrimPrefix(scope, "tag:")
+		value := ""
+		hasValue := false
+		if i := strings.Index(key, "="); i >= 0 {
+			key, value, hasValue = key[:i], key[i+1:], true
+		}
+		for _, tag := range resourceTags(machine["tags"]) {
+			if tag.Key == key && (!hasValue || tag.Value == value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func budgetSetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set SCOPE AMOUNT",
+		Short: "Set the monthly budget of a scope",
+		Long: `Set the monthly budget of a scope, which is all, cloud:NAME for the
+machines of a cloud, tag:KEY for the machines with a tag, or tag:KEY=VALUE
+for those whose tag has a value. Amounts are in the currency of the API.`,
+		Example: `  mist budget set cloud:aws 500
+  mist budget set tag:team=web 200`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if err := cobra.ExactArgs(2)(cmd, args); err != nil {
+				return err
+			}
+			return validBudgetScope(args[0])
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			amount, err := strconv.ParseFloat(args[1], 64)
+			if err != nil || amount <= 0 {
+				logger.Fatalf("Invalid amount %q, expected a positive number", args[1])
+			}
+			budgets := []budget{{Scope: args[0], Amount: amount}}
+			for _, b := range savedBudgets() {
+				if b.Scope != args[0] {
+					budgets = append(budgets, b)
+				}
+			}
+			if err := writeBudgets(budgets); err != nil {
+				logger.Fatalf("Error saving budget: %s", err.Error())
+			}
+			fmt.Printf("Budget of %s set to %s\n", args[0], args[1])
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func budgetListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List budgets",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			rows := []interface{}{}
+			for _, b := range savedBudgets() {
+				rows = append(rows, map[string]interface{}{"scope": b.Scope, "amount": b.Amount})
+			}
+			columns := []string{"scope", "amount"}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func budgetDeleteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete SCOPE",
+		Short: "Delete a budget",
+		Args:  cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			scopes := []string{}
+			for _, b := range savedBudgets() {
+				scopes = append(scopes, b.Scope)
+			}
+			return scopes, cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			budgets := []budget{}
+			for _, b := range savedBudgets() {
+				if b.Scope != args[0] {
+					budgets = append(budgets, b)
+				}
+			}
+			if len(budgets) == len(savedBudgets()) {
+				logger.Fatalf("No budget for %s", args[0])
+			}
+			if err := writeBudgets(budgets); err != nil {
+				logger.Fatalf("Error saving budgets: %s", err.Error())
+			}
+			fmt.Printf("Budget of %s deleted\n", args[0])
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func budgetCheckCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check the cost of machines against the budgets",
+		Long: `Check the cost of machines against the budgets.
+
+The cost of the month so far is estimated from the current hourly cost of
+the machines in each scope. With --projected, the projected cost of the
+whole month is checked instead, to be warned before a budget is exceeded.
+
+The exit code is 1 if any budget is exceeded, so that it can be run from
+cron or CI.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			budgets := savedBudgets()
+			if len(budgets) == 0 {
+				logger.Fatal("No budgets set, use budget set to add one")
+			}
+			machines, err := costedMachines("")
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			now := time.Now().UTC()
+			hours := now.Sub(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)).Hours()
+			projected := params.GetBool("projected")
+			names := make(referenceNames)
+			rows := []interface{}{}
+			exceeded := 0
+			for _, b := range budgets {
+				var spent, monthly float64
+				for _, machine := range machines {
+					if inBudgetScope(machine, b.Scope, names) {
+						hourly, m := machineCost(machine)
+						spent += hourly * hours
+						monthly += m
+					}
+				}
+				checked := spent
+				if projected {
+					checked = monthly
+				}
+				status := "ok"
+				if checked > b.Amount {
+					status = "exceeded"
+					exceeded++
+				}
+				rows = append(rows, map[string]interface{}{
+					"scope":     b.Scope,
+					"budget":    b.Amount,
+					"spent":     roundCost(spent, 2),
+					"projected": roundCost(monthly, 2),
+					"used":      fmt.Sprintf("%.0f%%", 100*checked/b.Amount),
+					"status":    status,
+				})
+			}
+			columns := []string{"scope", "budget", "spent", "projected", "used", "status"}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+			if exceeded > 0 {
+				fmt.Fprintf(os.Stderr, "%d of %d budgets exceeded\n", exceeded, len(budgets))
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().Bool("projected", false, "Check the projected cost of the whole month instead of the cost so far")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func budgetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "budget",
+		Short: "Set monthly cost budgets and check them",
+	}
+	cmd.AddCommand(budgetSetCmd())
+	cmd.AddCommand(budgetListCmd())
+	cmd.AddCommand(budgetDeleteCmd())
+	cmd.AddCommand(budgetCheckCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
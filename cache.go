@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+// defaultCacheTTL is how long responses are cached unless the cache_ttl
+// setting says otherwise.
+const defaultCacheTTL = 5 * time.Minute
+
+// cacheHeader marks responses served from the cache, so they aren't stored
+// again.
+const cacheHeader = "X-Mist-Cache"
+
+// cacheDir returns the directory responses are cached in, e.g.
+// ~/.cache/mist on Linux.
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mist"), nil
+}
+
+// contextCacheDir returns the directory the responses of the current
+// context are cached in.
+func contextCacheDir() (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	if id, err := selectedOrg(); err == nil && id != "" {
+		return filepath.Join(dir, viper.GetString("context"), "orgs", id), nil
+	}
+	return filepath.Join(dir, viper.GetString("context")), nil
+}
+
+// cacheTTL returns how long cached responses are used for.
+func cacheTTL() time.Duration {
+	if !viper.IsSet("cache_ttl") {
+		return defaultCacheTTL
+	}
+	return viper.GetDuration("cache_ttl")
+}
+
+// cacheEnabled returns whether responses are cached for the command being
+// run, if it is one of the commands. Only completions and get commands use
+// the cache, so they stay fast on large accounts while everything else
+// sees the live state, and describe commands store their responses for
+// --offline.
+func cacheEnabled(commands ...string) bool {
+	if noCache, _ := cli.Root.PersistentFlags().GetBool("no-cache"); noCache || cacheTTL() <= 0 {
+		return false
+	}
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == cobra.ShellCompRequestCmd || args[0] == cobra.ShellCompNoDescRequestCmd) {
+		return true
+	}
+	cmd, _, err := cli.Root.Find(args)
+	if err != nil {
+		return false
+	}
+	// Watching is about seeing changes as they happen.
+	if watch := cmd.Flags().Lookup("watch"); watch != nil && watch.Changed {
+		return false
+	}
+	for ; cmd.HasParent(); cmd = cmd.Parent() {
+		if cmd.Parent() == cli.Root {
+			for _, name := range commands {
+				if cmd.Name() == name {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// offline returns whether responses are only served from the cache, with
+// --offline or MIST_OFFLINE.
+func offline() bool {
+	return viper.GetBool("offline")
+}
+
+// cacheFile returns the file the response to the URL is cached in.
+func cacheFile(url string) (string, error) {
+	dir, err := contextCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])), nil
+}
+
+// cachedResponse returns the cached body of the response to the URL and
+// when it was cached, however long ago.
+func cachedResponse(url string) ([]byte, time.Time, bool) {
+	filename, err := cacheFile(url)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return body, info.ModTime(), true
+}
+
+// staleWarnings are the warnings about how old the responses served
+// offline are, shown once each.
+var staleWarnings = make(map[string]bool)
+
+// warnStale tells that the data shown is as old as the response cached at
+// the time, on stderr so that output can still be piped.
+func warnStale(cachedAt time.Time) {
+	age := "less than a minute"
+	if time.Since(cachedAt) >= time.Minute {
+		age = humanDuration(time.Since(cachedAt))
+	}
+	warning := fmt.Sprintf("Offline: showing data cached %s ago, at %s", age, cachedAt.Format(time.RFC3339))
+	if !staleWarnings[warning] {
+		staleWarnings[warning] = true
+		fmt.Fprintln(os.Stderr, warning)
+	}
+}
+
+// serveCached makes the response the cached body.
+func serveCached(ctx *context.Context, body []byte) {
+	ctx.Response.StatusCode = http.StatusOK
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	ctx.Response.Header.Set(cacheHeader, "hit")
+	ctx.Response.ContentLength = int64(len(body))
+	ctx.Response.Body = ioutil.NopCloser(bytes.NewReader(body))
+}
+
+// storeResponse caches the body of the response to the URL. Failing to
+// cache isn't worth failing the command for.
+func storeResponse(url string, body []byte) {
+	filename, err := cacheFile(url)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return
+	}
+	ioutil.WriteFile(filename, body, 0600)
+}
+
+// clearCache removes the cached responses of the current context, or of
+// all contexts.
+func clearCache(all bool) error {
+	dir, err := contextCacheDir()
+	if all {
+		dir, err = cacheDir()
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// initResponseCache serves GET requests of completions and get commands
+// from the on-disk cache while it is fresh, and caches their responses
+// along with those of describe commands. Any other request may change what
+// the listings would show, so it clears the cache of the context.
+//
+// With --offline, every GET request is served from the cache however old
+// the response is, with a warning telling how old, and other requests
+// fail.
+func initResponseCache() {
+	flags := cli.Root.PersistentFlags()
+	flags.Bool("no-cache", false, "Don't use cached responses")
+	flags.Bool("offline", false, "Serve requests from cached responses only, without connecting to the API")
+	viper.BindPFlag("offline", flags.Lookup("offline"))
+	viper.BindEnv("offline", "MIST_OFFLINE")
+	cli.Client.UseHandler("before dial", func(ctx *context.Context, h context.Handler) {
+		if offline() {
+			if ctx.Request.Method != http.MethodGet {
+				h.Error(ctx, fmt.Errorf("can't make %s requests while offline", ctx.Request.Method))
+				return
+			}
+			body, cachedAt, ok := cachedResponse(ctx.Request.URL.String())
+			if !ok {
+				h.Error(ctx, fmt.Errorf("%s isn't cached, run the command once online with get or describe", ctx.Request.URL.Path))
+				return
+			}
+			warnStale(cachedAt)
+			serveCached(ctx, body)
+			h.Next(ctx)
+			return
+		}
+		if ctx.Request.Method != http.MethodGet {
+			clearCache(false)
+			h.Next(ctx)
+			return
+		}
+		if !cacheEnabled("get") {
+			h.Next(ctx)
+			return
+		}
+		if body, cachedAt, ok := cachedResponse(ctx.Request.URL.String()); ok && time.Since(cachedAt) <= cacheTTL() {
+			serveCached(ctx, body)
+		}
+		h.Next(ctx)
+	})
+	cli.Client.UseResponse(func(ctx *context.Context, h context.Handler) {
+		if ctx.Request.Method != http.MethodGet || ctx.Response.StatusCode != http.StatusOK ||
+			ctx.Response.Header.Get(cacheHeader) != "" || !cacheEnabled("get", "describe") {
+			h.Next(ctx)
+			return
+		}
+		if !strings.HasPrefix(ctx.Response.Header.Get("Content-Type"), "application/json") {
+			h.Next(ctx)
+			return
+		}
+		body, err := ioutil.ReadAll(ctx.Response.Body)
+		ctx.Response.Body.Close()
+		if err != nil {
+			h.Error(ctx, err)
+			return
+		}
+		ctx.Response.Body = ioutil.NopCloser(bytes.NewReader(body))
+		storeResponse(ctx.Request.URL.String(), body)
+		h.Next(ctx)
+	})
+}
+
+func cacheClearCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Clear cached responses",
+		Long: `Clear the responses cached for the current context, or for all contexts
+with --all.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := clearCache(params.GetBool("all")); err != nil {
+				logger.Fatalf("Could not clear the cache: %s", err.Error())
+			}
+			fmt.Println("Cache cleared")
+		},
+	}
+	cmd.Flags().Bool("all", false, "Clear the cache of all contexts")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func cacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Response cache operations",
+		Long: `Completions and get commands cache the responses of the API for 5 minutes,
+or for the cache_ttl setting of the config file, e.g. cache_ttl: 1m. A
+cache_ttl of 0 disables the cache, and --no-cache skips it for a command.
+Creating, changing or deleting resources clears the cache of the context.
+
+With --offline, get and describe commands are served from the responses
+they last cached however old, e.g. during outages, with a warning telling
+how old the data is.`,
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.AddCommand(cacheClearCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// cloudCredential is a credential asked for when adding a cloud.
+type cloudCredential struct {
+	key      string
+	label    string
+	secret   bool
+	optional bool
+	validate func(string) error
+}
+
+// cloudProvider lists the credentials of a provider. Providers with a
+// credentials file, like the service account JSON of google, convert it
+// with fromFile.
+type cloudProvider struct {
+	title       string
+	credentials []cloudCredential
+	fromFile    func([]byte) (map[string]interface{}, error)
+}
+
+func matchCredential(pattern, description string) func(string) error {
+	re := regexp.MustCompile(pattern)
+	return func(value string) error {
+		if !re.MatchString(value) {
+			return fmt.Errorf("expected %s", description)
+		}
+		return nil
+	}
+}
+
+func validateCredentialURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("expected an http or https URL")
+	}
+	return nil
+}
+
+var cloudProviders = map[string]cloudProvider{
+	"amazon": {"Amazon Web Services", []cloudCredential{
+		{"apikey", "Access key ID", false, false, matchCredential(`^(AKIA|ASIA)[A-Z0-9]{16}$`, "20 characters starting with AKIA or ASIA")},
+		{"apisecret", "Secret access key", true, false, matchCredential(`^[A-Za-z0-9/+=]{40}$`, "40 characters")},
+		{"region", "Region, like us-east-1", false, true, matchCredential(`^[a-z]{2}(-gov)?-[a-z]+-\d$`, "a region like us-east-1")},
+	}, nil},
+	"google": {"Google Cloud", []cloudCredential{
+		{"projectId", "Project ID", false, false, matchCredential(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`, "a project id like my-project-123")},
+		{"email", "Service account email", false, false, matchCredential(`^[^@\s]+@[^@\s]+$`, "an email address")},
+		{"privateKey", "Service account private key", true, false, matchCredential(`BEGIN PRIVATE KEY`, "a PEM private key")},
+	}, googleServiceAccount},
+	"openstack": {"OpenStack", []cloudCredential{
+		{"auth_url", "Keystone auth URL, like https://keystone.example.com:5000", false, false, validateCredentialURL},
+		{"user", "User", false, false, nil},
+		{"password", "Password", true, false, nil},
+		{"tenant", "Project (tenant) name", false, false, nil},
+		{"domain", "Domain", false, true, nil},
+		{"region", "Region", false, true, nil},
+		{"compute_endpoint", "Compute endpoint URL", false, true, validateCredentialURL},
+	}, nil},
+	"azure_arm": {"Microsoft Azure", []cloudCredential{
+		{"tenant_id", "Tenant ID", false, false, matchCredential(`^[0-9a-fA-F-]{36}$`, "a UUID")},
+		{"subscription_id", "Subscription ID", false, false, matchCredential(`^[0-9a-fA-F-]{36}$`, "a UUID")},
+		{"key", "Client (application) ID", false, false, matchCredential(`^[0-9a-fA-F-]{36}$`, "a UUID")},
+		{"secret", "Client secret", true, false, nil},
+	}, nil},
+	"digitalocean": {"DigitalOcean", []cloudCredential{
+		{"token", "API token", true, false, nil},
+	}, nil},
+	"linode": {"Linode", []cloudCredential{
+		{"apikey", "API token", true, false, nil},
+	}, nil},
+	"vultr": {"Vultr", []cloudCredential{
+		{"apikey", "API key", true, false, nil},
+	}, nil},
+	"equinixmetal": {"Equinix Metal", []cloudCredential{
+		{"apikey", "API key", true, false, nil},
+		{"project_id", "Project ID", false, true, nil},
+	}, nil},
+}
+
+// cloudEndpoints are the credentials which are URLs to check.
+var cloudEndpoints = map[string]bool{"auth_url": true, "compute_endpoint": true}
+
+// googleServiceAccount returns the credentials in a service account JSON
+// key file.
+func googleServiceAccount(content []byte) (map[string]interface{}, error) {
+	var account map[string]interface{}
+	if err := json.Unmarshal(content, &account); err != nil {
+		return nil, err
+	}
+	if account["type"] != "service_account" {
+		return nil, nil
+	}
+	return map[string]interface{}{
+		"projectId":  account["project_id"],
+		"email":      account["client_email"],
+		"privateKey": account["private_key"],
+	}, nil
+}
+
+func cloudProviderNames() []string {
+	names := []string{}
+	for name := range cloudProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readCloudCredentials reads the credentials of the provider from a JSON
+// file, either a map of credentials or a file of the provider itself.
+func readCloudCredentials(provider cloudProvider, filename string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if provider.fromFile != nil {
+		credentials, err := provider.fromFile(content)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+		}
+		if credentials != nil {
+			return credentials, nil
+		}
+	}
+	credentials := map[string]interface{}{}
+	if err := json.Unmarshal(content, &credentials); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	return credentials, nil
+}
+
+// promptCloudCredentials asks for the credentials of the provider.
+func promptCloudCredentials(provider cloudProvider) (map[string]interface{}, error) {
+	credentials := map[string]interface{}{}
+	if provider.fromFile != nil {
+		prompt := promptui.Prompt{
+			Label: "Credentials file (empty to type them in)",
+			Validate: func(input string) error {
+				if input = strings.TrimSpace(input); input == "" {
+					return nil
+				}
+				if _, err := os.Stat(input); err != nil {
+					return fmt.Errorf("can't read %s", input)
+				}
+				return nil
+			},
+		}
+		filename, err := prompt.Run()
+		if err != nil {
+			return nil, err
+		}
+		if filename = strings.TrimSpace(filename); filename != "" {
+			return readCloudCredentials(provider, filename)
+		}
+	}
+	for _, credential := range provider.credentials {
+		credential := credential
+		label := credential.label
+		if credential.optional {
+			label += " (optional)"
+		}
+		prompt := promptui.Prompt{
+			Label: label,
+			Validate: func(input string) error {
+				input = strings.TrimSpace(input)
+				if input == "" {
+					if credential.optional {
+						return nil
+					}
+					return fmt.Errorf("%s can't be empty", strings.ToLower(credential.label))
+				}
+				if credential.validate != nil {
+					return credential.validate(input)
+				}
+				return nil
+			},
+		}
+		if credential.secret {
+			prompt.Mask = '*'
+		}
+		value, err := prompt.Run()
+		if err != nil {
+			return nil, err
+		}
+		if value = strings.TrimSpace(value); value != "" {
+			credentials[credential.key] = value
+		}
+	}
+	return credentials, nil
+}
+
+// validateCloudCredentials checks that the credentials are complete and
+// well formed, and that endpoints given in them are reachable.
+func validateCloudCredentials(name string, provider cloudProvider, credentials map[string]interface{}) error {
+	problems := []string{}
+	for _, credential := range provider.credentials {
+		value, _ := credentials[credential.key].(string)
+		if value == "" {
+			if !credential.optional {
+				problems = append(problems, fmt.Sprintf("%s (%s) is missing", credential.label, credential.key))
+			}
+			continue
+		}
+		if credential.validate == nil {
+			continue
+		}
+		if err := credential.validate(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s): %s", credential.label, credential.key, err))
+			continue
+		}
+		if !cloudEndpoints[credential.key] {
+			continue
+		}
+		client, err := httpClient()
+		if err != nil {
+			return err
+		}
+		client.Timeout = 10 * time.Second
+		resp, err := client.Get(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s) is not reachable: %s", credential.label, credential.key, err))
+			continue
+		}
+		resp.Body.Close()
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid %s credentials:\n  %s", name, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func cloudAddCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "add PROVIDER [NAME]",
+		Short: "Add a cloud",
+		Long: fmt.Sprintf(`Add a cloud of one of the providers %s.
+
+The credentials are asked for one by one, or read from --file, a JSON map
+of credentials or, for google, a service account key file. They are checked
+before the cloud is added: required credentials must be given, keys and ids
+must be well formed and endpoints must be reachable.`, strings.Join(cloudProviderNames(), ", ")),
+		Example: `  mist cloud add amazon aws1
+  mist cloud add google gce --file service-account.json
+  mist cloud add openstack --name private --file credentials.json`,
+		Args: cobra.RangeArgs(1, 2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return cloudProviderNames(), cobra.ShellCompDirectiveNoFileComp
+			}
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			provider, ok := cloudProviders[args[0]]
+			if !ok {
+				logger.Fatalf("Unknown provider %s, expected one of %s", args[0], strings.Join(cloudProviderNames(), ", "))
+			}
+			interactive := term.IsTerminal(int(os.Stdin.Fd()))
+			name := params.GetString("name")
+			if len(args) == 2 {
+				name = args[1]
+			}
+			if name == "" && interactive {
+				prompt := promptui.Prompt{Label: "Name", Default: args[0]}
+				input, err := prompt.Run()
+				if err == promptui.ErrInterrupt || err == promptui.ErrEOF {
+					fmt.Println("Cancelled")
+					return
+				}
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				name = strings.TrimSpace(input)
+			}
+			if name == "" {
+				logger.Fatal("Give the name of the cloud")
+			}
+			var credentials map[string]interface{}
+			var err error
+			switch filename := params.GetString("file"); {
+			case filename != "":
+				credentials, err = readCloudCredentials(provider, filename)
+			case interactive:
+				fmt.Printf("Adding %s cloud %s\n", provider.title, name)
+				credentials, err = promptCloudCredentials(provider)
+				if err == promptui.ErrInterrupt || err == promptui.ErrEOF {
+					fmt.Println("Cancelled")
+					return
+				}
+			default:
+				logger.Fatal("Give the credentials with --file when not running in a terminal")
+			}
+			if err != nil {
+				logger.Fatalf("Could not read credentials: %s", err.Error())
+			}
+			if err := validateCloudCredentials(args[0], provider, credentials); err != nil {
+				logger.Fatal(err)
+			}
+			body, err := json.Marshal(map[string]interface{}{
+				"name":        name,
+				"provider":    args[0],
+				"credentials": credentials,
+			})
+			if err != nil {
+				logger.Fatalf("Unable to get body: %s", err.Error())
+			}
+			_, decoded, outputOptions, err := MistApiV2AddCloud(params, string(body))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("name", "", "Name of the cloud")
+	cmd.Flags().StringP("file", "f", "", "JSON file with the credentials")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func cloudCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "cloud",
+		Aliases: []string{"clouds"},
+		Short:   "Cloud operations",
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.AddCommand(cloudAddCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
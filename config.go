@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+// configFileFromArgs returns the value of the --config flag. The config file
+// has to be loaded before the command line is parsed, so the flag is looked
+// up directly in the raw arguments.
+func configFileFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--config=") {
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return ""
+}
+
+// loadConfigFile makes viper read its settings from the given file instead
+// of the default config search path.
+func loadConfigFile(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("config file %s not found", filename)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("config file %s is a directory", filename)
+	}
+	viper.SetConfigFile(filename)
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("could not parse config file %s: %s", filename, err)
+	}
+	return nil
+}
+
+func initConfigFlag() {
+	cli.Root.PersistentFlags().String("config", "", "Config file to use instead of the default one")
+	filename := configFileFromArgs(os.Args[1:])
+	if filename == "" {
+		return
+	}
+	if err := loadConfigFile(filename); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// validateServerURL checks that the configured server is an absolute http(s)
+// URL, so misconfigurations are reported before any request is attempted.
+func validateServerURL(server string) error {
+	hint := fmt.Sprintf("set --server or use `%s config add-context --server <URL>`", cli.Root.CommandPath())
+	if strings.TrimSpace(server) == "" {
+		return fmt.Errorf("no server configured; %s", hint)
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return fmt.Errorf("invalid server URL %q; %s", server, hint)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid server URL %q, it must start with http:// or https://; %s", server, hint)
+	}
+	return nil
+}
+
+// normalizeServerURL prefixes servers configured without a scheme, like
+// mist.example.com, with http:// as requests to them always have been.
+func normalizeServerURL(server string) (string, bool) {
+	if strings.TrimSpace(server) == "" || strings.Contains(server, "://") {
+		return server, false
+	}
+	return "http://" + server, true
+}
+
+var schemelessServerWarning sync.Once
+
+// getValidServer returns the configured server after validating it.
+func getValidServer() (string, error) {
+	server, err := getServer()
+	if err != nil {
+		return "", err
+	}
+	if normalized, ok := normalizeServerURL(server); ok {
+		schemelessServerWarning.Do(func() {
+			fmt.Fprintf(os.Stderr, "Warning: the server %s has no scheme, using %s; set it with `%s config add-context --server <URL>`\n", server, normalized, cli.Root.CommandPath())
+		})
+		server = normalized
+	}
+	if err := validateServerURL(server); err != nil {
+		return "", err
+	}
+	return server, nil
+}
+
+func initServerValidation() {
+	cli.Client.UseRequest(func(ctx *context.Context, h context.Handler) {
+		if _, err := getValidServer(); err != nil {
+			h.Error(ctx, err)
+			return
+		}
+		h.Next(ctx)
+	})
+}
+
+// getContextToken returns the API token of the selected context, which is
+// the default one unless overridden with --context, or of its selected
+// organization.
+func getContextToken() (string, error) {
+	if err := setContext(); err != nil {
+		return "", err
+	}
+	id, err := selectedOrg()
+	if err != nil {
+		return "", err
+	}
+	if id != "" {
+		return orgToken(viper.GetString("context"), id)
+	}
+	return contextToken(viper.GetString("context"))
+}
+
+// contextSetting returns a setting of the selected context.
+func contextSetting(key string) string {
+	context := viper.GetString("context")
+	if context == "" {
+		context = cli.Creds.GetString("default.context")
+	}
+	if context == "" {
+		return ""
+	}
+	return cli.Creds.GetString("contexts." + context + "." + key)
+}
+
+func contextNames() []string {
+	names := []string{}
+	for name := range cli.Creds.GetStringMap("contexts") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contextAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return contextNames(), cobra.ShellCompDirectiveNoFileComp
+}
+
+// writeContexts replaces all the contexts in the credentials file.
+func writeContexts(contexts map[string]interface{}) error {
+	cli.Creds.Set("contexts", contexts)
+	return cli.Creds.WriteConfig()
+}
+
+func listContextsCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list-contexts",
+		Short: "List the configured contexts",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			current := cli.Creds.GetString("default.context")
+			rows := []interface{}{}
+			for _, name := range contextNames() {
+				marker := ""
+				if name == current {
+					marker = "*"
+				}
+				rows = append(rows, map[string]interface{}{
+					"current": marker,
+					"name":    name,
+					"server":  cli.Creds.GetString("contexts." + name + ".server"),
+					"org":     cli.Creds.GetString("contexts." + name + ".org"),
+					"output":  cli.Creds.GetString("contexts." + name + ".output"),
+				})
+			}
+			columns := []string{"current", "name", "server", "org", "output"}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func currentContextCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "current-context",
+		Short: "Show the current context",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setContext(); err != nil {
+				logger.Fatal(err)
+			}
+			fmt.Println(viper.GetString("context"))
+		},
+	}
+	return cmd
+}
+
+func useContextCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "use-context NAME",
+		Short:             "Switch the current context",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: contextAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			if !cli.ExistsContext(args[0]) {
+				logger.Fatalf("Context %s not configured. Use `%s config add-context` to add it.", args[0], cli.Root.CommandPath())
+			}
+			cli.UpdateDefaultContext(args[0])
+			fmt.Printf("Switched to context %s\n", args[0])
+		},
+	}
+	return cmd
+}
+
+func setContextCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "set-context NAME",
+		Short: "Create or update a context",
+		Long: `Create or update a context. Only the settings given are changed.
+
+A context may set the default output format, which is used unless -o is
+given.`,
+		Example:           "  mist config set-context prod --server https://mist.example.com --token $TOKEN --output json",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: contextAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+			if strings.ContainsAny(name, ". ") {
+				logger.Fatal("Context names can't contain dots or spaces")
+			}
+			if server := params.GetString("server"); server != "" {
+				if err := validateServerURL(server); err != nil {
+					logger.Fatal(err)
+				}
+			}
+			if !cli.ExistsContext(name) && params.GetString("token") == "" {
+				logger.Fatalf("Context %s does not exist, use --token to create it", name)
+			}
+			contexts := cli.Creds.GetStringMap("contexts")
+			context, _ := contexts[name].(map[string]interface{})
+			if context == nil {
+				context = make(map[string]interface{})
+			}
+			// Settings are stored under the keys used by add-context.
+			for flag, key := range map[string]string{"server": "server", "org": "org", "output": "output"} {
+				if cmd.Flags().Changed(flag) {
+					context[key] = params.GetString(flag)
+				}
+			}
+			if cmd.Flags().Changed("token") {
+				context["api_key"] = storeContextToken(name, params.GetString("token"))
+			}
+			contexts[name] = context
+			if err := writeContexts(contexts); err != nil {
+				logger.Fatalf("Error saving context: %s", err.Error())
+			}
+			if cli.Creds.GetString("default.context") == "" {
+				cli.UpdateDefaultContext(name)
+			}
+			fmt.Printf("Context %s saved\n", name)
+		},
+	}
+	cmd.Flags().String("server", "", "Server URL")
+	cmd.Flags().String("token", "", "API token")
+	cmd.Flags().String("org", "", "Organization the token belongs to")
+	cmd.Flags().String("output", "", "Default output format")
+	params.BindPFlags(cmd.Flags())
+	return cmd
+}
+
+func renameContextCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "rename-context OLD NEW",
+		Short:             "Rename a context",
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: contextAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			contexts := cli.Creds.GetStringMap("contexts")
+			if _, ok := contexts[args[0]]; !ok {
+				logger.Fatalf("Context %s not configured", args[0])
+			}
+			if _, ok := contexts[args[1]]; ok {
+				logger.Fatalf("Context %s already exists", args[1])
+			}
+			if strings.ContainsAny(args[1], ". ") {
+				logger.Fatal("Context names can't contain dots or spaces")
+			}
+			if settings, ok := contexts[args[0]].(map[string]interface{}); ok && settings["api_key"] == keyringPlaceholder {
+				token, err := contextToken(args[0])
+				if err != nil {
+					logger.Fatal(err)
+				}
+				settings["api_key"] = storeContextToken(args[1], token)
+				keyringStore{}.Delete(args[0])
+			}
+			if err := moveOrgTokens(args[0], args[1]); err != nil {
+				logger.Fatal(err)
+			}
+			contexts[args[1]] = contexts[args[0]]
+			delete(contexts, args[0])
+			if err := writeContexts(contexts); err != nil {
+				logger.Fatalf("Error saving context: %s", err.Error())
+			}
+			if cli.Creds.GetString("default.context") == args[0] {
+				cli.UpdateDefaultContext(args[1])
+			}
+			fmt.Printf("Context %s renamed to %s\n", args[0], args[1])
+		},
+	}
+	return cmd
+}
+
+func deleteContextCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "delete-context NAME",
+		Short:             "Delete a context",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: contextAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			contexts := cli.Creds.GetStringMap("contexts")
+			if _, ok := contexts[args[0]]; !ok {
+				logger.Fatalf("Context %s not configured", args[0])
+			}
+			deleteOrgTokens(args[0])
+			delete(contexts, args[0])
+			if err := writeContexts(contexts); err != nil {
+				logger.Fatalf("Error deleting context: %s", err.Error())
+			}
+			if err := (keyringStore{}).Delete(args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not delete the token from the OS keyring: %s\n", err)
+			}
+			if cli.Creds.GetString("default.context") == args[0] {
+				cli.UpdateDefaultContext("")
+			}
+			fmt.Printf("Context %s deleted\n", args[0])
+		},
+	}
+	return cmd
+}
+
+// initContextCmds adds the context management and settings commands the
+// config command of the generated CLI lacks.
+func initContextCmds() {
+	configCmd, _, err := cli.Root.Find([]string{"config"})
+	if err != nil || configCmd == cli.Root {
+		configCmd = &cobra.Command{
+			Use:   "config",
+			Short: "CLI configuration",
+		}
+		cli.Root.AddCommand(configCmd)
+	}
+	existing := make(map[string]bool)
+	for _, cmd := range configCmd.Commands() {
+		existing[cmd.Name()] = true
+	}
+	for _, cmd := range []*cobra.Command{listContextsCmd(), currentContextCmd(), useContextCmd(), setContextCmd(), renameContextCmd(), deleteContextCmd(), configSetCmd(), configGetCmd(), configViewCmd(), configEditCmd()} {
+		if !existing[cmd.Name()] {
+			configCmd.AddCommand(cmd)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// rfbGreeting starts the first message VNC servers send, which tells VNC
+// consoles apart from serial ones.
+const rfbGreeting = "RFB "
+
+// consoleGreetingWait is how long to wait for the VNC greeting before
+// taking the console for a serial one.
+const consoleGreetingWait = 3 * time.Second
+
+// machineConsole is the console of a machine: either a web page, or a
+// websocket to a VNC server or a serial console.
+type machineConsole struct {
+	url   string
+	conn  *websocket.Conn
+	first []byte
+	vnc   bool
+}
+
+// openMachineConsole requests the console of the machine. Websocket
+// consoles are read from until they send their first message, or for
+// consoleGreetingWait, to tell which kind they are.
+func openMachineConsole(machine string) (*machineConsole, error) {
+	description := "open the console of machine"
+	location, token, err := machineActionLocation(machine, "console", description)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("Could not %s: invalid location %q", description, location)
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return &machineConsole{url: location}, nil
+	}
+	c, err := dialActionSocket(location, token, description)
+	if err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(consoleGreetingWait))
+	_, first, err := c.ReadMessage()
+	if err != nil {
+		c.Close()
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return nil, err
+		}
+		// Serial consoles may not send anything until a key is pressed.
+		// A timed out websocket can't be read from again, so connect anew.
+		if c, err = dialActionSocket(location, token, description); err != nil {
+			return nil, err
+		}
+		return &machineConsole{conn: c}, nil
+	}
+	c.SetReadDeadline(time.Time{})
+	return &machineConsole{conn: c, first: first, vnc: strings.HasPrefix(string(first), rfbGreeting)}, nil
+}
+
+// pipeVNC copies data between a local VNC client connection and the VNC
+// console until either side closes. The greeting already read from the
+// console is sent first.
+func pipeVNC(c *websocket.Conn, greeting []byte, conn net.Conn) {
+	defer c.Close()
+	defer conn.Close()
+	if _, err := conn.Write(greeting); err != nil {
+		return
+	}
+	go func() {
+		defer c.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := c.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// serveVNCProxy listens on the local port, only reachable from this host,
+// and forwards every VNC client connection to a console session of its
+// own. The first connection uses the session already opened.
+func serveVNCProxy(machine string, mc *machineConsole, port int, open bool) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	vncURL := fmt.Sprintf("vnc://%s", listener.Addr())
+	fmt.Printf("VNC console of %s at %s, press Ctrl-C to stop\n", machine, vncURL)
+	if open {
+		if err := openBrowser(vncURL); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open %s: %s\n", vncURL, err)
+		}
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		session := mc
+		mc = nil
+		if session == nil {
+			if session, err = openMachineConsole(machine); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not open the console: %s\n", err)
+				conn.Close()
+				continue
+			}
+			if !session.vnc {
+				fmt.Fprintln(os.Stderr, "The console is no longer a VNC console")
+				session.conn.Close()
+				conn.Close()
+				continue
+			}
+		}
+		go pipeVNC(session.conn, session.first, conn)
+	}
+}
+
+func consoleCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "console MACHINE",
+		Short: "Open the serial or VNC console of a machine",
+		Long: `Open the console of a machine, for providers which offer one.
+
+Serial consoles are attached to the terminal, like ssh does. VNC consoles
+are served on a local port, only reachable from this host, for a VNC client
+to connect to, and web consoles are shown as a URL. With --open, VNC and web
+consoles are opened with the default application.`,
+		Example: `  mist console web-1
+  mist console web-1 --port 5901 --open`,
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: machineAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			machine := resolveArg("machine", args[0])
+			mc, err := openMachineConsole(machine)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			switch {
+			case mc.url != "":
+				fmt.Println(mc.url)
+				if params.GetBool("open") {
+					if err := openBrowser(mc.url); err != nil {
+						logger.Fatalf("Could not open %s: %s", mc.url, err)
+					}
+				}
+			case mc.vnc:
+				if err := serveVNCProxy(machine, mc, params.GetInt("port"), params.GetBool("open")); err != nil {
+					logger.Fatalf("VNC proxy stopped: %s", err)
+				}
+			default:
+				defer mc.conn.Close()
+				os.Stdout.Write(mc.first)
+				attachTerminal(mc.conn)
+			}
+		},
+	}
+	cmd.Flags().Int("port", 0, "Local port to serve VNC consoles on, any free port by default")
+	cmd.Flags().Bool("open", false, "Open VNC and web consoles with the default application")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
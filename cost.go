@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// costGroup is the cost of the machines sharing a --group-by value.
+type costGroup struct {
+	name     string
+	machines int
+	hourly   float64
+	monthly  float64
+}
+
+// machineCost returns the hourly and monthly cost estimates of the machine,
+// deriving either from the other when the provider only reports one.
+func machineCost(machine map[string]interface{}) (float64, float64) {
+	cost, _ := machine["cost"].(map[string]interface{})
+	hourly, _ := cost["hourly"].(float64)
+	monthly, _ := cost["monthly"].(float64)
+	switch {
+	case hourly == 0 && monthly > 0:
+		hourly = monthly / hoursPerMonth
+	case monthly == 0 && hourly > 0:
+		monthly = hourly * hoursPerMonth
+	}
+	return hourly, monthly
+}
+
+// costGroupName returns the group of the machine for --group-by, which is
+// one of machine, cloud, owner or tag:KEY.
+func costGroupName(machine map[string]interface{}, groupBy string, names referenceNames) string {
+	switch {
+	case groupBy == "machine":
+		name, _ := machine["name"].(string)
+		return name
+	case groupBy == "cloud":
+		if cloud, ok := machine["cloud"].(string); ok && cloud != "" {
+			return names.lookup("cloud", cloud)
+		}
+	case groupBy == "owner":
+		if owner, ok := machine["owned_by"].(string); ok && owner != "" {
+			return owner
+		}
+	case strings.HasPrefix(groupBy, "tag:"):
+		key := strings.TrimPrefix(groupBy, "tag:")
+		for _, tag := range resourceTags(machine["tags"]) {
+			if tag.Key == key {
+				return tag.Value
+			}
+		}
+	}
+	return "<none>"
+}
+
+// costedMachines returns the machines matching the search, with the fields
+// needed to report their cost.
+func costedMachines(search string) ([]map[string]interface{}, error) {
+	params := viper.New()
+	params.Set("search", search)
+	params.Set("only", "id,name,cloud,owned_by,tags,cost")
+	params.Set("limit", 1000)
+	_, decoded, _, err := MistApiV2ListMachines(params)
+	if err != nil {
+		return nil, err
+	}
+	return responseItems(decoded), nil
+}
+
+// costReport returns the cost of the machines matching the search, grouped
+// by --group-by and sorted by cost, most expensive first.
+func costReport(search, groupBy string) ([]*costGroup, error) {
+	machines, err := costedMachines(search)
+	if err != nil {
+		return nil, err
+	}
+	names := make(referenceNames)
+	groups := make(map[string]*costGroup)
+	for _, machine := range machines {
+		hourly, monthly := machineCost(machine)
+		name := costGroupName(machine, groupBy, names)
+		group, ok := groups[name]
+		if !ok {
+			group = &costGroup{name: name}
+			groups[name] = group
+		}
+		group.machines++
+		group.hourly += hourly
+		group.monthly += monthly
+	}
+	report := []*costGroup{}
+	for _, group := range groups {
+		report = append(report, group)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].monthly != report[j].monthly {
+			return report[i].monthly > report[j].monthly
+		}
+		return report[i].name < report[j].name
+	})
+	return report, nil
+}
+
+func roundCost(value float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(value*p) / p
+}
+
+func costCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "cost",
+		Short: "Report the cost of machines",
+		Long: `Report the cost of machines, from the cost estimates of the API,
+grouped by machine, cloud, owner or the value of a tag.
+
+The cost of the period between --start and --end, the current month by
+default, is estimated from the current hourly cost of the machines, so it
+doesn't account for machines which were resized, stopped or destroyed in
+the meantime. The monthly column is the projected cost of a whole month.
+
+Costs are in the currency of the API, usually US dollars. With --currency
+and --exchange-rate they are converted to another currency.`,
+		Example: `  mist cost --group-by cloud
+  mist cost --group-by tag:team --start 2024-05-01T00:00:00Z -o csv
+  mist cost --currency EUR --exchange-rate 0.92`,
+		Args: cobra.ExactValidArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			groupBy := params.GetString("group-by")
+			switch {
+			case groupBy == "machine", groupBy == "cloud", groupBy == "owner":
+			case strings.HasPrefix(groupBy, "tag:") && len(groupBy) > len("tag:"):
+			default:
+				logger.Fatalf("Invalid --group-by %q, expected machine, cloud, owner or tag:KEY", groupBy)
+			}
+			now := time.Now().UTC()
+			start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+			end := now
+			var err error
+			if s := params.GetString("start"); s != "" {
+				if start, err = parseTime(s); err != nil {
+					logger.Fatal(err)
+				}
+			}
+			if e := params.GetString("end"); e != "" {
+				if end, err = parseTime(e); err != nil {
+					logger.Fatal(err)
+				}
+			}
+			if !end.After(start) {
+				logger.Fatal("--end must be after --start")
+			}
+			rate := params.GetFloat64("exchange-rate")
+			if rate <= 0 {
+				logger.Fatal("--exchange-rate must be positive")
+			}
+			report, err := costReport(params.GetString("search"), groupBy)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			hours := end.Sub(start).Hours()
+			currency := params.GetString("currency")
+			rows := []interface{}{}
+			var machines int
+			var hourly, monthly float64
+			for _, group := range report {
+				machines += group.machines
+				hourly += group.hourly
+				monthly += group.monthly
+				rows = append(rows, map[string]interface{}{
+					"group":    group.name,
+					"machines": group.machines,
+					"hourly":   roundCost(group.hourly*rate, 4),
+					"period":   roundCost(group.hourly*hours*rate, 2),
+					"monthly":  roundCost(group.monthly*rate, 2),
+					"currency": currency,
+				})
+			}
+			footer := []string{"TOTAL", fmt.Sprintf("%d", machines), fmt.Sprintf("%.2f", hourly*hours*rate), fmt.Sprintf("%.2f", monthly*rate)}
+			wideFooter := []string{"TOTAL", fmt.Sprintf("%d", machines), fmt.Sprintf("%.4f", hourly*rate), fmt.Sprintf("%.2f", hourly*hours*rate), fmt.Sprintf("%.2f", monthly*rate), currency}
+			data := map[string]interface{}{"data": rows}
+			if err := formatReport(data, cli.CLIOutputOptions{
+				[]string{"group", "machines", "period", "monthly"},
+				[]string{"group", "machines", "hourly", "period", "monthly", "currency"},
+				footer,
+				wideFooter,
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("group-by", "cloud", "Group machines by machine, cloud, owner or tag:KEY")
+	cmd.Flags().String("search", "", "Only include the machines matching the search query")
+	cmd.Flags().String("start", "", "Start of the period <rfc3339 | unix_timestamp>, the start of the month by default")
+	cmd.Flags().String("end", "", "End of the period <rfc3339 | unix_timestamp>, now by default")
+	cmd.Flags().String("currency", "USD", "Currency to show the costs in")
+	cmd.Flags().Float64("exchange-rate", 1, "Rate converting the costs of the API to --currency")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
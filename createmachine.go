@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+)
+
+// machineRequestBody returns the create machine request given as arguments
+// or in a file. Files may be YAML or JSON, and may be a machine entry of a
+// manifest, as printed by the wizard.
+func machineRequestBody(args []string, filename string) (string, error) {
+	if filename == "" || len(args) > 0 {
+		return cli.GetBody("application/json", args, filename)
+	}
+	spec, err := readResourceSpec("machine", filename)
+	if err != nil {
+		return "", err
+	}
+	j, err := json.Marshal(spec)
+	return string(j), err
+}
+
+// readResourceSpec reads the fields of a resource of the kind from a YAML
+// or JSON file, or stdin if the filename is -. The file may be an entry of
+// a manifest, with the kind of the resource.
+func readResourceSpec(kind, filename string) (map[string]interface{}, error) {
+	var raw []byte
+	var err error
+	if filename == "-" {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	spec, ok := normalizeYAML(doc).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a map of %s fields", filename, kind)
+	}
+	if k, ok := spec["kind"]; ok {
+		if k != kind {
+			return nil, fmt.Errorf("%s describes a %v, not a %s", filename, k, kind)
+		}
+		delete(spec, "kind")
+	}
+	return spec, nil
+}
+
+// waitForCreatedMachine waits until the machine shows up and is running.
+func waitForCreatedMachine(name string, deadline time.Time) (resourceRef, error) {
+	for {
+		live, err := lookupResource("machine", name)
+		if err != nil {
+			return resourceRef{}, err
+		}
+		if live != nil {
+			id, _ := live["id"].(string)
+			machine := resourceRef{name: name, id: id}
+			return machine, waitForMachineState(machine, "running", deadline)
+		}
+		if time.Now().After(deadline) {
+			return resourceRef{}, fmt.Errorf("timed out waiting for %s to be created", name)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// createMachine submits the create machine request. With --wait it then
+// waits for the job to finish and the machine to be running, and with
+// --ssh-after it opens a shell to the machine once SSH is usable.
+func createMachine(cmd *cobra.Command, body string) {
+	wait, _ := cmd.Flags().GetBool("wait")
+	sshAfter, _ := cmd.Flags().GetBool("ssh-after")
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	var request struct {
+		Name     string  `json:"name"`
+		Quantity float64 `json:"quantity"`
+	}
+	if err := json.Unmarshal([]byte(body), &request); err != nil {
+		logger.Fatalf("Unable to get body: %s", err.Error())
+	}
+	single := request.Name != "" && request.Quantity <= 1
+	if sshAfter && !single {
+		logger.Fatal("--ssh-after needs a single machine with a name")
+	}
+	if sshAfter && !term.IsTerminal(int(os.Stdin.Fd())) {
+		logger.Fatal("--ssh-after needs a terminal")
+	}
+	deadline := time.Now().Add(timeout)
+
+	params := viper.New()
+	_, decoded, outputOptions, err := MistApiV2CreateMachine(params, body)
+	if err != nil {
+		logger.Fatalf("Error calling operation: %s", err.Error())
+	}
+	if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+	if !wait && !sshAfter {
+		return
+	}
+	if jobID, _ := decoded["jobId"].(string); jobID != "" {
+		if err := waitForJob(jobID, time.Until(deadline)); err != nil {
+			logger.Fatalf("Waiter error: %s", err.Error())
+		}
+	}
+	if !single {
+		fmt.Println("Create machine completed successfully")
+		return
+	}
+	machine, err := waitForCreatedMachine(request.Name, deadline)
+	if err != nil {
+		logger.Fatalf("Error waiting: %s", err.Error())
+	}
+	fmt.Printf(" * %s: running\n", machine.name)
+	if !sshAfter {
+		return
+	}
+	if err := waitForSSH(machine.id, time.Until(deadline)); err != nil {
+		logger.Fatalf("Error waiting: %s", err.Error())
+	}
+	interactiveShell(machine.id)
+}
+
+// initCreateMachineCmd makes create machine read YAML files, wait for the
+// machine to be running and open a shell to it. Run in a terminal without
+// a request body, or with --interactive, it asks for the machine step by
+// step.
+func initCreateMachineCmd() {
+	var createMachineCmd *cobra.Command
+	for _, cmd := range cli.Root.Commands() {
+		if cmd.Name() != "create" {
+			continue
+		}
+		for _, sub := range cmd.Commands() {
+			if sub.Name() == "machine" {
+				createMachineCmd = sub
+			}
+		}
+	}
+	if createMachineCmd == nil {
+		return
+	}
+	createMachineCmd.Flags().BoolP("interactive", "i", false, "Choose the cloud, image, size, network, key and cloud-init script step by step")
+	createMachineCmd.Flags().Bool("ssh-after", false, "Open a shell to the machine once it is reachable over SSH, implies --wait")
+	createMachineCmd.Flags().Duration("timeout", 15*time.Minute, "Maximum time to wait for the machine with --wait and --ssh-after")
+	if wait := createMachineCmd.Flags().Lookup("wait"); wait != nil {
+		wait.Usage = "Wait until the machine is running"
+	}
+	createMachineCmd.Example = "  " + cli.Root.CommandPath() + " create machine --interactive\n" +
+		"  " + cli.Root.CommandPath() + " create machine -f machine.yaml --wait --ssh-after\n" +
+		createMachineCmd.Example
+	createMachineCmd.Run = func(cmd *cobra.Command, args []string) {
+		interactive, _ := cmd.Flags().GetBool("interactive")
+		filename, _ := cmd.Flags().GetString("filename")
+		hasBody := len(args) > 0 || filename != ""
+		if interactive || (!hasBody && term.IsTerminal(int(os.Stdin.Fd()))) {
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				logger.Fatal("--interactive needs a terminal")
+			}
+			if hasBody {
+				logger.Fatal("--interactive can't be used with a request body")
+			}
+			createMachineInteractive(cmd)
+			return
+		}
+		body, err := machineRequestBody(args, filename)
+		if err != nil {
+			logger.Fatalf("Unable to get body: %s", err.Error())
+		}
+		createMachine(cmd, body)
+	}
+}
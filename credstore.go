@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/zalando/go-keyring"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+// keyringService is the service API tokens are stored under in the OS
+// keyring, with the context name as the user.
+const keyringService = "mist-cli"
+
+// keyringPlaceholder is stored as the API key of contexts whose token is in
+// the OS keyring, so the credentials file never holds the token itself.
+const keyringPlaceholder = "keyring:"
+
+// credentialStore keeps the API tokens of contexts.
+type credentialStore interface {
+	Get(context string) (string, error)
+	// Set stores the token and returns the value to keep as the API key of
+	// the context in the credentials file.
+	Set(context, token string) (string, error)
+	Delete(context string) error
+}
+
+// keyringStore keeps tokens in the macOS Keychain, the Windows Credential
+// Manager or the Secret Service on Linux.
+type keyringStore struct{}
+
+func (keyringStore) Get(context string) (string, error) {
+	return keyring.Get(keyringService, context)
+}
+
+func (keyringStore) Set(context, token string) (string, error) {
+	if err := keyring.Set(keyringService, context, token); err != nil {
+		return "", err
+	}
+	return keyringPlaceholder, nil
+}
+
+func (keyringStore) Delete(context string) error {
+	err := keyring.Delete(keyringService, context)
+	if err == keyring.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// fileStore keeps tokens in plain text in the credentials file.
+type fileStore struct{}
+
+func (fileStore) Get(context string) (string, error) {
+	return cli.Creds.GetString("contexts." + context + ".api_key"), nil
+}
+
+func (fileStore) Set(context, token string) (string, error) {
+	return token, nil
+}
+
+func (fileStore) Delete(context string) error {
+	return nil
+}
+
+// tokenStore returns the configured credential store. The OS keyring is
+// used unless the credential_store setting is "file".
+func tokenStore() credentialStore {
+	if viper.GetString("credential_store") == "file" {
+		return fileStore{}
+	}
+	return keyringStore{}
+}
+
+// contextToken returns the token of the context, resolving it through the
+// OS keyring if it is stored there.
+func contextToken(context string) (string, error) {
+	apiKey := cli.Creds.GetString("contexts." + context + ".api_key")
+	if apiKey != keyringPlaceholder {
+		return apiKey, nil
+	}
+	token, err := keyringStore{}.Get(context)
+	if err != nil {
+		return "", fmt.Errorf("could not read the token of context %s from the OS keyring: %s", context, err)
+	}
+	return token, nil
+}
+
+// storeContextToken stores the token of the context, falling back to the
+// credentials file if the OS keyring is unavailable, and returns the value
+// to keep as the API key of the context.
+func storeContextToken(context, token string) string {
+	apiKey, err := tokenStore().Set(context, token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not use the OS keyring, the token is stored in plain text: %s\n", err)
+		return token
+	}
+	return apiKey
+}
+
+// migrateTokens moves the plain text tokens of the credentials file to the
+// OS keyring. Contexts whose token can't be moved are left untouched.
+func migrateTokens() {
+	if _, ok := tokenStore().(keyringStore); !ok {
+		return
+	}
+	contexts := cli.Creds.GetStringMap("contexts")
+	migrated := false
+	for name, value := range contexts {
+		settings, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		token, _ := settings["api_key"].(string)
+		if token == "" || token == keyringPlaceholder {
+			continue
+		}
+		apiKey, err := (keyringStore{}).Set(name, token)
+		if err != nil {
+			return
+		}
+		settings["api_key"] = apiKey
+		migrated = true
+	}
+	if migrated {
+		if err := writeContexts(contexts); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not update the credentials file: %s\n", err)
+		}
+	}
+}
+
+// initCredentialStore migrates existing tokens to the configured store and
+// resolves the tokens kept in the OS keyring when authenticating requests.
+func initCredentialStore() {
+	migrateTokens()
+	cli.Client.UseHandler("before dial", func(ctx *context.Context, h context.Handler) {
+		authorization := ctx.Request.Header.Get("Authorization")
+		if !strings.HasSuffix(authorization, keyringPlaceholder) {
+			h.Next(ctx)
+			return
+		}
+		if err := setContext(); err != nil {
+			h.Error(ctx, err)
+			return
+		}
+		token, err := contextToken(viper.GetString("context"))
+		if err != nil {
+			h.Error(ctx, err)
+			return
+		}
+		ctx.Request.Header.Set("Authorization", strings.TrimSuffix(authorization, keyringPlaceholder)+token)
+		h.Next(ctx)
+	})
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+// debugBodyLimit is how much of a body is logged with --debug.
+const debugBodyLimit = 16 * 1024
+
+// redacted replaces secrets in logs and traces.
+const redacted = "REDACTED"
+
+// requestIDHeaders are the headers a request ID may be returned in.
+var requestIDHeaders = []string{"X-Request-Id", "X-Correlation-Id", "X-Amzn-Trace-Id"}
+
+// secretFields are the parts of field names whose values are redacted from
+// logged bodies.
+var secretFields = []string{"token", "password", "secret", "private", "api_key", "apikey", "credentials"}
+
+var (
+	debugMutex   sync.Mutex
+	traceEntries = []interface{}{}
+)
+
+// verbosity returns 0 for no request logs, 1 for -v and 2 for --debug,
+// which adds headers and bodies.
+func verbosity() int {
+	switch {
+	case viper.GetBool("debug"):
+		return 2
+	case viper.GetBool("verbose"):
+		return 1
+	}
+	return 0
+}
+
+// redactHeaders returns the headers with credentials replaced.
+func redactHeaders(header http.Header) http.Header {
+	copied := make(http.Header)
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Cookie", "Set-Cookie", "X-Auth-Token":
+			copied[name] = []string{redacted}
+		default:
+			copied[name] = values
+		}
+	}
+	return copied
+}
+
+// redactValue replaces the values of the fields which may hold secrets.
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{})
+		for key, item := range v {
+			copied[key] = redactValue(item)
+			for _, field := range secretFields {
+				if strings.Contains(strings.ToLower(key), field) {
+					copied[key] = redacted
+					break
+				}
+			}
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = redactValue(item)
+		}
+		return copied
+	}
+	return value
+}
+
+// redactBody returns a body with its secrets replaced, if it is JSON.
+func redactBody(body []byte) string {
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return string(body)
+	}
+	redactedBody, err := json.Marshal(redactValue(decoded))
+	if err != nil {
+		return string(body)
+	}
+	return string(redactedBody)
+}
+
+// readBody reads a request or response body, and returns it along with a
+// copy to be read instead.
+func readBody(body io.ReadCloser) ([]byte, io.ReadCloser) {
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	return data, ioutil.NopCloser(bytes.NewReader(data))
+}
+
+func requestID(header http.Header) string {
+	for _, name := range requestIDHeaders {
+		if id := header.Get(name); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+func logHeaders(prefix string, header http.Header) {
+	names := []string{}
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", prefix, name, value)
+		}
+	}
+}
+
+func logBody(prefix string, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	text := redactBody(body)
+	if len(text) > debugBodyLimit {
+		text = text[:debugBodyLimit] + fmt.Sprintf("... (%d bytes)", len(body))
+	}
+	fmt.Fprintf(os.Stderr, "%s\n%s\n", prefix, text)
+}
+
+// harHeaders converts headers to the list of name and value pairs of HAR.
+func harHeaders(header http.Header) []interface{} {
+	headers := []interface{}{}
+	for name, values := range redactHeaders(header) {
+		for _, value := range values {
+			headers = append(headers, map[string]interface{}{"name": name, "value": value})
+		}
+	}
+	return headers
+}
+
+// traceEntry returns the exchange as an entry of a HAR log.
+func traceEntry(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte, started time.Time, elapsed time.Duration, err error) map[string]interface{} {
+	request := map[string]interface{}{
+		"method":      req.Method,
+		"url":         req.URL.String(),
+		"httpVersion": "HTTP/1.1",
+		"headers":     harHeaders(req.Header),
+		"queryString": []interface{}{},
+		"cookies":     []interface{}{},
+		"headersSize": -1,
+		"bodySize":    len(reqBody),
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			request["queryString"] = append(request["queryString"].([]interface{}), map[string]interface{}{"name": name, "value": value})
+		}
+	}
+	if len(reqBody) > 0 {
+		request["postData"] = map[string]interface{}{"mimeType": req.Header.Get("Content-Type"), "text": redactBody(reqBody)}
+	}
+	response := map[string]interface{}{
+		"status":      0,
+		"statusText":  "",
+		"httpVersion": "HTTP/1.1",
+		"headers":     []interface{}{},
+		"cookies":     []interface{}{},
+		"content":     map[string]interface{}{"size": len(respBody), "mimeType": "", "text": ""},
+		"redirectURL": "",
+		"headersSize": -1,
+		"bodySize":    len(respBody),
+	}
+	if resp != nil {
+		response["status"] = resp.StatusCode
+		response["statusText"] = http.StatusText(resp.StatusCode)
+		response["headers"] = harHeaders(resp.Header)
+		response["content"] = map[string]interface{}{"size": len(respBody), "mimeType": resp.Header.Get("Content-Type"), "text": redactBody(respBody)}
+	}
+	if err != nil {
+		response["_error"] = err.Error()
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	return map[string]interface{}{
+		"startedDateTime": started.Format(time.RFC3339Nano),
+		"time":            ms,
+		"request":         request,
+		"response":        response,
+		"cache":           map[string]interface{}{},
+		"timings":         map[string]interface{}{"send": 0, "wait": ms, "receive": 0},
+	}
+}
+
+// writeTrace adds the entry to the trace file, which is rewritten with
+// every request so it is complete even if the command fails.
+func writeTrace(filename string, entry map[string]interface{}) error {
+	traceEntries = append(traceEntries, entry)
+	har := map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]interface{}{"name": cli.Root.Name(), "version": cli.Root.Version},
+			"entries": traceEntries,
+		},
+	}
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+// logExchange logs a request and its response or error to stderr, and adds
+// it to the trace file.
+func logExchange(ctx *context.Context, err error) {
+	started, ok := ctx.Get("debugStarted").(time.Time)
+	// Requests failing before being sent, and failures of requests already
+	// logged with their response, aren't logged.
+	if !ok || ctx.Get("debugLogged") != nil {
+		return
+	}
+	ctx.Set("debugLogged", true)
+	elapsed := time.Since(started)
+	reqBody, _ := ctx.Get("debugRequestBody").([]byte)
+	var respBody []byte
+	resp := ctx.Response
+	if err != nil || resp == nil || resp.StatusCode == 0 {
+		resp = nil
+	} else if resp.Body != nil {
+		respBody, resp.Body = readBody(resp.Body)
+	}
+
+	debugMutex.Lock()
+	defer debugMutex.Unlock()
+	level := verbosity()
+	if level > 0 {
+		fmt.Fprintf(os.Stderr, "> %s %s\n", ctx.Request.Method, ctx.Request.URL)
+		if level > 1 {
+			logHeaders(">", redactHeaders(ctx.Request.Header))
+			logBody(">", reqBody)
+		}
+		if resp == nil {
+			fmt.Fprintf(os.Stderr, "< failed after %s: %s\n", elapsed.Round(time.Millisecond), err)
+		} else {
+			status := fmt.Sprintf("< %d %s %s", resp.StatusCode, http.StatusText(resp.StatusCode), elapsed.Round(time.Millisecond))
+			if id := requestID(resp.Header); id != "" {
+				status += " request-id=" + id
+			}
+			if resp.Header.Get(cacheHeader) != "" {
+				status += " (cached)"
+			}
+			fmt.Fprintln(os.Stderr, status)
+			if level > 1 {
+				logHeaders("<", redactHeaders(resp.Header))
+				logBody("<", respBody)
+			}
+		}
+	}
+	if filename := viper.GetString("trace_file"); filename != "" {
+		if err := writeTrace(filename, traceEntry(ctx.Request, reqBody, resp, respBody, started, elapsed, err)); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not write the trace: %s\n", err)
+		}
+	}
+}
+
+// initDebug adds -v, which logs the method, URL, status, latency and
+// request ID of every API request to stderr, --debug, which logs their
+// headers and bodies too, and --trace-file, which writes them to a HAR file
+// to attach to support tickets. Credentials are redacted from all of them.
+// --debug can also be enabled with MIST_DEBUG=1.
+func initDebug() {
+	flags := cli.Root.PersistentFlags()
+	if flags.Lookup("verbose") == nil {
+		if flags.ShorthandLookup("v") == nil {
+			flags.BoolP("verbose", "v", false, "Log the requests made to the API")
+		} else {
+			flags.Bool("verbose", false, "Log the requests made to the API")
+		}
+	}
+	flags.Bool("debug", false, "Log the requests made to the API with their headers and bodies")
+	flags.String("trace-file", "", "Write the requests made to the API to this HAR file")
+	viper.BindPFlag("verbose", flags.Lookup("verbose"))
+	viper.BindPFlag("debug", flags.Lookup("debug"))
+	viper.BindPFlag("trace_file", flags.Lookup("trace-file"))
+	viper.BindEnv("debug", "MIST_DEBUG")
+	viper.BindEnv("trace_file", "MIST_TRACE_FILE")
+	enabled := func() bool {
+		return verbosity() > 0 || viper.GetString("trace_file") != ""
+	}
+	cli.Client.UseHandler("before dial", func(ctx *context.Context, h context.Handler) {
+		if enabled() {
+			ctx.Set("debugStarted", time.Now())
+			if ctx.Request.Body != nil {
+				var body []byte
+				body, ctx.Request.Body = readBody(ctx.Request.Body)
+				ctx.Set("debugRequestBody", body)
+			}
+		}
+		h.Next(ctx)
+	})
+	cli.Client.UseResponse(func(ctx *context.Context, h context.Handler) {
+		if enabled() {
+			logExchange(ctx, nil)
+		}
+		h.Next(ctx)
+	})
+	cli.Client.UseError(func(ctx *context.Context, h context.Handler) {
+		if enabled() && ctx.Error != nil {
+			logExchange(ctx, ctx.Error)
+		}
+		h.Next(ctx)
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// resourceRef is a resource resolved to its id.
+type resourceRef struct {
+	name string
+	id   string
+}
+
+// searchResources returns the resources of the kind matching the search
+// query.
+func searchResources(kind, search string) ([]resourceRef, error) {
+	params := viper.New()
+	params.Set("search", search)
+	params.Set("only", "id,name")
+	params.Set("limit", 1000)
+	list, ok := resourceListControllersMap[kind]
+	if !ok {
+		list = wizardListControllersMap[kind]
+	}
+	_, decoded, _, err := list(params)
+	if err != nil {
+		return nil, err
+	}
+	targets := []resourceRef{}
+	items, _ := decoded["data"].([]interface{})
+	for _, item := range items {
+		resource, _ := item.(map[string]interface{})
+		id, _ := resource["id"].(string)
+		name, _ := resource["name"].(string)
+		if id != "" {
+			targets = append(targets, resourceRef{name: name, id: id})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name < targets[j].name })
+	return targets, nil
+}
+
+// confirmAction asks whether to go on with an action on count resources.
+func confirmAction(verb string, count int, kind string) bool {
+	label := fmt.Sprintf("%s %d %s", verb, count, kind)
+	if count != 1 {
+		label += "s"
+	}
+	prompt := promptui.Prompt{
+		Label:     label,
+		IsConfirm: true,
+	}
+	_, err := prompt.Run()
+	return err == nil
+}
+
+// resolveResources returns the resources of the kind given by name, id or
+// unique prefix, and those matching the search query, each once.
+func resolveResources(kind string, names []string, search string) ([]resourceRef, error) {
+	resources := []resourceRef{}
+	for _, name := range uniqueStrings(names) {
+		resolved, err := resolveResource(kind, name)
+		if err != nil {
+			return nil, err
+		}
+		if resolved.name == "" {
+			resolved.name = name
+		}
+		resources = append(resources, resolved)
+	}
+	if search != "" {
+		found, err := searchResources(kind, search)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, found...)
+	}
+	seen := make(map[string]bool)
+	unique := []resourceRef{}
+	for _, resource := range resources {
+		if !seen[resource.id] {
+			seen[resource.id] = true
+			unique = append(unique, resource)
+		}
+	}
+	return unique, nil
+}
+
+// deleteRun deletes the resources given by name or id, and those matching
+// --search, after confirmation.
+func deleteRun(cmd *cobra.Command, args []string) {
+	kind := strings.Fields(cmd.Use)[0]
+	search, _ := cmd.Flags().GetString("search")
+	resultFile, _ := cmd.Flags().GetString("result-file")
+	result := newOperationResult()
+	targets, err := resolveResources(kind, args, search)
+	if err != nil {
+		logger.Fatalf("Error calling operation: %s", err.Error())
+	}
+	if len(targets) == 0 {
+		logger.Fatalf("No %ss to delete, give names or use --search", kind)
+	}
+	if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			logger.Fatal("Refusing to delete without confirmation, use --yes")
+		}
+		for _, target := range targets {
+			fmt.Printf(" * %s (%s)\n", target.name, target.id)
+		}
+		if !confirmAction("Delete", len(targets), kind) {
+			fmt.Println("Cancelled")
+			for _, target := range targets {
+				result.skip(kind + "/" + target.name)
+			}
+			result.write(resultFile, 0)
+			return
+		}
+	}
+	failed := 0
+	for _, target := range targets {
+		if err := resourceDeleteControllersMap[kind](target.id, viper.New()); err != nil {
+			fmt.Fprintf(os.Stderr, " * %s/%s could not be deleted: %s\n", kind, target.name, err)
+			result.fail(kind+"/"+target.name, err)
+			failed++
+			continue
+		}
+		result.succeed(kind + "/" + target.name)
+		fmt.Printf(" * %s/%s deleted\n", kind, target.name)
+	}
+	if failed > 0 {
+		result.write(resultFile, 1)
+		os.Exit(1)
+	}
+	result.write(resultFile, 0)
+}
+
+// initDeleteCmds makes the delete commands accept many resources, --search
+// and --yes, and adds the ones missing for resources which are removed or
+// destroyed instead, e.g. delete machine.
+func initDeleteCmds() {
+	var deleteCmd *cobra.Command
+	for _, cmd := range cli.Root.Commands() {
+		if cmd.Name() == "delete" {
+			deleteCmd = cmd
+		}
+	}
+	if deleteCmd == nil {
+		return
+	}
+	existing := make(map[string]*cobra.Command)
+	for _, cmd := range deleteCmd.Commands() {
+		existing[cmd.Name()] = cmd
+	}
+	kinds := []string{}
+	for kind := range resourceDeleteControllersMap {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	aliasesMap := calculateAliasesMap(kinds)
+	for _, kind := range kinds {
+		cmd, ok := existing[kind]
+		if !ok {
+			cmd = &cobra.Command{
+				Short:             "Delete " + kind + "s",
+				Aliases:           aliasesMap[kind],
+				ValidArgsFunction: tagValidArgsFunction,
+			}
+			cmd.SetErr(os.Stderr)
+			deleteCmd.AddCommand(cmd)
+		}
+		cmd.Use = kind + " [" + strings.ToUpper(kind) + "...]"
+		cmd.Long = fmt.Sprintf(`Delete %[1]ss by name or id, or all %[1]ss matching --search.
+
+The %[1]ss are listed and a confirmation is asked for before deleting them,
+unless --yes is given.`, kind)
+		cmd.Example = fmt.Sprintf("  %[1]s delete %[2]s a b c\n  %[1]s delete %[2]s --search 'tag:tmp' --yes", cli.Root.CommandPath(), kind)
+		cmd.Args = cobra.ArbitraryArgs
+		cmd.Run = deleteRun
+		cmd.Flags().String("search", "", "Delete the "+kind+"s matching the search query")
+		cmd.Flags().BoolP("yes", "y", false, "Delete without asking for confirmation")
+		cmd.Flags().String("result-file", "", "Write a JSON summary of the outcome of every "+kind+" to a file")
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// describeField is a line of a describe section, showing the value at Path.
+// Values referring to other resources by id are shown by name when Ref
+// names the kind of resource.
+type describeField struct {
+	Label string
+	Path  string
+	Ref   string
+}
+
+type describeSection struct {
+	Title  string
+	Fields []describeField
+}
+
+var describeBasicFields = []describeField{
+	{"Name", "name", ""},
+	{"ID", "id", ""},
+}
+
+var describeOwnerFields = []describeField{
+	{"Created", "created", ""},
+	{"Owner", "owned_by", ""},
+	{"Created by", "created_by", ""},
+}
+
+// describeTemplates lists the sections shown for each kind of resource,
+// after which tags and related resources are shown. Fields missing from a
+// resource are skipped.
+var describeTemplates = map[string][]describeSection{
+	"machine": {
+		{"", append(append(append([]describeField{}, describeBasicFields...), []describeField{
+			{"State", "state", ""},
+			{"Cloud", "cloud", "cloud"},
+			{"Location", "location", ""},
+			{"Size", "size", ""},
+			{"Image", "image", ""},
+			{"External ID", "external_id", ""},
+			{"Public IPs", "public_ips", ""},
+			{"Private IPs", "private_ips", ""},
+			{"Expiration", "expiration", ""},
+		}...), describeOwnerFields...)},
+		{"Cost", []describeField{
+			{"Hourly", "cost.hourly", ""},
+			{"Monthly", "cost.monthly", ""},
+		}},
+		{"Monitoring", []describeField{
+			{"Enabled", "monitoring.hasmonitoring", ""},
+			{"Method", "monitoring.method", ""},
+			{"Installation", "monitoring.installation_status.state", ""},
+		}},
+	},
+	"cloud": {
+		{"", append(append(append([]describeField{}, describeBasicFields...), []describeField{
+			{"Provider", "provider", ""},
+			{"Enabled", "enabled", ""},
+		}...), describeOwnerFields...)},
+	},
+	"volume": {
+		{"", append(append(append([]describeField{}, describeBasicFields...), []describeField{
+			{"Size", "size", ""},
+			{"Cloud", "cloud", "cloud"},
+			{"Location", "location", ""},
+			{"External ID", "external_id", ""},
+			{"Attached to", "attached_to", "machine"},
+		}...), describeOwnerFields...)},
+	},
+	"network": {
+		{"", append(append(append([]describeField{}, describeBasicFields...), []describeField{
+			{"Cloud", "cloud", "cloud"},
+			{"Location", "location", ""},
+			{"External ID", "external_id", ""},
+			{"Subnets", "subnets", ""},
+			{"Machines", "machines", "machine"},
+		}...), describeOwnerFields...)},
+	},
+	"zone": {
+		{"", append(append(append([]describeField{}, describeBasicFields...), []describeField{
+			{"Domain", "domain", ""},
+			{"Type", "type", ""},
+			{"TTL", "ttl", ""},
+			{"Cloud", "cloud", "cloud"},
+			{"External ID", "external_id", ""},
+			{"Records", "records", ""},
+		}...), describeOwnerFields...)},
+	},
+	"cluster": {
+		{"", append(append(append([]describeField{}, describeBasicFields...), []describeField{
+			{"Cloud", "cloud", "cloud"},
+			{"Provider", "provider", ""},
+			{"Location", "location", ""},
+		}...), describeOwnerFields...)},
+		{"Capacity", []describeField{
+			{"Nodes", "total_nodes", ""},
+			{"CPUs", "total_cpus", ""},
+			{"RAM", "total_ram", ""},
+		}},
+	},
+	"key": {
+		{"", append(append(append([]describeField{}, describeBasicFields...), []describeField{
+			{"Default", "default", ""},
+		}...), describeOwnerFields...)},
+	},
+	"rule": {
+		{"", append(append([]describeField{}, describeBasicFields...), []describeField{
+			{"Resource type", "resource_type", ""},
+			{"Selectors", "selectors", ""},
+		}...)},
+		{"Trigger", []describeField{
+			{"Queries", "queries", ""},
+			{"Window", "window", ""},
+			{"Frequency", "frequency", ""},
+			{"Trigger after", "trigger_after", ""},
+			{"Actions", "actions", ""},
+		}},
+	},
+}
+
+// describeRelated lists, for each kind, the resources of other kinds whose
+// field refers to it.
+var describeRelated = map[string][]struct {
+	Title string
+	Kind  string
+	Field string
+}{
+	"machine": {
+		{"Volumes", "volume", "attached_to"},
+		{"Networks", "network", "machines"},
+	},
+	"cloud": {
+		{"Machines", "machine", "cloud"},
+		{"Volumes", "volume", "cloud"},
+		{"Networks", "network", "cloud"},
+		{"Zones", "zone", "cloud"},
+	},
+}
+
+func describeValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		items := []string{}
+		for _, item := range list {
+			items = append(items, transposedValue(item))
+		}
+		return strings.Join(items, ", ")
+	}
+	return transposedValue(value)
+}
+
+// describeFieldValue returns the value of the field, or false if the
+// resource doesn't have it.
+func describeFieldValue(field describeField, data map[string]interface{}, names referenceNames) (string, bool) {
+	value, err := jmespath.Search(field.Path, data)
+	if err != nil || value == nil {
+		return "", false
+	}
+	if field.Ref != "" {
+		switch v := value.(type) {
+		case string:
+			if v != "" {
+				value = names.lookup(field.Ref, v)
+			}
+		case []interface{}:
+			resolved := []interface{}{}
+			for _, item := range v {
+				if id, ok := item.(string); ok && id != "" {
+					resolved = append(resolved, names.lookup(field.Ref, id))
+				} else {
+					resolved = append(resolved, item)
+				}
+			}
+			value = resolved
+		}
+	}
+	s := describeValue(localizeTimes(value))
+	return s, s != ""
+}
+
+// relatedResources returns the names of the resources of the kind whose
+// field is or contains id.
+func relatedResources(kind, field, id string) ([]string, error) {
+	params := viper.New()
+	params.Set("only", "id,name,"+field)
+	params.Set("limit", 1000)
+	_, decoded, _, err := resourceListControllersMap[kind](params)
+	if err != nil {
+		return nil, err
+	}
+	related := []string{}
+	items, _ := decoded["data"].([]interface{})
+	for _, item := range items {
+		resource, _ := item.(map[string]interface{})
+		refs := referencedNames(resource[field])
+		for _, ref := range refs {
+			if ref == id {
+				name, _ := resource["name"].(string)
+				related = append(related, name)
+				break
+			}
+		}
+	}
+	sort.Strings(related)
+	return related, nil
+}
+
+// describeResource writes a human readable description of the resource.
+func describeResource(w *tabwriter.Writer, kind string, data map[string]interface{}, names referenceNames) error {
+	sections, ok := describeTemplates[kind]
+	if !ok {
+		// Show every field of resources without a template.
+		fields := []describeField{}
+		keys := []string{}
+		for key := range data {
+			if key != "tags" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			label := strings.Title(strings.Replace(key, "_", " ", -1))
+			fields = append(fields, describeField{Label: label, Path: key})
+		}
+		sections = []describeSection{{"", fields}}
+	}
+	for _, section := range sections {
+		lines := []string{}
+		for _, field := range section.Fields {
+			if value, ok := describeFieldValue(field, data, names); ok {
+				lines = append(lines, field.Label+":\t"+value)
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		indent := ""
+		if section.Title != "" {
+			fmt.Fprintf(w, "%s:\n", section.Title)
+			indent = "  "
+		}
+		for _, line := range lines {
+			fmt.Fprintf(w, "%s%s\n", indent, line)
+		}
+	}
+	tags := resourceTags(data["tags"])
+	fmt.Fprintln(w, "Tags:")
+	if len(tags) == 0 {
+		fmt.Fprintln(w, "  <none>")
+	}
+	for _, tag := range tags {
+		if tag.Value == "" {
+			fmt.Fprintf(w, "  %s\n", tag.Key)
+		} else {
+			fmt.Fprintf(w, "  %s=%s\n", tag.Key, tag.Value)
+		}
+	}
+	id, _ := data["id"].(string)
+	for _, related := range describeRelated[kind] {
+		items, err := relatedResources(related.Kind, related.Field, id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s:\n", related.Title)
+		if len(items) == 0 {
+			fmt.Fprintln(w, "  <none>")
+		}
+		for _, item := range items {
+			fmt.Fprintf(w, "  %s\n", item)
+		}
+	}
+	return nil
+}
+
+func describeRun(cmd *cobra.Command, args []string, params *viper.Viper) {
+	kind := strings.Fields(cmd.Use)[0]
+	names := make(referenceNames)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i, name := range args {
+		_, decoded, outputOptions, err := resourceGetControllersMap[kind](resolveArg(kind, name), viper.New())
+		if err != nil {
+			logger.Fatalf("Error calling operation: %s", err.Error())
+		}
+		if !isTableOutput() {
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+			continue
+		}
+		data, _ := decoded["data"].(map[string]interface{})
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if err := describeResource(w, kind, data, names); err != nil {
+			logger.Fatalf("Error calling operation: %s", err.Error())
+		}
+		w.Flush()
+	}
+}
+
+func describeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "describe",
+		Short: "Show details of resources",
+		Long: `Show a human readable description of resources, with their main
+fields grouped in sections, their tags and related resources, e.g. the
+volumes and networks of a machine. Referenced resources are shown by name.
+
+With -o json or yaml the resources are printed as returned by the API.`,
+	}
+	cmd.SetErr(os.Stderr)
+	kinds := []string{}
+	for kind := range resourceGetControllersMap {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	aliasesMap := calculateAliasesMap(kinds)
+	for _, kind := range kinds {
+		params := viper.New()
+		cmdResource := &cobra.Command{
+			Use:               kind + " " + strings.ToUpper(kind) + "...",
+			Short:             "Show details of " + kind + "s",
+			Aliases:           aliasesMap[kind],
+			Args:              cobra.MinimumNArgs(1),
+			ValidArgsFunction: tagValidArgsFunction,
+			Run: func(cmd *cobra.Command, args []string) {
+				describeRun(cmd, args, params)
+			},
+		}
+		cmdResource.SetErr(os.Stderr)
+		cmd.AddCommand(cmdResource)
+	}
+	return cmd
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// dfCommand reports disk usage in the POSIX format, in 1024 byte blocks,
+// which both GNU and BSD df support.
+const dfCommand = "df -P -k"
+
+// pseudoFilesystems are the memory backed filesystems left out unless --all
+// is given.
+var pseudoFilesystems = map[string]bool{"tmpfs": true, "devtmpfs": true, "overlay": true, "shm": true, "udev": true, "none": true}
+
+// diskUsage is a filesystem reported by df.
+type diskUsage struct {
+	machine    string
+	filesystem string
+	size       int64
+	used       int64
+	available  int64
+	percent    int
+	mountedOn  string
+}
+
+// parseDF parses the output of df -P -k.
+func parseDF(machine, output string, all bool) ([]diskUsage, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "Filesystem") {
+		return nil, fmt.Errorf("unexpected output of df: %q", output)
+	}
+	usages := []diskUsage{}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		size, err1 := strconv.ParseInt(fields[1], 10, 64)
+		used, err2 := strconv.ParseInt(fields[2], 10, 64)
+		available, err3 := strconv.ParseInt(fields[3], 10, 64)
+		percent, err4 := strconv.Atoi(strings.TrimSuffix(fields[4], "%"))
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		if !all && (size == 0 || pseudoFilesystems[fields[0]]) {
+			continue
+		}
+		usages = append(usages, diskUsage{
+			machine:    machine,
+			filesystem: fields[0],
+			size:       size * 1024,
+			used:       used * 1024,
+			available:  available * 1024,
+			percent:    percent,
+			mountedOn:  strings.Join(fields[5:], " "),
+		})
+	}
+	return usages, nil
+}
+
+// machineDiskUsage runs df on the machine over its SSH connection.
+func machineDiskUsage(machine string, all bool) ([]diskUsage, error) {
+	shell, err := openRemoteShell(machine)
+	if err != nil {
+		return nil, err
+	}
+	defer shell.Close()
+	output, err := shell.Output(dfCommand)
+	if err != nil {
+		return nil, err
+	}
+	return parseDF(machine, output, all)
+}
+
+// diskUsages runs df on every machine, at most parallel at a time, and
+// returns the filesystems of all, along with the machines it failed on.
+func diskUsages(machines []string, parallel int, all bool) ([]diskUsage, map[string]error) {
+	var mutex sync.Mutex
+	usages := []diskUsage{}
+	failed := map[string]error{}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for _, machine := range machines {
+		wg.Add(1)
+		go func(machine string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			found, err := machineDiskUsage(machine, all)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failed[machine] = err
+				return
+			}
+			usages = append(usages, found...)
+		}(machine)
+	}
+	wg.Wait()
+	return usages, failed
+}
+
+func machineDfCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "df [MACHINE...]",
+		Short: "Show the disk usage of machines",
+		Long: `Show the disk usage of machines, by running df over their SSH connections,
+as a table of their filesystems sorted by usage, fullest first.
+
+The machines are given by name, or selected by tag with --tag or with
+--search using the same query syntax as listings. Memory backed
+filesystems like tmpfs are left out unless --all is given. Filesystems
+used more than --threshold percent are flagged, and make the command exit
+with 1, e.g. for monitoring scripts. It exits with 255 if df could not be
+run on a machine. The machines need a POSIX df.`,
+		Example: `  mist machine df web-1
+  mist machine df --tag role=web --threshold 80`,
+		ValidArgsFunction: completeResourceFlag("machine"),
+		Run: func(cmd *cobra.Command, args []string) {
+			machines, err := targetMachines(args, params.GetStringSlice("tag"), params.GetString("search"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if len(machines) == 0 {
+				logger.Fatal("No machines given, give machine names or use --tag or --search")
+			}
+			threshold := params.GetInt("threshold")
+			if threshold < 0 || threshold > 100 {
+				logger.Fatal("--threshold must be a percent between 0 and 100")
+			}
+			parallel := parallelism(params)
+			if parallel < 1 {
+				parallel = 1
+			}
+			usages, failed := diskUsages(machines, parallel, params.GetBool("all"))
+			sort.SliceStable(usages, func(i, j int) bool {
+				if usages[i].percent != usages[j].percent {
+					return usages[i].percent > usages[j].percent
+				}
+				return usages[i].machine < usages[j].machine
+			})
+			rows := []interface{}{}
+			over := []string{}
+			for _, usage := range usages {
+				flag := ""
+				if threshold > 0 && usage.percent > threshold {
+					flag = "over"
+					over = append(over, fmt.Sprintf("%s:%s (%d%%)", usage.machine, usage.mountedOn, usage.percent))
+				}
+				rows = append(rows, map[string]interface{}{
+					"machine":    usage.machine,
+					"filesystem": usage.filesystem,
+					"size":       formatBytes(usage.size),
+					"used":       formatBytes(usage.used),
+					"available":  formatBytes(usage.available),
+					"use":        fmt.Sprintf("%d%%", usage.percent),
+					"mounted_on": usage.mountedOn,
+					"threshold":  flag,
+				})
+			}
+			columns := []string{"filesystem", "size", "used", "available", "use", "mounted_on"}
+			if len(machines) > 1 {
+				columns = append([]string{"machine"}, columns...)
+			}
+			if threshold > 0 {
+				columns = append(columns, "threshold")
+			}
+			wideColumns := columns
+			if len(machines) == 1 {
+				wideColumns = append([]string{"machine"}, columns...)
+			}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, wideColumns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+			names := make([]string, 0, len(failed))
+			for machine := range failed {
+				names = append(names, machine)
+			}
+			sort.Strings(names)
+			for _, machine := range names {
+				fmt.Fprintf(os.Stderr, "Error running df on %s: %s\n", machine, failed[machine])
+			}
+			if len(over) > 0 {
+				fmt.Fprintf(os.Stderr, "%d filesystems used more than %d%%: %s\n", len(over), threshold, strings.Join(over, ", "))
+			}
+			switch {
+			case len(failed) > 0:
+				os.Exit(255)
+			case len(over) > 0:
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringSlice("tag", nil, "Show the machines with the tag, as KEY=VALUE")
+	cmd.Flags().String("search", "", "Show the machines matching the search query")
+	cmd.Flags().Int("threshold", 0, "Flag filesystems used more than this percent, and exit with 1 if any is")
+	cmd.Flags().Bool("all", false, "Also show memory backed filesystems like tmpfs")
+	cmd.Flags().Int("parallel", 10, "Maximum number of machines to run df on at the same time")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
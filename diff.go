@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// referenceNames caches the names of resources referenced by id.
+type referenceNames map[string]string
+
+func (names referenceNames) lookup(kind, id string) string {
+	key := kind + "/" + id
+	if name, ok := names[key]; ok {
+		return name
+	}
+	name := id
+	if live, err := lookupResource(kind, id); err == nil && live != nil {
+		if n, ok := live["name"].(string); ok && n != "" {
+			name = n
+		}
+	}
+	names[key] = name
+	return name
+}
+
+// normalizeLiveValue returns the live value in the form used by the
+// manifest: referenced resources by name, and resources embedded as objects
+// by the name or id the manifest uses for them.
+func normalizeLiveValue(want, have interface{}, refKind string, names referenceNames) interface{} {
+	switch w := want.(type) {
+	case string:
+		switch h := have.(type) {
+		case string:
+			if refKind != "" && h != w && names.lookup(refKind, h) == w {
+				return w
+			}
+		case map[string]interface{}:
+			if h["name"] == w || h["id"] == w {
+				return w
+			}
+		}
+	case []interface{}:
+		h, ok := have.([]interface{})
+		if !ok || len(h) != len(w) {
+			return have
+		}
+		normalized := make([]interface{}, len(h))
+		for i := range h {
+			normalized[i] = normalizeLiveValue(w[i], h[i], refKind, names)
+		}
+		return normalized
+	}
+	return have
+}
+
+// liveSpec returns the fields of the live resource which the manifest sets,
+// normalized for comparison. Fields the API doesn't return, like
+// credentials, can't be compared and are taken from the manifest.
+func liveSpec(r *manifestResource, live map[string]interface{}, names referenceNames) map[string]interface{} {
+	spec := make(map[string]interface{})
+	for field, want := range r.Spec {
+		have, ok := live[field]
+		if !ok {
+			spec[field] = want
+			continue
+		}
+		spec[field] = normalizeLiveValue(want, have, manifestReferences[r.Kind][field], names)
+	}
+	return spec
+}
+
+// resourceYAML renders a resource as YAML lines, with its kind and name
+// first and the rest of its fields sorted.
+func resourceYAML(r *manifestResource, spec map[string]interface{}) ([]string, error) {
+	doc := yaml.MapSlice{{Key: "kind", Value: r.Kind}, {Key: "name", Value: r.Name}}
+	fields := []string{}
+	for field := range spec {
+		if field != "name" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		// Round trip through JSON so that numbers and nested maps render
+		// the same on both sides.
+		var value interface{}
+		j, err := json.Marshal(spec[field])
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(j, &value); err != nil {
+			return nil, err
+		}
+		doc = append(doc, yaml.MapItem{Key: field, Value: value})
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"), nil
+}
+
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// diffLines returns the edit script turning a into b, from their longest
+// common subsequence.
+func diffLines(a, b []string) []diffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	lines := []diffLine{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		default:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		}
+	}
+	return lines
+}
+
+// unifiedDiff returns the unified diff of a and b, or nothing if they are
+// the same.
+func unifiedDiff(a, b []string, from, to string) []string {
+	lines := diffLines(a, b)
+	changes := []int{}
+	for i, line := range lines {
+		if line.op != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	out := []string{"--- " + from, "+++ " + to}
+	for k := 0; k < len(changes); {
+		start := changes[k] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changes[k]
+		for k < len(changes) && changes[k]-end <= 2*diffContext {
+			end = changes[k]
+			k++
+		}
+		end += diffContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+		aStart, bStart := 0, 0
+		for _, line := range lines[:start] {
+			if line.op != '+' {
+				aStart++
+			}
+			if line.op != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		hunk := []string{}
+		for _, line := range lines[start:end] {
+			if line.op != '+' {
+				aLen++
+			}
+			if line.op != '-' {
+				bLen++
+			}
+			hunk = append(hunk, string(line.op)+line.text)
+		}
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		out = append(out, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen))
+		out = append(out, hunk...)
+	}
+	return out
+}
+
+func colorizeDiffLine(line string) string {
+	switch {
+	case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		return "\033[1m" + line + "\033[0m"
+	case strings.HasPrefix(line, "@@"):
+		return "\033[36m" + line + "\033[0m"
+	case strings.HasPrefix(line, "+"):
+		return "\033[32m" + line + "\033[0m"
+	case strings.HasPrefix(line, "-"):
+		return "\033[31m" + line + "\033[0m"
+	}
+	return line
+}
+
+// manifestDiff returns the unified diff of the live state against every
+// resource of the manifest.
+func manifestDiff(resources []*manifestResource) ([]string, error) {
+	names := make(referenceNames)
+	out := []string{}
+	for _, r := range resources {
+		want, err := resourceYAML(r, r.Spec)
+		if err != nil {
+			return nil, err
+		}
+		live, err := lookupResource(r.Kind, r.Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up %s: %s", r, err)
+		}
+		have := []string{}
+		if live != nil {
+			if have, err = resourceYAML(r, liveSpec(r, live, names)); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, unifiedDiff(have, want, "live/"+r.String(), "manifest/"+r.String())...)
+	}
+	return out, nil
+}
+
+func diffCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "diff -f FILENAME",
+		Short: "Show the differences between a manifest and the live resources",
+		Long: `Show the differences between a manifest and the live resources.
+
+Every resource of the manifest is compared with the live one on the fields
+the manifest sets, and the differences are printed as a unified diff.
+References to other resources are compared by name. Fields the API doesn't
+return, like cloud credentials, are not compared.
+
+The exit code is 0 if there are no differences, 1 if there are and 2 if
+the comparison failed, so that it can be used to detect drift in CI.`,
+		Args: cobra.ExactValidArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			filename := params.GetString("filename")
+			if filename == "" {
+				fmt.Fprintln(os.Stderr, "A manifest is required, use -f to specify one")
+				os.Exit(2)
+			}
+			resources, err := readManifest(filename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not read manifest: %s\n", err)
+				os.Exit(2)
+			}
+			lines, err := manifestDiff(resources)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not compare manifest: %s\n", err)
+				os.Exit(2)
+			}
+			color := colorOutput(params)
+			for _, line := range lines {
+				if color {
+					line = colorizeDiffLine(line)
+				}
+				fmt.Println(line)
+			}
+			if len(lines) > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("filename", "f", "", "Manifest file, or - for stdin")
+	cmd.Flags().Bool("no-color", false, "Don't color the diff")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
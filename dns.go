@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// recordTypes are the types of DNS records that can be added.
+var recordTypes = []string{"A", "AAAA", "CNAME", "TXT"}
+
+var recordOutputOptions = cli.CLIOutputOptions{
+	[]string{"name", "type", "ttl", "value"},
+	[]string{"id", "name", "type", "ttl", "value"},
+	[]string{},
+	[]string{},
+	map[string]string{},
+}
+
+func zoneAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeFirstArg(completeResourceFlag("zone"))(cmd, args, toComplete)
+}
+
+// recordAutocomplete completes the zone, then the records of the zone.
+func recordAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return zoneAutocomplete(cmd, args, toComplete)
+	}
+	records, err := zoneRecords(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, record := range records {
+		if name, _ := record["name"].(string); strings.HasPrefix(name, toComplete) {
+			names = append(names, name)
+		}
+	}
+	return uniqueStrings(names), cobra.ShellCompDirectiveNoFileComp
+}
+
+// recordValue returns the value of a record, joining the values of records
+// with many.
+func recordValue(record map[string]interface{}) string {
+	for _, field := range []string{"rdata", "value", "data"} {
+		switch v := record[field].(type) {
+		case []interface{}:
+			values := []string{}
+			for _, item := range v {
+				values = append(values, fmt.Sprintf("%v", item))
+			}
+			return strings.Join(values, ", ")
+		case string:
+			return v
+		}
+	}
+	return ""
+}
+
+// zoneRecords returns the records of the zone.
+func zoneRecords(zone string) ([]map[string]interface{}, error) {
+	_, decoded, _, err := MistApiV2ListRecords(zone, viper.New())
+	if err != nil {
+		return nil, err
+	}
+	return responseItems(decoded), nil
+}
+
+// findRecords returns the records of the zone with the id or name, and the
+// type if one is given.
+func findRecords(records []map[string]interface{}, record, recordType string) []map[string]interface{} {
+	found := []map[string]interface{}{}
+	for _, r := range records {
+		if r["id"] != record && r["name"] != record {
+			continue
+		}
+		if t, _ := r["type"].(string); recordType != "" && !strings.EqualFold(t, recordType) {
+			continue
+		}
+		found = append(found, r)
+	}
+	return found
+}
+
+// parseTTL parses a TTL given in seconds, like 300, or as a duration, like
+// 5m.
+func parseTTL(s string) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("invalid TTL %q, it can't be negative", s)
+		}
+		return n, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 || d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid TTL %q, give seconds or a duration like 5m", s)
+	}
+	return int(d / time.Second), nil
+}
+
+// validateRecord checks that the value is valid for the type of record.
+func validateRecord(recordType, value string) error {
+	ip := net.ParseIP(value)
+	switch recordType {
+	case "A":
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("%q is not an IPv4 address", value)
+		}
+	case "AAAA":
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("%q is not an IPv6 address", value)
+		}
+	case "CNAME":
+		if ip != nil || strings.ContainsAny(value, " \t") {
+			return fmt.Errorf("%q is not a host name", value)
+		}
+	case "TXT":
+		if len(value) > 255 {
+			return fmt.Errorf("TXT values are at most 255 characters long")
+		}
+	default:
+		return fmt.Errorf("unsupported record type %s, expected one of %s", recordType, strings.Join(recordTypes, ", "))
+	}
+	return nil
+}
+
+// showRecords formats the records of a zone with their values.
+func showRecords(records []map[string]interface{}, params *viper.Viper) {
+	rows := []interface{}{}
+	for _, record := range records {
+		rows = append(rows, map[string]interface{}{
+			"id":    record["id"],
+			"name":  record["name"],
+			"type":  record["type"],
+			"ttl":   record["ttl"],
+			"value": recordValue(record),
+		})
+	}
+	if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, recordOutputOptions); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+}
+
+func dnsRecordListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:               "list ZONE",
+		Short:             "List the records of a zone",
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: zoneAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			records, err := zoneRecords(args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if recordType := params.GetString("type"); recordType != "" {
+				filtered := []map[string]interface{}{}
+				for _, record := range records {
+					if t, _ := record["type"].(string); strings.EqualFold(t, recordType) {
+						filtered = append(filtered, record)
+					}
+				}
+				records = filtered
+			}
+			showRecords(records, params)
+		},
+	}
+	cmd.Flags().String("type", "", "Only list records of this type")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func dnsRecordAddCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "add ZONE NAME TYPE VALUE",
+		Short: "Add a record to a zone",
+		Long: `Add an A, AAAA, CNAME or TXT record to a zone. NAME is relative to the
+zone, use @ for the zone itself.
+
+The TTL is given in seconds or as a duration, like 5m. Without --ttl the
+default TTL of the provider is used.`,
+		Example: `  mist dns record add example.com www A 203.0.113.10 --ttl 5m
+  mist dns record add example.com @ TXT "v=spf1 -all"
+  mist dns record add example.com blog CNAME www.example.com`,
+		Args:              cobra.ExactArgs(4),
+		ValidArgsFunction: zoneAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			recordType := strings.ToUpper(args[2])
+			if err := validateRecord(recordType, args[3]); err != nil {
+				logger.Fatal(err)
+			}
+			record := map[string]interface{}{
+				"name":  args[1],
+				"type":  recordType,
+				"value": args[3],
+			}
+			if ttl := params.GetString("ttl"); ttl != "" {
+				seconds, err := parseTTL(ttl)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				record["ttl"] = seconds
+			}
+			body, err := json.Marshal(record)
+			if err != nil {
+				logger.Fatalf("Unable to get body: %s", err.Error())
+			}
+			_, decoded, outputOptions, err := MistApiV2CreateRecord(args[0], params, string(body))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("ttl", "", "Time to live, in seconds or as a duration like 5m")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func dnsRecordDeleteCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "delete ZONE RECORD...",
+		Short: "Delete records of a zone",
+		Long: `Delete records of a zone by name or id. Records sharing a name, like the
+A and TXT records of the zone itself, are told apart with --type.
+
+The records are listed and a confirmation is asked for before deleting
+them, unless --yes is given.`,
+		Example: `  mist dns record delete example.com www
+  mist dns record delete example.com @ --type TXT --yes`,
+		Args:              cobra.MinimumNArgs(2),
+		ValidArgsFunction: recordAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			records, err := zoneRecords(args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			targets := []map[string]interface{}{}
+			for _, name := range uniqueStrings(args[1:]) {
+				found := findRecords(records, name, params.GetString("type"))
+				switch {
+				case len(found) == 0:
+					logger.Fatalf("Record %s not found in zone %s", name, args[0])
+				case len(found) > 1 && params.GetString("type") == "":
+					types := []string{}
+					for _, record := range found {
+						t, _ := record["type"].(string)
+						types = append(types, t)
+					}
+					logger.Fatalf("Zone %s has %d records named %s, of types %s, pick one with --type", args[0], len(found), name, strings.Join(types, ", "))
+				}
+				targets = append(targets, found...)
+			}
+			for _, record := range targets {
+				fmt.Printf("  %v\t%v\t%s\n", record["name"], record["type"], recordValue(record))
+			}
+			if !params.GetBool("yes") && !confirmAction("Delete", len(targets), "record") {
+				return
+			}
+			for _, record := range targets {
+				id, _ := record["id"].(string)
+				if _, _, _, err := MistApiV2DeleteRecord(args[0], id, viper.New()); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf("Record %v %v deleted\n", record["name"], record["type"])
+			}
+		},
+	}
+	cmd.Flags().String("type", "", "Only delete records of this type")
+	cmd.Flags().BoolP("yes", "y", false, "Delete without asking for confirmation")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func dnsCmd() *cobra.Command {
+	recordCmd := &cobra.Command{
+		Use:     "record",
+		Aliases: []string{"records"},
+		Short:   "Manage the records of DNS zones",
+	}
+	recordCmd.AddCommand(dnsRecordListCmd())
+	recordCmd.AddCommand(dnsRecordAddCmd())
+	recordCmd.AddCommand(dnsRecordDeleteCmd())
+	recordCmd.SetErr(os.Stderr)
+	cmd := &cobra.Command{
+		Use:   "dns",
+		Short: "Manage DNS zones and records",
+	}
+	cmd.AddCommand(recordCmd)
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+// initRecordCmds makes get records show a record or the records of a zone,
+// with their values, and complete zones and records.
+func initRecordCmds() {
+	for _, cmd := range cli.Root.Commands() {
+		if cmd.Name() != "get" {
+			continue
+		}
+		for _, sub := range cmd.Commands() {
+			if sub.Name() != "records" {
+				continue
+			}
+			params := viper.New()
+			params.BindPFlags(sub.Flags())
+			sub.Args = cobra.RangeArgs(1, 2)
+			sub.ValidArgsFunction = recordAutocomplete
+			sub.Run = func(cmd *cobra.Command, args []string) {
+				if len(args) == 2 {
+					_, decoded, outputOptions, err := MistApiV2GetRecord(args[0], args[1], params)
+					if err != nil {
+						logger.Fatalf("Error calling operation: %s", err.Error())
+					}
+					if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+						logger.Fatalf("Formatting failed: %s", err.Error())
+					}
+					return
+				}
+				_, decoded, _, err := MistApiV2ListRecords(args[0], params)
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				showRecords(responseItems(decoded), params)
+			}
+		}
+	}
+}
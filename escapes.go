@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// States of escapeFilter.
+const (
+	escapeNormal = iota
+	escapeStart
+	escapeOSCParam
+	escapeOSCPass
+	escapeOSCPassEnd
+	escapeOSCDrop
+	escapeOSCDropEnd
+	escapeCSI
+)
+
+// maxEscapeLength bounds the escape sequences held back to be checked, past
+// which they are passed through.
+const maxEscapeLength = 64
+
+// escapeFilter passes the output of a remote terminal through, except for
+// the escape sequences which were disabled: OSC 52 clipboard writes, OSC 0,
+// 1 and 2 window titles and bracketed paste mode. Sequences split across
+// writes are recognized, and long clipboard writes are passed or dropped as
+// they come without being held back.
+type escapeFilter struct {
+	w                  io.Writer
+	dropClipboard      bool
+	dropTitle          bool
+	dropBracketedPaste bool
+	state              int
+	seq                []byte
+}
+
+func (f *escapeFilter) dropOSC(param string) bool {
+	switch param {
+	case "52":
+		return f.dropClipboard
+	case "0", "1", "2":
+		return f.dropTitle
+	}
+	return false
+}
+
+func (f *escapeFilter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		switch f.state {
+		case escapeNormal:
+			if b == 0x1b {
+				f.state, f.seq = escapeStart, []byte{b}
+			} else {
+				out = append(out, b)
+			}
+		case escapeStart:
+			switch b {
+			case ']':
+				f.state, f.seq = escapeOSCParam, append(f.seq, b)
+			case '[':
+				f.state, f.seq = escapeCSI, append(f.seq, b)
+			case 0x1b:
+				out = append(out, f.seq...)
+				f.seq = []byte{b}
+			default:
+				out = append(out, append(f.seq, b)...)
+				f.state = escapeNormal
+			}
+		case escapeOSCParam:
+			f.seq = append(f.seq, b)
+			if b >= '0' && b <= '9' && len(f.seq) < maxEscapeLength {
+				continue
+			}
+			drop := f.dropOSC(string(f.seq[2 : len(f.seq)-1]))
+			if !drop {
+				out = append(out, f.seq...)
+			}
+			switch {
+			case b == 0x07:
+				f.state = escapeNormal
+			case b == 0x1b && drop:
+				f.state = escapeOSCDropEnd
+			case b == 0x1b:
+				f.state = escapeOSCPassEnd
+			case drop:
+				f.state = escapeOSCDrop
+			default:
+				f.state = escapeOSCPass
+			}
+		case escapeOSCPass, escapeOSCDrop:
+			if f.state == escapeOSCPass {
+				out = append(out, b)
+			}
+			switch {
+			case b == 0x07:
+				f.state = escapeNormal
+			case b == 0x1b && f.state == escapeOSCPass:
+				f.state = escapeOSCPassEnd
+			case b == 0x1b:
+				f.state = escapeOSCDropEnd
+			}
+		case escapeOSCPassEnd:
+			// The escape was passed, and whatever follows it too.
+			out = append(out, b)
+			f.state = escapeNormal
+		case escapeOSCDropEnd:
+			f.state = escapeNormal
+			if b != '\\' {
+				// Another escape sequence ends the OSC and starts anew.
+				f.state, f.seq = escapeStart, []byte{0x1b}
+				i--
+			}
+		case escapeCSI:
+			f.seq = append(f.seq, b)
+			if b >= 0x40 && b <= 0x7e {
+				params := string(f.seq[2:])
+				if !f.dropBracketedPaste || params != "?2004h" && params != "?2004l" {
+					out = append(out, f.seq...)
+				}
+				f.state = escapeNormal
+			} else if len(f.seq) >= maxEscapeLength {
+				out = append(out, f.seq...)
+				f.state = escapeNormal
+			}
+		}
+	}
+	if _, err := f.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+var (
+	terminalEscapes     *escapeFilter
+	terminalEscapesOnce sync.Once
+)
+
+// terminalEscapeFilter returns the filter of the escape sequences disabled
+// with the flags of ssh, or nil if none are.
+func terminalEscapeFilter() *escapeFilter {
+	terminalEscapesOnce.Do(func() {
+		f := &escapeFilter{
+			dropClipboard:      viper.GetBool("ssh_no_clipboard"),
+			dropTitle:          viper.GetBool("ssh_no_title"),
+			dropBracketedPaste: viper.GetBool("ssh_no_bracketed_paste"),
+		}
+		if f.dropClipboard || f.dropTitle || f.dropBracketedPaste {
+			terminalEscapes = f
+		}
+	})
+	return terminalEscapes
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// eventTypes are the types of events the events command streams.
+var eventTypes = []string{"machine", "rule", "audit"}
+
+// maxEventsBackoff is the longest the events command waits before polling
+// again after failing to.
+const maxEventsBackoff = time.Minute
+
+// machineState is what the events command keeps of a machine between polls.
+type machineState struct {
+	name  string
+	state string
+}
+
+// machineStates lists the state of every machine, page by page.
+func machineStates() (map[string]machineState, error) {
+	states := map[string]machineState{}
+	for start := 0; ; start += maxPageSize {
+		params := viper.New()
+		params.Set("only", "id,name,state")
+		params.Set("start", strconv.Itoa(start))
+		params.Set("limit", maxPageSize)
+		_, decoded, _, err := MistApiV2ListMachines(params)
+		if err != nil {
+			return nil, err
+		}
+		items, _ := decoded["data"].([]interface{})
+		for _, item := range items {
+			machine, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			id, _ := machine["id"].(string)
+			name, _ := machine["name"].(string)
+			state, _ := machine["state"].(string)
+			states[id] = machineState{name: name, state: state}
+		}
+		if len(items) < maxPageSize {
+			return states, nil
+		}
+	}
+}
+
+// machineStateEvents returns an event for every machine whose state changed
+// between polls, and for those added or removed.
+func machineStateEvents(before, after map[string]machineState, now time.Time) []map[string]interface{} {
+	ids := []string{}
+	for id := range after {
+		ids = append(ids, id)
+	}
+	for id := range before {
+		if _, ok := after[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	events := []map[string]interface{}{}
+	for _, id := range ids {
+		old, existed := before[id]
+		current, exists := after[id]
+		event := map[string]interface{}{
+			"time":     now.Format(time.RFC3339),
+			"type":     "machine",
+			"resource": "machine " + id,
+			"name":     current.name,
+			"from":     old.state,
+			"to":       current.state,
+		}
+		switch {
+		case !existed:
+			event["action"] = "added"
+		case !exists:
+			event["action"] = "removed"
+			event["name"] = old.name
+		case old.state != current.state:
+			event["action"] = "state_changed"
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// logStreamEvent turns a logged event into an event of the stream. Incidents
+// raised by rules are rule events, and the others audit events.
+func logStreamEvent(logged map[string]interface{}) map[string]interface{} {
+	row := logRow(logged)
+	event := map[string]interface{}{
+		"time":     row["time"],
+		"type":     "audit",
+		"action":   row["action"],
+		"resource": row["resource"],
+		"user":     row["user"],
+		"error":    row["error"],
+		"severity": logSeverity(logged),
+	}
+	if logged["type"] == "incident" {
+		event["type"] = "rule"
+	}
+	if name, ok := logged["rule_title"].(string); ok {
+		event["name"] = name
+	}
+	return event
+}
+
+// eventDetails summarizes the fields of an event not shown in the other
+// columns.
+func eventDetails(event map[string]interface{}) string {
+	details := []string{}
+	if name, _ := event["name"].(string); name != "" {
+		details = append(details, name)
+	}
+	if event["action"] == "state_changed" {
+		details = append(details, fmt.Sprintf("%s -> %s", event["from"], event["to"]))
+	}
+	if user, _ := event["user"].(string); user != "" {
+		details = append(details, "by "+user)
+	}
+	if failed, _ := event["error"].(string); failed != "" {
+		details = append(details, "error: "+failed)
+	}
+	return strings.Join(details, ", ")
+}
+
+// eventStream writes the events of the selected types matching the
+// filters, one per line, as JSON with -o json or as columns otherwise.
+type eventStream struct {
+	types   map[string]bool
+	filters []resourceFilter
+	json    bool
+	w       *tabwriter.Writer
+}
+
+func (es *eventStream) write(events []map[string]interface{}) error {
+	for _, event := range events {
+		if !es.types[event["type"].(string)] {
+			continue
+		}
+		matches := true
+		for _, f := range es.filters {
+			if !f.match(event) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		if es.json {
+			j, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(j))
+			continue
+		}
+		fmt.Fprintf(es.w, "%s\t%s\t%s\t%s\t%s\n", event["time"], strings.ToUpper(event["type"].(string)), event["action"], event["resource"], eventDetails(event))
+	}
+	return es.w.Flush()
+}
+
+// eventsFollower polls the logs, and the states of the machines if
+// machines is set, for new events.
+type eventsFollower struct {
+	stream   *eventStream
+	machines bool
+	last     time.Time
+	seen     map[string]bool
+	states   map[string]machineState
+}
+
+func (f *eventsFollower) poll() error {
+	now := time.Now().UTC()
+	logged, err := logEvents(f.last, now)
+	if err != nil {
+		return err
+	}
+	unseen, last, seen := newEvents(logged, f.last, f.seen)
+	events := []map[string]interface{}{}
+	for _, event := range unseen {
+		events = append(events, logStreamEvent(event))
+	}
+	var states map[string]machineState
+	if f.machines {
+		if states, err = machineStates(); err != nil {
+			return err
+		}
+		if f.states != nil {
+			events = append(events, machineStateEvents(f.states, states, now)...)
+		}
+	}
+	if err := f.stream.write(events); err != nil {
+		logger.Fatal(err)
+	}
+	f.last, f.seen, f.states = last, seen, states
+	return nil
+}
+
+// follow polls for new events every interval. When a poll fails, it waits
+// twice as long as before up to maxEventsBackoff before polling again, and
+// goes back to the interval once a poll succeeds.
+func (f *eventsFollower) follow(interval time.Duration) {
+	backoff := time.Duration(0)
+	for {
+		wait := interval
+		if backoff > 0 {
+			wait = backoff
+		}
+		time.Sleep(wait)
+		if err := f.poll(); err != nil {
+			if backoff *= 2; backoff == 0 {
+				backoff = interval
+			}
+			if backoff > maxEventsBackoff {
+				backoff = maxEventsBackoff
+			}
+			fmt.Fprintf(os.Stderr, "Could not poll for events (%s), retrying in %s\n", err, backoff)
+			continue
+		}
+		if backoff > 0 {
+			fmt.Fprintln(os.Stderr, "Polling for events again")
+		}
+		backoff = 0
+	}
+}
+
+func eventsCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "Stream machine state changes, rule triggers and audit events",
+		Long: `Show the events of the organization as they happen: machines changing
+state, incidents raised by rules and audit events.
+
+The events logged since --since ago are shown first, and with --follow
+mist keeps polling the logs and the machines every --interval. Machine
+state changes are found by comparing the machines between polls, so they
+are only shown while following. When a poll fails, mist waits twice as
+long before every new attempt, up to a minute, until it succeeds again.
+
+Events are filtered by --type and by --filter expressions on their fields,
+time, type, action, resource, name, user, error, and from and to for
+state changes, using the same comparisons as --where. With -o json, events
+are written one per line as JSON.`,
+		Example: `  mist events --follow
+  mist events --follow --type machine --filter to==error
+  mist events --since 1h --filter "action=~^(create|destroy)_machine$" -o json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			stream := &eventStream{
+				types: map[string]bool{},
+				json:  outputFormat() == "json",
+				w:     tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0),
+			}
+			for _, t := range eventTypes {
+				stream.types[t] = false
+			}
+			for _, t := range params.GetStringSlice("type") {
+				if _, ok := stream.types[t]; !ok {
+					logger.Fatalf("Unknown event type %s, expected one of %s", t, strings.Join(eventTypes, ", "))
+				}
+				stream.types[t] = true
+			}
+			filters, _ := cmd.Flags().GetStringArray("filter")
+			for _, expr := range filters {
+				f, err := parseWhere("filter", expr)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				stream.filters = append(stream.filters, f)
+			}
+			interval := params.GetDuration("interval")
+			if interval <= 0 {
+				logger.Fatal("--interval must be positive")
+			}
+			start, err := parseSince(params.GetString("since"), time.Now().UTC())
+			if err != nil {
+				logger.Fatal(err)
+			}
+			follower := &eventsFollower{
+				stream:   stream,
+				machines: stream.types["machine"] && params.GetBool("follow"),
+				last:     start.Truncate(time.Second),
+				seen:     map[string]bool{},
+			}
+			if err := follower.poll(); err != nil {
+				logger.Fatalf("Could not read the events: %s", err)
+			}
+			if params.GetBool("follow") {
+				follower.follow(interval)
+			}
+		},
+	}
+	cmd.Flags().BoolP("follow", "f", false, "Keep polling for new events")
+	cmd.Flags().Duration("interval", 5*time.Second, "How often to poll for new events with --follow")
+	cmd.Flags().String("since", "10m", "Show the events logged since, a duration before now <1h | 7d> or a timestamp <rfc3339 | unix_timestamp>")
+	cmd.Flags().StringSlice("type", eventTypes, "Types of events to show: machine, rule or audit")
+	cmd.Flags().StringArray("filter", []string{}, "Only show events where FIELD==VALUE, also !=, =~, !~, <, <=, >, >=, may be repeated")
+	cmd.RegisterFlagCompletionFunc("type", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return eventTypes, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
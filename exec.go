@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// prefixWriter writes complete lines to w, each prefixed with the name of
+// the machine it came from. Writers of different machines share a mutex so
+// that their lines don't interleave.
+type prefixWriter struct {
+	w      io.Writer
+	mutex  *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, err := fmt.Fprintf(p.w, "%s%s", p.prefix, line)
+	return err
+}
+
+// flush writes out the last line if it doesn't end with a newline.
+func (p *prefixWriter) flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+// execResult is the outcome of running a command on a machine.
+type execResult struct {
+	Machine  string
+	ExitCode int
+	Err      error
+}
+
+// runOnMachine runs command on the machine, giving up after timeout if it
+// is not zero.
+func runOnMachine(machine, command string, stdout, stderr io.Writer, timeout time.Duration) (int, error) {
+	shell, err := openRemoteShell(machine)
+	if err != nil {
+		return 0, err
+	}
+	defer shell.Close()
+	type outcome struct {
+		exitCode int
+		err      error
+	}
+	finished := make(chan outcome, 1)
+	go func() {
+		exitCode, err := shell.Run(command, stdout, stderr)
+		finished <- outcome{exitCode, err}
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case o := <-finished:
+		return o.exitCode, o.err
+	case <-expired:
+		shell.terminate()
+		return 0, fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// execOnMachines runs command on every machine, at most parallel at a time,
+// prefixing every line of output with the name of the machine.
+func execOnMachines(machines []string, command string, parallel int, timeout time.Duration) []execResult {
+	width := 0
+	for _, machine := range machines {
+		if len(machine) > width {
+			width = len(machine)
+		}
+	}
+	var outputMutex sync.Mutex
+	results := make([]execResult, len(machines))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, machine := range machines {
+		wg.Add(1)
+		go func(i int, machine string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			prefix := fmt.Sprintf("%-*s | ", width, machine)
+			stdout := &prefixWriter{w: os.Stdout, mutex: &outputMutex, prefix: prefix}
+			stderr := &prefixWriter{w: os.Stderr, mutex: &outputMutex, prefix: prefix}
+			exitCode, err := runOnMachine(machine, command, stdout, stderr, timeout)
+			stdout.flush()
+			stderr.flush()
+			if err != nil {
+				stderr.writeLine([]byte(fmt.Sprintf("error: %s\n", err)))
+			}
+			results[i] = execResult{Machine: machine, ExitCode: exitCode, Err: err}
+		}(i, machine)
+	}
+	wg.Wait()
+	return results
+}
+
+// searchMachines returns the names of the machines matching the search
+// query.
+func searchMachines(search string) ([]string, error) {
+	found, err := searchResources("machine", search)
+	if err != nil {
+		return nil, err
+	}
+	machines := []string{}
+	for _, machine := range found {
+		if machine.name != "" {
+			machines = append(machines, machine.name)
+		}
+	}
+	return machines, nil
+}
+
+// targetMachines returns the names of the machines given by name, and of
+// those having the tags, given as KEY=VALUE, or matching the search query.
+func targetMachines(names, tags []string, search string) ([]string, error) {
+	terms := []string{}
+	for _, tag := range tags {
+		terms = append(terms, "tag:"+tag)
+	}
+	if search != "" {
+		terms = append(terms, search)
+	}
+	machines := append([]string{}, names...)
+	if len(terms) > 0 {
+		found, err := searchMachines(strings.Join(terms, " "))
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, found...)
+	}
+	return uniqueStrings(machines), nil
+}
+
+func uniqueStrings(items []string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, item := range items {
+		if !seen[item] {
+			seen[item] = true
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
+
+// execExitCode aggregates the results: 0 if the command succeeded on every
+// machine, 255 if it could not be run on any of them, e.g. because a
+// machine was unreachable or the command timed out, and 1 otherwise.
+func execExitCode(results []execResult) int {
+	exitCode := 0
+	for _, result := range results {
+		if result.Err != nil {
+			return 255
+		}
+		if result.ExitCode != 0 {
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+func printExecSummary(results []execResult) {
+	failed := []string{}
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed = append(failed, fmt.Sprintf("%s (%s)", result.Machine, result.Err))
+		case result.ExitCode != 0:
+			failed = append(failed, fmt.Sprintf("%s (exit code %d)", result.Machine, result.ExitCode))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Succeeded on %d of %d machines\n", len(results)-len(failed), len(results))
+	for _, failure := range failed {
+		fmt.Fprintf(os.Stderr, " * %s\n", failure)
+	}
+}
+
+// execOperationResult turns the results into the summary of --result-file,
+// where commands exiting with non zero codes failed.
+func execOperationResult(results []execResult) *operationResult {
+	result := newOperationResult()
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			result.fail(r.Machine, r.Err)
+		case r.ExitCode != 0:
+			result.fail(r.Machine, fmt.Errorf("exit code %d", r.ExitCode))
+		default:
+			result.succeed(r.Machine)
+		}
+	}
+	return result
+}
+
+// execNDJSON runs the command of every line of input, a JSON object like
+// {"machine":"web-1","command":"uptime"}, on its machine, at most parallel
+// at a time. A JSON object is written per line as each is done, with the
+// fields of the line along with the exit code and output of the command.
+func execNDJSON(input io.Reader, parallel int, timeout time.Duration) []execResult {
+	var outputMutex sync.Mutex
+	emit := func(line map[string]interface{}) {
+		j, _ := json.Marshal(line)
+		outputMutex.Lock()
+		defer outputMutex.Unlock()
+		fmt.Println(string(j))
+	}
+	var resultsMutex sync.Mutex
+	results := []execResult{}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		line := map[string]interface{}{}
+		err := json.Unmarshal([]byte(text), &line)
+		machine, _ := line["machine"].(string)
+		command, _ := line["command"].(string)
+		if err == nil && (machine == "" || command == "") {
+			err = fmt.Errorf("machine and command must be strings")
+		}
+		if err != nil {
+			err = fmt.Errorf("line %d: %s", n, err)
+			emit(map[string]interface{}{"line": n, "error": err.Error()})
+			resultsMutex.Lock()
+			results = append(results, execResult{Machine: fmt.Sprintf("line %d", n), Err: err})
+			resultsMutex.Unlock()
+			continue
+		}
+		// Lines are read as slots free up, so that input is streamed.
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(line map[string]interface{}, machine, command string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			var stdout, stderr bytes.Buffer
+			exitCode, err := runOnMachine(machine, command, &stdout, &stderr, timeout)
+			line["exit_code"] = exitCode
+			line["stdout"] = stdout.String()
+			line["stderr"] = stderr.String()
+			if err != nil {
+				line["error"] = err.Error()
+			}
+			emit(line)
+			resultsMutex.Lock()
+			defer resultsMutex.Unlock()
+			results = append(results, execResult{Machine: machine, ExitCode: exitCode, Err: err})
+		}(line, machine, command)
+	}
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		logger.Fatalf("Error reading the input: %s", err)
+	}
+	return results
+}
+
+func execCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "exec [MACHINE...] -- COMMAND... | exec --ndjson-input",
+		Short: "Run a command on many machines",
+		Long: `Run a command on many machines concurrently.
+
+The machines are given by name, or selected with --search using the same
+query syntax as listings. Every line of output is prefixed with the name of
+the machine it came from. The exit code is 0 if the command succeeded on
+every machine, 1 if it failed on any of them and 255 if it could not be run
+on any of them, e.g. because a machine was unreachable or it timed out.
+
+With --ndjson-input, the machines and commands are read from stdin, one
+JSON object per line like {"machine":"web-1","command":"uptime"}, so that
+machines can run different commands. A JSON object is written per line as
+each command is done, with the fields of its input line along with
+exit_code, stdout, stderr and error.`,
+		Example: `  mist exec --search 'tag:web' -- uptime
+  mist exec web-1 web-2 --parallel 1 -- sudo systemctl restart nginx
+  jq -c '.[]' jobs.json | mist exec --ndjson-input`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if ndjson, _ := cmd.Flags().GetBool("ndjson-input"); ndjson {
+				if len(args) > 0 {
+					return fmt.Errorf("machines and commands are read from stdin with --ndjson-input")
+				}
+				return nil
+			}
+			if cmd.ArgsLenAtDash() < 0 || cmd.ArgsLenAtDash() == len(args) {
+				return fmt.Errorf("the command to run must follow --")
+			}
+			return nil
+		},
+		ValidArgsFunction: sshAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			parallel := parallelism(params)
+			if parallel < 1 {
+				parallel = 1
+			}
+			if params.GetBool("ndjson-input") {
+				results := execNDJSON(os.Stdin, parallel, params.GetDuration("timeout"))
+				execOperationResult(results).write(params.GetString("result-file"), execExitCode(results))
+				os.Exit(execExitCode(results))
+			}
+			machines := args[:cmd.ArgsLenAtDash()]
+			command := strings.Join(args[cmd.ArgsLenAtDash():], " ")
+			if search := params.GetString("search"); search != "" {
+				found, err := searchMachines(search)
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				machines = append(machines, found...)
+			}
+			machines = uniqueStrings(machines)
+			if len(machines) == 0 {
+				logger.Fatal("No machines to run the command on, give machine names or use --search")
+			}
+			results := execOnMachines(machines, command, parallel, params.GetDuration("timeout"))
+			printExecSummary(results)
+			execOperationResult(results).write(params.GetString("result-file"), execExitCode(results))
+			os.Exit(execExitCode(results))
+		},
+	}
+	cmd.Flags().String("search", "", "Run on the machines matching the search query")
+	cmd.Flags().Int("parallel", 10, "Maximum number of machines to run the command on at the same time")
+	cmd.Flags().Duration("timeout", 0, "Maximum time the command may run on each machine, 0 for no limit")
+	cmd.Flags().Bool("ndjson-input", false, "Read the machines and commands to run from stdin, one JSON object per line")
+	cmd.Flags().String("result-file", "", "Write a JSON summary of the outcome on every machine to a file")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
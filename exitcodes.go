@@ -0,0 +1,189 @@
+package main
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+// Exit codes of failed commands, so that scripts can tell failures apart.
+// Some commands document exit codes of their own, like diff or exec.
+const (
+	exitError          = 1
+	exitAuth           = 2
+	exitNotFound       = 3
+	exitRateLimited    = 4
+	exitInvalidRequest = 5
+	exitServerError    = 6
+	exitNetwork        = 7
+	// exitInterrupted is the code shells report for commands stopped with
+	// Ctrl-C.
+	exitInterrupted = 130
+)
+
+// exitCodeNames name the exit codes in JSON errors.
+var exitCodeNames = map[int]string{
+	exitError:          "error",
+	exitAuth:           "unauthorized",
+	exitNotFound:       "not_found",
+	exitRateLimited:    "rate_limited",
+	exitInvalidRequest: "invalid_request",
+	exitServerError:    "server_error",
+	exitNetwork:        "network_error",
+	exitInterrupted:    "interrupted",
+}
+
+// apiErrorPattern matches the errors of failed API requests.
+var apiErrorPattern = regexp.MustCompile(`HTTP (\d{3}): ?(.*)`)
+
+var (
+	lastRequestErrorMutex sync.Mutex
+	// lastRequestError is the error of the last API request which failed,
+	// to tell why a command failed from its message.
+	lastRequestError error
+)
+
+// authError is an error caused by the token of the context.
+type authError struct {
+	error
+}
+
+func (e authError) ExitCode() int {
+	return exitAuth
+}
+
+// statusExitCode returns the exit code for an HTTP status.
+func statusExitCode(status int) int {
+	switch {
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return exitAuth
+	case status == http.StatusNotFound:
+		return exitNotFound
+	case status == http.StatusTooManyRequests:
+		return exitRateLimited
+	case status >= 500:
+		return exitServerError
+	case status >= 400:
+		return exitInvalidRequest
+	}
+	return exitError
+}
+
+// errorExitCode returns the exit code for an error.
+func errorExitCode(err error) int {
+	var coder interface{ ExitCode() int }
+	if errors.As(err, &coder) {
+		return coder.ExitCode()
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) || errors.Is(err, gocontext.DeadlineExceeded) {
+		return exitNetwork
+	}
+	return messageExitCode(err.Error())
+}
+
+// messageExitCode returns the exit code for the message of a failure,
+// which may include the status of a failed API request.
+func messageExitCode(message string) int {
+	if match := apiErrorPattern.FindStringSubmatch(message); match != nil {
+		status, _ := strconv.Atoi(match[1])
+		return statusExitCode(status)
+	}
+	return exitError
+}
+
+// failureExitCode returns the exit code of a command failing with the
+// message. Errors among the values the message was made of tell why, or
+// else the last failed API request, if the message is about it.
+func failureExitCode(message string, values []interface{}) int {
+	for _, value := range values {
+		if err, ok := value.(error); ok {
+			return errorExitCode(err)
+		}
+	}
+	lastRequestErrorMutex.Lock()
+	err := lastRequestError
+	lastRequestErrorMutex.Unlock()
+	if err != nil && strings.Contains(message, err.Error()) {
+		return errorExitCode(err)
+	}
+	return messageExitCode(message)
+}
+
+// errorEnvelope returns a failure as a JSON error, including the status
+// and response of the API if the failure is about a request.
+func errorEnvelope(message string, code int) map[string]interface{} {
+	envelope := map[string]interface{}{
+		"code":      exitCodeNames[code],
+		"exit_code": code,
+		"message":   message,
+	}
+	if match := apiErrorPattern.FindStringSubmatch(message); match != nil {
+		status, _ := strconv.Atoi(match[1])
+		envelope["status"] = status
+		var details interface{}
+		if err := json.Unmarshal([]byte(match[2]), &details); err == nil {
+			envelope["details"] = details
+		}
+	}
+	return map[string]interface{}{"error": envelope}
+}
+
+// fail reports the failure and exits with its exit code, as a JSON error
+// with -o json.
+func fail(message string, values []interface{}) {
+	code := failureExitCode(message, values)
+	message = withInitHint(message)
+	if outputFormat() == "json" {
+		j, _ := json.MarshalIndent(errorEnvelope(message, code), "", "  ")
+		fmt.Fprintln(os.Stdout, string(j))
+	} else {
+		logger.Logger.Println(message)
+	}
+	os.Exit(code)
+}
+
+// errorLogger is the logger of the CLI. Fatal errors exit with the code
+// telling why the command failed instead of always 1.
+type errorLogger struct {
+	*log.Logger
+}
+
+func (l *errorLogger) Fatal(v ...interface{}) {
+	fail(fmt.Sprint(v...), v)
+}
+
+func (l *errorLogger) Fatalf(format string, v ...interface{}) {
+	fail(fmt.Sprintf(format, v...), v)
+}
+
+func (l *errorLogger) Fatalln(v ...interface{}) {
+	fail(strings.TrimSuffix(fmt.Sprintln(v...), "\n"), v)
+}
+
+// initErrorTracking keeps the error of the last API request which failed
+// before the API could answer, or was rejected by the CLI.
+func initErrorTracking() {
+	cli.Client.UseError(func(ctx *context.Context, h context.Handler) {
+		if ctx.Error != nil {
+			lastRequestErrorMutex.Lock()
+			lastRequestError = ctx.Error
+			lastRequestErrorMutex.Unlock()
+		}
+		h.Next(ctx)
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// expirationActions are what happens to machines when they expire.
+var expirationActions = []string{"stop", "destroy"}
+
+// machineExpiration returns the time the machine expires at, and its
+// expiration, if it has one.
+func machineExpiration(machine map[string]interface{}) (time.Time, map[string]interface{}, bool) {
+	expiration, _ := machine["expiration"].(map[string]interface{})
+	date, _ := expiration["date"].(string)
+	if date == "" {
+		return time.Time{}, nil, false
+	}
+	t, err := parseTime(date)
+	if err != nil {
+		if t, err = time.Parse(scheduleTimeLayout, date); err != nil {
+			return time.Time{}, nil, false
+		}
+	}
+	return t, expiration, true
+}
+
+// setMachineExpiration sets the expiration of the machine, or removes it if
+// expiration is nil.
+func setMachineExpiration(machineID string, expiration map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"expiration": expiration})
+	if err != nil {
+		return err
+	}
+	_, _, _, err = MistApiV2EditMachine(machineID, viper.New(), string(body))
+	return err
+}
+
+// humanDuration shows the duration in days and hours, or hours and
+// minutes under a day, like 3d4h or 5h20m.
+func humanDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days, hours, minutes := d/(24*time.Hour), d%(24*time.Hour)/time.Hour, d%time.Hour/time.Minute
+	switch {
+	case days > 0 && hours > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case days > 0:
+		return fmt.Sprintf("%dd", days)
+	case hours > 0 && minutes > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh", hours)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+func machineExpireCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "expire [MACHINE...]",
+		Short: "Set when machines expire",
+		Long: `Set machines to be stopped or destroyed once they expire, --in a while from
+now or --at a time, like leases of ephemeral environments. With --notify
+their owners are emailed that long before they expire. Machines are given
+by name or id, or are all the machines matching --search.
+
+With --cancel, the expiration of the machines is removed instead. Use
+machine extend to push it back, and machine expiring to list the machines
+expiring soon.`,
+		Example: `  mist machine expire dev-1 --in 72h --action stop --notify 24h
+  mist machine expire --search 'tag:env=preview' --in 7d --action destroy
+  mist machine expire dev-1 --cancel`,
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return machineAutocomplete(cmd, nil, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			machines, err := resolveResources("machine", args, params.GetString("search"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if len(machines) == 0 {
+				logger.Fatal("No machines given, give machine names or use --search")
+			}
+			if params.GetBool("cancel") {
+				for _, machine := range machines {
+					if err := setMachineExpiration(machine.id, nil); err != nil {
+						logger.Fatalf("Error calling operation: %s", err.Error())
+					}
+					fmt.Printf(" * %s: expiration cancelled\n", machine.name)
+				}
+				return
+			}
+			var expires time.Time
+			switch in, at := params.GetString("in"), params.GetString("at"); {
+			case in != "" && at != "", in == "" && at == "":
+				logger.Fatal("Give one of --in or --at, or --cancel")
+			case in != "":
+				d, err := parseDuration(in)
+				if err != nil || d <= 0 {
+					logger.Fatalf("Invalid --in %q, give a duration like 72h or 7d", in)
+				}
+				expires = time.Now().UTC().Add(d)
+			default:
+				if expires, err = parseTime(at); err != nil {
+					logger.Fatal(err)
+				}
+				if !expires.After(time.Now()) {
+					logger.Fatal("--at must be in the future")
+				}
+			}
+			action := params.GetString("action")
+			valid := false
+			for _, a := range expirationActions {
+				valid = valid || a == action
+			}
+			if !valid {
+				logger.Fatalf("Invalid --action %q, expected stop or destroy", action)
+			}
+			expiration := map[string]interface{}{
+				"date":   expires.UTC().Format(time.RFC3339),
+				"action": action,
+			}
+			if notify := params.GetString("notify"); notify != "" {
+				d, err := parseDuration(notify)
+				if err != nil || d <= 0 {
+					logger.Fatalf("Invalid --notify %q, give a duration like 24h", notify)
+				}
+				if d >= time.Until(expires) {
+					logger.Fatal("--notify must be shorter than the time until the machines expire")
+				}
+				expiration["notify"] = ruleInterval(d, "value")
+			}
+			for _, machine := range machines {
+				if err := setMachineExpiration(machine.id, expiration); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf(" * %s: %s at %s\n", machine.name, action, expires.UTC().Format(time.RFC3339))
+			}
+		},
+	}
+	cmd.Flags().String("search", "", "Act on the machines matching the search query")
+	cmd.Flags().String("in", "", "Expire this long from now, like 72h or 7d")
+	cmd.Flags().String("at", "", "Expire at this time <rfc3339 | unix_timestamp>")
+	cmd.Flags().String("action", "stop", "What to do when the machines expire: stop or destroy")
+	cmd.Flags().String("notify", "", "Email the owners this long before the machines expire, like 24h")
+	cmd.Flags().Bool("cancel", false, "Remove the expiration of the machines")
+	cmd.RegisterFlagCompletionFunc("action", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return expirationActions, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func machineExtendCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "extend MACHINE... --by DURATION",
+		Short: "Push back the expiration of machines",
+		Long: `Push back the expiration of machines by a while, keeping what happens when
+they expire and when their owners are notified.`,
+		Example: `  mist machine extend dev-1 --by 24h`,
+		Args:    cobra.MinimumNArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return machineAutocomplete(cmd, nil, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			by, err := parseDuration(params.GetString("by"))
+			if err != nil || by <= 0 {
+				logger.Fatalf("Invalid --by %q, give a duration like 24h or 7d", params.GetString("by"))
+			}
+			machines, err := resolveResources("machine", args, "")
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			for _, machine := range machines {
+				live, err := lookupResource("machine", machine.id)
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				expires, expiration, ok := machineExpiration(live)
+				if !ok {
+					logger.Fatalf("Machine %s doesn't expire, use machine expire to set when it does", machine.name)
+				}
+				// Leases which ran out while the machine was kept are extended
+				// from now.
+				if expires.Before(time.Now()) {
+					expires = time.Now().UTC()
+				}
+				expires = expires.Add(by)
+				expiration["date"] = expires.UTC().Format(time.RFC3339)
+				if err := setMachineExpiration(machine.id, expiration); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf(" * %s: %v at %s\n", machine.name, expiration["action"], expires.UTC().Format(time.RFC3339))
+			}
+		},
+	}
+	cmd.Flags().String("by", "", "How long to push back the expiration, like 24h or 7d")
+	cmd.MarkFlagRequired("by")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func machineExpiringCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "expiring",
+		Short: "List machines expiring soon",
+		Long: `List the machines expiring --within a while from now, soonest first, with
+what happens to them then.`,
+		Example: `  mist machine expiring
+  mist machine expiring --within 30d --search 'tag:env=dev'`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			within, err := parseDuration(params.GetString("within"))
+			if err != nil || within <= 0 {
+				logger.Fatalf("Invalid --within %q, give a duration like 24h or 7d", params.GetString("within"))
+			}
+			listParams := viper.New()
+			listParams.Set("search", params.GetString("search"))
+			listParams.Set("only", "id,name,state,expiration,owned_by")
+			listParams.Set("limit", 1000)
+			_, decoded, _, err := MistApiV2ListMachines(listParams)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			now := time.Now().UTC()
+			type expiring struct {
+				expires time.Time
+				row     map[string]interface{}
+			}
+			found := []expiring{}
+			for _, machine := range responseItems(decoded) {
+				expires, expiration, ok := machineExpiration(machine)
+				if !ok || expires.After(now.Add(within)) {
+					continue
+				}
+				in := humanDuration(expires.Sub(now))
+				if expires.Before(now) {
+					in = "overdue"
+				}
+				found = append(found, expiring{expires, map[string]interface{}{
+					"id":      machine["id"],
+					"name":    machine["name"],
+					"state":   machine["state"],
+					"owner":   machine["owned_by"],
+					"expires": expires.Format(time.RFC3339),
+					"in":      in,
+					"action":  expiration["action"],
+				}})
+			}
+			sort.Slice(found, func(i, j int) bool { return found[i].expires.Before(found[j].expires) })
+			rows := []interface{}{}
+			for _, machine := range found {
+				rows = append(rows, machine.row)
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{
+				[]string{"name", "state", "expires", "in", "action"},
+				[]string{"id", "name", "state", "owner", "expires", "in", "action"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("within", "7d", "List the machines expiring within this long from now")
+	cmd.Flags().String("search", "", "Only list the machines matching the search query")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// terraformKinds are the kinds of resources export terraform renders.
+var terraformKinds = []string{"machine", "network", "volume"}
+
+// terraformProvider is how the resources of a cloud provider are declared
+// in Terraform: the resource type of each kind, and the attribute holding
+// the size of volumes in GB.
+type terraformProvider struct {
+	Types      map[string]string
+	VolumeSize string
+	// NameTag is true for providers naming resources with a Name tag.
+	NameTag bool
+}
+
+var terraformProviders = map[string]terraformProvider{
+	"amazon": {map[string]string{
+		"machine": "aws_instance",
+		"network": "aws_vpc",
+		"volume":  "aws_ebs_volume",
+	}, "size", true},
+	"google": {map[string]string{
+		"machine": "google_compute_instance",
+		"network": "google_compute_network",
+		"volume":  "google_compute_disk",
+	}, "size", false},
+	"azure_arm": {map[string]string{
+		"machine": "azurerm_virtual_machine",
+		"network": "azurerm_virtual_network",
+		"volume":  "azurerm_managed_disk",
+	}, "disk_size_gb", false},
+	"digitalocean": {map[string]string{
+		"machine": "digitalocean_droplet",
+		"network": "digitalocean_vpc",
+		"volume":  "digitalocean_volume",
+	}, "size", false},
+	"linode": {map[string]string{
+		"machine": "linode_instance",
+		"volume":  "linode_volume",
+	}, "size", false},
+	"openstack": {map[string]string{
+		"machine": "openstack_compute_instance_v2",
+		"network": "openstack_networking_network_v2",
+		"volume":  "openstack_blockstorage_volume_v3",
+	}, "size", false},
+	"vultr": {map[string]string{
+		"machine": "vultr_instance",
+		"network": "vultr_vpc",
+		"volume":  "vultr_block_storage",
+	}, "size_gb", false},
+	"equinixmetal": {map[string]string{
+		"machine": "equinix_metal_device",
+	}, "", false},
+}
+
+// invalidTerraformChars are replaced in the local names of resources.
+var invalidTerraformChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// terraformName returns a local name for the resource which is valid in
+// Terraform and not among the used ones.
+func terraformName(name string, used map[string]bool) string {
+	name = invalidTerraformChars.ReplaceAllString(strings.ToLower(name), "_")
+	if name == "" || !(name[0] == '_' || name[0] >= 'a' && name[0] <= 'z') {
+		name = "r_" + name
+	}
+	unique := name
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d", name, i)
+	}
+	used[unique] = true
+	return unique
+}
+
+// terraformImport is a terraform import command for a rendered resource.
+type terraformImport struct {
+	Address string
+	ID      string
+}
+
+// terraformBlock renders the resource as a Terraform resource block, with
+// the attributes the API tells. The rest have to be filled in from the
+// plan once it is imported.
+func terraformBlock(b *strings.Builder, kind, resourceType, localName string, provider terraformProvider, item map[string]interface{}) {
+	name, _ := item["name"].(string)
+	fmt.Fprintf(b, "resource %q %q {\n", resourceType, localName)
+	if !provider.NameTag {
+		fmt.Fprintf(b, "  name = %q\n", name)
+	}
+	if size, ok := item["size"].(float64); ok && kind == "volume" && provider.VolumeSize != "" {
+		fmt.Fprintf(b, "  %s = %d\n", provider.VolumeSize, int(size))
+	}
+	if provider.NameTag {
+		tags := map[string]string{"Name": name}
+		for _, tag := range resourceTags(item["tags"]) {
+			tags[tag.Key] = tag.Value
+		}
+		keys := []string{}
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(b, "  tags = {")
+		for _, key := range keys {
+			fmt.Fprintf(b, "    %q = %q\n", key, tags[key])
+		}
+		fmt.Fprintln(b, "  }")
+	}
+	fmt.Fprintf(b, "\n  # Imported from Mist %s %s. Complete the other arguments from\n  # terraform plan once it is imported.\n}\n\n", kind, item["id"])
+}
+
+// exportTerraform renders the resources of a cloud, by kind, as Terraform
+// resource blocks, and returns them with the imports of their resources.
+// Resources without an external ID can't be imported and are left out.
+func exportTerraform(provider terraformProvider, resources map[string][]map[string]interface{}) (string, []terraformImport) {
+	var b strings.Builder
+	imports := []terraformImport{}
+	used := make(map[string]bool)
+	for _, kind := range terraformKinds {
+		resourceType, ok := provider.Types[kind]
+		if !ok {
+			continue
+		}
+		items := resources[kind]
+		sort.SliceStable(items, func(i, j int) bool {
+			return fmt.Sprint(items[i]["name"]) < fmt.Sprint(items[j]["name"])
+		})
+		for _, item := range items {
+			externalID, _ := item["external_id"].(string)
+			if externalID == "" {
+				continue
+			}
+			name, _ := item["name"].(string)
+			if name == "" {
+				name = externalID
+			}
+			localName := terraformName(name, used)
+			terraformBlock(&b, kind, resourceType, localName, provider, item)
+			imports = append(imports, terraformImport{resourceType + "." + localName, externalID})
+		}
+	}
+	return b.String(), imports
+}
+
+// importCommands returns the terraform import commands of the imports, with
+// the IDs quoted for the shell.
+func importCommands(imports []terraformImport) string {
+	var b strings.Builder
+	for _, i := range imports {
+		fmt.Fprintf(&b, "terraform import %s '%s'\n", i.Address, strings.ReplaceAll(i.ID, "'", `'\''`))
+	}
+	return b.String()
+}
+
+func exportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export resources to other tools",
+		Long:  "Export resources to the configuration of other tools, like Terraform.",
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.AddCommand(exportTerraformCmd())
+	return cmd
+}
+
+func exportTerraformCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "terraform",
+		Short: "Export the resources of a cloud as Terraform configuration",
+		Long: `Show the machines, networks and volumes of a cloud as resource blocks of
+the Terraform provider of the cloud, followed by the terraform import
+commands bringing them under its management. Only the names, tags and
+volume sizes known to Mist are filled in, so run terraform plan after
+importing and complete the blocks until it shows no changes.
+
+Resources without an external ID, and kinds the Terraform provider has no
+resource for, are left out.`,
+		Example: `  mist export terraform --cloud aws1 > aws1.tf
+  mist export terraform --cloud gce --type machines --import-file import.sh`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			kinds := terraformKinds
+			if types := params.GetString("type"); types != "" {
+				var err error
+				if kinds, err = searchKinds(types); err != nil {
+					logger.Fatal(err)
+				}
+				for _, kind := range kinds {
+					if kind != "machine" && kind != "network" && kind != "volume" {
+						logger.Fatalf("Can't export %ss to terraform", kind)
+					}
+				}
+			}
+			_, decoded, _, err := MistApiV2GetCloud(params.GetString("cloud"), viper.New())
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			cloud, _ := decoded["data"].(map[string]interface{})
+			providerName, _ := cloud["provider"].(string)
+			provider, ok := terraformProviders[providerName]
+			if !ok {
+				logger.Fatalf("Can't export clouds of provider %s to terraform", providerName)
+			}
+			resources := make(map[string][]map[string]interface{})
+			for _, kind := range kinds {
+				listParams := viper.New()
+				listParams.Set("cloud", cloud["id"])
+				decoded, _, err := listAllPages(kind, resourceListControllersMap[kind], listParams)
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				resources[kind] = responseItems(decoded)
+			}
+			blocks, imports := exportTerraform(provider, resources)
+			fmt.Print(blocks)
+			if filename := params.GetString("import-file"); filename != "" {
+				if err := ioutil.WriteFile(filename, []byte("#!/bin/sh\nset -e\n"+importCommands(imports)), 0755); err != nil {
+					logger.Fatalf("Could not write the imports: %s", err.Error())
+				}
+				return
+			}
+			if len(imports) > 0 {
+				fmt.Println("# Import the resources with:")
+				for _, line := range strings.Split(strings.TrimSuffix(importCommands(imports), "\n"), "\n") {
+					fmt.Println("#   " + line)
+				}
+			}
+		},
+	}
+	cmd.Flags().String("cloud", "", "Cloud to export the resources of")
+	cmd.Flags().String("type", "", "Only export these kinds, separated by commas: machines, networks, volumes")
+	cmd.Flags().String("import-file", "", "Write the terraform import commands to this script instead")
+	cmd.MarkFlagRequired("cloud")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
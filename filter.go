@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/cobra"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// serverFilterFlags are the flags of listings that the API filters by, so
+// they see every resource.
+var serverFilterFlags = []string{"search", "cloud", "at"}
+
+// resourceFilter is a filter of a listing. Filters applied on the server
+// are only reported, while client-side ones are matched against every
+// listed resource.
+type resourceFilter struct {
+	flag       string
+	value      string
+	serverSide bool
+	match      func(item map[string]interface{}) bool
+}
+
+func (f resourceFilter) String() string {
+	return fmt.Sprintf("--%s %s", f.flag, strconv.Quote(f.value))
+}
+
+// activeFilters holds the filters of the listing being run.
+var activeFilters *listingFilters
+
+// listingFilters are the filters given to a listing.
+type listingFilters struct {
+	filters []resourceFilter
+	explain bool
+	// paged is set when the listing was limited to a page with --limit,
+	// --start or --no-all.
+	paged bool
+}
+
+func (l *listingFilters) clientSide() []resourceFilter {
+	filters := []resourceFilter{}
+	for _, f := range l.filters {
+		if !f.serverSide {
+			filters = append(filters, f)
+		}
+	}
+	return filters
+}
+
+// whereOperators are the comparisons of --where, longest first so that
+// e.g. `>=` is not taken for `>`.
+var whereOperators = []string{"==", "!=", "=~", "!~", ">=", "<=", ">", "<", "="}
+
+// parseWhere parses a `path OP value` filter given with the flag, where
+// path is a JMESPath expression on the resource.
+func parseWhere(flag, expr string) (resourceFilter, error) {
+	f := resourceFilter{flag: flag, value: expr}
+	index, op := -1, ""
+	for _, candidate := range whereOperators {
+		if i := strings.Index(expr, candidate); i > 0 && (index < 0 || i < index) {
+			index, op = i, candidate
+		}
+	}
+	if index < 0 {
+		return f, fmt.Errorf("invalid --%s %q, expected FIELD==VALUE, FIELD!=VALUE, FIELD=~REGEX, FIELD!~REGEX or a <, <=, >, >= comparison", flag, expr)
+	}
+	path := strings.TrimSpace(expr[:index])
+	value := strings.TrimSpace(expr[index+len(op):])
+	query, err := jmespath.Compile(path)
+	if err != nil {
+		return f, fmt.Errorf("invalid field %q in --%s %q: %s", path, flag, expr, err)
+	}
+	var re *regexp.Regexp
+	if op == "=~" || op == "!~" {
+		if re, err = regexp.Compile(value); err != nil {
+			return f, fmt.Errorf("invalid regular expression in --%s %q: %s", flag, expr, err)
+		}
+	}
+	f.match = func(item map[string]interface{}) bool {
+		found, err := query.Search(item)
+		if err != nil {
+			return false
+		}
+		actual := ""
+		if found != nil {
+			actual = fmt.Sprint(found)
+		}
+		switch op {
+		case "==", "=":
+			return actual == value
+		case "!=":
+			return actual != value
+		case "=~":
+			return re.MatchString(actual)
+		case "!~":
+			return !re.MatchString(actual)
+		}
+		a, aErr := strconv.ParseFloat(actual, 64)
+		b, bErr := strconv.ParseFloat(value, 64)
+		cmp := strings.Compare(actual, value)
+		if aErr == nil && bErr == nil {
+			switch {
+			case a < b:
+				cmp = -1
+			case a > b:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+		switch op {
+		case ">=":
+			return cmp >= 0
+		case "<=":
+			return cmp <= 0
+		case ">":
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	return f, nil
+}
+
+// listedTags returns the tags of a resource, which the API lists either
+// as a map or as a list of key and value pairs.
+func listedTags(item map[string]interface{}) map[string]string {
+	tags := make(map[string]string)
+	switch t := item["tags"].(type) {
+	case map[string]interface{}:
+		for key, value := range t {
+			tags[key] = ""
+			if value != nil {
+				tags[key] = fmt.Sprint(value)
+			}
+		}
+	case []interface{}:
+		for _, entry := range t {
+			if pair, ok := entry.(map[string]interface{}); ok {
+				key, _ := pair["key"].(string)
+				value, _ := pair["value"].(string)
+				tags[key] = value
+			}
+		}
+	}
+	return tags
+}
+
+// parseTag parses a `KEY` or `KEY=VALUE` filter on the tags of resources.
+func parseTag(tag string) (resourceFilter, error) {
+	f := resourceFilter{flag: "tag", value: tag}
+	key, value, hasValue := tag, "", false
+	if i := strings.Index(tag, "="); i >= 0 {
+		key, value, hasValue = tag[:i], tag[i+1:], true
+	}
+	if key == "" {
+		return f, fmt.Errorf("invalid --tag %q, expected KEY or KEY=VALUE", tag)
+	}
+	f.match = func(item map[string]interface{}) bool {
+		actual, ok := listedTags(item)[key]
+		return ok && (!hasValue || actual == value)
+	}
+	return f, nil
+}
+
+// parseSelector parses a label selector on the tags of resources: a comma
+// separated list of `KEY`, `!KEY`, `KEY=VALUE` and `KEY!=VALUE`
+// requirements that all have to hold.
+func parseSelector(selector string) (resourceFilter, error) {
+	f := resourceFilter{flag: "selector", value: selector}
+	type requirement struct {
+		key, value       string
+		hasValue, negate bool
+	}
+	requirements := []requirement{}
+	for _, entry := range strings.Split(selector, ",") {
+		entry = strings.TrimSpace(entry)
+		r := requirement{key: entry}
+		switch {
+		case strings.Contains(entry, "!="):
+			i := strings.Index(entry, "!=")
+			r = requirement{key: entry[:i], value: entry[i+2:], hasValue: true, negate: true}
+		case strings.Contains(entry, "="):
+			i := strings.Index(entry, "=")
+			r = requirement{key: entry[:i], value: strings.TrimPrefix(entry[i+1:], "="), hasValue: true}
+		case strings.HasPrefix(entry, "!"):
+			r = requirement{key: entry[1:], negate: true}
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if r.key == "" {
+			return f, fmt.Errorf("invalid --selector %q, expected KEY, !KEY, KEY=VALUE or KEY!=VALUE entries", selector)
+		}
+		requirements = append(requirements, r)
+	}
+	f.match = func(item map[string]interface{}) bool {
+		tags := listedTags(item)
+		for _, r := range requirements {
+			actual, ok := tags[r.key]
+			holds := ok && (!r.hasValue || actual == r.value)
+			if holds == r.negate {
+				return false
+			}
+		}
+		return true
+	}
+	return f, nil
+}
+
+// parseListingFilters reads the filters given to a listing command.
+func parseListingFilters(cmd *cobra.Command) (*listingFilters, error) {
+	l := &listingFilters{}
+	for _, name := range serverFilterFlags {
+		if flag := cmd.Flags().Lookup(name); flag != nil && flag.Changed {
+			l.filters = append(l.filters, resourceFilter{flag: name, value: flag.Value.String(), serverSide: true})
+		}
+	}
+	tags, _ := cmd.Flags().GetStringArray("tag")
+	for _, tag := range tags {
+		f, err := parseTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		l.filters = append(l.filters, f)
+	}
+	wheres, _ := cmd.Flags().GetStringArray("where")
+	for _, where := range wheres {
+		f, err := parseWhere("where", where)
+		if err != nil {
+			return nil, err
+		}
+		l.filters = append(l.filters, f)
+	}
+	if selector, _ := cmd.Flags().GetString("selector"); selector != "" {
+		f, err := parseSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		l.filters = append(l.filters, f)
+	}
+	l.explain, _ = cmd.Flags().GetBool("explain-filters")
+	noAll, _ := cmd.Flags().GetBool("no-all")
+	l.paged = noAll || cmd.Flags().Changed("limit") || cmd.Flags().Changed("start")
+	return l, nil
+}
+
+// listingCount returns how many resources a listing returned, and how many
+// the API reports there are in total, if it does.
+func listingCount(response map[string]interface{}, items []interface{}) (int, int) {
+	meta, _ := response["meta"].(map[string]interface{})
+	total, ok := meta["total"].(float64)
+	if !ok {
+		return len(items), 0
+	}
+	return len(items), int(total)
+}
+
+// applyClientFilters drops the listed resources that the client-side
+// filters don't match, and explains how the filters were applied.
+func applyClientFilters(data interface{}) interface{} {
+	if activeFilters == nil {
+		return data
+	}
+	response, ok := data.(map[string]interface{})
+	if !ok {
+		return data
+	}
+	items, ok := response["data"].([]interface{})
+	if !ok {
+		return data
+	}
+	clientSide := activeFilters.clientSide()
+	fetched, total := listingCount(response, items)
+	incomplete := len(clientSide) > 0 && (activeFilters.paged || total > fetched)
+	if activeFilters.explain {
+		explainFilters(activeFilters.filters)
+	}
+	if incomplete {
+		if total > fetched {
+			fmt.Fprintf(os.Stderr, "Warning: client-side filters only saw %d of %d resources, more may match. Drop --limit, --start and --no-all to fetch every page, or filter with --search\n", fetched, total)
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: client-side filters only saw a page of %d resources, more may match\n", fetched)
+		}
+	}
+	if len(clientSide) == 0 {
+		return data
+	}
+	filtered := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		resource, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		matches := true
+		for _, f := range clientSide {
+			if !f.match(resource) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, item)
+		}
+	}
+	result := make(map[string]interface{})
+	for key, value := range response {
+		result[key] = value
+	}
+	result["data"] = filtered
+	if meta, ok := response["meta"].(map[string]interface{}); ok {
+		updated := make(map[string]interface{})
+		for key, value := range meta {
+			updated[key] = value
+		}
+		updated["returned"] = len(filtered)
+		result["meta"] = updated
+	}
+	return result
+}
+
+// explainFilters prints whether every filter was applied on the server,
+// where it sees every resource, or on the client, where it only sees the
+// resources fetched.
+func explainFilters(filters []resourceFilter) {
+	if len(filters) == 0 {
+		fmt.Fprintln(os.Stderr, "No filters given")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Filters:")
+	for _, f := range filters {
+		mode := "client-side, applied to the resources fetched"
+		if f.serverSide {
+			mode = "server-side, applied by the API to every resource"
+		}
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", f, mode)
+	}
+}
+
+// initClientFilters adds the --tag, --where, --selector and
+// --explain-filters flags to the commands listing resources. Client-side
+// filters only see the resources fetched, so unless a page is asked for
+// with --limit or --start, or --no-all is given, every page is fetched
+// before filtering.
+func initClientFilters() {
+	cmds := []*cobra.Command{}
+	for _, cmd := range cli.Root.Commands() {
+		switch {
+		case cmd.Name() == "get":
+			cmds = append(cmds, cmd.Commands()...)
+		case strings.HasPrefix(cmd.Name(), "list-"):
+			cmds = append(cmds, cmd)
+		}
+	}
+	for _, cmd := range cmds {
+		if cmd.Run == nil || cmd.Flags().Lookup("search") == nil {
+			continue
+		}
+		cmd.Flags().StringArray("tag", []string{}, "Only show resources with this tag, given as KEY or KEY=VALUE (Only for listings)")
+		cmd.Flags().StringArray("where", []string{}, "Only show resources where FIELD==VALUE, also !=, =~, !~, <, <=, >, >= (Only for listings)")
+		cmd.Flags().String("selector", "", "Only show resources whose tags match a selector, e.g. env=prod,!legacy (Only for listings)")
+		cmd.Flags().Bool("explain-filters", false, "Show which filters run on the server and which on the client (Only for listings)")
+		cmd.Flags().Bool("no-all", false, "Only fetch a single page when filtering on the client (Only for listings)")
+		run := cmd.Run
+		cmd.Run = func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				run(cmd, args)
+				return
+			}
+			filters, err := parseListingFilters(cmd)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			activeFilters = filters
+			// With --all every page is fetched already.
+			all, _ := cmd.Flags().GetBool("all")
+			if len(filters.clientSide()) > 0 && !filters.paged && !all {
+				runAllPages(run, cmd, args)
+			} else {
+				run(cmd, args)
+			}
+			activeFilters = nil
+		}
+	}
+}
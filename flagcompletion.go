@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// flagCompletionKinds are the kinds of resources flags of the same name
+// refer to.
+var flagCompletionKinds = map[string]bool{
+	"cloud":    true,
+	"cluster":  true,
+	"image":    true,
+	"key":      true,
+	"location": true,
+	"machine":  true,
+	"network":  true,
+	"rule":     true,
+	"schedule": true,
+	"script":   true,
+	"secret":   true,
+	"size":     true,
+	"volume":   true,
+	"zone":     true,
+}
+
+// completeResourceFlag completes the names of the resources of the kind.
+// Images, sizes, locations and networks are those of the --cloud of the
+// command, if it is given.
+func completeResourceFlag(kind string) func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		list, ok := wizardListControllersMap[kind]
+		if !ok {
+			list = resourceListControllersMap[kind]
+		}
+		params := viper.New()
+		params.Set("search", toComplete)
+		params.Set("only", "id,name")
+		params.Set("limit", 1000)
+		if _, ok := wizardListControllersMap[kind]; ok && kind != "cloud" {
+			if cloud, err := cmd.Flags().GetString("cloud"); err == nil && cloud != "" {
+				params.Set("cloud", cloud)
+			}
+		}
+		_, decoded, _, err := list(params)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		names := []string{}
+		for _, item := range responseItems(decoded) {
+			if name, _ := item["name"].(string); name != "" {
+				names = append(names, name)
+			}
+		}
+		return uniqueStrings(names), cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completeFirstArg completes the first argument with complete, and no
+// further ones.
+func completeFirstArg(complete func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective)) func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return complete(cmd, args, toComplete)
+	}
+}
+
+// initFlagCompletions makes flags naming resources, like --cloud, --image,
+// --size or --key, complete their names. It runs once every command has
+// been added, and leaves flags which complete on their own alone.
+func initFlagCompletions() {
+	var walk func(cmd *cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		for kind := range flagCompletionKinds {
+			flag := cmd.LocalFlags().Lookup(kind)
+			// Flags like the --size of volumes in GB aren't references.
+			if flag != nil && (flag.Value.Type() == "string" || flag.Value.Type() == "stringSlice") {
+				// Fails for flags which already complete, which is fine.
+				cmd.RegisterFlagCompletionFunc(kind, completeResourceFlag(kind))
+			}
+		}
+		for _, sub := range cmd.Commands() {
+			walk(sub)
+		}
+	}
+	walk(cli.Root)
+}
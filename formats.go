@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// customColumnsPrefix starts the -o value selecting columns, as in
+// `-o custom-columns=NAME:.name,IP:.public_ips[0]`.
+const customColumnsPrefix = "custom-columns="
+
+// goTemplatePrefix and goTemplateFilePrefix start the -o values rendering
+// the response with a Go template, given inline or in a file.
+const (
+	goTemplatePrefix     = "go-template="
+	goTemplateFilePrefix = "go-template-file="
+)
+
+// templateFuncs are the helpers available to -o go-template, named after
+// their sprig counterparts.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		j, err := json.Marshal(v)
+		return string(j), err
+	},
+	"yaml": func(v interface{}) (string, error) {
+		y, err := yaml.Marshal(v)
+		return strings.TrimSuffix(string(y), "\n"), err
+	},
+	"toString": func(v interface{}) string {
+		s, _ := rawValue(v)
+		return s
+	},
+	"default": func(d, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return d
+		}
+		return v
+	},
+	"join": func(sep string, v interface{}) string {
+		list, _ := v.([]interface{})
+		items := []string{}
+		for _, item := range list {
+			s, _ := rawValue(item)
+			items = append(items, s)
+		}
+		return strings.Join(items, sep)
+	},
+	"first": func(v interface{}) interface{} {
+		if list, ok := v.([]interface{}); ok && len(list) > 0 {
+			return list[0]
+		}
+		return nil
+	},
+	"split":     func(sep, s string) []string { return strings.Split(s, sep) },
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"trim":      strings.TrimSpace,
+	"replace":   func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"quote":     func(s string) string { return strconv.Quote(s) },
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+	},
+	"query": func(expression string, v interface{}) (interface{}, error) {
+		return jmespath.Search(expression, v)
+	},
+}
+
+// writeGoTemplate renders the response, after applying -q, with the Go
+// template. Numbers are float64 as in JSON. Nested fields which may be
+// missing are best read with the query helper, which returns nil for them.
+func writeGoTemplate(w io.Writer, data interface{}, text string) error {
+	tmpl, err := template.New("output").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal(j, &value); err != nil {
+		return err
+	}
+	if query := outputQuery(); query != "" {
+		if value, err = jmespath.Search(query, value); err != nil {
+			return err
+		}
+	}
+	return tmpl.Execute(w, value)
+}
+
+// responseItems returns the resources of a listing, or the resource of a
+// single resource response.
+func responseItems(data interface{}) []map[string]interface{} {
+	response, ok := data.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	items := []map[string]interface{}{}
+	switch d := response["data"].(type) {
+	case []interface{}:
+		for _, item := range d {
+			if m, ok := item.(map[string]interface{}); ok {
+				items = append(items, m)
+			}
+		}
+	case map[string]interface{}:
+		items = append(items, d)
+	}
+	return items
+}
+
+// queriedItems returns the items to write as rows, after applying the -q
+// query if there is one. Scalars are put in a value column.
+func queriedItems(data interface{}) ([]map[string]interface{}, error) {
+	query := outputQuery()
+	if query == "" {
+		return responseItems(data), nil
+	}
+	value, err := jmespath.Search(query, data)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		list = []interface{}{value}
+	}
+	items := []map[string]interface{}{}
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{"value": item}
+		}
+		items = append(items, m)
+	}
+	return items, nil
+}
+
+// tableColumns returns the columns to write for the items: those of --only,
+// then those of the command, then all the fields of the items.
+func tableColumns(items []map[string]interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) []string {
+	if params != nil && outputQuery() == "" {
+		if fields := parseOnlyFields(params.GetString("only")); len(fields) > 0 {
+			columns := []string{}
+			for _, field := range fields {
+				columns = append(columns, field.Alias)
+			}
+			return columns
+		}
+	}
+	if outputQuery() == "" {
+		if columns := outputOptions.Columns; len(columns) > 0 {
+			return columns
+		}
+	}
+	seen := make(map[string]bool)
+	columns := []string{}
+	for _, item := range items {
+		for key := range item {
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// cellValue renders a value on a single line.
+func cellValue(value interface{}) string {
+	s := describeValue(value)
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+// writeTSV writes the items as tab separated values, with a header line of
+// column names.
+func writeTSV(w io.Writer, data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) error {
+	items, err := queriedItems(data)
+	if err != nil {
+		return err
+	}
+	columns := tableColumns(items, params, outputOptions)
+	if _, err := fmt.Fprintln(w, strings.Join(columns, "\t")); err != nil {
+		return err
+	}
+	for _, item := range items {
+		cells := []string{}
+		for _, column := range columns {
+			value, err := jmespath.Search(column, item)
+			if err != nil {
+				value = item[column]
+			}
+			cells = append(cells, cellValue(value))
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(cells, "\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCSV writes the items as comma separated values, with a header line of
+// column names.
+func writeCSV(w io.Writer, data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) error {
+	items, err := queriedItems(data)
+	if err != nil {
+		return err
+	}
+	columns := tableColumns(items, params, outputOptions)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, item := range items {
+		cells := []string{}
+		for _, column := range columns {
+			value, err := jmespath.Search(column, item)
+			if err != nil {
+				value = item[column]
+			}
+			cells = append(cells, describeValue(value))
+		}
+		if err := cw.Write(cells); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatReport writes the rows of a report, like meter or cost. CSV is
+// written with a header of the wide columns and without the totals, to be
+// loaded in other tools.
+func formatReport(data interface{}, outputOptions cli.CLIOutputOptions) error {
+	if outputFormat() == "csv" {
+		// Round trip through JSON, as rows may be typed maps.
+		j, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		var rows interface{}
+		if err := json.Unmarshal(j, &rows); err != nil {
+			return err
+		}
+		return writeCSV(os.Stdout, rows, nil, wideOutputOptions(outputOptions))
+	}
+	return cli.Formatter.Format(data, &viper.Viper{}, outputOptions)
+}
+
+// parseCustomColumns parses the NAME:.path,... spec of -o custom-columns.
+func parseCustomColumns(spec string) ([]onlyField, error) {
+	columns := parseOnlyFields(spec)
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("custom-columns needs at least one NAME:.path column")
+	}
+	for i, column := range columns {
+		if column.Alias == column.Path {
+			return nil, fmt.Errorf("invalid custom column %q, expected NAME:.path", column.Alias)
+		}
+		columns[i].Path = strings.TrimPrefix(column.Path, ".")
+		if columns[i].Path == "" {
+			return nil, fmt.Errorf("custom column %s has no path", column.Alias)
+		}
+	}
+	return columns, nil
+}
+
+// writeCustomColumns writes the items as a table of the given columns.
+func writeCustomColumns(w io.Writer, data interface{}, spec string) error {
+	columns, err := parseCustomColumns(spec)
+	if err != nil {
+		return err
+	}
+	items, err := queriedItems(data)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	headers := []string{}
+	for _, column := range columns {
+		headers = append(headers, column.Alias)
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	for _, item := range items {
+		projected := projectOnlyFields(item, columns).(map[string]interface{})
+		cells := []string{}
+		for _, column := range columns {
+			cell := cellValue(projected[column.Alias])
+			if cell == "" {
+				cell = "<none>"
+			}
+			cells = append(cells, cell)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// rawValue renders a scalar without JSON quoting, and anything else as
+// JSON.
+func rawValue(value interface{}) (string, error) {
+	switch t := value.(type) {
+	case string:
+		return t, nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	}
+	j, err := json.Marshal(value)
+	return string(j), err
+}
+
+// writeRaw writes the result of the -q query for shell pipelines: strings
+// are not quoted, and list items are written one per line.
+func writeRaw(w io.Writer, data interface{}) error {
+	j, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal(j, &value); err != nil {
+		return err
+	}
+	if query := outputQuery(); query != "" {
+		if value, err = jmespath.Search(query, value); err != nil {
+			return err
+		}
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		list = []interface{}{value}
+	}
+	for _, item := range list {
+		line, err := rawValue(item)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wideOutputOptions shows the wide columns, which some formats only show
+// when asked to.
+func wideOutputOptions(outputOptions cli.CLIOutputOptions) cli.CLIOutputOptions {
+	if len(outputOptions.WideColumns) > 0 {
+		outputOptions.Columns = outputOptions.WideColumns
+		outputOptions.Footer = outputOptions.WideFooter
+	}
+	return outputOptions
+}
+
+// renderWide renders a table of the wide columns with the given formatter.
+func renderWide(next responseFormatter, data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) error {
+	flag := cli.Root.PersistentFlags().ShorthandLookup("o")
+	flag.Value.Set("table")
+	defer flag.Value.Set("wide")
+	return next.Format(data, params, wideOutputOptions(outputOptions))
+}
+
+// writeExtraFormat writes data in the output formats added on top of the
+// generated formatter, reporting false for the formats it doesn't handle.
+func writeExtraFormat(next responseFormatter, data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) (bool, error) {
+	format := outputFormat()
+	switch {
+	case format == "tsv":
+		return true, writeTSV(os.Stdout, data, params, outputOptions)
+	case format == "wide":
+		return true, renderWide(next, data, params, outputOptions)
+	case strings.HasPrefix(format, customColumnsPrefix):
+		return true, writeCustomColumns(os.Stdout, data, strings.TrimPrefix(format, customColumnsPrefix))
+	case strings.HasPrefix(format, goTemplatePrefix):
+		return true, writeGoTemplate(os.Stdout, data, strings.TrimPrefix(format, goTemplatePrefix))
+	case strings.HasPrefix(format, goTemplateFilePrefix):
+		text, err := ioutil.ReadFile(strings.TrimPrefix(format, goTemplateFilePrefix))
+		if err != nil {
+			return true, err
+		}
+		return true, writeGoTemplate(os.Stdout, data, string(text))
+	}
+	return false, nil
+}
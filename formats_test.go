@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseCustomColumns(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []onlyField
+		wantErr bool
+	}{
+		{"NAME:.name", []onlyField{{"NAME", "name"}}, false},
+		{"NAME:.name,IP:.public_ips[0]", []onlyField{{"NAME", "name"}, {"IP", "public_ips[0]"}}, false},
+		{"SIZE:extra.size", []onlyField{{"SIZE", "extra.size"}}, false},
+		{"", nil, true},
+		{"name", nil, true},
+		{"NAME:.", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseCustomColumns(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCustomColumns(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCustomColumns(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteCustomColumns(t *testing.T) {
+	setOutputQuery(t, "")
+	data := map[string]interface{}{
+		"data": []interface{}{
+			map[string]interface{}{"name": "web", "public_ips": []interface{}{"1.2.3.4"}},
+			map[string]interface{}{"name": "db", "public_ips": []interface{}{}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := writeCustomColumns(&buf, data, "NAME:.name,IP:.public_ips[0]"); err != nil {
+		t.Fatal(err)
+	}
+	want := "NAME   IP\nweb    1.2.3.4\ndb     <none>\n"
+	if buf.String() != want {
+		t.Errorf("writeCustomColumns wrote\n%q\nwant\n%q", buf.String(), want)
+	}
+}
+
+func TestRawValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"string", "web", "web"},
+		{"integer", float64(42), "42"},
+		{"float", 1.5, "1.5"},
+		{"large integer", float64(1e21), "1000000000000000000000"},
+		{"bool", true, "true"},
+		{"null", nil, "null"},
+		{"list", []interface{}{"a", float64(1)}, `["a",1]`},
+		{"object", map[string]interface{}{"a": "b"}, `{"a":"b"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rawValue(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("rawValue(%v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	data := map[string]interface{}{
+		"data": []interface{}{
+			map[string]interface{}{"name": "web", "cpus": 4},
+			map[string]interface{}{"name": "db", "cpus": 2},
+		},
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"data[].name", "web\ndb\n"},
+		{"data[?cpus > `2`].cpus", "4\n"},
+		{"data[0].name", "web\n"},
+		{"data[0]", `{"cpus":4,"name":"web"}` + "\n"},
+		{"data[?cpus > `8`]", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			setOutputQuery(t, tt.query)
+			var buf bytes.Buffer
+			if err := writeRaw(&buf, data); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("writeRaw with -q %s = %q, want %q", tt.query, buf.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// getAllKinds are the resources get all shows, in the order of their
+// sections.
+var getAllKinds = []string{"cloud", "machine", "volume", "network", "zone", "key", "script", "schedule", "rule", "secret", "cluster"}
+
+// getSection is the listing of a kind of resources.
+type getSection struct {
+	kind          string
+	decoded       map[string]interface{}
+	outputOptions cli.CLIOutputOptions
+	err           error
+	// partial is set for listings interrupted after fetching some pages,
+	// and pending for those interrupted before fetching any.
+	partial bool
+	pending bool
+}
+
+// getKinds returns the kinds of resources in a comma separated list like
+// clouds,machines,volumes, which may use any name of the get commands, or
+// all.
+func getKinds(get *cobra.Command, list string) ([]string, error) {
+	if list == "all" {
+		return getAllKinds, nil
+	}
+	kinds := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		kind := ""
+		for _, sub := range get.Commands() {
+			if sub.Name() == name || sub.HasAlias(name) {
+				kind = sub.Name()
+				break
+			}
+		}
+		if _, ok := resourceListControllersMap[kind]; !ok {
+			return nil, fmt.Errorf("can't list %s, only %s", name, strings.Join(getAllKinds, ", "))
+		}
+		kinds = append(kinds, kind)
+	}
+	if len(kinds) == 0 {
+		return nil, fmt.Errorf("no resources to list")
+	}
+	return uniqueStrings(kinds), nil
+}
+
+// listSections lists the kinds of resources with list, at most parallel at
+// a time. If interrupt receives before all are listed, it returns at once
+// with the listings not done yet marked pending, and true.
+func listSections(kinds []string, parallel int, interrupt <-chan os.Signal, list func(kind string) (map[string]interface{}, cli.CLIOutputOptions, error)) ([]getSection, bool) {
+	sections := make([]getSection, len(kinds))
+	for i, kind := range kinds {
+		sections[i] = getSection{kind: kind, pending: true}
+	}
+	var mu sync.Mutex
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, kind := range kinds {
+		wg.Add(1)
+		go func(i int, kind string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			decoded, outputOptions, err := list(kind)
+			mu.Lock()
+			defer mu.Unlock()
+			sections[i] = getSection{kind: kind, decoded: decoded, outputOptions: outputOptions, err: err}
+		}(i, kind)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return sections, false
+	case <-interrupt:
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]getSection{}, sections...), true
+	}
+}
+
+// showSections shows every listing in a section of its own for tables, or
+// all of them in a single document keyed by kind otherwise. Listings that
+// failed are reported and make the command fail once all are shown.
+func showSections(sections []getSection, params *viper.Viper) {
+	failed := []string{}
+	if isTableOutput() && outputQuery() == "" {
+		for i, section := range sections {
+			if i > 0 {
+				fmt.Println()
+			}
+			title := strings.Title(section.kind) + "s"
+			if section.err != nil {
+				fmt.Printf("%s\n", title)
+				fmt.Fprintf(os.Stderr, "Error listing %ss: %s\n", section.kind, section.err)
+				failed = append(failed, section.kind+"s")
+				continue
+			}
+			if section.pending {
+				fmt.Printf("%s (not fetched)\n", title)
+				continue
+			}
+			if section.partial {
+				fmt.Printf("%s (%d so far)\n", title, len(responseItems(section.decoded)))
+			} else {
+				fmt.Printf("%s (%d)\n", title, len(responseItems(section.decoded)))
+			}
+			if err := cli.Formatter.Format(section.decoded, params, section.outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		}
+	} else {
+		combined := make(map[string]interface{})
+		for _, section := range sections {
+			if section.err != nil {
+				fmt.Fprintf(os.Stderr, "Error listing %ss: %s\n", section.kind, section.err)
+				failed = append(failed, section.kind+"s")
+				continue
+			}
+			if section.pending {
+				continue
+			}
+			combined[section.kind+"s"] = section.decoded["data"]
+		}
+		if err := cli.Formatter.Format(combined, params, cli.CLIOutputOptions{}); err != nil {
+			logger.Fatalf("Formatting failed: %s", err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		logger.Fatalf("Error calling operation: could not list %s", strings.Join(failed, ", "))
+	}
+}
+
+// partialSections fills the sections interrupted with the pages their
+// pagers fetched, leaving those without any pending, and tells how many
+// resources were fetched.
+func partialSections(sections []getSection, pagers map[string]*pager) string {
+	complete, partial, fetched := 0, 0, 0
+	pending := []string{}
+	for i, section := range sections {
+		if !section.pending {
+			complete++
+			continue
+		}
+		p, ok := pagers[section.kind]
+		if ok {
+			p.stop()
+		}
+		if !ok || !p.fetched() {
+			pending = append(pending, section.kind+"s")
+			continue
+		}
+		sections[i].decoded = p.result()
+		sections[i].outputOptions = p.outputOptions
+		sections[i].partial, sections[i].pending = true, false
+		partial++
+		fetched += len(responseItems(sections[i].decoded))
+	}
+	note := fmt.Sprintf("showing the %d of %d listings done", complete, len(sections))
+	if partial > 0 {
+		note += fmt.Sprintf(" and %d resources of %d more", fetched, partial)
+	}
+	if len(pending) > 0 {
+		note += fmt.Sprintf(", %s not fetched", strings.Join(pending, ", "))
+	}
+	return note
+}
+
+func getSectionsRun(params *viper.Viper, list string) {
+	kinds, err := getKinds(getGroupCmd(), list)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if err := setContext(); err != nil {
+		logger.Fatalf("Error calling operation: %s", err.Error())
+	}
+	parallel := parallelism(params)
+	if parallel < 1 {
+		logger.Fatal("--parallel must be at least 1")
+	}
+	all := params.GetBool("all")
+	pagers := make(map[string]*pager)
+	for _, kind := range kinds {
+		pagers[kind] = &pager{kind: kind + "s"}
+	}
+	sigc, stop := notifyInterrupt()
+	defer stop()
+	sections, interrupted := listSections(kinds, parallel, sigc, func(kind string) (map[string]interface{}, cli.CLIOutputOptions, error) {
+		if all {
+			return listPages(pagers[kind], resourceListControllersMap[kind], viper.New())
+		}
+		_, decoded, outputOptions, err := resourceListControllersMap[kind](viper.New())
+		return decoded, outputOptions, err
+	})
+	if interrupted {
+		fmt.Fprintf(os.Stderr, "Interrupted, %s: results are partial\n", partialSections(sections, pagers))
+		showSections(sections, params)
+		os.Exit(exitInterrupted)
+	}
+	showSections(sections, params)
+}
+
+// getGroupCmd returns the get command group.
+func getGroupCmd() *cobra.Command {
+	for _, cmd := range cli.Root.Commands() {
+		if cmd.Name() == "get" {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func getAllCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "all",
+		Short: "List all resources",
+		Long: fmt.Sprintf(`List the %s in one go, fetching them
+in parallel, and show them in sections.
+
+To list only some kinds of resources, give them separated by commas to get,
+e.g. get clouds,machines,volumes.`, strings.Join(getAllKinds, "s, ")+"s"),
+		Example: `  mist get all
+  mist get clouds,machines,volumes
+  mist get machines,keys -o json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			getSectionsRun(params, "all")
+		},
+	}
+	cmd.Flags().Int("parallel", 4, "Maximum number of listings to fetch at the same time")
+	cmd.Flags().Bool("all", false, "Fetch every page of resources")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+// initGetAll adds get all, and makes get list the kinds of resources given
+// separated by commas, like get clouds,machines,volumes.
+func initGetAll() {
+	get := getGroupCmd()
+	if get == nil {
+		return
+	}
+	get.AddCommand(getAllCmd())
+	params := viper.New()
+	get.Args = cobra.MaximumNArgs(1)
+	get.Run = func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			return
+		}
+		getSectionsRun(params, args[0])
+	}
+	get.Flags().Int("parallel", 4, "Maximum number of listings to fetch at the same time")
+	get.Flags().Bool("all", false, "Fetch every page of resources")
+	params.BindPFlags(get.Flags())
+}
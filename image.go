@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+func starredImagesKey() string {
+	return "contexts." + viper.GetString("context") + ".starred_images"
+}
+
+// starredImages returns the ids of the images starred in the current
+// context.
+func starredImages() map[string]bool {
+	starred := make(map[string]bool)
+	items, _ := cli.Creds.Get(starredImagesKey()).([]interface{})
+	for _, item := range items {
+		if id, ok := item.(string); ok {
+			starred[id] = true
+		}
+	}
+	return starred
+}
+
+func writeStarredImages(starred map[string]bool) error {
+	ids := []string{}
+	for id := range starred {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	cli.Creds.Set(starredImagesKey(), ids)
+	return cli.Creds.WriteConfig()
+}
+
+// imageStarred returns whether the image is starred, either in Mist or in
+// the current context.
+func imageStarred(image map[string]interface{}, starred map[string]bool) bool {
+	id, _ := image["id"].(string)
+	s, _ := image["starred"].(bool)
+	return s || starred[id]
+}
+
+// fuzzyScore returns how well the term matches the text, 0 if it doesn't.
+// Substrings score above matches at the start of words, which score above
+// letters of the term appearing in order.
+func fuzzyScore(term, text string) int {
+	term, text = strings.ToLower(term), strings.ToLower(text)
+	if term == "" {
+		return 1
+	}
+	if i := strings.Index(text, term); i >= 0 {
+		if i == 0 {
+			return 1000 - len(text)
+		}
+		return 900 - len(text)
+	}
+	// Letters of the term in order, with a bonus for those starting words.
+	t, runes := []rune(term), []rune(text)
+	score, j := 0, 0
+	for i := 0; i < len(runes) && j < len(t); i++ {
+		if runes[i] != t[j] {
+			continue
+		}
+		score += 2
+		if i == 0 || !unicode.IsLetter(runes[i-1]) && !unicode.IsDigit(runes[i-1]) {
+			score += 10
+		}
+		j++
+	}
+	if j < len(t) {
+		return 0
+	}
+	return score
+}
+
+func imageSearchCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "search TERM",
+		Short: "Search images across clouds",
+		Long: `Search the images of all clouds, or of --cloud, by name and OS, forgiving
+typos like missing letters. The best matches are shown first, starred
+images before others that match equally well.`,
+		Example: `  mist image search ubuntu2204
+  mist image search "debian 12" --cloud gce --limit 5`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			listParams := viper.New()
+			listParams.Set("limit", 1000)
+			if cloud := params.GetString("cloud"); cloud != "" {
+				listParams.Set("cloud", cloud)
+			}
+			_, decoded, _, err := MistApiV2ListImages(listParams)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			starred := starredImages()
+			type match struct {
+				image   map[string]interface{}
+				score   int
+				starred bool
+			}
+			matches := []match{}
+			term := strings.Join(strings.Fields(args[0]), "")
+			for _, image := range responseItems(decoded) {
+				name, _ := image["name"].(string)
+				osType, _ := image["os_type"].(string)
+				score := fuzzyScore(term, strings.Replace(name, " ", "", -1))
+				if s := fuzzyScore(term, osType) / 2; s > score {
+					score = s
+				}
+				if score > 0 {
+					matches = append(matches, match{image, score, imageStarred(image, starred)})
+				}
+			}
+			sort.SliceStable(matches, func(i, j int) bool {
+				if matches[i].score != matches[j].score {
+					return matches[i].score > matches[j].score
+				}
+				return matches[i].starred && !matches[j].starred
+			})
+			if limit := params.GetInt("limit"); limit > 0 && len(matches) > limit {
+				matches = matches[:limit]
+			}
+			names := make(referenceNames)
+			rows := []interface{}{}
+			for _, m := range matches {
+				cloud := m.image["cloud"]
+				switch c := cloud.(type) {
+				case map[string]interface{}:
+					cloud = c["name"]
+				case string:
+					cloud = names.lookup("cloud", c)
+				}
+				rows = append(rows, map[string]interface{}{
+					"id":          m.image["id"],
+					"external_id": m.image["external_id"],
+					"name":        m.image["name"],
+					"cloud":       cloud,
+					"os_type":     m.image["os_type"],
+					"starred":     m.starred,
+				})
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{
+				[]string{"starred", "name", "cloud", "os_type"},
+				[]string{"starred", "id", "external_id", "name", "cloud", "os_type"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("cloud", "", "Only search the images of this cloud")
+	cmd.Flags().Int("limit", 20, "Maximum number of images to show, 0 for all")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func imageStarCmd(star bool) *cobra.Command {
+	use, short := "star", "Star images, listing them first in the create machine wizard"
+	if !star {
+		use, short = "unstar", "Unstar images"
+	}
+	cmd := &cobra.Command{
+		Use:               use + " IMAGE...",
+		Short:             short,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeResourceFlag("image"),
+		Run: func(cmd *cobra.Command, args []string) {
+			images, err := resolveResources("image", args, "")
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			starred := starredImages()
+			for _, image := range images {
+				if star {
+					starred[image.id] = true
+				} else {
+					delete(starred, image.id)
+				}
+			}
+			if err := writeStarredImages(starred); err != nil {
+				logger.Fatalf("Could not save starred images: %s", err.Error())
+			}
+			for _, image := range images {
+				fmt.Printf("Image %s %sred\n", image.name, use)
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func imageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "image",
+		Aliases: []string{"images"},
+		Short:   "Image operations",
+		Long: `Search and star images. Stars are kept in the configuration of the current
+context, and images starred in Mist count as starred too.`,
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.AddCommand(imageSearchCmd())
+	cmd.AddCommand(imageStarCmd(true))
+	cmd.AddCommand(imageStarCmd(false))
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
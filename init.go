@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// createToken creates an API token with the email and password of a user,
+// which is not possible for users signing in with SSO.
+func createToken(server, email, password string) (string, error) {
+	hostname, _ := os.Hostname()
+	body, _ := json.Marshal(map[string]interface{}{
+		"email":    email,
+		"password": password,
+		"name":     "mist-cli " + hostname,
+	})
+	req, err := http.NewRequest("POST", strings.TrimSuffix(server, "/")+"/api/v1/tokens", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client, err := httpClient()
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("wrong email or password")
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("could not create a token: %s", resp.Status)
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.Token == "" {
+		return "", fmt.Errorf("could not read the created token")
+	}
+	return created.Token, nil
+}
+
+// noContextsHint is the end of the message of setContext when no context
+// is configured, which init is the easiest way to fix.
+const noContextsHint = "config add-context` to add one."
+
+// withInitHint points to init instead of config add-context in the message
+// of a command failing because no context is configured.
+func withInitHint(message string) string {
+	if !strings.Contains(message, "No contexts configured.") || !strings.HasSuffix(message, noContextsHint) {
+		return message
+	}
+	return strings.TrimSuffix(message, noContextsHint) + "init` to set one up."
+}
+
+// initPrompt asks for a value, offering def as the default.
+func initPrompt(label, def string, validate func(string) error) (string, error) {
+	prompt := promptui.Prompt{
+		Label:     label,
+		Default:   def,
+		AllowEdit: true,
+		Validate: func(input string) error {
+			return validate(strings.TrimSpace(input))
+		},
+	}
+	value, err := prompt.Run()
+	return strings.TrimSpace(value), err
+}
+
+// initConfirm asks a yes or no question.
+func initConfirm(label string) bool {
+	prompt := promptui.Prompt{
+		Label:     label,
+		IsConfirm: true,
+	}
+	_, err := prompt.Run()
+	return err == nil
+}
+
+// initToken gets a token for the server, pasted or created in the
+// browser or with the email and password of the user.
+func initToken(server string) (string, error) {
+	choices := []string{"Paste an API token", "Create a token in the browser", "Create a token with email and password"}
+	prompt := promptui.Select{
+		Label: "API token",
+		Items: choices,
+	}
+	choice, _, err := prompt.Run()
+	if err != nil {
+		return "", err
+	}
+	switch choice {
+	case 1:
+		tokensURL := server + "/my-account/tokens"
+		if err := openBrowser(tokensURL); err != nil {
+			fmt.Fprintf(os.Stderr, "Open %s in your browser and create a token\n", tokensURL)
+		} else {
+			fmt.Fprintf(os.Stderr, "Create a token in the page opened in your browser (%s)\n", tokensURL)
+		}
+	case 2:
+		email, err := initPrompt("Email", "", func(input string) error {
+			if !strings.Contains(input, "@") {
+				return fmt.Errorf("not an email address")
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		password, err := (&promptui.Prompt{Label: "Password", Mask: '*'}).Run()
+		if err != nil {
+			return "", err
+		}
+		return createToken(server, email, password)
+	}
+	return tokenPrompt()
+}
+
+// completionScriptPath returns where the completion script of the shell is
+// installed for the user, and whether it is sourced from the rc file of
+// the shell rather than loaded from there by the shell.
+func completionScriptPath(shell string) (string, bool, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", false, err
+	}
+	switch shell {
+	case "bash":
+		return filepath.Join(home, ".local", "share", "bash-completion", "completions", "mist"), false, nil
+	case "fish":
+		return filepath.Join(home, ".config", "fish", "completions", "mist.fish"), false, nil
+	case "zsh":
+		return filepath.Join(home, ".zshrc"), true, nil
+	}
+	return "", false, fmt.Errorf("completion can't be installed for %s, see %s completion --help", shell, cli.Root.CommandPath())
+}
+
+// installCompletion installs the completion script of the shell, where it
+// is loaded by new shells.
+func installCompletion(shell string) (string, error) {
+	path, rc, err := completionScriptPath(shell)
+	if err != nil {
+		return "", err
+	}
+	if rc {
+		line := fmt.Sprintf("source <(%s completion %s)", cli.Root.Name(), shell)
+		content, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if bytes.Contains(content, []byte(line)) {
+			return path, nil
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintf(f, "\n# Completion of mist\n%s\n", line)
+		return path, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	var script bytes.Buffer
+	switch shell {
+	case "bash":
+		err = cli.Root.GenBashCompletion(&script)
+	case "fish":
+		err = cli.Root.GenFishCompletion(&script, true)
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path, script.Bytes(), 0644)
+}
+
+func initCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Set up mist for the first time",
+		Long: `Set up mist interactively: choose the server and a name for the context,
+paste an API token or create one, verify that the server accepts it with a
+test request, and install shell completion. The context is saved and made
+the current one.
+
+Run it again to add more contexts, e.g. for other servers.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			server := params.GetString("server")
+			if server == "" {
+				server = mistApiV2Servers()[0]["url"]
+			}
+			server, err := initPrompt("Server URL", server, validateServerURL)
+			if err != nil {
+				logger.Fatalf("Init cancelled: %s", err.Error())
+			}
+			server = strings.TrimSuffix(server, "/")
+			name := "default"
+			if len(contextNames()) > 0 {
+				name = ""
+			}
+			name, err = initPrompt("Context name", name, func(input string) error {
+				if input == "" || strings.ContainsAny(input, ". ") {
+					return fmt.Errorf("context names can't be empty or contain dots or spaces")
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Fatalf("Init cancelled: %s", err.Error())
+			}
+			if cli.ExistsContext(name) && !initConfirm(fmt.Sprintf("Context %s exists, replace its token", name)) {
+				logger.Fatal("Init cancelled")
+			}
+			for {
+				token, err := initToken(server)
+				if err == nil {
+					fmt.Fprintf(os.Stderr, "Checking the token with %s...\n", server)
+					err = verifyToken(server, token)
+				}
+				if err == promptui.ErrInterrupt || err == promptui.ErrEOF {
+					logger.Fatal("Init cancelled")
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+					if initConfirm("Try again") {
+						continue
+					}
+					logger.Fatal("Init cancelled")
+				}
+				if err := saveContextToken(name, server, token); err != nil {
+					logger.Fatalf("Error saving context: %s", err.Error())
+				}
+				break
+			}
+			cli.UpdateDefaultContext(name)
+			fmt.Printf("Context %s saved and selected\n", name)
+
+			shell := filepath.Base(os.Getenv("SHELL"))
+			if !params.GetBool("no-completion") && shell != "." && shell != "" {
+				if _, _, err := completionScriptPath(shell); err == nil && initConfirm(fmt.Sprintf("Install shell completion for %s", shell)) {
+					path, err := installCompletion(shell)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Could not install completion: %s\n", err)
+					} else {
+						fmt.Printf("Completion installed in %s, it works in new shells\n", path)
+					}
+				}
+			}
+			fmt.Printf("Try `%s get machines` to list your machines\n", cli.Root.CommandPath())
+		},
+	}
+	cmd.Flags().String("server", "", "Server URL to offer, instead of the default one")
+	cmd.Flags().Bool("no-completion", false, "Don't offer to install shell completion")
+	cmd.SetErr(os.Stderr)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// notifyInterrupt returns a channel receiving Ctrl-C, which no longer
+// stops mist until stop is called.
+func notifyInterrupt() (<-chan os.Signal, func()) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	return sigc, func() { signal.Stop(sigc) }
+}
+
+// showPartial shows what a listing fetched before being interrupted, with
+// a note that it is partial, and exits.
+func showPartial(data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions, note string) {
+	fmt.Fprintf(os.Stderr, "Interrupted, %s: results are partial\n", note)
+	if params == nil {
+		params = viper.New()
+	}
+	// The pager of the listing would capture the output otherwise.
+	var err error
+	if f, ok := cli.Formatter.(*outputFormatter); ok {
+		err = f.render(data, params, outputOptions)
+	} else {
+		err = cli.Formatter.Format(data, params, outputOptions)
+	}
+	if err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+	os.Exit(exitInterrupted)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// invalidGroupChars are replaced in Ansible group names, which may only
+// contain letters, digits and underscores.
+var invalidGroupChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func ansibleGroup(parts ...string) string {
+	return invalidGroupChars.ReplaceAllString(strings.Join(parts, "_"), "_")
+}
+
+// inventoryHost is a machine in the inventory.
+type inventoryHost struct {
+	name   string
+	vars   map[string]interface{}
+	groups []string
+}
+
+// machineIPs returns the IPs of the machine in the field, like public_ips.
+func machineIPs(machine map[string]interface{}, field string) []string {
+	ips := []string{}
+	items, _ := machine[field].([]interface{})
+	for _, item := range items {
+		if ip, ok := item.(string); ok && ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// inventoryHosts returns the machines with an IP as Ansible hosts, with
+// the IP to connect to, the SSH user and port of their first key
+// association, and groups for their cloud and tags. Machines without IPs
+// can't be reached and are left out.
+func inventoryHosts(machines []map[string]interface{}) []inventoryHost {
+	names := make(referenceNames)
+	seen := make(map[string]bool)
+	hosts := []inventoryHost{}
+	for _, machine := range machines {
+		id, _ := machine["id"].(string)
+		name, _ := machine["name"].(string)
+		publicIPs, privateIPs := machineIPs(machine, "public_ips"), machineIPs(machine, "private_ips")
+		ips := append(append([]string{}, publicIPs...), privateIPs...)
+		if len(ips) == 0 {
+			continue
+		}
+		if name == "" || seen[name] {
+			name = id
+		}
+		seen[name] = true
+		cloud := ""
+		switch c := machine["cloud"].(type) {
+		case map[string]interface{}:
+			cloud, _ = c["name"].(string)
+		case string:
+			cloud = fmt.Sprint(names.lookup("cloud", c))
+		}
+		tags := map[string]string{}
+		groups := []string{ansibleGroup("cloud", cloud)}
+		for _, tag := range resourceTags(machine["tags"]) {
+			tags[tag.Key] = tag.Value
+			if tag.Value == "" {
+				groups = append(groups, ansibleGroup("tag", tag.Key))
+			} else {
+				groups = append(groups, ansibleGroup("tag", tag.Key, tag.Value))
+			}
+		}
+		vars := map[string]interface{}{
+			"ansible_host": ips[0],
+			"mist_id":      id,
+			"mist_cloud":   cloud,
+			"mist_state":   machine["state"],
+			"public_ips":   publicIPs,
+			"private_ips":  privateIPs,
+			"mist_tags":    tags,
+		}
+		if associations, _ := machine["key_associations"].([]interface{}); len(associations) > 0 {
+			association, _ := associations[0].(map[string]interface{})
+			if user, _ := association["ssh_user"].(string); user != "" {
+				vars["ansible_user"] = user
+			}
+			if port, ok := association["port"].(float64); ok && port > 0 {
+				vars["ansible_port"] = int(port)
+			}
+			if key, _ := association["key"].(string); key != "" {
+				vars["mist_ssh_key"] = names.lookup("key", key)
+			}
+		}
+		hosts = append(hosts, inventoryHost{name: name, vars: vars, groups: uniqueStrings(groups)})
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].name < hosts[j].name })
+	return hosts
+}
+
+// inventoryGroups returns the hosts of every group, sorted by group.
+func inventoryGroups(hosts []inventoryHost) ([]string, map[string][]string) {
+	members := make(map[string][]string)
+	for _, host := range hosts {
+		for _, group := range host.groups {
+			members[group] = append(members[group], host.name)
+		}
+	}
+	groups := []string{}
+	for group := range members {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups, members
+}
+
+// ansibleInventory returns the hosts as the JSON of an Ansible dynamic
+// inventory, with the variables of every host in _meta.
+func ansibleInventory(hosts []inventoryHost) map[string]interface{} {
+	groups, members := inventoryGroups(hosts)
+	inventory := make(map[string]interface{})
+	for _, group := range groups {
+		inventory[group] = map[string]interface{}{"hosts": members[group]}
+	}
+	hostvars := make(map[string]interface{})
+	for _, host := range hosts {
+		hostvars[host.name] = host.vars
+	}
+	inventory["_meta"] = map[string]interface{}{"hostvars": hostvars}
+	return inventory
+}
+
+// iniInventory returns the hosts as a static Ansible inventory in INI
+// format. Hosts are listed with their connection variables first, then in
+// their groups.
+func iniInventory(hosts []inventoryHost) string {
+	var b strings.Builder
+	for _, host := range hosts {
+		fmt.Fprint(&b, host.name)
+		for _, name := range []string{"ansible_host", "ansible_user", "ansible_port", "mist_id", "mist_cloud"} {
+			value, ok := host.vars[name]
+			if !ok || value == "" {
+				continue
+			}
+			// Ansible splits host lines like a shell does.
+			if text := fmt.Sprint(value); strings.ContainsAny(text, " \t'\"#") {
+				fmt.Fprintf(&b, " %s=%q", name, text)
+			} else {
+				fmt.Fprintf(&b, " %s=%s", name, text)
+			}
+		}
+		fmt.Fprintln(&b)
+	}
+	groups, members := inventoryGroups(hosts)
+	for _, group := range groups {
+		fmt.Fprintf(&b, "\n[%s]\n%s\n", group, strings.Join(members[group], "\n"))
+	}
+	return b.String()
+}
+
+func inventoryCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "inventory",
+		Short: "Show machines as an Ansible inventory",
+		Long: `Show the machines as an Ansible dynamic inventory, grouped by cloud, like
+cloud_aws1, and by tag, like tag_env_prod. Hosts connect to their first
+public IP, or private IP if they have none, with the user and port of
+their first key association. Machines without IPs are left out.
+
+To use it with ansible -i, make a script running mist inventory with the
+arguments it is given, which it answers like Ansible expects. With
+--static ini, a static inventory in INI format is written instead.`,
+		Example: `  mist inventory --search state:running
+  mist inventory --static ini > hosts.ini
+  printf '#!/bin/sh\nexec mist inventory "$@"\n' > mist.sh && chmod +x mist.sh && ansible -i mist.sh all -m ping`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if format := params.GetString("format"); format != "ansible" {
+				logger.Fatalf("Unsupported inventory format %s, only ansible is", format)
+			}
+			static := params.GetString("static")
+			if static != "" && static != "ini" {
+				logger.Fatalf("Unsupported static inventory %s, only ini is", static)
+			}
+			listParams := viper.New()
+			for _, flag := range []string{"cloud", "search"} {
+				if value := params.GetString(flag); value != "" {
+					listParams.Set(flag, value)
+				}
+			}
+			decoded, _, err := listAllPages("machine", MistApiV2ListMachines, listParams)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			hosts := inventoryHosts(responseItems(decoded))
+			if static == "ini" {
+				fmt.Print(iniInventory(hosts))
+				return
+			}
+			var inventory interface{} = ansibleInventory(hosts)
+			if host := params.GetString("host"); host != "" {
+				// Variables are already in _meta, so Ansible won't ask.
+				inventory = map[string]interface{}{}
+				for _, h := range hosts {
+					if h.name == host {
+						inventory = h.vars
+					}
+				}
+			}
+			j, err := json.MarshalIndent(inventory, "", "  ")
+			if err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+			fmt.Println(string(j))
+		},
+	}
+	cmd.Flags().String("format", "ansible", "Inventory format, only ansible for now")
+	cmd.Flags().String("static", "", "Write a static inventory in this format instead, ini")
+	cmd.Flags().String("cloud", "", "Only include the machines of this cloud")
+	cmd.Flags().String("search", "", "Only include the machines matching this search query, e.g. state:running")
+	cmd.Flags().Bool("list", true, "List the whole inventory, as Ansible asks dynamic inventories to")
+	cmd.Flags().String("host", "", "Show the variables of this host, as Ansible asks dynamic inventories to")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// jobHistoryLimit is the number of jobs remembered per context.
+const jobHistoryLimit = 50
+
+// jobPollInterval is how often jobs are checked while waiting for them.
+const jobPollInterval = 2 * time.Second
+
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// lastJobID is the id of the last job started by the command being run.
+var lastJobID string
+
+// The API can't list jobs, so the jobs started by mist are remembered in
+// the cache file, per context, as maps of id, command and submitted time.
+
+func jobHistoryKey() string {
+	return "contexts." + viper.GetString("context") + ".jobs"
+}
+
+func jobHistory() []map[string]interface{} {
+	history := []map[string]interface{}{}
+	items, _ := cli.ClusterCache.Get(jobHistoryKey()).([]interface{})
+	for _, item := range items {
+		switch job := item.(type) {
+		case map[string]interface{}:
+			history = append(history, job)
+		case map[interface{}]interface{}:
+			history = append(history, normalizeYAML(job).(map[string]interface{}))
+		}
+	}
+	return history
+}
+
+// recordJob remembers a job started by the command being run. Failing to
+// write the cache is not worth failing the command over.
+func recordJob(id string) {
+	history := []interface{}{map[string]interface{}{
+		"id":        id,
+		"command":   strings.Join(os.Args[1:], " "),
+		"submitted": time.Now().UTC().Format(time.RFC3339),
+	}}
+	for _, job := range jobHistory() {
+		if len(history) == jobHistoryLimit {
+			break
+		}
+		if job["id"] != id {
+			history = append(history, job)
+		}
+	}
+	cli.ClusterCache.Set(jobHistoryKey(), history)
+	cli.ClusterCache.WriteConfig()
+}
+
+// trackJob records the job of responses to asynchronous requests.
+func trackJob(data interface{}) {
+	response, ok := data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if id, ok := response["jobId"].(string); ok && id != "" {
+		lastJobID = id
+		recordJob(id)
+	}
+}
+
+// jobStatus returns whether the job is running, finished or failed.
+func jobStatus(job map[string]interface{}) string {
+	switch e := job["error"].(type) {
+	case nil:
+	case bool:
+		if e {
+			return "failed"
+		}
+	case string:
+		if e != "" {
+			return "failed"
+		}
+	default:
+		return "failed"
+	}
+	if finished := job["finished_at"]; finished != nil && finished != "" {
+		return "finished"
+	}
+	return "running"
+}
+
+// jobActions returns the stages the job went through so far.
+func jobActions(job map[string]interface{}) []string {
+	actions := []string{}
+	logs, _ := job["logs"].([]interface{})
+	for _, log := range logs {
+		entry, _ := log.(map[string]interface{})
+		if action, ok := entry["action"].(string); ok {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// waitForJob polls the job until it finishes, printing its stages as it
+// goes through them, with a spinner when writing to a terminal.
+func waitForJob(id string, timeout time.Duration) error {
+	spinner := term.IsTerminal(int(os.Stderr.Fd()))
+	start := time.Now()
+	deadline := start.Add(timeout)
+	printed := 0
+	for i := 0; ; i++ {
+		resp, decoded, _, err := MistApiV2GetJob(id, viper.New())
+		if err != nil && (resp == nil || resp.StatusCode != 404) {
+			return err
+		}
+		// Jobs may not be found until they are picked up.
+		job, _ := decoded["data"].(map[string]interface{})
+		if job != nil {
+			actions := jobActions(job)
+			if spinner && printed < len(actions) {
+				fmt.Fprint(os.Stderr, "\r\033[K")
+			}
+			for _, action := range actions[printed:] {
+				fmt.Printf(" * %s\n", action)
+			}
+			printed = len(actions)
+			switch jobStatus(job) {
+			case "failed":
+				if spinner {
+					fmt.Fprint(os.Stderr, "\r\033[K")
+				}
+				return fmt.Errorf("job %s failed: %s", id, transposedValue(job["error"]))
+			case "finished":
+				if spinner {
+					fmt.Fprint(os.Stderr, "\r\033[K")
+				}
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if spinner {
+				fmt.Fprint(os.Stderr, "\r\033[K")
+			}
+			return fmt.Errorf("timed out after %s waiting for job %s", timeout, id)
+		}
+		if spinner {
+			elapsed := time.Since(start).Truncate(time.Second)
+			fmt.Fprintf(os.Stderr, "\r\033[K%s Waiting for job %s (%s)", spinnerFrames[i%len(spinnerFrames)], id, elapsed)
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
+
+// initJobWaitFlags adds --wait and --timeout to the commands changing
+// resources, which wait for the job of asynchronous requests to finish.
+// Synchronous requests are already done when the command returns.
+func initJobWaitFlags() {
+	for _, group := range cli.Root.Commands() {
+		switch group.Name() {
+		case "get", "download", "generate", "wait":
+			continue
+		}
+		for _, cmd := range group.Commands() {
+			if cmd.Run == nil || cmd.Flags().Lookup("wait") != nil {
+				continue
+			}
+			if cmd.Flags().ShorthandLookup("w") == nil {
+				cmd.Flags().BoolP("wait", "w", false, "Wait for the job of the request to finish")
+			} else {
+				cmd.Flags().Bool("wait", false, "Wait for the job of the request to finish")
+			}
+			if cmd.Flags().Lookup("timeout") == nil {
+				cmd.Flags().Duration("timeout", 15*time.Minute, "Maximum time to wait with --wait")
+			}
+			run := cmd.Run
+			cmd.Run = func(cmd *cobra.Command, args []string) {
+				run(cmd, args)
+				if wait, _ := cmd.Flags().GetBool("wait"); !wait || lastJobID == "" {
+					return
+				}
+				timeout, _ := cmd.Flags().GetDuration("timeout")
+				if err := waitForJob(lastJobID, timeout); err != nil {
+					logger.Fatalf("Waiter error: %s", err.Error())
+				}
+			}
+		}
+	}
+}
+
+func jobsCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "jobs",
+		Short: "Track the jobs of asynchronous requests",
+		Long: `List the jobs started by mist in the current context, most recent first,
+with their status.
+
+Requests like creating machines run as jobs in the background. Their jobs
+are remembered so that they can be followed later with jobs show and jobs
+wait, and mutating commands accept --wait to wait for them right away.`,
+		Args: cobra.ExactValidArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobs := []interface{}{}
+			for _, record := range jobHistory() {
+				id, _ := record["id"].(string)
+				job := map[string]interface{}{
+					"id":        id,
+					"command":   record["command"],
+					"submitted": record["submitted"],
+					"status":    "unknown",
+				}
+				_, decoded, _, err := MistApiV2GetJob(id, viper.New())
+				if data, ok := decoded["data"].(map[string]interface{}); err == nil && ok {
+					job["status"] = jobStatus(data)
+					job["finished_at"] = data["finished_at"]
+					actions := jobActions(data)
+					if len(actions) > 0 {
+						job["stage"] = actions[len(actions)-1]
+					}
+				}
+				if params.GetBool("running") && job["status"] != "running" {
+					continue
+				}
+				jobs = append(jobs, job)
+			}
+			outputOptions := cli.CLIOutputOptions{
+				[]string{"id", "status", "stage", "command"},
+				[]string{"id", "status", "stage", "submitted", "finished_at", "command"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": jobs}, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().Bool("running", false, "Only list the jobs still running")
+	cmd.AddCommand(jobsShowCmd())
+	cmd.AddCommand(jobsWaitCmd())
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func jobsShowCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "show JOB",
+		Short: "Show the status and stages of a job",
+		Args:  cobra.ExactValidArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			_, decoded, outputOptions, err := MistApiV2GetJob(args[0], params)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if !isTableOutput() {
+				if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+					logger.Fatalf("Formatting failed: %s", err.Error())
+				}
+				return
+			}
+			job, _ := decoded["data"].(map[string]interface{})
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(w, "ID:\t%s\n", args[0])
+			fmt.Fprintf(w, "Status:\t%s\n", jobStatus(job))
+			for _, field := range []describeField{{"Started", "started_at", ""}, {"Finished", "finished_at", ""}, {"Error", "error", ""}} {
+				if value, ok := describeFieldValue(field, job, nil); ok && value != "false" {
+					fmt.Fprintf(w, "%s:\t%s\n", field.Label, value)
+				}
+			}
+			fmt.Fprintln(w, "Stages:")
+			actions := jobActions(job)
+			if len(actions) == 0 {
+				fmt.Fprintln(w, "  <none>")
+			}
+			for _, action := range actions {
+				fmt.Fprintf(w, "  %s\n", action)
+			}
+			w.Flush()
+		},
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func jobsWaitCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "wait JOB...",
+		Short: "Wait for jobs to finish",
+		Long:  "Wait for jobs to finish, printing their stages as they go through them. The exit code is 1 if any job failed.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			deadline := time.Now().Add(params.GetDuration("timeout"))
+			failed := 0
+			for _, id := range args {
+				if err := waitForJob(id, time.Until(deadline)); err != nil {
+					fmt.Fprintf(os.Stderr, " * %s\n", err)
+					failed++
+				}
+			}
+			if failed > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().Duration("timeout", 15*time.Minute, "Maximum time to wait for all the jobs")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+func keyAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeResourceFlag("key")(cmd, args, toComplete)
+	}
+	return machineAutocomplete(cmd, args[1:], toComplete)
+}
+
+// sshString encodes b as a string of the SSH wire format.
+func sshString(b []byte) []byte {
+	buf := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
+
+// sshMPInt encodes n as an mpint of the SSH wire format.
+func sshMPInt(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return sshString(b)
+}
+
+// authorizedKey returns the public key blob in the authorized_keys format.
+func authorizedKey(keyType string, blob []byte, comment string) string {
+	return strings.TrimSpace(keyType + " " + base64.StdEncoding.EncodeToString(blob) + " " + comment)
+}
+
+// generateKeyPair returns a new private key in PEM and its public key in
+// the authorized_keys format. ed25519 keys use the OpenSSH format, which
+// has no PEM equivalent.
+func generateKeyPair(keyType string, bits int, comment string) ([]byte, string, error) {
+	switch keyType {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, "", err
+		}
+		private := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		blob := append(append(sshString([]byte("ssh-rsa")), sshMPInt(big.NewInt(int64(key.E)))...), sshMPInt(key.N)...)
+		return private, authorizedKey("ssh-rsa", blob, comment), nil
+	case "ed25519":
+		public, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", err
+		}
+		blob := append(sshString([]byte("ssh-ed25519")), sshString(public)...)
+		var check [4]byte
+		if _, err := rand.Read(check[:]); err != nil {
+			return nil, "", err
+		}
+		var section bytes.Buffer
+		section.Write(check[:])
+		section.Write(check[:])
+		section.Write(sshString([]byte("ssh-ed25519")))
+		section.Write(sshString(public))
+		section.Write(sshString(key))
+		section.Write(sshString([]byte(comment)))
+		for i := byte(1); section.Len()%8 != 0; i++ {
+			section.WriteByte(i)
+		}
+		var body bytes.Buffer
+		body.WriteString("openssh-key-v1\x00")
+		body.Write(sshString([]byte("none")))
+		body.Write(sshString([]byte("none")))
+		body.Write(sshString(nil))
+		body.Write([]byte{0, 0, 0, 1})
+		body.Write(sshString(blob))
+		body.Write(sshString(section.Bytes()))
+		private := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: body.Bytes()})
+		return private, authorizedKey("ssh-ed25519", blob, comment), nil
+	}
+	return nil, "", fmt.Errorf("unsupported key type %s, expected rsa or ed25519", keyType)
+}
+
+// writeKeyFiles writes the private key readable only by the user, and the
+// public key next to it. Existing files are only replaced with force.
+func writeKeyFiles(filename string, private []byte, public string, force bool) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	for _, file := range []struct {
+		name    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{filename, private, 0600},
+		{filename + ".pub", []byte(public + "\n"), 0644},
+	} {
+		if file.content == nil {
+			continue
+		}
+		f, err := os.OpenFile(file.name, flags, file.mode)
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists, use --force to replace it", file.name)
+		}
+		if err != nil {
+			return err
+		}
+		// The mode is only applied to new files.
+		if err := f.Chmod(file.mode); err != nil && runtime.GOOS != "windows" {
+			f.Close()
+			return err
+		}
+		if _, err := f.Write(file.content); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addKey uploads the private key, which Mist needs to connect to machines,
+// and returns the response.
+func addKey(name string, private []byte, params *viper.Viper) (map[string]interface{}, cli.CLIOutputOptions) {
+	body, err := json.Marshal(map[string]interface{}{
+		"name":    name,
+		"private": string(private),
+		"default": params.GetBool("default"),
+	})
+	if err != nil {
+		logger.Fatalf("Unable to get body: %s", err.Error())
+	}
+	_, decoded, outputOptions, err := MistApiV2AddKey(params, string(body))
+	if err != nil {
+		logger.Fatalf("Error calling operation: %s", err.Error())
+	}
+	return decoded, outputOptions
+}
+
+func keyGenerateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate a key pair and add it",
+		Long: `Generate an SSH key pair locally and add it to Mist, which keeps the private
+key to connect to machines.
+
+The key pair is written to ~/.ssh/NAME and ~/.ssh/NAME.pub, or to --output,
+with the private key readable only by you. Existing files are kept unless
+--force is given.`,
+		Example: `  mist key generate --name deploy
+  mist key generate --name legacy --type rsa --bits 4096 --output ./legacy`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			name := params.GetString("name")
+			filename := params.GetString("output")
+			if filename == "" {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					logger.Fatalf("Could not find the home directory: %s", err.Error())
+				}
+				filename = filepath.Join(home, ".ssh", name)
+			}
+			private, public, err := generateKeyPair(params.GetString("type"), params.GetInt("bits"), name)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if err := writeKeyFiles(filename, private, public, params.GetBool("force")); err != nil {
+				logger.Fatalf("Could not write key: %s", err.Error())
+			}
+			fmt.Fprintf(os.Stderr, "Key pair written to %s and %s.pub\n", filename, filename)
+			decoded, outputOptions := addKey(name, private, params)
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("name", "", "Name of the key")
+	cmd.Flags().String("type", "ed25519", "Type of the key, ed25519 or rsa")
+	cmd.Flags().Int("bits", 4096, "Size of rsa keys")
+	cmd.Flags().String("output", "", "File to write the private key to, the public key goes next to it")
+	cmd.Flags().Bool("force", false, "Replace existing key files")
+	cmd.Flags().Bool("default", false, "Make it the default key")
+	cmd.MarkFlagRequired("name")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func keyImportCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "import FILE",
+		Short: "Add an existing key pair",
+		Long: `Add an existing SSH key pair to Mist. Mist needs the private key to connect
+to machines, so given a public key file the private key is read from the
+file next to it, without the .pub extension.
+
+The key is named after the file unless --name is given.`,
+		Example: `  mist key import ~/.ssh/id_ed25519.pub
+  mist key import ~/.ssh/deploy --name deploy --default`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			filename := strings.TrimSuffix(args[0], ".pub")
+			info, err := os.Stat(filename)
+			if err != nil {
+				logger.Fatalf("Could not read private key: %s", err.Error())
+			}
+			if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+				fmt.Fprintf(os.Stderr, "Warning: %s is accessible by other users, consider chmod 600 %s\n", filename, filename)
+			}
+			private, err := ioutil.ReadFile(filename)
+			if err != nil {
+				logger.Fatalf("Could not read private key: %s", err.Error())
+			}
+			if block, _ := pem.Decode(private); block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+				logger.Fatalf("%s is not a private key", filename)
+			} else if _, encrypted := block.Headers["Proc-Type"]; encrypted {
+				logger.Fatalf("%s is encrypted, Mist needs a key without a passphrase", filename)
+			}
+			name := params.GetString("name")
+			if name == "" {
+				name = filepath.Base(filename)
+			}
+			decoded, outputOptions := addKey(name, private, params)
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("name", "", "Name of the key")
+	cmd.Flags().Bool("default", false, "Make it the default key")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func keyExportCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "export KEY",
+		Short: "Show the public key or download the key pair",
+		Long: `Show the public key of a key, or with --output download the key pair, the
+private key readable only by you. Existing files are kept unless --force
+is given.`,
+		Example: `  mist key export deploy >> authorized_keys
+  mist key export deploy --output ~/.ssh/deploy`,
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: keyAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			filename := params.GetString("output")
+			getParams := viper.New()
+			getParams.Set("private", filename != "")
+			_, decoded, _, err := MistApiV2GetKey(args[0], getParams)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			data, _ := decoded["data"].(map[string]interface{})
+			public, _ := data["public"].(string)
+			public = strings.TrimSpace(public)
+			if filename == "" {
+				fmt.Println(public)
+				return
+			}
+			private, _ := data["private"].(string)
+			if private == "" {
+				logger.Fatalf("Key %s has no private key to download", args[0])
+			}
+			if !strings.HasSuffix(private, "\n") {
+				private += "\n"
+			}
+			if err := writeKeyFiles(filename, []byte(private), public, params.GetBool("force")); err != nil {
+				logger.Fatalf("Could not write key: %s", err.Error())
+			}
+			fmt.Printf("Key %s written to %s\n", args[0], filename)
+		},
+	}
+	cmd.Flags().String("output", "", "File to write the private key to, the public key goes next to it")
+	cmd.Flags().Bool("force", false, "Replace existing key files")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func keyAssociateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "associate KEY MACHINE...",
+		Short: "Associate a key with machines",
+		Long: `Associate a key with machines, so that ssh, exec and scp can connect to them
+with it as --username on --port.`,
+		Example:           `  mist key associate deploy web-1 web-2 --username ubuntu`,
+		Args:              cobra.MinimumNArgs(2),
+		ValidArgsFunction: keyAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := json.Marshal(map[string]interface{}{
+				"key":      args[0],
+				"username": params.GetString("username"),
+				"port":     params.GetInt("port"),
+			})
+			if err != nil {
+				logger.Fatalf("Unable to get body: %s", err.Error())
+			}
+			for _, machine := range uniqueStrings(args[1:]) {
+				if _, _, _, err := MistApiV2AssociateKey(machine, params, string(body)); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf("Key %s associated with machine %s\n", args[0], machine)
+			}
+		},
+	}
+	cmd.Flags().String("username", "root", "User to connect as")
+	cmd.Flags().Int("port", 22, "SSH port")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func keyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "key",
+		Aliases: []string{"keys"},
+		Short:   "SSH key operations",
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.AddCommand(keyGenerateCmd())
+	cmd.AddCommand(keyImportCmd())
+	cmd.AddCommand(keyExportCmd())
+	cmd.AddCommand(keyAssociateCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
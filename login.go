@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// openBrowser opens url in the default browser.
+func openBrowser(url string) error {
+	var c *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		c = exec.Command("open", url)
+	case "windows":
+		c = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		c = exec.Command("xdg-open", url)
+	}
+	return c.Start()
+}
+
+func tokenPrompt() (string, error) {
+	prompt := promptui.Prompt{
+		Label: "API token",
+		Mask:  '*',
+		Validate: func(input string) error {
+			if strings.TrimSpace(input) == "" {
+				return fmt.Errorf("the token can't be empty")
+			}
+			return nil
+		},
+	}
+	token, err := prompt.Run()
+	return strings.TrimSpace(token), err
+}
+
+// verifyToken checks that the server accepts the token.
+func verifyToken(server, token string) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(server, "/")+"/api/v2/clouds?limit=1&only=id", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", token)
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	recordServerDate(resp.Header)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return authError{fmt.Errorf("the token was rejected by %s", server)}
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("could not verify the token: %s", resp.Status)
+	}
+	return checkTokenExpiry(token)
+}
+
+// saveContextToken stores the token and server in the context, creating it
+// if needed.
+func saveContextToken(name, server, token string) error {
+	contexts := cli.Creds.GetStringMap("contexts")
+	context, _ := contexts[name].(map[string]interface{})
+	if context == nil {
+		context = make(map[string]interface{})
+	}
+	context["api_key"] = storeContextToken(name, token)
+	context["server"] = server
+	contexts[name] = context
+	if err := writeContexts(contexts); err != nil {
+		return err
+	}
+	if cli.Creds.GetString("default.context") == "" {
+		cli.UpdateDefaultContext(name)
+	}
+	return nil
+}
+
+const (
+	// oauthClientID identifies mist to the authorization server of Mist.
+	oauthClientID = "mist-cli"
+	// oauthCallbackPath is where the browser is sent back to, on a port of
+	// the loopback interface chosen when logging in.
+	oauthCallbackPath = "/callback"
+	// oauthLoginTimeout is how long to wait for the user to sign in.
+	oauthLoginTimeout = 5 * time.Minute
+)
+
+// oauthCallback is the result of the authorization request, received on
+// the loopback interface.
+type oauthCallback struct {
+	code string
+	err  error
+}
+
+// randomURLString returns n random bytes encoded for URLs, for the state
+// and the PKCE verifier of the authorization request.
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oauthCallbackHandler receives the redirect of the authorization server,
+// checks its state and sends the code, or the error, to results.
+func oauthCallbackHandler(state string, results chan<- oauthCallback) http.Handler {
+	var once sync.Once
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != oauthCallbackPath {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		result := oauthCallback{code: query.Get("code")}
+		switch {
+		case query.Get("state") != state:
+			result = oauthCallback{err: fmt.Errorf("the callback doesn't belong to this login")}
+		case query.Get("error") != "":
+			description := query.Get("error_description")
+			if description == "" {
+				description = query.Get("error")
+			}
+			result = oauthCallback{err: fmt.Errorf("sign in failed: %s", description)}
+		case result.code == "":
+			result = oauthCallback{err: fmt.Errorf("the callback has no authorization code")}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if result.err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Login failed: %s\n", result.err)
+		} else {
+			fmt.Fprintln(w, "You are logged in to mist, you can close this window.")
+		}
+		once.Do(func() { results <- result })
+	})
+}
+
+// exchangeOAuthCode exchanges the authorization code for an API token.
+func exchangeOAuthCode(server, code, redirectURI, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {oauthClientID},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", server+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client, err := httpClient()
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&token)
+	if resp.StatusCode >= 400 {
+		if token.ErrorDescription != "" {
+			return "", fmt.Errorf("could not get a token: %s", token.ErrorDescription)
+		}
+		return "", fmt.Errorf("could not get a token: %s", resp.Status)
+	}
+	if decodeErr != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("could not read the token")
+	}
+	return token.AccessToken, nil
+}
+
+// loginWithOAuth signs in with the authorization code flow of Mist, with
+// PKCE: the sign in page, which offers SSO when the organization uses it,
+// is opened in the browser, or its URL printed with noBrowser, and the
+// browser is sent back to a port of the loopback interface with a code,
+// exchanged for an API token.
+func loginWithOAuth(server string, noBrowser bool) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("could not listen for the callback: %s", err)
+	}
+	defer listener.Close()
+	redirectURI := fmt.Sprintf("http://%s%s", listener.Addr(), oauthCallbackPath)
+	state, err := randomURLString(16)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	authorizeURL := server + "/oauth/authorize?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oauthClientID},
+		"redirect_uri":          {redirectURI},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	results := make(chan oauthCallback, 1)
+	callbackServer := &http.Server{Handler: oauthCallbackHandler(state, results)}
+	go callbackServer.Serve(listener)
+	defer callbackServer.Close()
+
+	if !noBrowser {
+		if err := openBrowser(authorizeURL); err != nil {
+			noBrowser = true
+		}
+	}
+	if noBrowser {
+		fmt.Fprintf(os.Stderr, "Open this URL in a browser on this machine to sign in:\n\n  %s\n\n", authorizeURL)
+	} else {
+		fmt.Fprintln(os.Stderr, "Sign in in the page opened in your browser")
+	}
+	fmt.Fprintln(os.Stderr, "Waiting for the sign in to complete...")
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			return "", result.err
+		}
+		return exchangeOAuthCode(server, result.code, redirectURI, verifier)
+	case <-time.After(oauthLoginTimeout):
+		return "", fmt.Errorf("timed out waiting for the sign in after %s", oauthLoginTimeout)
+	}
+}
+
+// loginInBrowser opens the token page of the server, or prints its URL with
+// noBrowser, and asks for the token created there.
+func loginInBrowser(server string, noBrowser bool) (string, error) {
+	tokensURL := server + "/my-account/tokens"
+	if !noBrowser {
+		if err := openBrowser(tokensURL); err != nil {
+			noBrowser = true
+		}
+	}
+	if noBrowser {
+		fmt.Fprintf(os.Stderr, "Open %s in your browser and create a token\n", tokensURL)
+	} else {
+		fmt.Fprintf(os.Stderr, "Create a token in the page opened in your browser (%s)\n", tokensURL)
+	}
+	return tokenPrompt()
+}
+
+// loginWithPassword creates a token with the email and the password of the
+// user, asked for or read from the first line of stdin.
+func loginWithPassword(server, email string, passwordStdin bool) (string, error) {
+	var password string
+	if passwordStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	} else {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return "", fmt.Errorf("no terminal to ask for the password, use --password-stdin")
+		}
+		var err error
+		if password, err = (&promptui.Prompt{Label: "Password", Mask: '*'}).Run(); err != nil {
+			return "", err
+		}
+	}
+	if password == "" {
+		return "", fmt.Errorf("the password can't be empty")
+	}
+	return createToken(server, email, password)
+}
+
+func loginCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "login [CONTEXT]",
+		Short: "Sign in and store an API token",
+		Long: `Sign in to Mist and store an API token in a context.
+
+The sign in page of the Mist portal is opened in the browser, where you can
+sign in, with SSO if your organization uses it. The browser is then sent
+back to mist, listening on a port of the loopback interface, which gets an
+API token for the sign in, verifies it against the server and stores it in
+the given context, or the current one if none is given. With --no-browser,
+the URL of the page is printed instead, to open in a browser on the same
+machine.
+
+When signing in from another machine, such as over SSH, use --paste-token
+to open the token page of the portal instead, create a token there and
+paste it at the prompt.
+
+With --email, a token is created with the email and password of the user
+instead, which is not possible for users signing in with SSO. The password
+is asked for, or read from stdin with --password-stdin.`,
+		Example: `  mist login staging --server https://mist.example.com
+  mist login --paste-token --no-browser
+  mist login --email ops@example.com
+  echo "$MIST_PASSWORD" | mist login --email ops@example.com --password-stdin`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: contextAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			name := viper.GetString("context")
+			if name == "" {
+				name = cli.Creds.GetString("default.context")
+			}
+			if len(args) > 0 {
+				name = args[0]
+			}
+			if name == "" {
+				name = "default"
+			}
+			if strings.ContainsAny(name, ". ") {
+				logger.Fatal("Context names can't contain dots or spaces")
+			}
+			server := params.GetString("server")
+			if server == "" {
+				server = cli.Creds.GetString("contexts." + name + ".server")
+			}
+			if server == "" {
+				server = mistApiV2Servers()[0]["url"]
+			}
+			server = strings.TrimSuffix(server, "/")
+			// Contexts added without a scheme are stored with it from now on.
+			server, _ = normalizeServerURL(server)
+			if err := validateServerURL(server); err != nil {
+				logger.Fatal(err)
+			}
+			var token string
+			var err error
+			if email := params.GetString("email"); email != "" {
+				token, err = loginWithPassword(server, email, params.GetBool("password-stdin"))
+				if err != nil {
+					logger.Fatalf("Login failed: %s", err.Error())
+				}
+			} else if params.GetBool("paste-token") {
+				token, err = loginInBrowser(server, params.GetBool("no-browser"))
+				if err != nil {
+					logger.Fatalf("Login cancelled: %s", err.Error())
+				}
+			} else {
+				token, err = loginWithOAuth(server, params.GetBool("no-browser"))
+				if err != nil {
+					logger.Fatalf("Login failed: %s", err.Error())
+				}
+			}
+			if err := verifyToken(server, token); err != nil {
+				logger.Fatalf("Login failed: %s", err.Error())
+			}
+			if err := saveContextToken(name, server, token); err != nil {
+				logger.Fatalf("Error saving context: %s", err.Error())
+			}
+			fmt.Printf("Logged in to %s, the token is stored in context %s\n", server, name)
+		},
+	}
+	cmd.Flags().String("server", "", "Server URL, if not the one of the context")
+	cmd.Flags().Bool("no-browser", false, "Print the URL of the sign in or token page instead of opening it")
+	cmd.Flags().Bool("paste-token", false, "Create a token in the token page of the portal and paste it")
+	cmd.Flags().String("email", "", "Create a token with the email and password of the user")
+	cmd.Flags().Bool("password-stdin", false, "Read the password of --email from stdin")
+	cmd.SetErr(os.Stderr)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOAuthCallbackHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantCode   string
+		wantErr    bool
+	}{
+		{"code", "/callback?state=s1&code=c1", http.StatusOK, "c1", false},
+		{"wrong state", "/callback?state=other&code=c1", http.StatusBadRequest, "", true},
+		{"denied", "/callback?state=s1&error=access_denied", http.StatusBadRequest, "", true},
+		{"no code", "/callback?state=s1", http.StatusBadRequest, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make(chan oauthCallback, 1)
+			rec := httptest.NewRecorder()
+			oauthCallbackHandler("s1", results).ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			result := <-results
+			if (result.err != nil) != tt.wantErr || result.code != tt.wantCode {
+				t.Errorf("result = %q, %v, want %q, error %v", result.code, result.err, tt.wantCode, tt.wantErr)
+			}
+		})
+	}
+
+	results := make(chan oauthCallback, 1)
+	rec := httptest.NewRecorder()
+	oauthCallbackHandler("s1", results).ServeHTTP(rec, httptest.NewRequest("GET", "/favicon.ico", nil))
+	if rec.Code != http.StatusNotFound || len(results) != 0 {
+		t.Errorf("other paths should be not found and ignored, got %d", rec.Code)
+	}
+}
+
+func TestExchangeOAuthCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"token", http.StatusOK, `{"access_token": "t1", "token_type": "bearer"}`, "t1", false},
+		{"invalid grant", http.StatusBadRequest, `{"error": "invalid_grant", "error_description": "code expired"}`, "", true},
+		{"no token", http.StatusOK, `{}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				if r.URL.Path != "/oauth/token" || r.Form.Get("code") != "c1" || r.Form.Get("code_verifier") != "v1" ||
+					r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("redirect_uri") != "http://127.0.0.1:1/callback" {
+					t.Errorf("unexpected token request %s %v", r.URL.Path, r.Form)
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+			got, err := exchangeOAuthCode(server.URL, "c1", "http://127.0.0.1:1/callback", "v1")
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("exchangeOAuthCode() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// logsPageSize is the number of events requested at a time.
+const logsPageSize = 500
+
+// logResourceKinds are the kinds of resources events refer to with a
+// <kind>_id field, in the order the resource of an event is picked from.
+var logResourceKinds = []string{"machine", "volume", "network", "cluster", "key", "script", "schedule", "rule", "zone", "record", "cloud", "team"}
+
+// apiV1Request sends the body, if any, as JSON with a request to version 1
+// of the API, and decodes the response into v, if given.
+func apiV1Request(method, path string, body, v interface{}) error {
+	server, err := getValidServer()
+	if err != nil {
+		return err
+	}
+	token, err := getContextToken()
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(j)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(server, "/")+"/api/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("could not %s %s: %s", strings.ToLower(method), path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// apiV1Get decodes the response of a GET request to version 1 of the API.
+func apiV1Get(path string, v interface{}) error {
+	return apiV1Request("GET", path, nil, v)
+}
+
+// parseDuration parses a duration, which may also be given in days, like
+// 7d.
+func parseDuration(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// parseSince parses the start of a period, given as a timestamp or as a
+// duration before now, like 24h or 7d.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := parseTime(s); err == nil {
+		return t, nil
+	}
+	d, err := parseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q, give a duration like 24h or 7d, or a timestamp", s)
+	}
+	return now.Add(-d), nil
+}
+
+// logEvents fetches every event logged between start and end, newest
+// first.
+func logEvents(start, end time.Time) ([]map[string]interface{}, error) {
+	return auditEvents(start, end, auditFilter{}, 0)
+}
+
+// logRow flattens an event to the columns of the log.
+func logRow(event map[string]interface{}) map[string]string {
+	row := map[string]string{}
+	if t, ok := event["time"].(float64); ok {
+		row["time"] = time.Unix(0, int64(t*float64(time.Second))).UTC().Format(time.RFC3339)
+	}
+	user, _ := event["email"].(string)
+	if user == "" {
+		user, _ = event["user_id"].(string)
+	}
+	row["user"] = user
+	row["action"], _ = event["action"].(string)
+	for _, kind := range logResourceKinds {
+		if id, ok := event[kind+"_id"].(string); ok && id != "" {
+			row["resource"] = kind + " " + id
+			break
+		}
+	}
+	if failed, ok := event["error"]; ok && failed != nil && failed != false && failed != "" {
+		row["error"] = describeValue(failed)
+	}
+	return row
+}
+
+// resourceID returns the id of the resource of the kind given by name or
+// id.
+func resourceID(kind, name string) string {
+	params := viper.New()
+	params.Set("only", "id")
+	_, decoded, _, err := resourceGetControllersMap[kind](name, params)
+	if err != nil {
+		logger.Fatalf("Could not find %s %s: %s", kind, name, err)
+	}
+	data, _ := decoded["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+	if id == "" {
+		return name
+	}
+	return id
+}
+
+// logSeverities are the severities of log events, from the lowest.
+var logSeverities = []string{"info", "warning", "error"}
+
+// logSeverity returns the severity of an event. Events carry none, so
+// failed events are errors, incidents raised by rules warnings and the
+// others info.
+func logSeverity(event map[string]interface{}) string {
+	if failed, ok := event["error"]; ok && failed != nil && failed != false && failed != "" {
+		return "error"
+	}
+	if event["type"] == "incident" {
+		return "warning"
+	}
+	return "info"
+}
+
+func severityLevel(severity string) int {
+	for i, s := range logSeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// logFilter selects events by minimum severity, machine, cloud and text
+// found in any of their fields.
+type logFilter struct {
+	severity string
+	machine  string
+	cloud    string
+	search   string
+}
+
+func (f logFilter) matches(event map[string]interface{}) bool {
+	if severityLevel(logSeverity(event)) < severityLevel(f.severity) {
+		return false
+	}
+	if f.machine != "" && event["machine_id"] != f.machine {
+		return false
+	}
+	if f.cloud != "" && event["cloud_id"] != f.cloud {
+		return false
+	}
+	if f.search != "" {
+		j, _ := json.Marshal(event)
+		return strings.Contains(strings.ToLower(string(j)), strings.ToLower(f.search))
+	}
+	return true
+}
+
+// eventTime returns the time of an event, in seconds.
+func eventTime(event map[string]interface{}) float64 {
+	t, _ := event["time"].(float64)
+	return t
+}
+
+// logWriter writes events one per line, as JSON with -o json to be
+// ingested by other tools, or as columns otherwise.
+type logWriter struct {
+	json bool
+	w    *tabwriter.Writer
+}
+
+func newLogWriter() *logWriter {
+	return &logWriter{
+		json: outputFormat() == "json",
+		w:    tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0),
+	}
+}
+
+func (lw *logWriter) write(event map[string]interface{}) error {
+	if lw.json {
+		line := map[string]interface{}{"severity": logSeverity(event)}
+		for key, value := range event {
+			line[key] = value
+		}
+		j, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(j))
+		return err
+	}
+	row := logRow(event)
+	_, err := fmt.Fprintf(lw.w, "%s\t%s\t%s\t%s\t%s\t%s\n", row["time"], strings.ToUpper(logSeverity(event)), row["user"], row["action"], row["resource"], row["error"])
+	return err
+}
+
+func (lw *logWriter) flush() error {
+	return lw.w.Flush()
+}
+
+// newEvents returns the events not seen already, oldest first. Polls fetch
+// again the events of the second they start from, so it also returns the
+// second of the newest event, or from if there are none, and the events
+// seen in it.
+func newEvents(events []map[string]interface{}, from time.Time, seen map[string]bool) ([]map[string]interface{}, time.Time, map[string]bool) {
+	sort.SliceStable(events, func(i, j int) bool { return eventTime(events[i]) < eventTime(events[j]) })
+	unseen := []map[string]interface{}{}
+	next, nextSeen := from, map[string]bool{}
+	for _, event := range events {
+		j, _ := json.Marshal(event)
+		key := string(j)
+		second := time.Unix(int64(eventTime(event)), 0).UTC()
+		if second.After(next) {
+			next, nextSeen = second, map[string]bool{}
+		}
+		nextSeen[key] = true
+		if !seen[key] {
+			unseen = append(unseen, event)
+		}
+	}
+	return unseen, next, nextSeen
+}
+
+// writeLogs writes the events matching the filter, oldest first, skipping
+// those seen already, and returns where the next poll starts from, as
+// newEvents does.
+func writeLogs(lw *logWriter, events []map[string]interface{}, from time.Time, seen map[string]bool, filter logFilter) (time.Time, map[string]bool) {
+	unseen, next, nextSeen := newEvents(events, from, seen)
+	for _, event := range unseen {
+		if !filter.matches(event) {
+			continue
+		}
+		if err := lw.write(event); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if err := lw.flush(); err != nil {
+		logger.Fatal(err)
+	}
+	return next, nextSeen
+}
+
+func logsCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Show and follow the logs of the organization",
+		Long: `Show the events logged for the organization since --since ago, oldest
+first, and with --follow keep polling for new ones every --interval.
+
+Events are filtered by their minimum severity, error for failed events,
+warning for incidents raised by rules and info for the others, by machine
+or cloud, given by name or id, and by text found in any of their fields
+with --search. With -o json, events are written one per line as JSON, to
+be ingested by other tools.`,
+		Example: `  mist logs --since 1h
+  mist logs --follow --severity error
+  mist logs --machine web-1 --search reboot -o json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			filter := logFilter{
+				severity: params.GetString("severity"),
+				search:   params.GetString("search"),
+			}
+			if severityLevel(filter.severity) < 0 {
+				logger.Fatalf("Unknown severity %s, expected one of %s", filter.severity, strings.Join(logSeverities, ", "))
+			}
+			if machine := params.GetString("machine"); machine != "" {
+				filter.machine = resourceID("machine", machine)
+			}
+			if cloud := params.GetString("cloud"); cloud != "" {
+				filter.cloud = resourceID("cloud", cloud)
+			}
+			interval := params.GetDuration("interval")
+			if interval <= 0 {
+				logger.Fatal("--interval must be positive")
+			}
+			now := time.Now().UTC()
+			start, err := parseSince(params.GetString("since"), now)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			events, err := logEvents(start, now)
+			if err != nil {
+				logger.Fatalf("Could not read the logs: %s", err)
+			}
+			last, seen := writeLogs(newLogWriter(), events, start.Truncate(time.Second), map[string]bool{}, filter)
+			for params.GetBool("follow") {
+				time.Sleep(interval)
+				events, err := logEvents(last, time.Now().UTC())
+				if err != nil {
+					logger.Fatalf("Could not read the logs: %s", err)
+				}
+				last, seen = writeLogs(newLogWriter(), events, last, seen, filter)
+			}
+		},
+	}
+	cmd.Flags().BoolP("follow", "f", false, "Keep polling for new events")
+	cmd.Flags().Duration("interval", 5*time.Second, "How often to poll for new events with --follow")
+	cmd.Flags().String("since", "1h", "Show the events logged since, a duration before now <1h | 7d> or a timestamp <rfc3339 | unix_timestamp>")
+	cmd.Flags().String("severity", "info", "Minimum severity of the events shown: info, warning or error")
+	cmd.Flags().String("machine", "", "Only show the events of the machine, by name or id")
+	cmd.Flags().String("cloud", "", "Only show the events of the cloud, by name or id")
+	cmd.Flags().String("search", "", "Only show the events containing the text")
+	cmd.RegisterFlagCompletionFunc("severity", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return logSeverities, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+func machineAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeMachines(toComplete)
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// waitForSSH polls the machine's SSH action until the websocket handshake
+// succeeds, backing off between attempts until the timeout expires. It
+// fails right away if the API refuses the request.
+func waitForSSH(machine string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 2 * time.Second
+	maxBackoff := 30 * time.Second
+	for {
+		c, err := dialMachineShell(machine)
+		if err == nil {
+			c.Close()
+			return nil
+		}
+		// Refused requests, like for a machine that doesn't exist or with a
+		// rejected token, would fail the same way every time.
+		switch errorExitCode(err) {
+		case exitAuth, exitNotFound, exitInvalidRequest:
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("timed out after %s waiting for SSH: %s", timeout, err)
+		}
+		fmt.Fprintf(os.Stderr, " * SSH not ready yet (%s), retrying in %s\n", err, backoff)
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func machineWaitSSHCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:               "wait-ssh MACHINE",
+		Short:             "Wait until SSH is usable on a machine",
+		Long:              "Blocks until an SSH session can be established to the machine, retrying with backoff until the timeout expires",
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: machineAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := waitForSSH(resolveArg("machine", args[0]), params.GetDuration("timeout")); err != nil {
+				logger.Fatalf("Error waiting: %s", err.Error())
+			}
+			fmt.Printf("Machine %s is reachable over SSH\n", args[0])
+		},
+	}
+	cmd.Flags().Duration("timeout", 5*time.Minute, "Maximum time to wait")
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+// machineMetadataPaths are the locations where providers expose instance
+// metadata or user data on the machine object, in order of preference.
+var machineMetadataPaths = []string{"data.extra.metadata", "data.extra.user_data", "data.extra.userdata"}
+
+func getMachineMetadata(machine string) (interface{}, string, error) {
+	_, decoded, _, err := MistApiV2GetMachine(machine, viper.New())
+	if err != nil {
+		return nil, "", err
+	}
+	for _, path := range machineMetadataPaths {
+		value, err := jmespath.Search(path, decoded)
+		if err == nil && value != nil {
+			return value, path[strings.LastIndex(path, ".")+1:], nil
+		}
+	}
+	return nil, "metadata", nil
+}
+
+func decodeMetadataBlob(blob string) string {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(blob))
+	if err != nil {
+		return blob
+	}
+	return string(decoded)
+}
+
+func formatMachineMetadata(metadata interface{}, params *viper.Viper) {
+	switch t := metadata.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		data := map[string]interface{}{"data": []interface{}{}}
+		for _, key := range keys {
+			data["data"] = append(data["data"].([]interface{}), map[string]interface{}{"key": key, "value": t[key]})
+		}
+		columns := []string{"key", "value"}
+		if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+			logger.Fatalf("Formatting failed: %s", err.Error())
+		}
+	case string:
+		if params.GetBool("decode") {
+			t = decodeMetadataBlob(t)
+		}
+		fmt.Println(t)
+	case nil:
+		fmt.Println("No metadata found")
+	default:
+		if err := cli.Formatter.Format(t, params, cli.CLIOutputOptions{[]string{}, []string{}, []string{}, []string{}, map[string]string{}}); err != nil {
+			logger.Fatalf("Formatting failed: %s", err.Error())
+		}
+	}
+}
+
+func machineMetadataCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "metadata MACHINE",
+		Short: "Show or update machine metadata and user data",
+		Long: `Show or update a machine's metadata or cloud-init user data.
+
+Metadata exposed as a map can be updated key by key with --set. User data
+exposed as a blob is replaced as a whole with --from-file.`,
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: machineAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			machine := resolveArg("machine", args[0])
+			metadata, field, err := getMachineMetadata(machine)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			set := params.GetStringSlice("set")
+			fromFile := params.GetString("from-file")
+			if len(set) == 0 && fromFile == "" {
+				formatMachineMetadata(metadata, params)
+				return
+			}
+			if len(set) > 0 && fromFile != "" {
+				logger.Fatal("--set and --from-file can't be used together")
+			}
+			var updated interface{}
+			if fromFile != "" {
+				content, err := ioutil.ReadFile(fromFile)
+				if err != nil {
+					logger.Fatalf("Could not read file: %s", err.Error())
+				}
+				updated = string(content)
+				if blob, ok := metadata.(string); ok && blob != decodeMetadataBlob(blob) {
+					updated = base64.StdEncoding.EncodeToString(content)
+				}
+			}
+			if len(set) > 0 {
+				current, ok := metadata.(map[string]interface{})
+				if metadata != nil && !ok {
+					logger.Fatalf("The %s of machine %s is not a map, use --from-file to replace it", field, machine)
+				}
+				if current == nil {
+					current = make(map[string]interface{})
+				}
+				for _, pair := range set {
+					kv := strings.SplitN(pair, "=", 2)
+					if len(kv) != 2 || kv[0] == "" {
+						logger.Fatalf("Invalid metadata entry %q, expected key=value", pair)
+					}
+					current[kv[0]] = kv[1]
+				}
+				updated = current
+			}
+			body, err := json.Marshal(map[string]interface{}{field: updated})
+			if err != nil {
+				logger.Fatalf("Error marshalling metadata: %s", err.Error())
+			}
+			if _, _, _, err := MistApiV2EditMachine(machine, params, string(body)); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			metadata, _, err = getMachineMetadata(machine)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			formatMachineMetadata(metadata, params)
+		},
+	}
+	cmd.Flags().StringSlice("set", []string{}, "Set metadata key=value pairs")
+	cmd.Flags().String("from-file", "", "Replace user data with the contents of a file")
+	cmd.Flags().Bool("decode", false, "Decode base64 encoded user data")
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+// machineAction is a lifecycle operation of machines, along with the state
+// machines end up in once it completes.
+type machineAction struct {
+	name        string
+	short       string
+	targetState string
+	run         func(machine string, params *viper.Viper) error
+}
+
+var machineActions = []machineAction{
+	{"start", "Start machines", "running", func(machine string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2StartMachine(machine, params)
+		return err
+	}},
+	{"stop", "Stop machines", "stopped", func(machine string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2StopMachine(machine, params)
+		return err
+	}},
+	{"reboot", "Reboot machines", "running", func(machine string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2RebootMachine(machine, params)
+		return err
+	}},
+	{"destroy", "Destroy machines", "terminated", func(machine string, params *viper.Viper) error {
+		_, _, _, err := MistApiV2DestroyMachine(machine, params)
+		return err
+	}},
+}
+
+// waitForMachineState polls the machine until it is in the state. Machines
+// which are gone count as terminated.
+func waitForMachineState(machine resourceRef, state string, deadline time.Time) error {
+	for {
+		live, err := lookupResource("machine", machine.id)
+		if err != nil {
+			return err
+		}
+		current := "terminated"
+		if live != nil {
+			current, _ = live["state"].(string)
+		}
+		if current == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s to be %s, it is %s", machine.name, state, current)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func machineActionCmd(action machineAction) *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   action.name + " [MACHINE...]",
+		Short: action.short,
+		Long: fmt.Sprintf(`%s given by name or id, or all machines matching --search.
+
+With --wait, the command returns once every machine is %s.`, action.short, action.targetState),
+		Example: fmt.Sprintf("  %[1]s machine %[2]s web-1 web-2 --wait\n  %[1]s machine %[2]s --search 'tag:staging'", cli.Root.CommandPath(), action.name),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return machineAutocomplete(cmd, nil, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			machines, err := resolveResources("machine", args, params.GetString("search"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if len(machines) == 0 {
+				logger.Fatal("No machines given, give machine names or use --search")
+			}
+			resultFile := params.GetString("result-file")
+			result := newOperationResult()
+			if action.name == "destroy" && !params.GetBool("yes") {
+				if !term.IsTerminal(int(os.Stdin.Fd())) {
+					logger.Fatal("Refusing to destroy machines without confirmation, use --yes")
+				}
+				for _, machine := range machines {
+					fmt.Printf(" * %s (%s)\n", machine.name, machine.id)
+				}
+				if !confirmAction("Destroy", len(machines), "machine") {
+					fmt.Println("Cancelled")
+					for _, machine := range machines {
+						result.skip("machine/" + machine.name)
+					}
+					result.write(resultFile, 0)
+					return
+				}
+			}
+			failed := 0
+			started := []resourceRef{}
+			for _, machine := range machines {
+				if err := action.run(machine.id, viper.New()); err != nil {
+					fmt.Fprintf(os.Stderr, " * %s: could not %s: %s\n", machine.name, action.name, err)
+					result.fail("machine/"+machine.name, err)
+					failed++
+					continue
+				}
+				started = append(started, machine)
+				fmt.Printf(" * %s: %s requested\n", machine.name, action.name)
+			}
+			if params.GetBool("wait") {
+				deadline := time.Now().Add(params.GetDuration("timeout"))
+				for _, machine := range started {
+					if err := waitForMachineState(machine, action.targetState, deadline); err != nil {
+						fmt.Fprintf(os.Stderr, " * %s: %s\n", machine.name, err)
+						result.fail("machine/"+machine.name, err)
+						failed++
+						continue
+					}
+					result.succeed("machine/" + machine.name)
+					fmt.Printf(" * %s: %s\n", machine.name, action.targetState)
+				}
+			} else {
+				for _, machine := range started {
+					result.succeed("machine/" + machine.name)
+				}
+			}
+			if failed > 0 {
+				result.write(resultFile, 1)
+				os.Exit(1)
+			}
+			result.write(resultFile, 0)
+		},
+	}
+	cmd.Flags().String("search", "", "Act on the machines matching the search query")
+	cmd.Flags().Bool("wait", false, "Wait until every machine is "+action.targetState)
+	cmd.Flags().Duration("timeout", 10*time.Minute, "Maximum time to wait with --wait")
+	cmd.Flags().String("result-file", "", "Write a JSON summary of the outcome on every machine to a file")
+	if action.name == "destroy" {
+		cmd.Flags().BoolP("yes", "y", false, "Destroy without asking for confirmation")
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func machineCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "machine",
+		Aliases: []string{"machines"},
+		Short:   "Machine operations",
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.AddCommand(machineWaitSSHCmd())
+	cmd.AddCommand(machineMetadataCmd())
+	cmd.AddCommand(machineScpMultiCmd())
+	cmd.AddCommand(machineDfCmd())
+	cmd.AddCommand(machineResizeCmd())
+	cmd.AddCommand(machineExpireCmd())
+	cmd.AddCommand(machineExtendCmd())
+	cmd.AddCommand(machineExpiringCmd())
+	cmd.AddCommand(assignCmd("machine"))
+	for _, action := range machineActions {
+		cmd.AddCommand(machineActionCmd(action))
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -9,22 +9,22 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/containerd/console"
 	"github.com/gorilla/websocket"
-	"github.com/jmespath/go-jmespath"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	trie "github.com/v-pap/trie"
 	"gitlab.ops.mist.io/mistio/openapi-cli-generator/apikey"
 	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
-	terminal "golang.org/x/term"
 )
 
-var logger = log.New(os.Stdout, "", 0)
+var logger = &errorLogger{log.New(os.Stdout, "", 0)}
 
 // completionCmd represents the completion command
 var completionCmd = &cobra.Command{
@@ -60,20 +60,33 @@ $ mist completion fish | source
 
 # To load completions for each session, execute once:
 $ mist completion fish > ~/.config/fish/completions/mist.fish
+
+Use --no-descriptions to generate zsh, fish or PowerShell completions without
+descriptions, if your shell renders them poorly. Bash completions have none.
 `,
 	DisableFlagsInUseLine: true,
 	ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
 	Args:                  cobra.ExactValidArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		noDescriptions, _ := cmd.Flags().GetBool("no-descriptions")
 		switch args[0] {
 		case "bash":
+			// The bash script never has descriptions.
 			cmd.Root().GenBashCompletion(os.Stdout)
 		case "zsh":
-			cmd.Root().GenZshCompletion(os.Stdout)
+			if noDescriptions {
+				cmd.Root().GenZshCompletionNoDesc(os.Stdout)
+			} else {
+				cmd.Root().GenZshCompletion(os.Stdout)
+			}
 		case "fish":
-			cmd.Root().GenFishCompletion(os.Stdout, true)
+			cmd.Root().GenFishCompletion(os.Stdout, !noDescriptions)
 		case "powershell":
-			cmd.Root().GenPowerShellCompletion(os.Stdout)
+			if noDescriptions {
+				cmd.Root().GenPowerShellCompletion(os.Stdout)
+			} else {
+				cmd.Root().GenPowerShellCompletionWithDesc(os.Stdout)
+			}
 		}
 	},
 }
@@ -130,7 +143,7 @@ func customUsageFunc(c *cobra.Command) error {
 	if err != nil {
 		return err
 	}
-	server, err := getServer()
+	server, err := getValidServer()
 	if err != nil {
 		return err
 	}
@@ -141,12 +154,36 @@ func customUsageFunc(c *cobra.Command) error {
 	return nil
 }
 
+// cliVersion is set by the CI when building releases.
+const cliVersion = "$CLI_VERSION"
+
 func versionCmd() *cobra.Command {
+	params := viper.New()
 	cmd := &cobra.Command{
 		Use:   "version",
 		Short: "Get CLI & API version",
-		Args:  cobra.ExactValidArgs(0),
+		Long: `Get the version of the CLI and of the Mist API. With --check, check
+whether a newer release is available on the update channel instead.`,
+		Example: `  mist version
+  mist version --check --channel beta`,
+		Args: cobra.ExactValidArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
+			if params.GetBool("check") {
+				channel, err := updateChannel(params)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				latest, err := latestRelease(channel)
+				if err != nil {
+					logger.Fatalf("Error checking for updates: %s", err)
+				}
+				message, newer := describeUpdate(latest, channel)
+				fmt.Println(message)
+				if newer {
+					os.Exit(exitError)
+				}
+				return
+			}
 			type version struct {
 				Sha      string `json:"sha"`
 				Name     string `json:"name"`
@@ -158,28 +195,24 @@ func versionCmd() *cobra.Command {
 			}
 			err := setContext()
 			if err != nil {
-				fmt.Println(err)
-				return
+				logger.Fatal(err)
 			}
-			server, err := getServer()
+			server, err := getValidServer()
 			if err != nil {
-				fmt.Println(err)
-				return
+				logger.Fatal(err)
 			}
 			url := server + "/version"
 			req := cli.Client.Get().URL(url)
 			resp, err := req.Do()
 			if err != nil {
-				fmt.Println(err)
-				return
+				logger.Fatal(err)
 			}
 			var ver versionResp
 			err = resp.JSON(&ver)
 			if err != nil {
-				fmt.Println(err)
-				return
+				logger.Fatal(err)
 			}
-			fmt.Println("CLI version: $CLI_VERSION")
+			fmt.Println("CLI version: " + cliVersion)
 			fmt.Printf("Server version: %s - %s#%s", ver.Version.Name, ver.Version.Repo, ver.Version.Sha)
 			if ver.Version.Modified {
 				fmt.Printf(" modified")
@@ -187,123 +220,404 @@ func versionCmd() *cobra.Command {
 			fmt.Println("")
 		},
 	}
+	cmd.Flags().Bool("check", false, "Check whether a newer release is available, exiting with 1 if so")
+	cmd.Flags().String("channel", "", "Release channel to check: stable or beta")
+	cmd.RegisterFlagCompletionFunc("channel", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return updateChannels, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
 	return cmd
 }
 
-func sshCmd() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:   "ssh",
-		Short: "Open a shell to a machine",
-		Args:  cobra.ExactValidArgs(1),
-		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+// machineActionLocation requests the action of the machine, which answers
+// with a redirect to where it is served, and returns the location along with
+// the token to connect to it with.
+func machineActionLocation(machine, action, description string) (string, string, error) {
+	err := setContext()
+	if err != nil {
+		return "", "", fmt.Errorf("Could not set context %s", err)
+	}
+	server, err := getValidServer()
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.HasSuffix(server, "/") {
+		server = server + "/"
+	}
+	path := server + "api/v2/machines/" + machine + "/actions/" + action
+	client, err := httpClient()
+	if err != nil {
+		return "", "", err
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	req, err := http.NewRequest("POST", path, nil)
+	if err != nil {
+		return "", "", err
+	}
+	token, err := validContextToken()
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Add("Authorization", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	recordServerDate(resp.Header)
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", "", rejectedTokenError(token)
+	}
+	if resp.StatusCode/100 != 3 {
+		return "", "", actionStatusError{description, resp.Status, resp.StatusCode}
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return resp.Header.Get("location"), token, nil
+}
 
-			if len(args) == 0 {
-				params := viper.New()
-				params.Set("only", "name")
-				params.Set("search", "key_associations:true AND state:running")
-				var decoded interface{}
-				_, decoded, _, err := MistApiV2ListMachines(params)
-				if err != nil {
-					logger.Fatalf("Error calling operation: %s", err.Error())
-				}
-				data, _ := jmespath.Search("data[].name", decoded)
-				j, _ := json.Marshal(data)
-				str := strings.Replace(strings.Replace(strings.Replace(string(j[:]), "[", "", -1), "]", "", -1), " ", "\\ ", -1)
-				return strings.Split(str, ","), cobra.ShellCompDirectiveNoFileComp
-			}
-			return nil, cobra.ShellCompDirectiveNoFileComp
-		},
-		Run: func(cmd *cobra.Command, args []string) {
-			machine := args[0]
-			// Time allowed to write a message to the peer.
-			writeWait := 2 * time.Second
+// actionStatusError is the status of a machine action the API refused.
+type actionStatusError struct {
+	description string
+	status      string
+	code        int
+}
 
-			// Time allowed to read the next pong message from the peer.
-			pongWait := 10 * time.Second
+func (e actionStatusError) Error() string {
+	return fmt.Sprintf("Could not %s: %s", e.description, e.status)
+}
 
-			// Send pings to peer with this period. Must be less than pongWait.
-			pingPeriod := (pongWait * 9) / 10
+func (e actionStatusError) ExitCode() int {
+	return statusExitCode(e.code)
+}
 
-			err := setContext()
-			if err != nil {
-				logger.Fatalf("Could not set context %s", err)
-			}
-			server, err := getServer()
-			if err != nil {
-				logger.Fatal(err)
-			}
-			if !strings.HasSuffix(server, "/") {
-				server = server + "/"
-			}
-			if !strings.HasPrefix(server, "http") {
-				server = "http://" + server
+// dialActionSocket connects to the websocket an action redirected to.
+func dialActionSocket(location, token, description string) (*websocket.Conn, error) {
+	dialer, err := websocketDialer()
+	if err != nil {
+		return nil, err
+	}
+	c, resp, err := dialer.Dial(location, http.Header{"Authorization": []string{token}})
+	if err != nil {
+		return nil, err
+	}
+	// Handle the case of redirections
+	if resp != nil && resp.StatusCode == 302 {
+		u, _ := resp.Location()
+		c, resp, err = dialer.Dial(u.String(), http.Header{"Authorization": []string{token}})
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 2 {
+			c.Close()
+			return nil, fmt.Errorf("Could not %s: %s", description, resp.Status)
+		}
+	}
+	return c, nil
+}
+
+// dialMachineShell requests an SSH session for the given machine and
+// returns the websocket connection to its shell.
+func dialMachineShell(machine string) (*websocket.Conn, error) {
+	location, token, err := machineActionLocation(machine, "ssh", "SSH into machine")
+	if err != nil {
+		return nil, err
+	}
+	return dialActionSocket(location, token, "SSH into machine")
+}
+
+// completeMachines completes the names of the machines matching the search
+// query.
+func completeMachines(search string) ([]string, cobra.ShellCompDirective) {
+	params := viper.New()
+	params.Set("search", search)
+	params.Set("only", "name")
+	_, decoded, _, err := MistApiV2ListMachines(params)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, item := range responseItems(decoded) {
+		if name, _ := item["name"].(string); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+func sshAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeMachines("key_associations:true AND state:running")
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// interactiveShell attaches the terminal to a shell on the machine until
+// the shell exits. Lost connections are reconnected to a new shell, with up
+// to ssh_reconnect attempts.
+func interactiveShell(machine string) {
+	c, err := dialMachineShell(machine)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	keepalive := viper.GetDuration("ssh_keepalive")
+	if keepalive <= 0 {
+		keepalive = defaultKeepalive
+	}
+	restore := rawTerminal()
+	for {
+		if shellStartup != "" {
+			c.WriteMessage(websocket.BinaryMessage, append([]byte{0}, shellStartup...))
+		}
+		lost := attachConnection(c, keepalive)
+		c.Close()
+		if lost == nil {
+			break
+		}
+		if c, err = reconnectShell(machine, lost, viper.GetInt("ssh_reconnect")); err != nil {
+			restore()
+			logger.Fatalf("Connection to %s lost: %s", machine, err)
+		}
+	}
+	restore()
+}
+
+// retryConnection calls connect until it succeeds, up to attempts times,
+// waiting longer after every failed attempt, and reports every attempt. It
+// returns the last error if all failed.
+func retryConnection(attempts int, lost error, report func(lost error, attempt int), connect func() error) error {
+	delay := time.Second
+	for attempt := 1; attempt <= attempts; attempt++ {
+		report(lost, attempt)
+		time.Sleep(delay)
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		lost = err
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+	return lost
+}
+
+// reconnectShell connects to a new shell on the machine after the
+// connection was lost, waiting longer after every failed attempt, and shows
+// how it goes on a status line.
+func reconnectShell(machine string, lost error, attempts int) (*websocket.Conn, error) {
+	var c *websocket.Conn
+	err := retryConnection(attempts, lost, func(lost error, attempt int) {
+		fmt.Fprintf(os.Stderr, "\r\n[Connection lost: %s. Reconnecting, attempt %d of %d...]\r\n", lost, attempt, attempts)
+	}, func() error {
+		var err error
+		c, err = dialMachineShell(machine)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(os.Stderr, "[Reconnected to a new shell]\r\n")
+	return c, nil
+}
+
+// attachTerminal attaches the terminal to the websocket of a remote
+// terminal until it is closed.
+func attachTerminal(c *websocket.Conn) {
+	restore := rawTerminal()
+	err := attachConnection(c, defaultKeepalive)
+	restore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Connection lost: %s\n", err)
+	}
+}
+
+func sshCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ssh MACHINE [-- COMMAND...]",
+		Short: "Open a shell to a machine",
+		Long: `Open a shell to a machine.
+
+If a command is given after --, it is run non-interactively instead. Its
+stdout and stderr are streamed to the local stdout and stderr, and mist exits
+with the command's exit code.
+
+Ports can be forwarded with -L and -R, which take the same
+[BIND_ADDRESS:]PORT:HOST:HOSTPORT arguments as ssh. Forwarded connections are
+made with nc on the machine, or bash if nc is not installed. Remote forwards
+accept one connection at a time. When the connection to the machine is
+lost, local forwards close their connections and keep listening while
+reconnecting, like shells do.
+
+With --stdio, stdin and stdout are connected to the SSH server of the
+machine instead, on --port, without a terminal. This makes mist ssh a
+ProxyCommand for OpenSSH, so that scp, rsync, sftp and agent forwarding
+work through Mist with the usual tools. ssh-config --gateway writes it in
+the stanzas it generates.
+
+With --record, the output of the shell is recorded with its timing to an
+asciicast file, which replay or asciinema play back. What is typed is only
+recorded as far as the shell echoes it, so passwords are left out.
+
+With -A, the local SSH agent is forwarded to a socket on the machine, which
+SSH_AUTH_SOCK points to in the shell or command, so that it can connect to
+other hosts with the keys of the agent. The socket is served with socat or
+the OpenBSD nc on the machine, one connection at a time. ssh --stdio
+works with the -A of OpenSSH itself, and cp-key copies a key to a machine
+instead.
+
+With --broadcast, shells are opened on all the machines given or matching
+--search, and every line typed is sent to all of them, Ctrl-C included.
+Their output is shown line by line, prefixed with the machine it came from,
+so full screen programs like editors can't be used.
+
+Escape sequences pass through unchanged, so the machine can set the local
+clipboard with OSC 52, set the title of the window and use bracketed paste.
+Since anything printed on the machine can use them, e.g. the contents of a
+file, they can be disabled with --no-clipboard, --no-title and
+--no-bracketed-paste, or with ssh_no_clipboard, ssh_no_title and
+ssh_no_bracketed_paste in the config file.
+
+Shells are pinged every --keepalive, and lost connections are retried
+--reconnect times, waiting longer after every attempt. The API can't resume
+a shell, so a reconnected shell is a new one: run long tasks in tmux or
+screen to get back to them. The ssh_keepalive and ssh_reconnect settings
+of the config file change the defaults.`,
+		Example: `  mist ssh web-1
+  mist ssh web-1 -- systemctl is-active nginx
+  mist ssh web-1 -N -L 8080:localhost:80
+  mist ssh bastion -A
+  ssh -o ProxyCommand='mist ssh --stdio --port %p web-1' ubuntu@web-1
+  mist ssh web-1 --record session.cast
+  mist ssh --broadcast --search 'tag:web'`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if broadcast, _ := cmd.Flags().GetBool("broadcast"); broadcast {
+				if cmd.ArgsLenAtDash() >= 0 {
+					return fmt.Errorf("--broadcast opens shells, use exec to run a command on many machines")
+				}
+				return nil
 			}
-			path := server + "api/v2/machines/" + machine + "/actions/ssh"
-			client := &http.Client{
-				CheckRedirect: func(req *http.Request, via []*http.Request) error {
-					return http.ErrUseLastResponse
-				}}
-			req, err := http.NewRequest("POST", path, nil)
-			if err != nil {
-				logger.Fatal(err)
+			if cmd.Flags().Changed("search") {
+				return fmt.Errorf("--search selects the machines of --broadcast")
 			}
-			token, err := getToken()
-			if err != nil {
-				logger.Fatal(err)
+			if len(args) == 0 {
+				return fmt.Errorf("requires a machine")
 			}
-			req.Header.Add("Authorization", token)
-			if err != nil {
-				logger.Fatal(err)
+			if len(args) > 1 && cmd.ArgsLenAtDash() != 1 {
+				return fmt.Errorf("the command to run must follow --")
 			}
-			resp, err := client.Do(req)
-			if err != nil {
-				logger.Fatal(err)
+			return nil
+		},
+		ValidArgsFunction: sshAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			if broadcast, _ := cmd.Flags().GetBool("broadcast"); broadcast {
+				for _, flag := range []string{"local-forward", "remote-forward", "no-shell", "stdio", "record", "forward-agent"} {
+					if cmd.Flags().Changed(flag) {
+						logger.Fatalf("--broadcast can't be combined with --%s", flag)
+					}
+				}
+				machines := args
+				if search, _ := cmd.Flags().GetString("search"); search != "" {
+					found, err := searchMachines(search)
+					if err != nil {
+						logger.Fatalf("Error calling operation: %s", err.Error())
+					}
+					machines = append(machines, found...)
+				}
+				machines = uniqueStrings(machines)
+				if len(machines) == 0 {
+					logger.Fatal("No machines to broadcast to, give machine names or use --search")
+				}
+				broadcastShell(machines)
+				return
 			}
-			defer resp.Body.Close()
-			if resp.StatusCode/100 != 3 {
-				logger.Fatalf("Could not SSH into machine: %s", resp.Status)
+			machine := resolveArg("machine", args[0])
+			localForwards, _ := cmd.Flags().GetStringArray("local-forward")
+			remoteForwards, _ := cmd.Flags().GetStringArray("remote-forward")
+			record, _ := cmd.Flags().GetString("record")
+			if stdio, _ := cmd.Flags().GetBool("stdio"); stdio {
+				noShell, _ := cmd.Flags().GetBool("no-shell")
+				forward, _ := cmd.Flags().GetBool("forward-agent")
+				if len(args) > 1 || len(localForwards) > 0 || len(remoteForwards) > 0 || noShell || record != "" || forward {
+					logger.Fatal("--stdio can't be combined with a command, -L, -R, -N, -A or --record")
+				}
+				port, _ := cmd.Flags().GetInt("port")
+				if port <= 0 || port > 65535 {
+					logger.Fatalf("Invalid port %d", port)
+				}
+				// Stdout carries the connection, so errors go to stderr.
+				if err := forwardStdio(machine, strconv.Itoa(port)); err != nil {
+					fmt.Fprintf(os.Stderr, "Could not connect to %s: %s\n", args[0], err)
+					os.Exit(errorExitCode(err))
+				}
+				return
 			}
-			_, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
+			if err := startPortForwards(machine, localForwards, remoteForwards); err != nil {
 				logger.Fatal(err)
 			}
-			location := resp.Header.Get("location")
-			c, resp, err := websocket.DefaultDialer.Dial(location, http.Header{"Authorization": []string{token}})
-			if err != nil {
-				logger.Fatal(err)
+			if record != "" && len(args) > 1 {
+				logger.Fatal("--record only records interactive shells, not commands")
 			}
-			// Handle the case of redirections
-			if resp != nil && resp.StatusCode == 302 {
-				u, _ := resp.Location()
-				c, resp, err = websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": []string{token}})
-				if err != nil || resp.StatusCode/100 != 2 {
+			command := strings.Join(args[1:], " ")
+			if forward, _ := cmd.Flags().GetBool("forward-agent"); forward {
+				socket, err := forwardAgent(machine)
+				if err != nil {
 					logger.Fatal(err)
 				}
+				// A leading space keeps it out of the history of most shells.
+				shellStartup = " export SSH_AUTH_SOCK=" + socket + "\n"
+				command = "export SSH_AUTH_SOCK=" + socket + "; " + command
 			}
-			defer c.Close()
-			current := console.Current()
-			if err := current.SetRaw(); err != nil {
-				logger.Fatal(err)
+			if len(args) > 1 {
+				os.Exit(runRemoteCommand(machine, command))
 			}
-			terminal.NewTerminal(current, "")
-			defer current.Reset()
-			done := make(chan bool)
-
-			var writeMutex sync.Mutex
-
-			err = updateTerminalSize(c, &writeMutex, writeWait)
-			if err != nil {
-				logger.Fatal(err)
+			if noShell, _ := cmd.Flags().GetBool("no-shell"); noShell {
+				fmt.Fprintln(os.Stderr, "Forwarding ports, press Ctrl-C to stop")
+				sigc := make(chan os.Signal, 1)
+				signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+				<-sigc
+				return
 			}
-
-			go handleTerminalResize(c, &done, &writeMutex, writeWait)
-			go readFromRemoteStdout(c, &done, pongWait)
-			go writeToRemoteStdin(c, &done, &writeMutex, writeWait)
-			go sendPingMessages(c, &done, writeWait, pingPeriod)
-
-			<-done
+			if record != "" {
+				recorder, err := newSessionRecorder(record, "mist ssh "+args[0])
+				if err != nil {
+					logger.Fatalf("Could not record the session: %s", err.Error())
+				}
+				activeRecorder = recorder
+				defer recorder.Close()
+			}
+			interactiveShell(machine)
 		},
 	}
+	cmd.Flags().StringArrayP("local-forward", "L", []string{}, "Forward a local port to a host and port reachable from the machine")
+	cmd.Flags().StringArrayP("remote-forward", "R", []string{}, "Forward a port of the machine to a local host and port")
+	cmd.Flags().BoolP("no-shell", "N", false, "Only forward ports, without opening a shell")
+	cmd.Flags().BoolP("forward-agent", "A", false, "Forward the local SSH agent, for connecting from the machine to other hosts")
+	cmd.Flags().Bool("stdio", false, "Connect stdin and stdout to the SSH server of the machine, for use as a ProxyCommand")
+	cmd.Flags().Int("port", 22, "Port of the SSH server to connect to with --stdio")
+	cmd.Flags().String("record", "", "Record the session to this asciicast file, to play back with replay")
+	cmd.Flags().Bool("broadcast", false, "Open shells on several machines and send every line typed to all of them")
+	cmd.Flags().String("search", "", "Broadcast to the machines matching the search query")
+	cmd.Flags().Duration("keepalive", defaultKeepalive, "How often to ping the shell to keep it open and notice lost connections")
+	cmd.Flags().Int("reconnect", 5, "How many times to try reconnecting a lost shell, 0 to exit instead")
+	cmd.Flags().Bool("no-clipboard", false, "Keep the machine from setting the local clipboard with OSC 52")
+	cmd.Flags().Bool("no-title", false, "Keep the machine from setting the title of the terminal window")
+	cmd.Flags().Bool("no-bracketed-paste", false, "Keep the machine from enabling bracketed paste")
+	viper.BindPFlag("ssh_keepalive", cmd.Flags().Lookup("keepalive"))
+	viper.BindPFlag("ssh_reconnect", cmd.Flags().Lookup("reconnect"))
+	viper.BindPFlag("ssh_no_clipboard", cmd.Flags().Lookup("no-clipboard"))
+	viper.BindPFlag("ssh_no_title", cmd.Flags().Lookup("no-title"))
+	viper.BindPFlag("ssh_no_bracketed_paste", cmd.Flags().Lookup("no-bracketed-paste"))
 	cmd.SetErr(os.Stderr)
 	return cmd
 }
@@ -327,48 +641,42 @@ func streamingCmd() *cobra.Command {
 			// Send pings to peer with this period. Must be less than pongWait.
 			pingPeriod := (10 * time.Second * 9) / 10
 
-			server, err := getServer()
+			server, err := getValidServer()
 			if err != nil {
-				logger.Println(err)
-				return
+				logger.Fatal(err)
 			}
 			if !strings.HasSuffix(server, "/") {
 				server = server + "/"
 			}
-			if !strings.HasPrefix(server, "http") {
-				server = "http://" + server
-			}
 			path := server + "api/v2/jobs/" + job_id
-			client := &http.Client{
-				CheckRedirect: func(req *http.Request, via []*http.Request) error {
-					return http.ErrUseLastResponse
-				}}
+			client, err := httpClient()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
 			req, err := http.NewRequest("GET", path, nil)
 			if err != nil {
-				logger.Println(err)
-				return
+				logger.Fatal(err)
 			}
-			token, err := getToken()
+			token, err := validContextToken()
 			if err != nil {
-				logger.Println(err)
-				return
+				logger.Fatal(err)
 			}
 			req.Header.Add("Authorization", token)
 			if err != nil {
-				logger.Println(err)
-				return
+				logger.Fatal(err)
 			}
 			resp, err := client.Do(req)
 			if err != nil {
-				logger.Println(err)
-				return
+				logger.Fatal(err)
 			}
 			var r any
 			decoder := json.NewDecoder(resp.Body)
 			err = decoder.Decode(&r)
 			if err != nil {
-				logger.Println(err)
-				return
+				logger.Fatal(err)
 			}
 			data, data_exists := r.(map[string]any)["data"]
 			var location string
@@ -383,27 +691,24 @@ func streamingCmd() *cobra.Command {
 				logger.Fatal(errors.New("api response for given JOB_ID does not contain any data"))
 			}
 			defer resp.Body.Close()
-			c, resp, err := websocket.DefaultDialer.Dial(location, http.Header{"Authorization": []string{token}})
+			dialer, err := websocketDialer()
 			if err != nil {
-				logger.Println(err)
-				return
+				logger.Fatal(err)
+			}
+			c, resp, err := dialer.Dial(location, http.Header{"Authorization": []string{token}})
+			if err != nil {
+				logger.Fatal(err)
 			}
 			if resp != nil && resp.StatusCode == 302 {
 				u, _ := resp.Location()
-				c, resp, err = websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": []string{token}})
+				c, resp, err = dialer.Dial(u.String(), http.Header{"Authorization": []string{token}})
 			}
 			defer c.Close()
 			if err != nil {
-				logger.Println(err)
-				return
+				logger.Fatal(err)
 			}
 
-			current := console.Current()
-			if err := current.SetRaw(); err != nil {
-				panic(err)
-			}
-			terminal.NewTerminal(current, "")
-			defer current.Reset()
+			defer rawTerminal()()
 			done := make(chan bool)
 
 			var writeMutex sync.Mutex
@@ -441,15 +746,54 @@ func getResourceMeterCmdRun(params *viper.Viper, resource string, detailedName b
 	if dtEnd == "" {
 		dtEnd = fmt.Sprintf("%d", (time.Now()).Unix())
 	}
-	_, resourceMetricsStart, _ := getMeteringData(dtStart, dtEnd, params.GetString("search"), fmt.Sprintf("first_over_time({metering=\"true\",%s_id=~\".+\"}", resource)+"[%ds])")
-	metricsSet, resourceMetricsEnd, resourceNames := getMeteringData(dtStart, dtEnd, params.GetString("search"), fmt.Sprintf("last_over_time({metering=\"true\",%s_id=~\".+\"}", resource)+"[%ds])")
+	gateway := params.GetString("push-gateway")
+
+	if params.GetBool("sparkline") {
+		if gateway != "" {
+			logger.Fatal("--push-gateway can't be used with --sparkline")
+		}
+		start, err := parseTime(dtStart)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		end, err := parseTime(dtEnd)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		formatMeteringSparklines(start, end, params.GetString("search"), resource, detailedName)
+		return
+	}
+	if granularity := params.GetString("granularity"); granularity != "" {
+		if gateway != "" {
+			logger.Fatal("--push-gateway can't be used with --granularity")
+		}
+		bucket, err := parseGranularity(granularity)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		start, err := parseTime(dtStart)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		end, err := parseTime(dtEnd)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		formatBucketedMeteringData(start, end, bucket, params.GetString("search"), resource, detailedName)
+		return
+	}
+	metricsSet, machineMetricsGauges, resourceNames := resourceMetering(dtStart, dtEnd, params.GetString("search"), resource)
 	if detailedName {
 		for resourceID, name := range resourceNames {
 			resourceNames[resourceID] = resource + "/" + name
 		}
 	}
-	machineMetricsGauges := calculateDiffs(resourceMetricsStart, resourceMetricsEnd, metricsSet)
-	formatMeteringData(metricsSet, machineMetricsGauges, resourceNames)
+	formatMeteringData(resource, metricsSet, machineMetricsGauges, resourceNames)
+	if gateway != "" {
+		if err := pushMetering(gateway, params.GetString("push-job"), resource, metricsSet, machineMetricsGauges, resourceNames); err != nil {
+			logger.Fatalf("Could not push metering data: %s", err.Error())
+		}
+	}
 }
 
 func getResourceMeterCmd(resource string, aliasesMap map[string][]string, detailedName bool) *cobra.Command {
@@ -466,6 +810,10 @@ func getResourceMeterCmd(resource string, aliasesMap map[string][]string, detail
 	cmd.Flags().String("start", "", "start <rfc3339 | unix_timestamp>")
 	cmd.Flags().String("end", "", "end <rfc3339 | unix_timestamp>")
 	cmd.Flags().String("search", "", "Only return results matching search filter")
+	cmd.Flags().Bool("sparkline", false, "Show the trend of each metric across the period as a sparkline")
+	cmd.Flags().String("granularity", "", "Split the period in windows of this length, like 1h or 1d, with a row per resource per window")
+	cmd.Flags().String("push-gateway", "", "Also push the usage to the Prometheus push gateway at this URL")
+	cmd.Flags().String("push-job", "mist_metering", "Job label of the usage pushed with --push-gateway")
 
 	cli.SetCustomFlags(cmd)
 
@@ -481,8 +829,20 @@ func getAllResourcesMeterCmd(resources []string, aliasesMap map[string][]string)
 		Use:     "all",
 		Aliases: aliasesMap["all"],
 		Short:   "Get metering data for all resources",
+		Long: `Get metering data for all resources, in a table per kind of resource.
+With --resource-type, only the given kinds of resources are reported.`,
+		Example: "  mist meter all --resource-type volume,network",
 		Args:    cobra.ExactValidArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
+			resources := resources
+			if types := params.GetStringSlice("resource-type"); len(types) > 0 {
+				for _, resource := range types {
+					if _, ok := meteringResourceLists[resource]; !ok {
+						logger.Fatalf("Invalid --resource-type %q, expected one of %s", resource, strings.Join(meteringResourceTypes, ", "))
+					}
+				}
+				resources = types
+			}
 			for i, resource := range resources {
 				getResourceMeterCmdRun(params, resource, true)
 				if i != len(resources)-1 {
@@ -494,6 +854,11 @@ func getAllResourcesMeterCmd(resources []string, aliasesMap map[string][]string)
 	cmd.Flags().String("start", "", "start <rfc3339 | unix_timestamp>")
 	cmd.Flags().String("end", "", "end <rfc3339 | unix_timestamp>")
 	cmd.Flags().String("search", "", "Only return results matching search filter")
+	cmd.Flags().Bool("sparkline", false, "Show the trend of each metric across the period as a sparkline")
+	cmd.Flags().String("granularity", "", "Split the period in windows of this length, like 1h or 1d, with a row per resource per window")
+	cmd.Flags().String("push-gateway", "", "Also push the usage to the Prometheus push gateway at this URL")
+	cmd.Flags().String("push-job", "mist_metering", "Job label of the usage pushed with --push-gateway")
+	cmd.Flags().StringSlice("resource-type", []string{}, fmt.Sprintf("Only report these kinds of resources, of %s", strings.Join(resources, ", ")))
 
 	cli.SetCustomFlags(cmd)
 
@@ -528,7 +893,7 @@ func meterCmd() *cobra.Command {
 			return nil, cobra.ShellCompDirectiveNoFileComp
 		},
 	}
-	resources := []string{"machine", "volume"}
+	resources := meteringResourceTypes
 	resourcesTrie := trie.New()
 	aliasesMap := make(map[string][]string)
 	for _, resource := range append(resources, []string{"all"}...) {
@@ -557,9 +922,42 @@ func main() {
 	})
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	// Load an alternate config file if one was given
+	initConfigFlag()
+
+	// Add support for extra output formats
+	initOutputFormatter()
+
+	// Show times in tables relative to now or as local timestamps
+	initTimeDisplay()
+
 	// Initialize the API key authentication.
 	apikey.Init("Authorization", apikey.LocationHeader)
 
+	// Validate the server URL before making requests
+	initServerValidation()
+	initOnlyExpressions()
+
+	// Log the requests made with -v, --debug and --trace-file
+	initDebug()
+
+	// Exit with codes telling why requests failed
+	initErrorTracking()
+
+	// Detect expired tokens before making requests
+	initCredentialStore()
+	initOrgs()
+	initTokenChecks()
+
+	// Connect through proxies and trust custom CA certificates
+	initTransport()
+
+	// Time out and retry requests failing temporarily
+	initRetries()
+
+	// Serve listings and completions from the response cache
+	initResponseCache()
+
 	// Add command groups
 	/*cli.Root.AddGroup(&cobra.Group{Group: "clouds", Title: "  # CLOUDS"})
 	cli.Root.AddGroup(&cobra.Group{Group: "machines", Title: "  # MACHINES"})
@@ -574,26 +972,203 @@ func main() {
 	cli.Root.AddGroup(&cobra.Group{Group: "teams", Title: "  # TEAMS"})*/
 
 	// Add completion command
+	completionCmd.Flags().Bool("no-descriptions", false, "Generate completions without descriptions")
 	cli.Root.AddCommand(completionCmd)
 
 	// Register auto-generated commands
 	mistApiV2Register(false)
 
+	// Show the values of records with get records
+	initRecordCmds()
+
+	// Add --page and --all to the commands listing resources
+	initPagination()
+
+	// Add client-side filters to the commands listing resources
+	initClientFilters()
+
+	// Add --watch to the commands showing resources
+	initWatchFlags()
+
+	// List many kinds of resources at once with get all
+	initGetAll()
+
+	// Make delete commands accept many resources
+	initDeleteCmds()
+
+	// Accept names and unique prefixes for the resources in arguments
+	initResolveArgs()
+
+	// Add --wait to the commands changing resources
+	initJobWaitFlags()
+
+	// Add the wizard, YAML files and --ssh-after to create machine
+	initCreateMachineCmd()
+
+	// Add context commands
+	initContextCmds()
+
+	// Add login command
+	cli.Root.AddCommand(loginCmd())
+
+	// Add init command
+	cli.Root.AddCommand(initCmd())
+
+	// Add org command
+	cli.Root.AddCommand(orgCmd())
+
+	// Add can-i command
+	cli.Root.AddCommand(canICmd())
+
+	// Add audit command
+	cli.Root.AddCommand(auditCmd())
+
+	// Add assign command
+	cli.Root.AddCommand(assignCmd(""))
+
 	// Add version command
 	cli.Root.AddCommand(versionCmd())
 
+	// Add update command
+	cli.Root.AddCommand(updateCmd())
+
 	// Add ssh command
 	cli.Root.AddCommand(sshCmd())
 
+	// Add console command
+	cli.Root.AddCommand(consoleCmd())
+
+	// Add scp command
+	cli.Root.AddCommand(scpCmd())
+
+	// Add exec command
+	cli.Root.AddCommand(execCmd())
+
 	cli.Root.AddCommand(streamingCmd())
 	// Add metering command
 	cli.Root.AddCommand(meterCmd())
 
+	// Add cost command
+	cli.Root.AddCommand(costCmd())
+
+	// Add budget command
+	cli.Root.AddCommand(budgetCmd())
+
+	// Add metrics command
+	cli.Root.AddCommand(metricsCmd())
+
+	// Add top command
+	cli.Root.AddCommand(topCmd())
+
+	// Add ui command
+	cli.Root.AddCommand(uiCmd())
+
+	// Add rule command
+	cli.Root.AddCommand(ruleCmd())
+
+	// Add notify command
+	cli.Root.AddCommand(notifyCmd())
+
+	// Add script command
+	cli.Root.AddCommand(scriptCmd())
+
+	// Add schedule command
+	cli.Root.AddCommand(scheduleCmd())
+
+	// Add template and stack commands
+	cli.Root.AddCommand(templateCmd())
+	cli.Root.AddCommand(stackCmd())
+
+	// Add dns command
+	cli.Root.AddCommand(dnsCmd())
+
+	// Add key command
+	cli.Root.AddCommand(keyCmd())
+
+	// Add snapshot command
+	cli.Root.AddCommand(snapshotCmd())
+
+	// Add volume command
+	cli.Root.AddCommand(volumeCmd())
+
+	// Add network command
+	cli.Root.AddCommand(networkCmd())
+
+	// Add image command
+	cli.Root.AddCommand(imageCmd())
+
+	// Add cloud command
+	cli.Root.AddCommand(cloudCmd())
+
+	// Add cache command
+	cli.Root.AddCommand(cacheCmd())
+
+	// Add search command
+	cli.Root.AddCommand(searchCmd())
+
+	// Add inventory command
+	cli.Root.AddCommand(inventoryCmd())
+
+	// Add export command
+	cli.Root.AddCommand(exportCmd())
+
+	// Add ssh-config command
+	cli.Root.AddCommand(sshConfigCmd())
+
+	// Add replay command
+	cli.Root.AddCommand(replayCmd())
+
+	// Add cp-key command
+	cli.Root.AddCommand(cpKeyCmd())
+
 	cli.Root.AddCommand(tagCmd())
 
 	cli.Root.AddCommand(untagCmd())
 
+	cli.Root.AddCommand(tagsCmd())
+
+	// Add describe command
+	cli.Root.AddCommand(describeCmd())
+
 	cli.Root.AddCommand(kubeconfigCmd())
 
-	cli.Root.Execute()
+	// Add machine command
+	cli.Root.AddCommand(machineCmd())
+
+	// Add apply command
+	cli.Root.AddCommand(applyCmd())
+
+	// Add diff command
+	cli.Root.AddCommand(diffCmd())
+
+	// Add jobs command
+	cli.Root.AddCommand(jobsCmd())
+
+	// Add query command
+	cli.Root.AddCommand(queryCmd())
+
+	// Add logs command
+	cli.Root.AddCommand(logsCmd())
+
+	// Add events command
+	cli.Root.AddCommand(eventsCmd())
+
+	// Add alias command
+	cli.Root.AddCommand(aliasCmd())
+
+	// Add plugin command
+	cli.Root.AddCommand(pluginCmd())
+
+	// Complete the resources flags like --cloud refer to
+	initFlagCompletions()
+
+	// Expand the alias being run, once all commands are added
+	initAliases()
+
+	// Run plugins for commands mist doesn't have
+	initPlugins()
+
+	if err := cli.Root.Execute(); err != nil {
+		os.Exit(exitError)
+	}
 }
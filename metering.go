@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math"
+	"net/http"
+	"os"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+	"gopkg.in/h2non/gentleman.v2"
 )
 
 type resultItem struct {
@@ -27,26 +34,44 @@ type promqlResponse struct {
 	Metadata map[string]interface{}
 }
 
-func formatMeteringData(metricsSet map[string]string, resourceMetrics map[string]map[string]string, resourceNames map[string]string) {
+// meteringResourceTypes are the kinds of resources which are metered, in
+// the order meter all reports them, with the operation listing them.
+var meteringResourceTypes = []string{"machine", "volume", "network"}
+
+var meteringResourceLists = map[string]func(*viper.Viper) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error){
+	"machine": MistApiV2ListMachines,
+	"volume":  MistApiV2ListVolumes,
+	"network": MistApiV2ListNetworks,
+}
+
+// meteringColumns returns the columns and wide columns of the usage of the
+// kind of resource. Resources are identified by the label of their id in
+// the metering data, like machine_id or volume_id.
+func meteringColumns(resource string, metrics []string) ([]string, []string) {
+	return append([]string{"name"}, metrics...), append([]string{resource + "_id", "name"}, metrics...)
+}
+
+func formatMeteringData(resource string, metricsSet map[string]string, resourceMetrics map[string]map[string]string, resourceNames map[string]string) {
 	metricsList := []string{}
 	for metric := range metricsSet {
 		metricsList = append(metricsList, metric)
 	}
 	sort.Strings(metricsList)
 	resources := make([]string, 0, len(resourceMetrics))
-	for resource := range resourceMetrics {
-		resources = append(resources, resource)
+	for resourceID := range resourceMetrics {
+		resources = append(resources, resourceID)
 	}
 	sort.Strings(resources)
+	idColumn := resource + "_id"
 	data := make(map[string][]interface{})
-	for _, resource := range resources {
+	for _, resourceID := range resources {
 		resourceData := make(map[string]string)
 		for _, metric := range metricsList {
-			if _, ok := resourceData["machine_id"]; !ok {
-				resourceData["machine_id"] = resource
-				resourceData["name"] = resourceNames[resource]
+			if _, ok := resourceData[idColumn]; !ok {
+				resourceData[idColumn] = resourceID
+				resourceData["name"] = resourceNames[resourceID]
 			}
-			resourceData[metric] = resourceMetrics[resource][metric]
+			resourceData[metric] = resourceMetrics[resourceID][metric]
 		}
 		if _, ok := data["data"]; !ok {
 			data["data"] = make([]interface{}, 0)
@@ -73,7 +98,8 @@ func formatMeteringData(metricsSet map[string]string, resourceMetrics map[string
 	for i, metric := range metricsList {
 		sums[i] = fmt.Sprintf("%f", metricSums[metric])
 	}
-	if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{append([]string{"name"}, metricsList...), append([]string{"machine_id", "name"}, metricsList...), append([]string{"TOTAL"}, sums...), append([]string{"TOTAL", ""}, sums...), map[string]string{}}); err != nil {
+	columns, wideColumns := meteringColumns(resource, metricsList)
+	if err := formatReport(data, cli.CLIOutputOptions{columns, wideColumns, append([]string{"TOTAL"}, sums...), append([]string{"TOTAL", ""}, sums...), map[string]string{}}); err != nil {
 		logger.Fatalf("Formatting failed: %s", err.Error())
 	}
 }
@@ -89,39 +115,33 @@ func parseTime(s string) (time.Time, error) {
 	return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp", s)
 }
 
-func getResourceNamesIDMap(search string) map[string]string {
+func getResourceNamesIDMap(search, resource string) map[string]string {
 	resourceNames := make(map[string]string)
 	paramsListResources := viper.New()
 	paramsListResources.Set("search", search)
-	_, decoded, _, err := MistApiV2ListMachines(paramsListResources)
+	_, decoded, _, err := meteringResourceLists[resource](paramsListResources)
 	if err != nil {
 		logger.Fatalf("Error calling operation: %s", err.Error())
 	}
-	for _, item := range decoded["data"].([]interface{}) {
-		resourceNames[item.(map[string]interface{})["id"].(string)] = item.(map[string]interface{})["name"].(string)
-	}
-	_, decoded, _, err = MistApiV2ListVolumes(paramsListResources)
-	if err != nil {
-		logger.Fatalf("Error calling operation: %s", err.Error())
-	}
-	for _, item := range decoded["data"].([]interface{}) {
-		resourceNames[item.(map[string]interface{})["id"].(string)] = item.(map[string]interface{})["name"].(string)
+	for _, item := range responseItems(decoded) {
+		id, _ := item["id"].(string)
+		name, _ := item["name"].(string)
+		resourceNames[id] = name
 	}
 	return resourceNames
 }
 
-func mapResourceNamesWithMetrics(response promqlResponse, search string) (map[string]string, map[string]map[string]string, map[string]string) {
+func mapResourceNamesWithMetrics(response promqlResponse, search, resource string) (map[string]string, map[string]map[string]string, map[string]string) {
 	metricsNameSet := make(map[string]string)
 	resourceIDToMetricMap := make(map[string]map[string]string)
-	resourceIDToNameMap := getResourceNamesIDMap(search)
+	resourceIDToNameMap := getResourceNamesIDMap(search, resource)
 
 	for _, item := range response.Data.DataPromql.Result {
-		resourceID, ok := item.Metric["machine_id"]
+		// Usage of other resources may be labeled with the resource too,
+		// like volumes with the machine they are attached to.
+		resourceID, ok := item.Metric[resource+"_id"]
 		if !ok {
-			resourceID, ok = item.Metric["volume_id"]
-			if !ok {
-				continue
-			}
+			continue
 		}
 		if resourceIDToMetricMap[resourceID] == nil {
 			resourceIDToMetricMap[resourceID] = make(map[string]string)
@@ -135,7 +155,7 @@ func mapResourceNamesWithMetrics(response promqlResponse, search string) (map[st
 	return metricsNameSet, resourceIDToMetricMap, resourceIDToNameMap
 }
 
-func getMeteringData(dtStart, dtEnd, search, queryTemplate string) (map[string]string, map[string]map[string]string, map[string]string) {
+func getMeteringData(dtStart, dtEnd, search, resource, queryTemplate string) (map[string]string, map[string]map[string]string, map[string]string) {
 	paramsGetDatapoints := viper.New()
 	paramsGetDatapoints.Set("time", dtEnd)
 	paramsGetDatapoints.Set("search", search)
@@ -159,7 +179,7 @@ func getMeteringData(dtStart, dtEnd, search, queryTemplate string) (map[string]s
 		fmt.Println("error:", err)
 	}
 
-	return mapResourceNamesWithMetrics(response, search)
+	return mapResourceNamesWithMetrics(response, search, resource)
 }
 
 func calculateDiffs(resourceMetricsStart map[string]map[string]string, resourceMetricsEnd map[string]map[string]string, metricsSet map[string]string) map[string]map[string]string {
@@ -190,3 +210,297 @@ func calculateDiffs(resourceMetricsStart map[string]map[string]string, resourceM
 	}
 	return resourceMetricsEnd
 }
+
+// maxMeteringBuckets limits the number of windows queried with
+// --granularity, each of which takes two queries.
+const maxMeteringBuckets = 500
+
+// parseGranularity parses a --granularity duration, which may also be given
+// in days, like 1d.
+func parseGranularity(s string) (time.Duration, error) {
+	var granularity time.Duration
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, errors.Errorf("invalid granularity %q", s)
+		}
+		granularity = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if granularity, err = time.ParseDuration(s); err != nil {
+			return 0, errors.Errorf("invalid granularity %q", s)
+		}
+	}
+	if granularity < time.Minute {
+		return 0, errors.Errorf("the granularity must be at least 1m")
+	}
+	return granularity, nil
+}
+
+// resourceMetering returns the usage of the resources between start and end:
+// the increase of counters, and the last value of gauges.
+func resourceMetering(dtStart, dtEnd, search, resource string) (map[string]string, map[string]map[string]string, map[string]string) {
+	_, resourceMetricsStart, _ := getMeteringData(dtStart, dtEnd, search, resource, fmt.Sprintf("first_over_time({metering=\"true\",%s_id=~\".+\"}", resource)+"[%ds])")
+	metricsSet, resourceMetricsEnd, resourceNames := getMeteringData(dtStart, dtEnd, search, resource, fmt.Sprintf("last_over_time({metering=\"true\",%s_id=~\".+\"}", resource)+"[%ds])")
+	return metricsSet, calculateDiffs(resourceMetricsStart, resourceMetricsEnd, metricsSet), resourceNames
+}
+
+// meteringSparklineWindows is the number of windows the period is split in
+// for --sparkline, one per character of the sparklines.
+const meteringSparklineWindows = 24
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline renders the values as a line of blocks of their height between
+// the lowest and highest value, averaging neighbours to fit the width.
+// Missing values are left blank.
+func sparkline(values []float64, width int) string {
+	if len(values) > width {
+		buckets := make([]float64, width)
+		for i := range buckets {
+			from, to := i*len(values)/width, (i+1)*len(values)/width
+			sum, count := 0.0, 0
+			for _, v := range values[from:to] {
+				if !math.IsNaN(v) {
+					sum += v
+					count++
+				}
+			}
+			buckets[i] = math.NaN()
+			if count > 0 {
+				buckets[i] = sum / float64(count)
+			}
+		}
+		values = buckets
+	}
+	low, high := seriesRange(values)
+	var b strings.Builder
+	for _, v := range values {
+		switch {
+		case math.IsNaN(v):
+			b.WriteRune(' ')
+		case high == low:
+			b.WriteRune(sparkBlocks[0])
+		default:
+			b.WriteRune(sparkBlocks[int((v-low)/(high-low)*float64(len(sparkBlocks)-1)+0.5)])
+		}
+	}
+	return b.String()
+}
+
+func seriesRange(values []float64) (float64, float64) {
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			low, high = math.Min(low, v), math.Max(high, v)
+		}
+	}
+	return low, high
+}
+
+// formatMeteringSparklines splits the period in meteringSparklineWindows
+// windows and shows the trend of every metric of each resource across them
+// as a sparkline. Sparklines only make sense in a table on a terminal, so
+// otherwise, and with -o json, yaml or csv, the usage in every window is
+// written instead, with a row per resource per window.
+func formatMeteringSparklines(start, end time.Time, search, resource string, detailedName bool) {
+	if !end.After(start) {
+		logger.Fatal("The end must be after the start")
+	}
+	window := end.Sub(start) / meteringSparklineWindows
+	metricsSet := make(map[string]string)
+	series := make(map[string]map[string][]float64)
+	names := make(map[string]string)
+	rows := []interface{}{}
+	for i := 0; i < meteringSparklineWindows; i++ {
+		windowStart := start.Add(time.Duration(i) * window)
+		windowEnd := windowStart.Add(window)
+		if i == meteringSparklineWindows-1 {
+			windowEnd = end
+		}
+		windowMetrics, resourceMetrics, resourceNames := resourceMetering(fmt.Sprintf("%d", windowStart.Unix()), fmt.Sprintf("%d", windowEnd.Unix()), search, resource)
+		for metric, valueType := range windowMetrics {
+			metricsSet[metric] = valueType
+		}
+		for resourceID, metrics := range resourceMetrics {
+			name := resourceNames[resourceID]
+			if detailedName {
+				name = resource + "/" + name
+			}
+			names[resourceID] = name
+			if series[resourceID] == nil {
+				series[resourceID] = make(map[string][]float64)
+			}
+			row := map[string]string{
+				"window":     windowStart.UTC().Format(time.RFC3339),
+				"machine_id": resourceID,
+				"name":       name,
+			}
+			for metric, value := range metrics {
+				row[metric] = value
+				v, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					continue
+				}
+				values := series[resourceID][metric]
+				for len(values) < i {
+					values = append(values, math.NaN())
+				}
+				series[resourceID][metric] = append(values, v)
+			}
+			rows = append(rows, row)
+		}
+	}
+	metricsList := []string{}
+	for metric := range metricsSet {
+		metricsList = append(metricsList, metric)
+	}
+	sort.Strings(metricsList)
+	columns := append([]string{"name"}, metricsList...)
+	wideColumns := append([]string{"machine_id", "name"}, metricsList...)
+
+	output := ""
+	if flag := cli.Root.PersistentFlags().ShorthandLookup("o"); flag != nil {
+		output = flag.Value.String()
+	}
+	if output == "json" || output == "yaml" || output == "csv" || !term.IsTerminal(int(os.Stdout.Fd())) {
+		data := map[string]interface{}{"data": rows}
+		if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{append([]string{"window"}, columns...), append([]string{"window"}, wideColumns...), []string{}, []string{}, map[string]string{}}); err != nil {
+			logger.Fatalf("Formatting failed: %s", err.Error())
+		}
+		return
+	}
+	resources := make([]string, 0, len(series))
+	for resourceID := range series {
+		resources = append(resources, resourceID)
+	}
+	sort.Strings(resources)
+	rows = []interface{}{}
+	for _, resourceID := range resources {
+		row := map[string]string{
+			"machine_id": resourceID,
+			"name":       names[resourceID],
+		}
+		for _, metric := range metricsList {
+			values := series[resourceID][metric]
+			for len(values) < meteringSparklineWindows {
+				values = append(values, math.NaN())
+			}
+			row[metric] = sparkline(values, meteringSparklineWindows)
+		}
+		rows = append(rows, row)
+	}
+	data := map[string]interface{}{"data": rows}
+	if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{columns, wideColumns, []string{}, []string{}, map[string]string{}}); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+}
+
+// formatBucketedMeteringData writes one row per resource per window of
+// --granularity, starting with the start of the window.
+func formatBucketedMeteringData(start, end time.Time, granularity time.Duration, search, resource string, detailedName bool) {
+	if int(end.Sub(start)/granularity) > maxMeteringBuckets {
+		logger.Fatalf("Too many windows of %s between start and end, at most %d are allowed", granularity, maxMeteringBuckets)
+	}
+	metricsSet := make(map[string]string)
+	rows := []interface{}{}
+	for bucketStart := start; bucketStart.Before(end); bucketStart = bucketStart.Add(granularity) {
+		bucketEnd := bucketStart.Add(granularity)
+		if bucketEnd.After(end) {
+			bucketEnd = end
+		}
+		bucketMetrics, resourceMetrics, resourceNames := resourceMetering(fmt.Sprintf("%d", bucketStart.Unix()), fmt.Sprintf("%d", bucketEnd.Unix()), search, resource)
+		for metric, valueType := range bucketMetrics {
+			metricsSet[metric] = valueType
+		}
+		resources := make([]string, 0, len(resourceMetrics))
+		for resourceID := range resourceMetrics {
+			resources = append(resources, resourceID)
+		}
+		sort.Strings(resources)
+		for _, resourceID := range resources {
+			name := resourceNames[resourceID]
+			if detailedName {
+				name = resource + "/" + name
+			}
+			row := map[string]string{
+				"bucket":         bucketStart.UTC().Format(time.RFC3339),
+				resource + "_id": resourceID,
+				"name":           name,
+			}
+			for metric, value := range resourceMetrics[resourceID] {
+				row[metric] = value
+			}
+			rows = append(rows, row)
+		}
+	}
+	metricsList := []string{}
+	for metric := range metricsSet {
+		metricsList = append(metricsList, metric)
+	}
+	sort.Strings(metricsList)
+	data := map[string]interface{}{"data": rows}
+	columns, wideColumns := meteringColumns(resource, metricsList)
+	if err := formatReport(data, cli.CLIOutputOptions{append([]string{"bucket"}, columns...), append([]string{"bucket"}, wideColumns...), []string{}, []string{}, map[string]string{}}); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+}
+
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// prometheusLabel escapes a label value of the Prometheus text format.
+func prometheusLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// meteringExposition renders the usage of the resources in the Prometheus
+// text format, as gauges labeled with the resource id and name.
+func meteringExposition(resource string, metricsSet map[string]string, resourceMetrics map[string]map[string]string, resourceNames map[string]string) []byte {
+	metrics := []string{}
+	for metric := range metricsSet {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	resources := []string{}
+	for resourceID := range resourceMetrics {
+		resources = append(resources, resourceID)
+	}
+	sort.Strings(resources)
+	var b bytes.Buffer
+	for _, metric := range metrics {
+		name := invalidMetricNameChars.ReplaceAllString(metric, "_")
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		for _, resourceID := range resources {
+			value, err := strconv.ParseFloat(resourceMetrics[resourceID][metric], 64)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(&b, "%s{%s_id=\"%s\",name=\"%s\"} %s\n", name, resource, prometheusLabel(resourceID), prometheusLabel(resourceNames[resourceID]), strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+	return b.Bytes()
+}
+
+// pushMetering replaces the usage of the resources of the kind in the
+// Prometheus push gateway, grouped by job and resource.
+func pushMetering(gateway, job, resource string, metricsSet map[string]string, resourceMetrics map[string]map[string]string, resourceNames map[string]string) error {
+	url := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + job + "/resource/" + resource
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(meteringExposition(resource, metricsSet, resourceMetrics, resourceNames)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("push gateway returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// machineMetric is a metric of machines and the PromQL query returning it,
+// given the id of the machine.
+type machineMetric struct {
+	name  string
+	query string
+	unit  string
+}
+
+var machineMetrics = []machineMetric{
+	{"cpu", `100 - avg(cpu_usage_idle{machine_id="%s",cpu="cpu-total"})`, "%"},
+	{"ram", `avg(mem_used_percent{machine_id="%s"})`, "%"},
+	{"disk", `max(disk_used_percent{machine_id="%s"})`, "%"},
+	{"net-rx", `sum(rate(net_bytes_recv{machine_id="%s"}[5m]))`, "B/s"},
+	{"net-tx", `sum(rate(net_bytes_sent{machine_id="%s"}[5m]))`, "B/s"},
+}
+
+type promqlRangeResponse struct {
+	Data struct {
+		DataPromql struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Values [][]interface{}   `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	} `json:"data"`
+}
+
+// selectMachineMetrics returns the metrics given with --metric. Names other
+// than the built in ones are queried as raw metrics of the machine.
+func selectMachineMetrics(names []string) []machineMetric {
+	if len(names) == 0 {
+		return machineMetrics
+	}
+	metrics := []machineMetric{}
+	for _, name := range names {
+		metric := machineMetric{name, "sum(" + name + `{machine_id="%s"})`, ""}
+		for _, m := range machineMetrics {
+			if m.name == name {
+				metric = m
+			}
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// metricSeries returns the values of the metric of the machine between start
+// and end, one per step. Missing values are NaN.
+func metricSeries(metric machineMetric, machineID string, start, end time.Time, step time.Duration) ([]float64, error) {
+	params := viper.New()
+	params.Set("start", fmt.Sprintf("%d", start.Unix()))
+	params.Set("end", fmt.Sprintf("%d", end.Unix()))
+	params.Set("step", fmt.Sprintf("%d", int(step.Seconds())))
+	_, decoded, _, err := MistApiV2GetDatapoints(fmt.Sprintf(metric.query, machineID), params)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	var response promqlRangeResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return nil, err
+	}
+	n := int(end.Sub(start)/step) + 1
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = math.NaN()
+	}
+	for _, result := range response.Data.DataPromql.Result {
+		for _, point := range result.Values {
+			if len(point) != 2 {
+				continue
+			}
+			ts, _ := point[0].(float64)
+			s, _ := point[1].(string)
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+			i := int(time.Unix(int64(ts), 0).Sub(start) / step)
+			if i < 0 || i >= n {
+				continue
+			}
+			if math.IsNaN(values[i]) {
+				values[i] = 0
+			}
+			values[i] += v
+		}
+	}
+	return values, nil
+}
+
+func formatMetricValue(value float64, unit string) string {
+	switch unit {
+	case "%":
+		return fmt.Sprintf("%.1f%%", value)
+	case "B/s":
+		return formatBytes(int64(value)) + "/s"
+	}
+	return strconv.FormatFloat(value, 'g', 4, 64)
+}
+
+// metricsWidth returns the width of the sparklines, leaving room for the
+// name of the metric and its min, max and last values.
+func metricsWidth() int {
+	width := 80
+	if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		width = w
+	}
+	if width -= 50; width < 10 {
+		width = 10
+	}
+	return width
+}
+
+// showMachineMetrics prints a sparkline per metric of the machine, or the
+// datapoints with non table output.
+func showMachineMetrics(params *viper.Viper, machine, machineID string, metrics []machineMetric, since time.Duration) {
+	width := metricsWidth()
+	end := time.Now()
+	start := end.Add(-since)
+	step := since / time.Duration(width)
+	if step < time.Second {
+		step = time.Second
+	}
+	step = step.Round(time.Second)
+	rows := []interface{}{}
+	lines := []string{}
+	for _, metric := range metrics {
+		values, err := metricSeries(metric, machineID, start, end, step)
+		if err != nil {
+			logger.Fatalf("Error calling operation: %s", err.Error())
+		}
+		points := []interface{}{}
+		last := math.NaN()
+		for i, v := range values {
+			if !math.IsNaN(v) {
+				points = append(points, []interface{}{start.Add(time.Duration(i) * step).Unix(), v})
+				last = v
+			}
+		}
+		rows = append(rows, map[string]interface{}{"metric": metric.name, "unit": metric.unit, "values": points})
+		if math.IsNaN(last) {
+			lines = append(lines, fmt.Sprintf("%-8s %-*s  no data", metric.name, width, ""))
+			continue
+		}
+		low, high := seriesRange(values)
+		lines = append(lines, fmt.Sprintf("%-8s %-*s  min %-10s max %-10s last %s", metric.name, width, sparkline(values, width), formatMetricValue(low, metric.unit), formatMetricValue(high, metric.unit), formatMetricValue(last, metric.unit)))
+	}
+	if !isTableOutput() {
+		data := map[string]interface{}{"data": rows}
+		if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{[]string{}, []string{}, []string{}, []string{}, map[string]string{}}); err != nil {
+			logger.Fatalf("Formatting failed: %s", err.Error())
+		}
+		return
+	}
+	fmt.Printf("%s, last %s\n", machine, since)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+func metricsCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "metrics MACHINE",
+		Short: "Show recent metrics of a machine",
+		Long: `Show the recent CPU, RAM, disk and network usage of a monitored machine as
+sparklines, with the lowest, highest and last value of each metric.
+
+--metric picks the metrics to show, which are cpu, ram, disk, net-rx and
+net-tx, or the name of any other metric of the machine. With --live the
+metrics are refreshed until interrupted.`,
+		Example: `  mist metrics web-1
+  mist metrics web-1 --metric cpu,ram --since 6h
+  mist metrics web-1 --live`,
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: machineAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			since := params.GetDuration("since")
+			if since <= 0 {
+				logger.Fatal("--since must be positive")
+			}
+			live := params.GetBool("live")
+			if live && !isTableOutput() {
+				logger.Fatal("--live can only be used with table output")
+			}
+			if live && params.GetDuration("refresh") <= 0 {
+				logger.Fatal("--refresh must be positive")
+			}
+			machine, err := lookupResource("machine", args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if machine == nil {
+				logger.Fatalf("Machine %s not found", args[0])
+			}
+			machineID, _ := machine["id"].(string)
+			metrics := selectMachineMetrics(params.GetStringSlice("metric"))
+			if !live {
+				showMachineMetrics(params, args[0], machineID, metrics, since)
+				return
+			}
+			for {
+				fmt.Print("\033[H\033[2J")
+				showMachineMetrics(params, args[0], machineID, metrics, since)
+				time.Sleep(params.GetDuration("refresh"))
+			}
+		},
+	}
+	cmd.Flags().StringSlice("metric", []string{}, "Metrics to show, all of cpu, ram, disk, net-rx and net-tx by default")
+	cmd.Flags().Duration("since", time.Hour, "Show the metrics of this long ago until now")
+	cmd.Flags().Bool("live", false, "Refresh the metrics until interrupted")
+	cmd.Flags().Duration("refresh", 10*time.Second, "How often to refresh the metrics with --live")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
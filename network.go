@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// networkProvider describes what the networks of a provider need.
+type networkProvider struct {
+	cidrRequired bool
+	// Prefix lengths the provider accepts for networks, 0 for any.
+	minPrefix, maxPrefix int
+	subnets              bool
+	zones                bool
+}
+
+// networkProviders lists the providers networks can be created on.
+var networkProviders = map[string]networkProvider{
+	"amazon":    {cidrRequired: true, minPrefix: 16, maxPrefix: 28, subnets: true, zones: true},
+	"alibaba":   {cidrRequired: true, minPrefix: 8, maxPrefix: 24, subnets: true, zones: true},
+	"google":    {subnets: true},
+	"openstack": {subnets: true},
+	"vexxhost":  {subnets: true},
+	"azure_arm": {cidrRequired: true, minPrefix: 8, maxPrefix: 29, subnets: true},
+	"lxd":       {},
+	"libvirt":   {},
+	"gig_g8":    {},
+}
+
+// parseNetworkCIDR parses an IPv4 CIDR range, which must be the address of
+// the network.
+func parseNetworkCIDR(cidr, flag string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid --%s %q, expected an IPv4 CIDR range like 10.0.0.0/16", flag, cidr)
+	}
+	if !ip.Equal(ipNet.IP) {
+		return nil, fmt.Errorf("invalid --%s %q, did you mean %s?", flag, cidr, ipNet)
+	}
+	return ipNet, nil
+}
+
+// validateNetwork checks the CIDR ranges and availability zone against what
+// the provider of the cloud accepts.
+func validateNetwork(provider string, cidr, subnet, zone string) error {
+	p, ok := networkProviders[provider]
+	if !ok {
+		names := []string{}
+		for name := range networkProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("networks can't be created on %s clouds, only on %s", provider, strings.Join(names, ", "))
+	}
+	if cidr == "" && p.cidrRequired {
+		return fmt.Errorf("%s networks need a --cidr", provider)
+	}
+	var network *net.IPNet
+	if cidr != "" {
+		var err error
+		if network, err = parseNetworkCIDR(cidr, "cidr"); err != nil {
+			return err
+		}
+		ones, _ := network.Mask.Size()
+		if p.minPrefix != 0 && (ones < p.minPrefix || ones > p.maxPrefix) {
+			return fmt.Errorf("%s networks range from /%d to /%d, %s is /%d", provider, p.minPrefix, p.maxPrefix, cidr, ones)
+		}
+	}
+	if subnet != "" {
+		if !p.subnets {
+			return fmt.Errorf("%s networks have no subnets", provider)
+		}
+		s, err := parseNetworkCIDR(subnet, "subnet")
+		if err != nil {
+			return err
+		}
+		if network != nil {
+			networkOnes, _ := network.Mask.Size()
+			subnetOnes, _ := s.Mask.Size()
+			if !network.Contains(s.IP) || subnetOnes < networkOnes {
+				return fmt.Errorf("subnet %s is not within network %s", subnet, cidr)
+			}
+		}
+	}
+	if zone != "" {
+		if !p.zones {
+			return fmt.Errorf("%s subnets have no availability zones", provider)
+		}
+		if subnet == "" {
+			return fmt.Errorf("--availability-zone is the zone of the --subnet, which is missing")
+		}
+	}
+	return nil
+}
+
+func networkCreateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a network",
+		Long: `Create a network on a cloud, along with a subnet with --subnet.
+
+The CIDR ranges and availability zone are checked against what the provider
+of the cloud accepts before the network is created, e.g. amazon networks
+need a --cidr between /16 and /28 and subnets must be within it.`,
+		Example: `  mist network create vpc1 --cloud aws1 --cidr 10.0.0.0/16 --subnet 10.0.1.0/24 --availability-zone us-east-1a
+  mist network create net1 --cloud openstack --subnet 192.168.10.0/24`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cloud, err := lookupResource("cloud", params.GetString("cloud"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if cloud == nil {
+				logger.Fatalf("Cloud %s not found", params.GetString("cloud"))
+			}
+			provider, _ := cloud["provider"].(string)
+			cidr, subnetCIDR, zone := params.GetString("cidr"), params.GetString("subnet"), params.GetString("availability-zone")
+			if err := validateNetwork(provider, cidr, subnetCIDR, zone); err != nil {
+				logger.Fatal(err)
+			}
+			network := map[string]interface{}{"name": args[0]}
+			if cidr != "" {
+				network["cidr"] = cidr
+			}
+			request := map[string]interface{}{
+				"name":    args[0],
+				"cloud":   cloud["id"],
+				"network": network,
+			}
+			if location := params.GetString("location"); location != "" {
+				request["location"] = location
+			}
+			if subnetCIDR != "" {
+				subnet := map[string]interface{}{"cidr": subnetCIDR}
+				if zone != "" {
+					subnet["availability_zone"] = zone
+				}
+				request["subnet"] = subnet
+			}
+			body, err := json.Marshal(request)
+			if err != nil {
+				logger.Fatalf("Unable to get body: %s", err.Error())
+			}
+			_, decoded, outputOptions, err := MistApiV2CreateNetwork(params, string(body))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("cloud", "", "Cloud to create the network on")
+	cmd.Flags().String("location", "", "Location to create the network in")
+	cmd.Flags().String("cidr", "", "IPv4 range of the network, like 10.0.0.0/16")
+	cmd.Flags().String("subnet", "", "IPv4 range of a subnet to create in the network, like 10.0.1.0/24")
+	cmd.Flags().String("availability-zone", "", "Availability zone of the subnet")
+	cmd.MarkFlagRequired("cloud")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func networkDeleteCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "delete NETWORK...",
+		Short: "Delete networks",
+		Long: `Delete networks by name or id. The networks are listed and a confirmation
+is asked for before deleting them, unless --yes is given.`,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeResourceFlag("network"),
+		Run: func(cmd *cobra.Command, args []string) {
+			networks, err := resolveResources("network", args, "")
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			for _, network := range networks {
+				fmt.Printf("  %s\n", network.name)
+			}
+			if !params.GetBool("yes") && !confirmAction("Delete", len(networks), "network") {
+				return
+			}
+			for _, network := range networks {
+				if err := resourceDeleteControllersMap["network"](network.id, viper.New()); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf("Network %s deleted\n", network.name)
+			}
+		},
+	}
+	cmd.Flags().BoolP("yes", "y", false, "Delete without asking for confirmation")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func networkRenameCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "rename NETWORK NAME",
+		Short:             "Rename a network",
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeResourceFlag("network"),
+		Run: func(cmd *cobra.Command, args []string) {
+			params := viper.New()
+			params.Set("name", args[1])
+			if _, _, _, err := MistApiV2EditNetwork(args[0], params); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			fmt.Printf("Network %s renamed to %s\n", args[0], args[1])
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func networkCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "network",
+		Aliases: []string{"networks"},
+		Short:   "Network operations",
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.AddCommand(networkCreateCmd())
+	cmd.AddCommand(networkDeleteCmd())
+	cmd.AddCommand(networkRenameCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// Notification channels are stored in the credentials file with the
+// context, as a list of maps of name, type and target, since the targets of
+// Slack and PagerDuty are secrets. The target is the emails of email
+// channels, separated by commas, the webhook URL of slack and webhook
+// channels, and the routing key of pagerduty channels.
+
+// channelTypes are the types of notification channels, with the flag
+// giving their target.
+var channelTypes = []string{"email", "slack", "pagerduty", "webhook"}
+
+// pagerDutyEventsURL is where alerts of pagerduty channels are sent.
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+type channel struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Target string `json:"target"`
+}
+
+func channelsKey() string {
+	return "contexts." + viper.GetString("context") + ".channels"
+}
+
+func savedChannels() []channel {
+	channels := []channel{}
+	items, _ := cli.Creds.Get(channelsKey()).([]interface{})
+	for _, item := range items {
+		entry, ok := normalizeYAML(item).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := entry["name"].(string)
+		channelType, _ := entry["type"].(string)
+		target, _ := entry["target"].(string)
+		channels = append(channels, channel{Name: name, Type: channelType, Target: target})
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels
+}
+
+func writeChannels(channels []channel) error {
+	items := []interface{}{}
+	for _, c := range channels {
+		items = append(items, map[string]interface{}{"name": c.Name, "type": c.Type, "target": c.Target})
+	}
+	cli.Creds.Set(channelsKey(), items)
+	return cli.Creds.WriteConfig()
+}
+
+func findChannel(name string) (channel, bool) {
+	for _, c := range savedChannels() {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return channel{}, false
+}
+
+// redactedTarget hides the secret part of the target, leaving enough to
+// tell channels apart.
+func (c channel) redactedTarget() string {
+	if c.Type == "email" || len(c.Target) <= 12 {
+		return c.Target
+	}
+	return c.Target[:len(c.Target)-8] + "********"
+}
+
+// alertPayload returns the JSON body posted to the channel when the rule
+// triggers, or for a test alert.
+func (c channel) alertPayload(summary string) map[string]interface{} {
+	switch c.Type {
+	case "slack":
+		return map[string]interface{}{"text": summary}
+	case "pagerduty":
+		return map[string]interface{}{
+			"routing_key":  c.Target,
+			"event_action": "trigger",
+			"payload": map[string]interface{}{
+				"summary":  summary,
+				"source":   "mist",
+				"severity": "critical",
+			},
+		}
+	}
+	return map[string]interface{}{"source": "mist", "text": summary}
+}
+
+// url returns where alerts of the channel are posted.
+func (c channel) url() string {
+	if c.Type == "pagerduty" {
+		return pagerDutyEventsURL
+	}
+	return c.Target
+}
+
+// ruleAction returns the rule action notifying the channel: a notification
+// for emails, and a webhook posting the alert otherwise.
+func (c channel) ruleAction(rule string) map[string]interface{} {
+	if c.Type == "email" {
+		return map[string]interface{}{"action_type": "notification", "emails": strings.Split(c.Target, ","), "users": []string{}, "teams": []string{}}
+	}
+	return map[string]interface{}{
+		"action_type": "webhook",
+		"method":      "POST",
+		"url":         c.url(),
+		"json":        c.alertPayload(fmt.Sprintf("Mist rule %s triggered", rule)),
+		"headers":     map[string]interface{}{"Content-Type": "application/json"},
+	}
+}
+
+// isRuleAction reports whether the action of a rule notifies the channel.
+func (c channel) isRuleAction(action map[string]interface{}) bool {
+	switch action["action_type"] {
+	case "notification":
+		if c.Type != "email" {
+			return false
+		}
+		emails, _ := action["emails"].([]interface{})
+		found := []string{}
+		for _, email := range emails {
+			found = append(found, fmt.Sprintf("%v", email))
+		}
+		return strings.Join(found, ",") == c.Target
+	case "webhook":
+		if c.Type == "email" || action["url"] != c.url() {
+			return false
+		}
+		if c.Type != "pagerduty" {
+			return true
+		}
+		payload, _ := action["json"].(map[string]interface{})
+		return payload["routing_key"] == c.Target
+	}
+	return false
+}
+
+// sendAlert posts an alert to the channel.
+func (c channel) sendAlert(summary string) error {
+	if c.Type == "email" {
+		return fmt.Errorf("emails are sent by Mist when rules trigger, so email channels can't be tested")
+	}
+	body, err := json.Marshal(c.alertPayload(summary))
+	if err != nil {
+		return err
+	}
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(c.url(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s rejected the alert: %s", c.Type, resp.Status)
+	}
+	return nil
+}
+
+func channelAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, c := range savedChannels() {
+		names = append(names, c.Name)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+func notifyCreateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a notification channel",
+		Long: `Create a notification channel, which sends emails to the addresses given
+with --email, posts to a Slack incoming webhook, triggers PagerDuty alerts
+with the routing key of an Events API v2 integration, or posts to any
+webhook. Creating a channel with the name of an existing one replaces it.
+
+Channels are kept with the context and attached to rules with notify
+attach.`,
+		Example: `  mist notify create ops --email ops@example.com --email oncall@example.com
+  mist notify create team-chat --slack https://hooks.slack.com/services/T000/B000/XXXX
+  mist notify create pager --pagerduty 0123456789abcdef0123456789abcdef`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			c := channel{Name: args[0]}
+			for _, channelType := range channelTypes {
+				if !cmd.Flags().Changed(channelType) {
+					continue
+				}
+				if c.Type != "" {
+					logger.Fatalf("Give only one of --%s", strings.Join(channelTypes, ", --"))
+				}
+				c.Type = channelType
+			}
+			switch c.Type {
+			case "":
+				logger.Fatalf("Give one of --%s", strings.Join(channelTypes, ", --"))
+			case "email":
+				emails, _ := cmd.Flags().GetStringArray("email")
+				for _, email := range emails {
+					if !strings.Contains(email, "@") {
+						logger.Fatalf("%q is not an email address", email)
+					}
+				}
+				c.Target = strings.Join(emails, ",")
+			case "pagerduty":
+				if c.Target, _ = cmd.Flags().GetString(c.Type); c.Target == "" {
+					logger.Fatal("Invalid --pagerduty: the routing key is empty")
+				}
+			default:
+				c.Target, _ = cmd.Flags().GetString(c.Type)
+				if err := validateServerURL(c.Target); err != nil {
+					logger.Fatalf("Invalid --%s: %s", c.Type, err)
+				}
+			}
+			channels := []channel{c}
+			for _, saved := range savedChannels() {
+				if saved.Name != c.Name {
+					channels = append(channels, saved)
+				}
+			}
+			if err := writeChannels(channels); err != nil {
+				logger.Fatalf("Error saving channel: %s", err.Error())
+			}
+			fmt.Printf("Channel %s created\n", c.Name)
+		},
+	}
+	cmd.Flags().StringArray("email", []string{}, "Email to notify, may be repeated")
+	cmd.Flags().String("slack", "", "Incoming webhook URL of a Slack channel")
+	cmd.Flags().String("pagerduty", "", "Routing key of a PagerDuty Events API v2 integration")
+	cmd.Flags().String("webhook", "", "URL to post alerts to as JSON")
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func notifyListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List notification channels",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			rows := []interface{}{}
+			for _, c := range savedChannels() {
+				rows = append(rows, map[string]interface{}{"name": c.Name, "type": c.Type, "target": c.redactedTarget()})
+			}
+			columns := []string{"name", "type", "target"}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func notifyDeleteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "delete CHANNEL",
+		Short:             "Delete a notification channel",
+		Long:              `Delete a notification channel. Rules it is attached to keep notifying it until it is detached.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: channelAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			channels := []channel{}
+			for _, c := range savedChannels() {
+				if c.Name != args[0] {
+					channels = append(channels, c)
+				}
+			}
+			if len(channels) == len(savedChannels()) {
+				logger.Fatalf("No channel %s", args[0])
+			}
+			if err := writeChannels(channels); err != nil {
+				logger.Fatalf("Error saving channels: %s", err.Error())
+			}
+			fmt.Printf("Channel %s deleted\n", args[0])
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func notifyTestCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test CHANNEL",
+		Short: "Send a test alert to a notification channel",
+		Long: `Send a synthetic alert to a notification channel, the way rules it is
+attached to do when they trigger, to check that it is set up right.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: channelAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			c, ok := findChannel(args[0])
+			if !ok {
+				logger.Fatalf("No channel %s", args[0])
+			}
+			if err := c.sendAlert(fmt.Sprintf("Test alert of the Mist notification channel %s", c.Name)); err != nil {
+				logger.Fatal(err)
+			}
+			fmt.Printf("Test alert sent to %s\n", c.Name)
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+// notifyRuleCmd attaches the channel to rules, or detaches it.
+func notifyRuleCmd(attach bool) *cobra.Command {
+	params := viper.New()
+	use, short := "attach", "Make rules notify a channel when they trigger"
+	if !attach {
+		use, short = "detach", "Stop rules from notifying a channel"
+	}
+	cmd := &cobra.Command{
+		Use:     use + " CHANNEL RULE...",
+		Short:   short,
+		Example: fmt.Sprintf(`  mist notify %s pager high-cpu disk-full`, use),
+		Args:    cobra.MinimumNArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return channelAutocomplete(cmd, args, toComplete)
+			}
+			return completeResourceFlag("rule")(cmd, args, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			c, ok := findChannel(args[0])
+			if !ok {
+				logger.Fatalf("No channel %s", args[0])
+			}
+			for _, rule := range args[1:] {
+				live, err := lookupResource("rule", rule)
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				if live == nil {
+					logger.Fatalf("Rule %s not found", rule)
+				}
+				actions := []interface{}{}
+				found := false
+				items, _ := live["actions"].([]interface{})
+				for _, item := range items {
+					action, _ := item.(map[string]interface{})
+					if c.isRuleAction(action) {
+						found = true
+						continue
+					}
+					actions = append(actions, item)
+				}
+				if attach {
+					name, _ := live["name"].(string)
+					actions = append(actions, c.ruleAction(name))
+				} else if !found {
+					fmt.Fprintf(os.Stderr, "Rule %s doesn't notify %s\n", rule, c.Name)
+					continue
+				} else if len(actions) == 0 {
+					logger.Fatalf("Rule %s only notifies %s, rules need an action", rule, c.Name)
+				}
+				spec := map[string]interface{}{}
+				for _, field := range manifestEditableFields["rule"] {
+					if value, ok := live[field]; ok {
+						spec[field] = value
+					}
+				}
+				spec["actions"] = actions
+				body, err := json.Marshal(spec)
+				if err != nil {
+					logger.Fatalf("Unable to get body: %s", err.Error())
+				}
+				id, _ := live["id"].(string)
+				if _, _, _, err := MistApiV2EditRule(id, params, string(body)); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				if attach {
+					fmt.Printf("Rule %s notifies %s\n", rule, c.Name)
+				} else {
+					fmt.Printf("Rule %s no longer notifies %s\n", rule, c.Name)
+				}
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func notifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "notify",
+		Short: "Manage notification channels",
+		Long: `Create, list, test and delete notification channels, which send emails,
+post to Slack or trigger PagerDuty alerts, and attach them to rules to be
+notified when they trigger.`,
+	}
+	cmd.AddCommand(notifyCreateCmd())
+	cmd.AddCommand(notifyListCmd())
+	cmd.AddCommand(notifyDeleteCmd())
+	cmd.AddCommand(notifyTestCmd())
+	cmd.AddCommand(notifyRuleCmd(true))
+	cmd.AddCommand(notifyRuleCmd(false))
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
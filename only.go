@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+// onlyField is an entry of the --only flag. Entries are either plain field
+// names or `alias:path` expressions, where path is a field name followed by
+// optional `.key` and `[index]` selectors, e.g. `ip:public_ips[0]`.
+type onlyField struct {
+	Alias string
+	Path  string
+}
+
+func parseOnlyFields(only string) []onlyField {
+	fields := []onlyField{}
+	for _, entry := range strings.Split(only, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		field := onlyField{Alias: entry, Path: entry}
+		if i := strings.Index(entry, ":"); i >= 0 {
+			field.Alias = strings.TrimSpace(entry[:i])
+			field.Path = strings.TrimSpace(entry[i+1:])
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// topLevel returns the field of the resource the path starts from.
+func (f onlyField) topLevel() string {
+	if i := strings.IndexAny(f.Path, ".["); i >= 0 {
+		return f.Path[:i]
+	}
+	return f.Path
+}
+
+func (f onlyField) isExpression() bool {
+	return f.Alias != f.Path || f.topLevel() != f.Path
+}
+
+// hasOnlyExpressions reports whether any of the fields needs projecting on
+// the client side.
+func hasOnlyExpressions(fields []onlyField) bool {
+	for _, field := range fields {
+		if field.isExpression() {
+			return true
+		}
+	}
+	return false
+}
+
+// projectOnlyFields builds an item holding the value of every field, keyed
+// by its alias.
+func projectOnlyFields(item interface{}, fields []onlyField) interface{} {
+	if _, ok := item.(map[string]interface{}); !ok {
+		return item
+	}
+	projected := make(map[string]interface{})
+	for _, field := range fields {
+		value, err := jmespath.Search(field.Path, item)
+		if err != nil {
+			value = nil
+		}
+		projected[field.Alias] = value
+	}
+	return projected
+}
+
+// applyOnlyExpressions projects and renames the listed data according to
+// the `alias:path` entries of --only, and shows the aliases as columns.
+func applyOnlyExpressions(data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) (interface{}, cli.CLIOutputOptions) {
+	if params == nil {
+		return data, outputOptions
+	}
+	fields := parseOnlyFields(params.GetString("only"))
+	if !hasOnlyExpressions(fields) {
+		return data, outputOptions
+	}
+	response, ok := data.(map[string]interface{})
+	if !ok {
+		return data, outputOptions
+	}
+	projected := make(map[string]interface{})
+	for key, value := range response {
+		projected[key] = value
+	}
+	switch t := response["data"].(type) {
+	case []interface{}:
+		items := make([]interface{}, 0, len(t))
+		for _, item := range t {
+			items = append(items, projectOnlyFields(item, fields))
+		}
+		projected["data"] = items
+	case map[string]interface{}:
+		projected["data"] = projectOnlyFields(t, fields)
+	}
+	aliases := make([]string, 0, len(fields))
+	for _, field := range fields {
+		aliases = append(aliases, field.Alias)
+	}
+	params.Set("only", strings.Join(aliases, ","))
+	return projected, withOutputColumns(outputOptions, aliases)
+}
+
+// initOnlyExpressions rewrites the only query parameter of API requests to
+// the top level fields the `alias:path` entries of --only refer to, since
+// the API only understands plain field names. The query parameters are
+// added by request level plugins, so this runs right before dialing.
+func initOnlyExpressions() {
+	cli.Client.UseHandler("before dial", func(ctx *context.Context, h context.Handler) {
+		query := ctx.Request.URL.Query()
+		fields := parseOnlyFields(query.Get("only"))
+		if !hasOnlyExpressions(fields) {
+			h.Next(ctx)
+			return
+		}
+		seen := make(map[string]bool)
+		topLevel := []string{}
+		for _, field := range fields {
+			if name := field.topLevel(); !seen[name] {
+				seen[name] = true
+				topLevel = append(topLevel, name)
+			}
+		}
+		query.Set("only", strings.Join(topLevel, ","))
+		ctx.Request.URL.RawQuery = query.Encode()
+		h.Next(ctx)
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOnlyFields(t *testing.T) {
+	tests := []struct {
+		only string
+		want []onlyField
+	}{
+		{"", []onlyField{}},
+		{"name", []onlyField{{"name", "name"}}},
+		{"name, state ,", []onlyField{{"name", "name"}, {"state", "state"}}},
+		{"ip:public_ips[0]", []onlyField{{"ip", "public_ips[0]"}}},
+		{"name,size: extra.size", []onlyField{{"name", "name"}, {"size", "extra.size"}}},
+		{"zone:location.zone:name", []onlyField{{"zone", "location.zone:name"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.only, func(t *testing.T) {
+			if got := parseOnlyFields(tt.only); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseOnlyFields(%q) = %v, want %v", tt.only, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnlyFieldExpressions(t *testing.T) {
+	tests := []struct {
+		field        onlyField
+		topLevel     string
+		isExpression bool
+	}{
+		{onlyField{"name", "name"}, "name", false},
+		{onlyField{"ip", "public_ips[0]"}, "public_ips", true},
+		{onlyField{"size", "extra.size"}, "extra", true},
+		{onlyField{"title", "name"}, "name", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field.Alias+":"+tt.field.Path, func(t *testing.T) {
+			if got := tt.field.topLevel(); got != tt.topLevel {
+				t.Errorf("topLevel() = %q, want %q", got, tt.topLevel)
+			}
+			if got := tt.field.isExpression(); got != tt.isExpression {
+				t.Errorf("isExpression() = %v, want %v", got, tt.isExpression)
+			}
+		})
+	}
+}
+
+func TestProjectOnlyFields(t *testing.T) {
+	item := map[string]interface{}{
+		"name":       "web",
+		"public_ips": []interface{}{"1.2.3.4", "5.6.7.8"},
+		"extra":      map[string]interface{}{"size": "large"},
+	}
+	tests := []struct {
+		only string
+		want interface{}
+	}{
+		{"name", map[string]interface{}{"name": "web"}},
+		{"ip:public_ips[1],size:extra.size", map[string]interface{}{"ip": "5.6.7.8", "size": "large"}},
+		{"missing:extra.zone", map[string]interface{}{"missing": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.only, func(t *testing.T) {
+			if got := projectOnlyFields(item, parseOnlyFields(tt.only)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("projectOnlyFields(%q) = %v, want %v", tt.only, got, tt.want)
+			}
+		})
+	}
+	if got := projectOnlyFields("scalar", parseOnlyFields("name")); got != "scalar" {
+		t.Errorf("projectOnlyFields of a scalar = %v, want it unchanged", got)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+// Tokens of Mist belong to one organization, so a context keeps a token for
+// every organization it is used with, under orgs in its settings, by id:
+//
+//   orgs:
+//     <id>:
+//       name: <name>
+//       api_key: <token or keyring:>
+//
+// The org setting of the context selects which one is used, and the token
+// of the context is used when it names none of them.
+
+// contextOrgs returns the organizations with tokens in the context, by id.
+func contextOrgs(context string) map[string]map[string]interface{} {
+	orgs := make(map[string]map[string]interface{})
+	for id, value := range cli.Creds.GetStringMap("contexts." + context + ".orgs") {
+		if settings, ok := value.(map[string]interface{}); ok {
+			orgs[id] = settings
+		}
+	}
+	return orgs
+}
+
+// findContextOrg returns the id of the organization of the context with the
+// name or id.
+func findContextOrg(context, org string) (string, bool) {
+	for id, settings := range contextOrgs(context) {
+		name, _ := settings["name"].(string)
+		if id == strings.ToLower(org) || strings.EqualFold(name, org) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// selectedOrg returns the id of the organization selected with --org, or
+// else with the org setting of the context, or "" if the token of the
+// context is used. A context org without a token of its own is the one the
+// token of the context belongs to.
+func selectedOrg() (string, error) {
+	context := viper.GetString("context")
+	if org := viper.GetString("org"); org != "" {
+		id, ok := findContextOrg(context, org)
+		if !ok {
+			return "", fmt.Errorf("no token for organization %s in context %s, use `%s org use %s` to add one", org, context, cli.Root.CommandPath(), org)
+		}
+		return id, nil
+	}
+	if org := contextSetting("org"); org != "" {
+		id, _ := findContextOrg(context, org)
+		return id, nil
+	}
+	return "", nil
+}
+
+// orgTokenAccount is the user the token of an organization is stored under
+// in the OS keyring.
+func orgTokenAccount(context, id string) string {
+	return context + "/" + id
+}
+
+// orgToken returns the token of the organization of the context.
+func orgToken(context, id string) (string, error) {
+	apiKey := cli.Creds.GetString("contexts." + context + ".orgs." + id + ".api_key")
+	if apiKey != keyringPlaceholder {
+		return apiKey, nil
+	}
+	token, err := keyringStore{}.Get(orgTokenAccount(context, id))
+	if err != nil {
+		return "", fmt.Errorf("could not read the token of organization %s from the OS keyring: %s", id, err)
+	}
+	return token, nil
+}
+
+// saveOrgToken stores the token of the organization in the context.
+func saveOrgToken(context, id, name, token string) error {
+	contexts := cli.Creds.GetStringMap("contexts")
+	settings, _ := contexts[context].(map[string]interface{})
+	if settings == nil {
+		return fmt.Errorf("context %s not configured", context)
+	}
+	orgs, _ := settings["orgs"].(map[string]interface{})
+	if orgs == nil {
+		orgs = make(map[string]interface{})
+	}
+	orgs[id] = map[string]interface{}{
+		"name":    name,
+		"api_key": storeContextToken(orgTokenAccount(context, id), token),
+	}
+	settings["orgs"] = orgs
+	return writeContexts(contexts)
+}
+
+// selectContextOrg makes the context act in the organization.
+func selectContextOrg(context, name string) error {
+	contexts := cli.Creds.GetStringMap("contexts")
+	settings, _ := contexts[context].(map[string]interface{})
+	if settings == nil {
+		return fmt.Errorf("context %s not configured", context)
+	}
+	settings["org"] = name
+	return writeContexts(contexts)
+}
+
+// moveOrgTokens moves the tokens of the organizations of a renamed context
+// in the OS keyring.
+func moveOrgTokens(from, to string) error {
+	for id, settings := range contextOrgs(from) {
+		if settings["api_key"] != keyringPlaceholder {
+			continue
+		}
+		token, err := orgToken(from, id)
+		if err != nil {
+			return err
+		}
+		if _, err := (keyringStore{}).Set(orgTokenAccount(to, id), token); err != nil {
+			return err
+		}
+		keyringStore{}.Delete(orgTokenAccount(from, id))
+	}
+	return nil
+}
+
+// deleteOrgTokens deletes the tokens of the organizations of a context from
+// the OS keyring.
+func deleteOrgTokens(context string) {
+	for id := range contextOrgs(context) {
+		keyringStore{}.Delete(orgTokenAccount(context, id))
+	}
+}
+
+// userOrgs lists the organizations the user of the token is a member of.
+func userOrgs(server, token string) ([]map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(server, "/")+"/api/v1/orgs", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", token)
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("could not list the organizations: %s", resp.Status)
+	}
+	var decoded interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, err
+	}
+	if data, ok := decoded.(map[string]interface{}); ok {
+		decoded = data["data"]
+	}
+	list, _ := decoded.([]interface{})
+	orgs := []map[string]interface{}{}
+	for _, item := range list {
+		if org, ok := item.(map[string]interface{}); ok {
+			orgs = append(orgs, org)
+		}
+	}
+	return orgs, nil
+}
+
+// initOrgs adds --org and makes API requests use the token of the selected
+// organization.
+func initOrgs() {
+	flags := cli.Root.PersistentFlags()
+	flags.String("org", "", "Organization to act in, by name or id, instead of the one of the context")
+	viper.BindPFlag("org", flags.Lookup("org"))
+	viper.BindEnv("org", "MIST_ORG")
+	cli.Client.UseHandler("before dial", func(ctx *context.Context, h context.Handler) {
+		if err := setContext(); err != nil {
+			h.Error(ctx, err)
+			return
+		}
+		id, err := selectedOrg()
+		if err != nil {
+			h.Error(ctx, err)
+			return
+		}
+		if id != "" {
+			token, err := orgToken(viper.GetString("context"), id)
+			if err != nil {
+				h.Error(ctx, err)
+				return
+			}
+			ctx.Request.Header.Set("Authorization", token)
+		}
+		h.Next(ctx)
+	})
+}
+
+func orgListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the organizations of the user",
+		Long: `List the organizations the user of the context is a member of, marking the
+selected one and those with a token in the context.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setContext(); err != nil {
+				logger.Fatal(err)
+			}
+			name := viper.GetString("context")
+			server, err := getValidServer()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			token, err := getContextToken()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			selected, _ := selectedOrg()
+			stored := contextOrgs(name)
+			orgs, err := userOrgs(server, token)
+			if err != nil {
+				// Show the organizations known to the context at least.
+				fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+				for id, settings := range stored {
+					orgs = append(orgs, map[string]interface{}{"id": id, "name": settings["name"]})
+				}
+			}
+			sort.SliceStable(orgs, func(i, j int) bool { return fmt.Sprint(orgs[i]["name"]) < fmt.Sprint(orgs[j]["name"]) })
+			rows := []interface{}{}
+			for _, org := range orgs {
+				id, _ := org["id"].(string)
+				orgName, _ := org["name"].(string)
+				current, hasToken := "", ""
+				if selected != "" && id == selected || selected == "" && strings.EqualFold(orgName, contextSetting("org")) {
+					current = "*"
+				}
+				if _, ok := stored[id]; ok {
+					hasToken = "yes"
+				}
+				rows = append(rows, map[string]interface{}{"current": current, "name": orgName, "id": id, "token": hasToken})
+			}
+			columns := []string{"current", "name", "id", "token"}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func orgUseCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "use ORG",
+		Short: "Switch the organization of the context",
+		Long: `Switch the organization the context acts in, by name or id. Tokens belong
+to one organization, so the first time an organization is used a token of
+it is asked for, or given with --token, and kept in the context.
+
+To act in another organization for a single command, use --org instead.`,
+		Example: `  mist org use acme
+  mist org use acme --token $ACME_TOKEN
+  mist get machines --org other`,
+		Args: cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) != 0 || setContext() != nil {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			names := []string{}
+			for _, settings := range contextOrgs(viper.GetString("context")) {
+				if name, ok := settings["name"].(string); ok {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			return names, cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setContext(); err != nil {
+				logger.Fatal(err)
+			}
+			name := viper.GetString("context")
+			if id, ok := findContextOrg(name, args[0]); ok && !cmd.Flags().Changed("token") {
+				orgName, _ := contextOrgs(name)[id]["name"].(string)
+				if err := selectContextOrg(name, orgName); err != nil {
+					logger.Fatalf("Error saving context: %s", err.Error())
+				}
+				fmt.Printf("Switched context %s to organization %s\n", name, orgName)
+				return
+			}
+			server, err := getValidServer()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			server = strings.TrimSuffix(server, "/")
+			token, err := getContextToken()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			orgs, err := userOrgs(server, token)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			var org map[string]interface{}
+			for _, candidate := range orgs {
+				if candidate["id"] == strings.ToLower(args[0]) || strings.EqualFold(fmt.Sprint(candidate["name"]), args[0]) {
+					org = candidate
+				}
+			}
+			if org == nil {
+				logger.Fatalf("Organization %s not found, see %s org list", args[0], cli.Root.CommandPath())
+			}
+			id, _ := org["id"].(string)
+			orgName, _ := org["name"].(string)
+			orgToken := params.GetString("token")
+			if orgToken == "" {
+				fmt.Fprintf(os.Stderr, "Create a token of organization %s at %s/my-account/tokens\n", orgName, server)
+				if orgToken, err = tokenPrompt(); err != nil {
+					logger.Fatalf("Switch cancelled: %s", err.Error())
+				}
+			}
+			if err := verifyToken(server, orgToken); err != nil {
+				logger.Fatal(err)
+			}
+			if err := saveOrgToken(name, id, orgName, orgToken); err != nil {
+				logger.Fatalf("Error saving context: %s", err.Error())
+			}
+			if err := selectContextOrg(name, orgName); err != nil {
+				logger.Fatalf("Error saving context: %s", err.Error())
+			}
+			fmt.Printf("Switched context %s to organization %s\n", name, orgName)
+		},
+	}
+	cmd.Flags().String("token", "", "API token of the organization")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func orgCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "org",
+		Short: "Switch between organizations",
+	}
+	cmd.AddCommand(orgListCmd())
+	cmd.AddCommand(orgUseCmd())
+	return cmd
+}
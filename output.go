@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+type responseFormatter interface {
+	Format(data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) error
+}
+
+// outputFormatter extends the generated formatter with additional output
+// formats and delegates everything else to it.
+type outputFormatter struct {
+	next responseFormatter
+}
+
+func (f *outputFormatter) Format(data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) error {
+	trackJob(data)
+
+	if activePager != nil {
+		activePager.capture(data, params, outputOptions)
+		return nil
+	}
+	data = applyClientFilters(data)
+	if activeWatcher != nil {
+		activeWatcher.capture(data, params, outputOptions)
+		return nil
+	}
+	return f.render(data, params, outputOptions)
+}
+
+func (f *outputFormatter) render(data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) error {
+	applyContextOutput()
+	// The only query of the request was rewritten to the top level fields
+	// of --only, so even msgpack needs the fields projected.
+	data, outputOptions = applyOnlyExpressions(data, params, outputOptions)
+	switch outputFormat() {
+	case "msgpack":
+		return writeMsgpack(os.Stdout, data)
+	}
+	outputOptions = hideConfiguredColumns(outputOptions, params)
+	if raw, _ := cli.Root.PersistentFlags().GetBool("raw"); raw {
+		return writeRaw(os.Stdout, data)
+	}
+	if localizedOutput() {
+		data = localizeTimes(data)
+	}
+	if shouldTranspose(data) {
+		data, outputOptions = transpose(data, outputOptions)
+	}
+	if ok, err := writeExtraFormat(f.next, data, params, outputOptions); ok {
+		return err
+	}
+	return f.next.Format(data, params, outputOptions)
+}
+
+// isTableOutput reports whether the output is rendered as a table.
+func isTableOutput() bool {
+	switch format := outputFormat(); {
+	case format == "json", format == "yaml", format == "csv", format == "tsv", format == "msgpack":
+		return false
+	case strings.HasPrefix(format, customColumnsPrefix), strings.HasPrefix(format, goTemplatePrefix), strings.HasPrefix(format, goTemplateFilePrefix):
+		return false
+	}
+	return true
+}
+
+// shouldTranspose reports whether a single resource is rendered with its
+// fields as rows. This is done when --transpose is set, and by default for
+// single resource get commands writing to a terminal unless --no-transpose
+// is set.
+func shouldTranspose(data interface{}) bool {
+	response, ok := data.(map[string]interface{})
+	if !ok || !isTableOutput() || outputQuery() != "" {
+		return false
+	}
+	if _, ok := response["data"].(map[string]interface{}); !ok {
+		return false
+	}
+	if on, _ := cli.Root.PersistentFlags().GetBool("transpose"); on {
+		return true
+	}
+	if off, _ := cli.Root.PersistentFlags().GetBool("no-transpose"); off {
+		return false
+	}
+	cmd := executingCommand()
+	return cmd.HasParent() && cmd.Parent().Name() == "get" && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// transpose turns a single resource into a FIELD/VALUE table of its wide
+// columns, or of all its fields if the command defines no columns.
+func transpose(data interface{}, outputOptions cli.CLIOutputOptions) (interface{}, cli.CLIOutputOptions) {
+	item := data.(map[string]interface{})["data"].(map[string]interface{})
+	fields := append([]string{}, outputOptions.WideColumns...)
+	if len(fields) == 0 {
+		for field := range item {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+	}
+	rows := []interface{}{}
+	for _, field := range fields {
+		value, err := jmespath.Search(field, item)
+		if err != nil {
+			value = item[field]
+		}
+		rows = append(rows, map[string]interface{}{"field": field, "value": transposedValue(value)})
+	}
+	return map[string]interface{}{"data": rows}, withOutputColumns(outputOptions, []string{"field", "value"})
+}
+
+func transposedValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		j, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprintf("%v", value)
+		}
+		return string(j)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// executingCommand returns the command being run.
+func executingCommand() *cobra.Command {
+	cmd, _, err := cli.Root.Find(os.Args[1:])
+	if err != nil {
+		return cli.Root
+	}
+	return cmd
+}
+
+// outputOptionsLists returns the table and wide table columns of the
+// output options, each along with its footer.
+func outputOptionsLists(outputOptions *cli.CLIOutputOptions) [2][2]*[]string {
+	return [2][2]*[]string{
+		{&outputOptions.Columns, &outputOptions.Footer},
+		{&outputOptions.WideColumns, &outputOptions.WideFooter},
+	}
+}
+
+// removeColumns drops the given columns from the table and wide table
+// columns, along with the matching footer entries.
+func removeColumns(outputOptions cli.CLIOutputOptions, hidden map[string]bool) cli.CLIOutputOptions {
+	for _, list := range outputOptionsLists(&outputOptions) {
+		columns, footer := *list[0], *list[1]
+		keptColumns := []string{}
+		keptFooter := []string{}
+		for j, column := range columns {
+			if hidden[column] {
+				continue
+			}
+			keptColumns = append(keptColumns, column)
+			if len(footer) == len(columns) {
+				keptFooter = append(keptFooter, footer[j])
+			}
+		}
+		if len(keptColumns) == 0 {
+			continue
+		}
+		*list[0] = keptColumns
+		if len(footer) == len(columns) {
+			*list[1] = keptFooter
+		}
+	}
+	return outputOptions
+}
+
+// withOutputColumns replaces the table and wide table columns of the output
+// options, dropping their footers.
+func withOutputColumns(outputOptions cli.CLIOutputOptions, columns []string) cli.CLIOutputOptions {
+	outputOptions.Columns = columns
+	outputOptions.WideColumns = columns
+	outputOptions.Footer = []string{}
+	outputOptions.WideFooter = []string{}
+	return outputOptions
+}
+
+// configuredHiddenColumns returns the columns hidden by the hidden_columns
+// config setting for the running command. The setting is either a list of
+// columns hidden everywhere, or a map from resource type (or "*" for all
+// types) to such a list.
+func configuredHiddenColumns() []string {
+	setting := viper.Get("hidden_columns")
+	if setting == nil {
+		return nil
+	}
+	if _, ok := setting.([]interface{}); ok {
+		return viper.GetStringSlice("hidden_columns")
+	}
+	hidden := viper.GetStringMapStringSlice("hidden_columns")
+	columns := hidden["*"]
+	resource := strings.TrimSuffix(executingCommand().Name(), "s")
+	return append(columns, hidden[resource]...)
+}
+
+func hideConfiguredColumns(outputOptions cli.CLIOutputOptions, params *viper.Viper) cli.CLIOutputOptions {
+	columns := configuredHiddenColumns()
+	if len(columns) == 0 {
+		return outputOptions
+	}
+	hidden := make(map[string]bool)
+	for _, column := range columns {
+		hidden[column] = true
+	}
+	// Columns asked for with --only are shown, including the aliases of its
+	// alias:path entries.
+	if params != nil {
+		for _, field := range parseOnlyFields(params.GetString("only")) {
+			delete(hidden, field.Alias)
+		}
+	}
+	return removeColumns(outputOptions, hidden)
+}
+
+func initOutputFormatter() {
+	cli.Root.PersistentFlags().Bool("transpose", false, "Show single resources with their fields as rows")
+	cli.Root.PersistentFlags().Bool("no-transpose", false, "Never show single resources with their fields as rows")
+	cli.Root.PersistentFlags().Bool("raw", false, "Write the result of -q without quoting strings, with list items one per line")
+	cli.Formatter = &outputFormatter{next: cli.Formatter}
+}
+
+// outputFormat returns the value of the global -o flag.
+func outputFormat() string {
+	if flag := cli.Root.PersistentFlags().ShorthandLookup("o"); flag != nil {
+		return flag.Value.String()
+	}
+	return ""
+}
+
+// applyContextOutput makes the default output format of the selected
+// context, or else of the output setting, apply unless -o was given.
+func applyContextOutput() {
+	flag := cli.Root.PersistentFlags().ShorthandLookup("o")
+	if flag == nil || flag.Changed {
+		return
+	}
+	if output := contextSetting("output"); output != "" {
+		flag.Value.Set(output)
+	} else if output := viper.GetString("output"); output != "" {
+		flag.Value.Set(output)
+	}
+}
+
+// outputQuery returns the value of the global -q flag.
+func outputQuery() string {
+	if flag := cli.Root.PersistentFlags().ShorthandLookup("q"); flag != nil {
+		return flag.Value.String()
+	}
+	return ""
+}
+
+// jsonValue converts data to the generic representation produced by
+// decoding its JSON form, so every output format sees the same values as
+// `-o json`.
+func jsonValue(data interface{}) (interface{}, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// writeMsgpack serializes data as MessagePack (https://msgpack.org). The
+// encoded value mirrors the JSON output: objects become maps with string
+// keys sorted alphabetically, arrays become arrays, integral numbers become
+// integers and all other numbers 64-bit floats. The -q query is applied
+// before encoding, on float64 numbers as for `-o json`, since JMESPath only
+// compares those; json.Number is only used to tell integers from floats.
+func writeMsgpack(w io.Writer, data interface{}) error {
+	if query := outputQuery(); query != "" {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return err
+		}
+		if data, err = jmespath.Search(query, decoded); err != nil {
+			return err
+		}
+	}
+	value, err := jsonValue(data)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, value); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func encodeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch t := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			encodeMsgpackInt(buf, i)
+			return nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return err
+		}
+		encodeMsgpackFloat(buf, f)
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1<<63 {
+			encodeMsgpackInt(buf, int64(t))
+		} else {
+			encodeMsgpackFloat(buf, t)
+		}
+	case string:
+		n := len(t)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.Write([]byte{0xd9, byte(n)})
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(t)
+	case []interface{}:
+		n := len(t)
+		switch {
+		case n < 16:
+			buf.WriteByte(0x90 | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xdc)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdd)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		for _, item := range t {
+			if err := encodeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		n := len(t)
+		switch {
+		case n < 16:
+			buf.WriteByte(0x80 | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xde)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdf)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		keys := make([]string, 0, n)
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := encodeMsgpack(buf, key); err != nil {
+				return err
+			}
+			if err := encodeMsgpack(buf, t[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode value of type %T", value)
+	}
+	return nil
+}
+
+func encodeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func encodeMsgpackFloat(buf *bytes.Buffer, f float64) {
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+func TestEncodeMsgpack(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"true", true, []byte{0xc3}},
+		{"false", false, []byte{0xc2}},
+		{"positive fixint", json.Number("5"), []byte{0x05}},
+		{"negative fixint", json.Number("-3"), []byte{0xfd}},
+		{"int8", json.Number("-100"), []byte{0xd0, 0x9c}},
+		{"int16", json.Number("1000"), []byte{0xd1, 0x03, 0xe8}},
+		{"int32", json.Number("100000"), []byte{0xd2, 0x00, 0x01, 0x86, 0xa0}},
+		{"float", json.Number("1.5"), []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"integral float64", float64(2), []byte{0x02}},
+		{"fixstr", "ab", []byte{0xa2, 'a', 'b'}},
+		{"fixarray", []interface{}{json.Number("1"), "a"}, []byte{0x92, 0x01, 0xa1, 'a'}},
+		{"sorted fixmap", map[string]interface{}{"b": true, "a": nil}, []byte{0x82, 0xa1, 'a', 0xc0, 0xa1, 'b', 0xc3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := encodeMsgpack(&buf, tt.value); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Errorf("encodeMsgpack(%v) = % x, want % x", tt.value, buf.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+// setOutputQuery gives the -q flag of a stand-in root command the query,
+// restoring the root command when the test ends.
+func setOutputQuery(t *testing.T, query string) {
+	root := cli.Root
+	t.Cleanup(func() { cli.Root = root })
+	cli.Root = &cobra.Command{Use: "mist"}
+	cli.Root.PersistentFlags().StringP("query", "q", "", "")
+	if err := cli.Root.PersistentFlags().Set("query", query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteMsgpackQuery(t *testing.T) {
+	data := map[string]interface{}{
+		"data": []interface{}{
+			map[string]interface{}{"name": "small", "cpus": 1},
+			map[string]interface{}{"name": "large", "cpus": 4},
+		},
+	}
+	tests := []struct {
+		query string
+		want  []interface{}
+	}{
+		{"data[?cpus > `2`].name", []interface{}{"large"}},
+		{"data[?cpus == `1`].cpus", []interface{}{json.Number("1")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			setOutputQuery(t, tt.query)
+			var got, want bytes.Buffer
+			if err := writeMsgpack(&got, data); err != nil {
+				t.Fatal(err)
+			}
+			if err := encodeMsgpack(&want, tt.want); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("writeMsgpack with -q %s = % x, want % x", tt.query, got.Bytes(), want.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+	"gopkg.in/h2non/gentleman.v2"
+)
+
+// maxPageSize is the largest page the API returns.
+const maxPageSize = 1000
+
+// largeFetchSize is the number of resources above which fetching every page
+// prints a warning, as it may take a while.
+const largeFetchSize = 5000
+
+// activePager receives the output of the command being paged through
+// instead of the formatter.
+var activePager *pager
+
+// pager concatenates the pages of a listing. Pages may be added while the
+// listing is being interrupted, so its fields are guarded by mu.
+type pager struct {
+	mu            sync.Mutex
+	kind          string
+	items         []interface{}
+	total         int
+	returned      int
+	decoded       map[string]interface{}
+	params        *viper.Viper
+	outputOptions cli.CLIOutputOptions
+	progress      bool
+	warned        bool
+
+	// stopped is set once the listing is interrupted, after which pages
+	// still arriving are dropped.
+	stopped bool
+}
+
+func newPager(kind string) *pager {
+	return &pager{kind: kind, progress: term.IsTerminal(int(os.Stderr.Fd()))}
+}
+
+func (p *pager) capture(data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.params = params
+	p.outputOptions = outputOptions
+	decoded, _ := data.(map[string]interface{})
+	p.append(decoded)
+}
+
+// add appends a page, and keeps the total the API reports, if any.
+func (p *pager) add(decoded map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		p.append(decoded)
+	}
+}
+
+func (p *pager) append(decoded map[string]interface{}) {
+	p.decoded = decoded
+	items, _ := decoded["data"].([]interface{})
+	p.items = append(p.items, items...)
+	p.returned = len(items)
+	if meta, ok := decoded["meta"].(map[string]interface{}); ok {
+		if total, ok := meta["total"].(float64); ok {
+			p.total = int(total)
+		}
+	}
+	if p.total > largeFetchSize && !p.warned {
+		p.warned = true
+		fmt.Fprintf(os.Stderr, "Warning: fetching all %d %s, this may take a while. Use --limit or --no-all to fetch a single page\n", p.total, p.kind)
+	}
+	if p.progress {
+		if p.total > 0 {
+			fmt.Fprintf(os.Stderr, "\rFetched %d of %d %s", len(p.items), p.total, p.kind)
+		} else {
+			fmt.Fprintf(os.Stderr, "\rFetched %d %s", len(p.items), p.kind)
+		}
+	}
+}
+
+// done returns whether the last page was fetched.
+func (p *pager) done(pageSize int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.returned < pageSize || p.total > 0 && len(p.items) >= p.total
+}
+
+// fetched returns whether a page was fetched.
+func (p *pager) fetched() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.decoded != nil
+}
+
+// stop drops the pages fetched from now on, and tells how many resources
+// were fetched until then.
+func (p *pager) stop() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	if p.total > 0 {
+		return fmt.Sprintf("showing the %d of %d %s fetched", len(p.items), p.total, p.kind)
+	}
+	return fmt.Sprintf("showing the %d %s fetched", len(p.items), p.kind)
+}
+
+// result returns the concatenated pages as a single response, and clears
+// the progress indicator.
+func (p *pager) result() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.progress {
+		fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", 40))
+	}
+	result := map[string]interface{}{"data": p.items}
+	if meta, ok := p.decoded["meta"].(map[string]interface{}); ok {
+		combined := map[string]interface{}{}
+		for k, v := range meta {
+			combined[k] = v
+		}
+		combined["start"] = 0
+		combined["returned"] = len(p.items)
+		result["meta"] = combined
+	}
+	return result
+}
+
+// listAllPages calls a list operation page by page until every resource
+// has been fetched, and returns them as a single response.
+func listAllPages(kind string, list func(params *viper.Viper) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error), params *viper.Viper) (map[string]interface{}, cli.CLIOutputOptions, error) {
+	return listPages(&pager{kind: kind + "s"}, list, params)
+}
+
+// listPages fetches every page of a listing with the pager, which holds
+// the pages fetched so far.
+func listPages(p *pager, list func(params *viper.Viper) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error), params *viper.Viper) (map[string]interface{}, cli.CLIOutputOptions, error) {
+	var outputOptions cli.CLIOutputOptions
+	for start := 0; ; start += maxPageSize {
+		params.Set("start", strconv.Itoa(start))
+		params.Set("limit", maxPageSize)
+		_, decoded, options, err := list(params)
+		if err != nil {
+			return nil, outputOptions, err
+		}
+		outputOptions = options
+		p.capture(decoded, params, options)
+		if p.done(maxPageSize) {
+			return p.result(), outputOptions, nil
+		}
+	}
+}
+
+// runAllPages runs a listing command page by page, concatenating the pages
+// it outputs, and shows them once all have been fetched. Interrupting it
+// with Ctrl-C shows the pages fetched so far.
+func runAllPages(run func(cmd *cobra.Command, args []string), cmd *cobra.Command, args []string) {
+	pageSize, _ := cmd.Flags().GetInt64("limit")
+	if pageSize <= 0 || pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	p := newPager(cmd.Name())
+	activePager = p
+	sigc, stop := notifyInterrupt()
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for start := 0; ; start += int(pageSize) {
+			cmd.Flags().Set("start", strconv.Itoa(start))
+			cmd.Flags().Set("limit", strconv.FormatInt(pageSize, 10))
+			p.mu.Lock()
+			before := len(p.items)
+			p.decoded = nil
+			p.mu.Unlock()
+			run(cmd, args)
+			p.mu.Lock()
+			listed, fetched := p.decoded != nil, len(p.items) > before
+			p.mu.Unlock()
+			if !listed {
+				logger.Fatal("Fetching every page is only supported for commands listing resources")
+			}
+			if p.done(int(pageSize)) || !fetched {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-sigc:
+		note := p.stop()
+		showPartial(p.result(), p.params, p.outputOptions, note)
+	}
+	activePager = nil
+	if err := cli.Formatter.Format(p.result(), p.params, p.outputOptions); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+}
+
+// initPagination adds the --page and --all flags to the commands listing
+// resources, which take a --limit and --start from the API. --page picks a
+// page of --limit resources, and --all fetches every page.
+func initPagination() {
+	cmds := []*cobra.Command{}
+	for _, cmd := range cli.Root.Commands() {
+		switch {
+		case cmd.Name() == "get":
+			cmds = append(cmds, cmd.Commands()...)
+		case strings.HasPrefix(cmd.Name(), "list-"):
+			cmds = append(cmds, cmd)
+		}
+	}
+	for _, cmd := range cmds {
+		if cmd.Run == nil || cmd.Flags().Lookup("limit") == nil || cmd.Flags().Lookup("start") == nil {
+			continue
+		}
+		cmd.Flags().Int("page", 0, "Show this page of --limit resources, counting from 1 (Only for listings)")
+		cmd.Flags().Bool("all", false, "Fetch every page of resources (Only for listings)")
+		run := cmd.Run
+		cmd.Run = func(cmd *cobra.Command, args []string) {
+			page, _ := cmd.Flags().GetInt("page")
+			all, _ := cmd.Flags().GetBool("all")
+			switch {
+			case len(args) > 0 || page == 0 && !all:
+				run(cmd, args)
+			case all:
+				if page != 0 || cmd.Flags().Changed("start") {
+					logger.Fatal("--all can't be combined with --page or --start")
+				}
+				if watch, _ := cmd.Flags().GetBool("watch"); watch {
+					logger.Fatal("--all can't be combined with --watch")
+				}
+				runAllPages(run, cmd, args)
+			default:
+				if page < 0 {
+					logger.Fatal("--page must be at least 1")
+				}
+				if cmd.Flags().Changed("start") {
+					logger.Fatal("--page can't be combined with --start")
+				}
+				limit, _ := cmd.Flags().GetInt64("limit")
+				if limit <= 0 {
+					logger.Fatal("--page needs a --limit")
+				}
+				cmd.Flags().Set("start", strconv.FormatInt(int64(page-1)*limit, 10))
+				run(cmd, args)
+			}
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// Plugins are executables named mist-NAME, run for "mist NAME" when mist
+// has no such command, like the plugins of kubectl. They are looked up in
+// ~/.mist/plugins, where plugin install puts them, and then on the PATH.
+// "mist foo bar" runs mist-foo-bar if there is one, and mist-foo otherwise.
+
+const pluginPrefix = "mist-"
+
+// pluginName matches the names plugins may have, so that names from the
+// registry can't point outside the plugins directory.
+var pluginName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// pluginIndex is the index of a plugin registry, listing the plugins which
+// can be installed and their executables for each platform.
+type pluginIndex struct {
+	Plugins []pluginEntry `json:"plugins"`
+}
+
+type pluginEntry struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Version     string           `json:"version"`
+	Homepage    string           `json:"homepage"`
+	Platforms   []pluginPlatform `json:"platforms"`
+}
+
+type pluginPlatform struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// installedPlugin is an executable found where plugins are looked up.
+type installedPlugin struct {
+	name string
+	path string
+	// shadowedBy is the command or plugin run instead of this one.
+	shadowedBy string
+}
+
+func pluginDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".mist", "plugins"), nil
+}
+
+// pluginDirs returns where plugins are looked up, in order.
+func pluginDirs() []string {
+	dirs := []string{}
+	if dir, err := pluginDir(); err == nil {
+		dirs = append(dirs, dir)
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return uniqueStrings(dirs)
+}
+
+func pluginFilename(name string) string {
+	if runtime.GOOS == "windows" {
+		return pluginPrefix + name + ".exe"
+	}
+	return pluginPrefix + name
+}
+
+// isExecutable returns whether the file is one plugins can be, which on
+// Windows is told from its extension.
+func isExecutable(info os.FileInfo) bool {
+	if info.IsDir() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Ext(info.Name()), ".exe")
+	}
+	return info.Mode().Perm()&0111 != 0
+}
+
+// findPlugins returns the plugins found, in the order they are looked up.
+func findPlugins() []installedPlugin {
+	plugins := []installedPlugin{}
+	found := make(map[string]string)
+	for _, dir := range pluginDirs() {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), pluginPrefix) || !isExecutable(entry) {
+				continue
+			}
+			name := strings.TrimPrefix(entry.Name(), pluginPrefix)
+			if runtime.GOOS == "windows" {
+				name = strings.TrimSuffix(name, filepath.Ext(name))
+			}
+			plugin := installedPlugin{name: name, path: filepath.Join(dir, entry.Name())}
+			if path, ok := found[name]; ok {
+				plugin.shadowedBy = path
+			} else if builtinCommand(strings.SplitN(name, "-", 2)[0]) {
+				plugin.shadowedBy = "command " + strings.SplitN(name, "-", 2)[0]
+			} else {
+				found[name] = plugin.path
+			}
+			plugins = append(plugins, plugin)
+		}
+	}
+	return plugins
+}
+
+// lookupPlugin returns the plugin run for the arguments, the one named
+// after the most arguments before the first flag, and the arguments left
+// for it.
+func lookupPlugin(args []string) (string, []string, bool) {
+	words := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") || !pluginName.MatchString(arg) {
+			break
+		}
+		words = append(words, arg)
+	}
+	for n := len(words); n > 0; n-- {
+		filename := pluginFilename(strings.Join(words[:n], "-"))
+		for _, dir := range pluginDirs() {
+			path := filepath.Join(dir, filename)
+			if info, err := os.Stat(path); err == nil && isExecutable(info) {
+				return path, args[n:], true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// runPlugin runs the plugin, telling it the context in use and how to run
+// mist, so that it can make requests with mist itself.
+func runPlugin(path string, args []string) error {
+	c := exec.Command(path, args...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Env = os.Environ()
+	if executable, err := os.Executable(); err == nil {
+		c.Env = append(c.Env, "MIST_CLI="+executable)
+	}
+	if setContext() == nil {
+		c.Env = append(c.Env, "MIST_CONTEXT="+viper.GetString("context"))
+	}
+	return c.Run()
+}
+
+// initPlugins runs the plugin for the command line if mist has no command
+// for it, exiting with the exit code of the plugin.
+func initPlugins() {
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") || builtinCommand(args[0]) {
+		return
+	}
+	if cmd, _, err := cli.Root.Find(args); err == nil && cmd != cli.Root {
+		return
+	}
+	path, rest, ok := lookupPlugin(args)
+	if !ok {
+		return
+	}
+	err := runPlugin(path, rest)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		logger.Fatalf("Error running plugin %s: %s", path, err.Error())
+	}
+	os.Exit(0)
+}
+
+// pluginRegistry returns the URL of the registry index given with
+// --registry, or the plugin_registry setting.
+func pluginRegistry(params *viper.Viper) string {
+	if registry := params.GetString("registry"); registry != "" {
+		return registry
+	}
+	return viper.GetString("plugin_registry")
+}
+
+// fetchPluginIndex reads the index of the registry.
+func fetchPluginIndex(registry string) (pluginIndex, error) {
+	var index pluginIndex
+	if registry == "" {
+		return index, fmt.Errorf("no plugin registry set, give --registry or run %s config set plugin_registry URL", cli.Root.CommandPath())
+	}
+	client, err := httpClient()
+	if err != nil {
+		return index, err
+	}
+	client.Timeout = 30 * time.Second
+	resp, err := client.Get(registry)
+	if err != nil {
+		return index, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return index, fmt.Errorf("could not read plugin registry %s: %s", registry, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return index, fmt.Errorf("could not parse plugin registry %s: %s", registry, err)
+	}
+	return index, nil
+}
+
+// platform returns the executable of the plugin for this system.
+func (entry pluginEntry) platform() (pluginPlatform, error) {
+	for _, platform := range entry.Platforms {
+		if platform.OS == runtime.GOOS && platform.Arch == runtime.GOARCH {
+			return platform, nil
+		}
+	}
+	return pluginPlatform{}, fmt.Errorf("plugin %s is not available for %s/%s", entry.Name, runtime.GOOS, runtime.GOARCH)
+}
+
+// installPlugin downloads the executable of the plugin to the plugins
+// directory, checking its checksum before replacing any installed one.
+func installPlugin(entry pluginEntry) (string, error) {
+	platform, err := entry.platform()
+	if err != nil {
+		return "", err
+	}
+	if platform.SHA256 == "" {
+		return "", fmt.Errorf("the registry has no checksum for plugin %s", entry.Name)
+	}
+	dir, err := pluginDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	client, err := downloadClient(5 * time.Minute)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Get(platform.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("could not download %s: %s", platform.URL, resp.Status)
+	}
+	tmp, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not download %s: %s", platform.URL, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, platform.SHA256) {
+		return "", fmt.Errorf("checksum of %s is %s, expected %s", platform.URL, sum, platform.SHA256)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, pluginFilename(entry.Name))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func pluginAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	dir, err := pluginDir()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, plugin := range findPlugins() {
+		if filepath.Dir(plugin.path) == dir {
+			names = append(names, plugin.name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+func pluginListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List plugins",
+		Long: `List the plugins found in ~/.mist/plugins and on the PATH, and which of
+them aren't run because a command or another plugin has their name. With
+--available, list the plugins of the registry instead.`,
+		Example: `  mist plugin list
+  mist plugin list --available`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			rows := []interface{}{}
+			var columns, wideColumns []string
+			if params.GetBool("available") {
+				index, err := fetchPluginIndex(pluginRegistry(params))
+				if err != nil {
+					logger.Fatal(err)
+				}
+				installed := make(map[string]bool)
+				for _, plugin := range findPlugins() {
+					installed[plugin.name] = installed[plugin.name] || plugin.shadowedBy == ""
+				}
+				sort.Slice(index.Plugins, func(i, j int) bool { return index.Plugins[i].Name < index.Plugins[j].Name })
+				for _, entry := range index.Plugins {
+					_, err := entry.platform()
+					rows = append(rows, map[string]interface{}{
+						"name":        entry.Name,
+						"version":     entry.Version,
+						"description": entry.Description,
+						"homepage":    entry.Homepage,
+						"installed":   installed[entry.Name],
+						"available":   err == nil,
+					})
+				}
+				columns = []string{"name", "version", "installed", "description"}
+				wideColumns = []string{"name", "version", "installed", "available", "description", "homepage"}
+			} else {
+				for _, plugin := range findPlugins() {
+					rows = append(rows, map[string]interface{}{
+						"name":        plugin.name,
+						"path":        plugin.path,
+						"shadowed_by": plugin.shadowedBy,
+					})
+				}
+				columns = []string{"name", "path", "shadowed_by"}
+				wideColumns = columns
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{columns, wideColumns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().Bool("available", false, "List the plugins of the registry")
+	cmd.Flags().String("registry", "", "URL of the plugin registry index, instead of the plugin_registry setting")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func pluginInstallCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "install NAME...",
+		Short: "Install plugins from the registry",
+		Long: `Install plugins from the registry to ~/.mist/plugins, or update them if
+they are installed. The executables are checked against the checksums of
+the registry before being installed.
+
+The registry is the URL of a JSON index, set with the plugin_registry
+setting or --registry, like:
+
+  {"plugins": [{"name": "report", "version": "1.0.0", "description": "...",
+    "platforms": [{"os": "linux", "arch": "amd64",
+      "url": "https://example.com/mist-report-linux-amd64", "sha256": "..."}]}]}`,
+		Example: `  mist plugin install report
+  mist report --help`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			index, err := fetchPluginIndex(pluginRegistry(params))
+			if err != nil {
+				logger.Fatal(err)
+			}
+			entries := make(map[string]pluginEntry)
+			for _, entry := range index.Plugins {
+				entries[entry.Name] = entry
+			}
+			for _, name := range args {
+				entry, ok := entries[name]
+				if !ok {
+					logger.Fatalf("Plugin %s not found in the registry, see %s plugin list --available", name, cli.Root.CommandPath())
+				}
+				if !pluginName.MatchString(name) {
+					logger.Fatalf("Invalid plugin name %q in the registry", name)
+				}
+				if builtinCommand(strings.SplitN(name, "-", 2)[0]) {
+					logger.Fatalf("Plugin %s would never run, %s is a command", name, strings.SplitN(name, "-", 2)[0])
+				}
+				path, err := installPlugin(entry)
+				if err != nil {
+					logger.Fatalf("Error installing plugin %s: %s", name, err)
+				}
+				fmt.Printf("Installed %s %s to %s\n", name, entry.Version, path)
+			}
+		},
+	}
+	cmd.Flags().String("registry", "", "URL of the plugin registry index, instead of the plugin_registry setting")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func pluginUninstallCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "uninstall NAME...",
+		Short:             "Remove plugins installed with plugin install",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: pluginAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			dir, err := pluginDir()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			for _, name := range args {
+				if !pluginName.MatchString(name) {
+					logger.Fatalf("Invalid plugin name %q", name)
+				}
+				if err := os.Remove(filepath.Join(dir, pluginFilename(name))); err != nil {
+					if os.IsNotExist(err) {
+						logger.Fatalf("Plugin %s is not installed in %s", name, dir)
+					}
+					logger.Fatal(err)
+				}
+				fmt.Printf("Plugin %s uninstalled\n", name)
+			}
+		},
+	}
+	return cmd
+}
+
+func pluginCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plugin",
+		Short: "Install and list plugins",
+		Long: `Install and list plugins, executables named mist-NAME which run as
+"mist NAME" for commands mist doesn't have. Plugins are looked up in
+~/.mist/plugins and on the PATH, and "mist foo bar" runs mist-foo-bar if
+there is one and mist-foo otherwise, with the rest of the arguments.
+
+Plugins are run with MIST_CLI set to the path of mist and MIST_CONTEXT to
+the context in use, so that they can run mist to make requests.`,
+	}
+	cmd.AddCommand(pluginListCmd())
+	cmd.AddCommand(pluginInstallCmd())
+	cmd.AddCommand(pluginUninstallCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
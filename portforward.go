@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+)
+
+// forwardSpec is a port forward in the [BIND_ADDRESS:]PORT:HOST:HOSTPORT
+// form used by ssh's -L and -R flags.
+type forwardSpec struct {
+	bindAddress string
+	bindPort    string
+	host        string
+	hostPort    string
+}
+
+var forwardHostPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+func parseForwardSpec(spec string) (forwardSpec, error) {
+	var f forwardSpec
+	// IPv6 addresses can be given in brackets.
+	parts := []string{}
+	for rest := spec; rest != ""; {
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return f, fmt.Errorf("invalid forward %q", spec)
+			}
+			parts = append(parts, rest[1:end])
+			rest = strings.TrimPrefix(rest[end+1:], ":")
+			continue
+		}
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			parts = append(parts, rest)
+			break
+		}
+		parts = append(parts, rest[:i])
+		rest = rest[i+1:]
+	}
+	switch len(parts) {
+	case 3:
+		f = forwardSpec{bindPort: parts[0], host: parts[1], hostPort: parts[2]}
+	case 4:
+		f = forwardSpec{bindAddress: parts[0], bindPort: parts[1], host: parts[2], hostPort: parts[3]}
+	default:
+		return f, fmt.Errorf("invalid forward %q, expected [BIND_ADDRESS:]PORT:HOST:HOSTPORT", spec)
+	}
+	for _, port := range []string{f.bindPort, f.hostPort} {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return f, fmt.Errorf("invalid port %q in forward %q", port, spec)
+		}
+	}
+	for _, host := range []string{f.bindAddress, f.host} {
+		if host != "" && !forwardHostPattern.MatchString(host) {
+			return f, fmt.Errorf("invalid host %q in forward %q", host, spec)
+		}
+	}
+	return f, nil
+}
+
+func (f forwardSpec) bindHost() string {
+	if f.bindAddress == "" {
+		return "localhost"
+	}
+	return f.bindAddress
+}
+
+// openTunnel connects to the machine's terminal and replaces its shell with
+// script, after putting the terminal in raw mode so that it passes bytes
+// through unchanged. It returns once script is about to run.
+func openTunnel(machine, script string) (*remoteShell, error) {
+	s, err := dialRemoteShell(machine)
+	if err != nil {
+		return nil, err
+	}
+	marker := randomMarker()
+	half := len(marker) / 2
+	// The script is single quoted for the login shell, so it must not
+	// contain single quotes itself.
+	script = fmt.Sprintf(`stty raw -echo -iexten; printf "%%s%%s\n" %s %s; %s`, marker[:half], marker[half:], script)
+	if err := s.write("exec sh -c " + shellQuote(script) + "\n"); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.readUntil(marker+"\n", ioutil.Discard); err != nil {
+		s.terminate()
+		return nil, err
+	}
+	return s, nil
+}
+
+// pipeTunnel copies data between a local connection and a tunnel until
+// either side closes. It returns the error the connection of the tunnel
+// was lost with, if it was.
+func pipeTunnel(s *remoteShell, conn io.ReadWriteCloser) error {
+	done := make(chan struct{}, 2)
+	lost := make(chan error, 1)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		for {
+			data, err := s.read()
+			if err != nil {
+				if s.readErr != nil && !websocket.IsCloseError(s.readErr, websocket.CloseNormalClosure) {
+					lost <- err
+				}
+				return
+			}
+			if _, err := conn.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := s.write(string(buf[:n])); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	<-done
+	conn.Close()
+	s.terminate()
+	select {
+	case err := <-lost:
+		return err
+	default:
+		return nil
+	}
+}
+
+// localForwardScript connects the terminal to host:port, with nc or with
+// bash's /dev/tcp if nc is not installed.
+func localForwardScript(host, port string) string {
+	return fmt.Sprintf(`if command -v nc >/dev/null 2>&1; then exec nc %[1]s %[2]s; else exec bash -c "exec 3<>/dev/tcp/%[1]s/%[2]s; cat <&3 & exec cat >&3"; fi`, host, port)
+}
+
+// remoteForwardScript accepts a single connection on port, with either the
+// OpenBSD or the traditional flavor of nc.
+func remoteForwardScript(address, port string) string {
+	openBSD, traditional := "nc -l "+port, "nc -l -p "+port
+	if address != "" {
+		openBSD, traditional = "nc -l "+address+" "+port, "nc -l -s "+address+" -p "+port
+	}
+	return fmt.Sprintf(`if nc -h 2>&1 | grep -q OpenBSD; then exec %s; else exec %s; fi`, openBSD, traditional)
+}
+
+// localForward forwards the connections to a local port through tunnels
+// to the machine, each over its own SSH connection. When the connection to
+// the machine is lost, the tunnels still open are torn down and the port
+// is kept listening while it reconnects, up to ssh_reconnect attempts like
+// shells do, so that connections made meanwhile go through once it is
+// back.
+type localForward struct {
+	machine  string
+	spec     forwardSpec
+	listener net.Listener
+	mutex    sync.Mutex
+	tunnels  map[*remoteShell]net.Conn
+	// up is closed while the connection to the machine works, and replaced
+	// while reconnecting.
+	up      chan struct{}
+	stopped bool
+}
+
+// forwardLocal listens on the local port and forwards every connection to
+// the host and port as seen from the machine.
+func forwardLocal(machine string, f forwardSpec) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(f.bindHost(), f.bindPort))
+	if err != nil {
+		return err
+	}
+	up := make(chan struct{})
+	close(up)
+	forward := &localForward{machine: machine, spec: f, listener: listener, tunnels: make(map[*remoteShell]net.Conn), up: up}
+	go forward.serve()
+	return nil
+}
+
+func (lf *localForward) serve() {
+	defer lf.listener.Close()
+	for {
+		conn, err := lf.listener.Accept()
+		if err != nil {
+			lf.mutex.Lock()
+			stopped := lf.stopped
+			lf.mutex.Unlock()
+			if !stopped {
+				fmt.Fprintf(os.Stderr, "Port forward %s stopped: %s\r\n", lf.spec.bindPort, err)
+			}
+			return
+		}
+		go lf.forward(conn)
+	}
+}
+
+// forward waits for the connection to the machine to be up, and pipes the
+// local connection through a tunnel of its own.
+func (lf *localForward) forward(conn net.Conn) {
+	lf.mutex.Lock()
+	up := lf.up
+	lf.mutex.Unlock()
+	<-up
+	lf.mutex.Lock()
+	if lf.stopped {
+		lf.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	lf.mutex.Unlock()
+	s, err := openTunnel(lf.machine, localForwardScript(lf.spec.host, lf.spec.hostPort))
+	if err != nil {
+		conn.Close()
+		lf.lost(fmt.Errorf("could not forward connection to %s:%s: %s", lf.spec.host, lf.spec.hostPort, err))
+		return
+	}
+	lf.mutex.Lock()
+	lf.tunnels[s] = conn
+	lf.mutex.Unlock()
+	lost := pipeTunnel(s, conn)
+	lf.mutex.Lock()
+	delete(lf.tunnels, s)
+	lf.mutex.Unlock()
+	if lost != nil {
+		lf.lost(lost)
+	}
+}
+
+// lost tears down the open tunnels and reconnects, unless it is already
+// reconnecting.
+func (lf *localForward) lost(err error) {
+	lf.mutex.Lock()
+	select {
+	case <-lf.up:
+	default:
+		lf.mutex.Unlock()
+		return
+	}
+	if lf.stopped {
+		lf.mutex.Unlock()
+		return
+	}
+	lf.up = make(chan struct{})
+	for s, conn := range lf.tunnels {
+		conn.Close()
+		s.terminate()
+		delete(lf.tunnels, s)
+	}
+	lf.mutex.Unlock()
+	go lf.reconnect(err)
+}
+
+func (lf *localForward) reconnect(lost error) {
+	attempts := viper.GetInt("ssh_reconnect")
+	err := retryConnection(attempts, lost, func(lost error, attempt int) {
+		fmt.Fprintf(os.Stderr, "\r\n[Port forward %s: %s. Reconnecting, attempt %d of %d...]\r\n", lf.spec.bindPort, lost, attempt, attempts)
+	}, func() error {
+		c, err := dialMachineShell(lf.machine)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	})
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	if err != nil {
+		lf.stopped = true
+		lf.listener.Close()
+		fmt.Fprintf(os.Stderr, "\r\n[Port forward %s stopped: %s]\r\n", lf.spec.bindPort, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "[Port forward %s reconnected to %s]\r\n", lf.spec.bindPort, lf.machine)
+	}
+	close(lf.up)
+}
+
+// forwardRemote listens on the port of the machine and forwards connections
+// to the local host and port.
+func forwardRemote(machine string, f forwardSpec) {
+	relayRemote(machine, remoteForwardScript(f.bindAddress, f.bindPort), "listen on port "+f.bindPort, func() (net.Conn, error) {
+		return net.Dial("tcp", net.JoinHostPort(f.host, f.hostPort))
+	})
+}
+
+// relayRemote runs script on the machine to accept a connection, and relays
+// it to a local connection made with dial. Connections are accepted one at
+// a time: the local connection is opened as soon as the machine listens,
+// and a new listener is started once the connection closes.
+func relayRemote(machine, script, description string, dial func() (net.Conn, error)) {
+	go func() {
+		for {
+			s, err := openTunnel(machine, script)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not %s of %s: %s\r\n", description, machine, err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			conn, err := dial()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not connect: %s\r\n", err)
+				s.terminate()
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			pipeTunnel(s, conn)
+		}
+	}()
+}
+
+// startPortForwards sets up the -L and -R port forwards of the ssh command.
+func startPortForwards(machine string, local, remote []string) error {
+	for _, spec := range local {
+		f, err := parseForwardSpec(spec)
+		if err != nil {
+			return err
+		}
+		if err := forwardLocal(machine, f); err != nil {
+			return err
+		}
+	}
+	for _, spec := range remote {
+		f, err := parseForwardSpec(spec)
+		if err != nil {
+			return err
+		}
+		forwardRemote(machine, f)
+	}
+	return nil
+}
+
+// stdioConn is the stdin and stdout of the CLI as a connection.
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdioConn) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdioConn) Close() error {
+	return os.Stdout.Close()
+}
+
+// forwardStdio connects stdin and stdout to the port of the machine until
+// either side closes, for ssh to use as its ProxyCommand.
+func forwardStdio(machine, port string) error {
+	s, err := openTunnel(machine, localForwardScript("localhost", port))
+	if err != nil {
+		return err
+	}
+	pipeTunnel(s, stdioConn{})
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// Named queries are stored in the credentials file next to the contexts, as
+// a map from query name to the command line arguments of the query.
+
+func savedQueries() map[string][]string {
+	queries := make(map[string][]string)
+	for name := range cli.Creds.GetStringMap("queries") {
+		queries[name] = cli.Creds.GetStringSlice("queries." + name)
+	}
+	return queries
+}
+
+func writeQueries(queries map[string][]string) error {
+	cli.Creds.Set("queries", queries)
+	return cli.Creds.WriteConfig()
+}
+
+func queryAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for name := range savedQueries() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// runQuery runs the saved query with extra arguments appended, in a new
+// process so the query is parsed exactly as if typed on the command line.
+func runQuery(name string, extraArgs []string) error {
+	args, ok := savedQueries()[name]
+	if !ok {
+		return fmt.Errorf("query %s not found", name)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	c := exec.Command(executable, append(args, extraArgs...)...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+func runQueryOrExit(name string, extraArgs []string) {
+	err := runQuery(name, extraArgs)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		logger.Fatalf("Error running query: %s", err.Error())
+	}
+}
+
+func querySaveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "save NAME -- COMMAND...",
+		Short: "Save a named query",
+		Example: `  mist query save prod-machines -- get machines --search env:prod -o json
+  mist query run prod-machines`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if cmd.ArgsLenAtDash() != 1 || len(args) < 2 {
+				return fmt.Errorf("expected a query name followed by -- and the command to save")
+			}
+			if strings.ContainsAny(args[0], ". ") {
+				return fmt.Errorf("query names can't contain dots or spaces")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			queries := savedQueries()
+			queries[args[0]] = args[1:]
+			if err := writeQueries(queries); err != nil {
+				logger.Fatalf("Error saving query: %s", err.Error())
+			}
+			fmt.Printf("Query %s saved\n", args[0])
+		},
+	}
+	return cmd
+}
+
+func queryRunCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:                "run NAME [FLAGS...]",
+		Short:              "Run a named query",
+		Long:               "Run a named query. Any arguments after the name are appended to the saved command line.",
+		Args:               cobra.MinimumNArgs(1),
+		DisableFlagParsing: true,
+		ValidArgsFunction:  queryAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			runQueryOrExit(args[0], args[1:])
+		},
+	}
+	return cmd
+}
+
+func queryListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List named queries",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			queries := savedQueries()
+			names := make([]string, 0, len(queries))
+			for name := range queries {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			rows := []interface{}{}
+			for _, name := range names {
+				rows = append(rows, map[string]interface{}{"name": name, "command": strings.Join(queries[name], " ")})
+			}
+			columns := []string{"name", "command"}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	return cmd
+}
+
+func queryDeleteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "delete NAME",
+		Short:             "Delete a named query",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: queryAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			queries := savedQueries()
+			if _, ok := queries[args[0]]; !ok {
+				logger.Fatalf("Query %s not found", args[0])
+			}
+			delete(queries, args[0])
+			if err := writeQueries(queries); err != nil {
+				logger.Fatalf("Error deleting query: %s", err.Error())
+			}
+			fmt.Printf("Query %s deleted\n", args[0])
+		},
+	}
+	return cmd
+}
+
+func queryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "query [NAME [FLAGS...]]",
+		Aliases: []string{"q"},
+		Short:   "Save and run named queries",
+		Long: `Save and run named queries.
+
+A named query is a saved command line, usually a get command with its
+filters and output flags. "mist query NAME" is a shortcut for
+"mist query run NAME".`,
+		Args:               cobra.ArbitraryArgs,
+		DisableFlagParsing: true,
+		ValidArgsFunction:  queryAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 || args[0] == "-h" || args[0] == "--help" {
+				cmd.Help()
+				return
+			}
+			runQueryOrExit(args[0], args[1:])
+		},
+	}
+	cmd.AddCommand(querySaveCmd())
+	cmd.AddCommand(queryRunCmd())
+	cmd.AddCommand(queryListCmd())
+	cmd.AddCommand(queryDeleteCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// rbacActions maps the verbs of the CLI to the actions of Mist's RBAC, which
+// are used as they are otherwise, e.g. start or create_resources.
+var rbacActions = map[string]string{
+	"get":      "read",
+	"list":     "read",
+	"describe": "read",
+	"delete":   "remove",
+	"rename":   "edit",
+	"tag":      "edit_tags",
+	"untag":    "edit_tags",
+	"ssh":      "open_shell",
+}
+
+// cloudResources are created in a cloud, which needs create_resources on
+// the cloud too.
+var cloudResources = map[string]bool{"machine": true, "volume": true, "network": true, "zone": true, "cluster": true}
+
+// rbacRule is a rule of a team policy. Empty actions and resource types
+// match any, and rules apply to a single resource with rid, or to the
+// resources with all of rtags.
+type rbacRule struct {
+	Operator string            `json:"operator"`
+	Action   string            `json:"action"`
+	Rtype    string            `json:"rtype"`
+	Rid      string            `json:"rid"`
+	Rtags    map[string]string `json:"rtags"`
+}
+
+type rbacTeam struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Policy  struct {
+		Operator string     `json:"operator"`
+		Rules    []rbacRule `json:"rules"`
+	} `json:"policy"`
+}
+
+type rbacOrg struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	IsOwner bool       `json:"is_owner"`
+	Teams   []rbacTeam `json:"teams"`
+}
+
+// rbacResource is what a permission is checked on. The id and tags are
+// empty for actions on no particular resource, like creating one.
+type rbacResource struct {
+	kind string
+	id   string
+	tags map[string]string
+}
+
+func (r rbacResource) String() string {
+	if r.id == "" {
+		return r.kind
+	}
+	return r.kind + " " + r.id
+}
+
+func (rule rbacRule) matches(action string, r rbacResource) bool {
+	if rule.Action != "" && rule.Action != action || rule.Rtype != "" && rule.Rtype != r.kind {
+		return false
+	}
+	if rule.Rid != "" && rule.Rid != r.id {
+		return false
+	}
+	for key, value := range rule.Rtags {
+		if have, ok := r.tags[key]; !ok || value != "" && have != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule rbacRule) String() string {
+	action, rtype := rule.Action, rule.Rtype
+	if action == "" {
+		action = "*"
+	}
+	if rtype == "" {
+		rtype = "*"
+	}
+	s := fmt.Sprintf("%s %s on %s", strings.ToUpper(rule.Operator), action, rtype)
+	if rule.Rid != "" {
+		s += " " + rule.Rid
+	}
+	if len(rule.Rtags) > 0 {
+		tags := []string{}
+		for key, value := range rule.Rtags {
+			tags = append(tags, key+"="+value)
+		}
+		sort.Strings(tags)
+		s += " tagged " + strings.Join(tags, ",")
+	}
+	return s
+}
+
+// rbacDecision is whether an action is allowed, and the policy deciding so.
+type rbacDecision struct {
+	allowed bool
+	reason  string
+}
+
+// checkPermission decides an action on a resource like Mist does: owners
+// may do anything, and otherwise the first rule of a team policy matching
+// the action decides for the team, or the default operator of the policy
+// if none does. The action is allowed if any team of the user allows it.
+func checkPermission(org rbacOrg, userID, action string, r rbacResource) rbacDecision {
+	if org.IsOwner {
+		return rbacDecision{true, fmt.Sprintf("owners of organization %s may do anything", org.Name)}
+	}
+	denials := []string{}
+	for _, team := range org.Teams {
+		member := false
+		for _, id := range team.Members {
+			member = member || id == userID
+		}
+		if !member {
+			continue
+		}
+		decided := false
+		for i, rule := range team.Policy.Rules {
+			if !rule.matches(action, r) {
+				continue
+			}
+			reason := fmt.Sprintf("rule %d of team %s: %s", i+1, team.Name, rule)
+			if strings.EqualFold(rule.Operator, "allow") {
+				return rbacDecision{true, reason}
+			}
+			denials = append(denials, reason)
+			decided = true
+			break
+		}
+		if decided {
+			continue
+		}
+		if strings.EqualFold(team.Policy.Operator, "allow") {
+			return rbacDecision{true, fmt.Sprintf("default of team %s: ALLOW", team.Name)}
+		}
+		denials = append(denials, fmt.Sprintf("default of team %s: DENY", team.Name))
+	}
+	if len(denials) == 0 {
+		return rbacDecision{false, fmt.Sprintf("not a member of any team of organization %s", org.Name)}
+	}
+	return rbacDecision{false, strings.Join(denials, "; ")}
+}
+
+// rbacTarget looks up the resource a permission is checked on, with its
+// tags, which rules may match.
+func rbacTarget(kind, ref string) (rbacResource, error) {
+	r := rbacResource{kind: kind, tags: map[string]string{}}
+	if ref == "" {
+		return r, nil
+	}
+	resolved, err := resolveResource(kind, ref)
+	if err != nil {
+		return r, err
+	}
+	r.id = resolved.id
+	live, err := lookupResource(kind, resolved.id)
+	if err != nil {
+		return r, err
+	}
+	for _, tag := range resourceTags(live["tags"]) {
+		r.tags[tag.Key] = tag.Value
+	}
+	return r, nil
+}
+
+func canICmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "can-i ACTION KIND [NAME]",
+		Short: "Check whether the token may do something",
+		Long: `Check whether the policies of the teams of the token's user allow an
+action on a kind of resource, or on a single resource given by name or id,
+and show the rule deciding it. Exits with 0 if the action is allowed and 1
+if it is not.
+
+Actions are those of Mist's RBAC, e.g. read, create, edit, remove, start,
+stop or destroy; get, delete, rename, tag and ssh are also understood.
+Creating resources in a cloud also needs create_resources on the cloud,
+which is checked too if --cloud is given.`,
+		Example: `  mist can-i create machine --cloud aws1
+  mist can-i destroy machine web-1
+  mist can-i delete key deploy`,
+		Args: cobra.RangeArgs(2, 3),
+		Run: func(cmd *cobra.Command, args []string) {
+			action := strings.ToLower(args[0])
+			if mapped, ok := rbacActions[action]; ok {
+				action = mapped
+			}
+			kind := strings.TrimSuffix(strings.ToLower(args[1]), "s")
+			if action == "remove" && kind == "machine" {
+				action = "destroy"
+			}
+			ref := ""
+			if len(args) == 3 {
+				ref = args[2]
+			}
+			var org rbacOrg
+			if err := apiV1Get("org", &org); err != nil {
+				logger.Fatalf("Could not read the policies of the organization: %s", err)
+			}
+			var user struct {
+				ID     string `json:"id"`
+				UserID string `json:"user_id"`
+			}
+			if !org.IsOwner {
+				if err := apiV1Get("whoami", &user); err != nil {
+					logger.Fatalf("Could not tell which user the token belongs to: %s", err)
+				}
+				if user.ID == "" {
+					user.ID = user.UserID
+				}
+			}
+			type check struct {
+				action   string
+				resource rbacResource
+			}
+			target, err := rbacTarget(kind, ref)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			checks := []check{{action, target}}
+			if cloud := params.GetString("cloud"); cloud != "" && action == "create" && cloudResources[kind] {
+				r, err := rbacTarget("cloud", cloud)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				checks = append(checks, check{"create_resources", r})
+			}
+			allowed := true
+			for _, c := range checks {
+				decision := checkPermission(org, user.ID, c.action, c.resource)
+				verdict := "yes"
+				if !decision.allowed {
+					verdict, allowed = "no", false
+				}
+				fmt.Printf("%s %s: %s, %s\n", c.action, c.resource, verdict, decision.reason)
+			}
+			if !allowed {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().String("cloud", "", "Cloud the resource is created in")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
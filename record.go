@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	terminal "golang.org/x/term"
+)
+
+// activeRecorder records the output of the terminal attached to a machine,
+// if ssh --record is given.
+var activeRecorder *sessionRecorder
+
+// sessionRecorder writes the output of a terminal session to a file in the
+// asciicast v2 format of asciinema. Every event is written as it happens,
+// so the recording is complete up to the point a session fails.
+type sessionRecorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	started time.Time
+	// pending is the start of a UTF-8 character split across writes.
+	pending []byte
+}
+
+// newSessionRecorder creates the recording, with the size of the terminal.
+func newSessionRecorder(filename, title string) (*sessionRecorder, error) {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &sessionRecorder{file: file, started: time.Now()}
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     width,
+		"height":    height,
+		"timestamp": r.started.Unix(),
+		"title":     title,
+		"env":       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	})
+	if _, err := file.Write(append(header, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// event writes an event of the type at the time since the session started.
+func (r *sessionRecorder) event(kind, data string) error {
+	line, err := json.Marshal([]interface{}{time.Since(r.started).Seconds(), kind, data})
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// Write records output of the terminal. Characters split across writes are
+// recorded once they are complete, since events are JSON strings.
+func (r *sessionRecorder) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data := append(r.pending, p...)
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte{}, data[end:]...)
+	if end > 0 {
+		if err := r.event("o", string(data[:end])); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// resize records a change of the size of the terminal.
+func (r *sessionRecorder) resize(width, height int) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close writes what is left of the output and closes the recording.
+func (r *sessionRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.pending = nil
+	}
+	return r.file.Close()
+}
+
+// terminalOutput is where the output of a remote terminal is written, which
+// is also recorded with ssh --record, without the escape sequences which
+// were disabled.
+func terminalOutput() io.Writer {
+	var w io.Writer = os.Stdout
+	if activeRecorder != nil {
+		w = io.MultiWriter(os.Stdout, activeRecorder)
+	}
+	if f := terminalEscapeFilter(); f != nil {
+		f.w = w
+		return f
+	}
+	return w
+}
+
+// replaySession plays the output events of an asciicast v2 recording, with
+// their timing divided by speed. Pauses longer than idleLimit are shortened
+// to it, unless it is 0.
+func replaySession(in io.Reader, out io.Writer, speed float64, idleLimit time.Duration) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("the recording is empty")
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		return fmt.Errorf("not an asciicast v2 recording")
+	}
+	previous := 0.0
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			return fmt.Errorf("invalid event on line %d", line)
+		}
+		at, ok := event[0].(float64)
+		kind, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if !ok {
+			return fmt.Errorf("invalid event on line %d", line)
+		}
+		// Only output is played, the size of the terminal can't be changed.
+		if kind != "o" {
+			continue
+		}
+		wait := time.Duration((at - previous) / speed * float64(time.Second))
+		if idleLimit > 0 && wait > idleLimit {
+			wait = idleLimit
+		}
+		time.Sleep(wait)
+		previous = at
+		if _, err := io.WriteString(out, data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func replayCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "replay FILE",
+		Short: "Play back a recorded SSH session",
+		Long: `Play back a session recorded with ssh --record in the terminal, with its
+original timing. Recordings are asciicast v2 files, which can also be
+played with asciinema.`,
+		Example: `  mist replay session.cast
+  mist replay session.cast --speed 2 --idle-limit 1s`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			speed := params.GetFloat64("speed")
+			if speed <= 0 {
+				logger.Fatal("--speed must be greater than 0")
+			}
+			file, err := os.Open(args[0])
+			if err != nil {
+				logger.Fatal(err)
+			}
+			defer file.Close()
+			if err := replaySession(file, os.Stdout, speed, params.GetDuration("idle-limit")); err != nil {
+				logger.Fatalf("Could not replay %s: %s", args[0], err.Error())
+			}
+		},
+	}
+	cmd.Flags().Float64("speed", 1, "Play back this many times faster")
+	cmd.Flags().Duration("idle-limit", 0, "Shorten pauses to at most this long, e.g. 2s")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
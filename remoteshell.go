@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// remoteShellBootstrap turns the machine's login shell into a predictable
+// command loop: the terminal is put in raw mode so output is not translated
+// and input is not echoed or line limited, and commands are then read and
+// evaluated one line at a time by sh, without prompts.
+const remoteShellBootstrap = `stty raw -echo; exec sh -c 'while IFS= read -r l; do eval "$l"; done'`
+
+// remoteShell runs commands non-interactively over the SSH websocket of a
+// machine. The websocket carries a terminal, so the output of every command
+// is delimited by random markers which are printed in two halves, so that
+// input echoed before the terminal is configured never contains them.
+type remoteShell struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+	writeWait  time.Duration
+	messages   chan []byte
+	readErr    error
+	pending    []byte
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// dialRemoteShell connects to the terminal of the machine, without setting
+// it up for running commands.
+func dialRemoteShell(machine string) (*remoteShell, error) {
+	c, err := dialMachineShell(machine)
+	if err != nil {
+		return nil, err
+	}
+	s := &remoteShell{
+		conn:      c,
+		writeWait: 10 * time.Second,
+		messages:  make(chan []byte, 64),
+		done:      make(chan struct{}),
+	}
+	pongWait := 30 * time.Second
+	go s.readMessages(pongWait)
+	go s.sendPings(pongWait * 9 / 10)
+	return s, nil
+}
+
+func openRemoteShell(machine string) (*remoteShell, error) {
+	s, err := dialRemoteShell(machine)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.write(remoteShellBootstrap + "\n"); err != nil {
+		s.Close()
+		return nil, err
+	}
+	// Wait for the command loop to be up, discarding the banner and prompt
+	// of the login shell.
+	if _, err := s.Run("true", ioutil.Discard, ioutil.Discard); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("could not start remote shell: %s", err)
+	}
+	return s, nil
+}
+
+func (s *remoteShell) readMessages(pongWait time.Duration) {
+	defer close(s.messages)
+	s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	s.conn.SetPongHandler(func(string) error { s.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	for {
+		_, r, err := s.conn.NextReader()
+		if err != nil {
+			s.readErr = err
+			return
+		}
+		message, err := ioutil.ReadAll(r)
+		if err != nil {
+			s.readErr = err
+			return
+		}
+		select {
+		case s.messages <- message:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *remoteShell) sendPings(pingPeriod time.Duration) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(s.writeWait)); err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// write sends input to the remote terminal.
+func (s *remoteShell) write(input string) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.writeWait))
+	return s.conn.WriteMessage(websocket.BinaryMessage, append([]byte{0}, input...))
+}
+
+// read returns the next chunk of remote output.
+func (s *remoteShell) read() ([]byte, error) {
+	if len(s.pending) > 0 {
+		data := s.pending
+		s.pending = nil
+		return data, nil
+	}
+	data, ok := <-s.messages
+	if !ok {
+		if s.readErr != nil && !websocket.IsCloseError(s.readErr, websocket.CloseNormalClosure) {
+			return nil, fmt.Errorf("connection lost: %s", s.readErr)
+		}
+		return nil, fmt.Errorf("connection closed by the remote shell")
+	}
+	return data, nil
+}
+
+// readUntil reads output up to and including marker, streaming the output
+// before the marker to w.
+func (s *remoteShell) readUntil(marker string, w io.Writer) error {
+	var buf []byte
+	for {
+		if i := bytes.Index(buf, []byte(marker)); i >= 0 {
+			if _, err := w.Write(buf[:i]); err != nil {
+				return err
+			}
+			s.pending = append(buf[i+len(marker):], s.pending...)
+			return nil
+		}
+		// Keep enough output to find a marker split across chunks.
+		if keep := len(marker) - 1; len(buf) > keep {
+			if _, err := w.Write(buf[:len(buf)-keep]); err != nil {
+				return err
+			}
+			buf = append([]byte{}, buf[len(buf)-keep:]...)
+		}
+		data, err := s.read()
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+	}
+}
+
+func randomMarker() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "MIST" + hex.EncodeToString(b)
+}
+
+// printMarker returns a command printing marker followed by suffix, without
+// the marker itself appearing in the command.
+func printMarker(marker, suffix string) string {
+	half := len(marker) / 2
+	return fmt.Sprintf("printf '%%s%%s%s' '%s' '%s'", suffix, marker[:half], marker[half:])
+}
+
+// stderrDemux splits the output of a command into stdout and stderr. Lines
+// written to stderr are prefixed with a tag by the remote shell.
+type stderrDemux struct {
+	stdout io.Writer
+	stderr io.Writer
+	tag    []byte
+	buf    []byte
+}
+
+func (d *stderrDemux) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	for {
+		i := bytes.Index(d.buf, d.tag)
+		if i < 0 {
+			// Hold back what could be the start of a tag.
+			n := len(d.buf) - len(d.tag) + 1
+			if n > 0 {
+				if _, err := d.stdout.Write(d.buf[:n]); err != nil {
+					return 0, err
+				}
+				d.buf = append([]byte{}, d.buf[n:]...)
+			}
+			return len(p), nil
+		}
+		if _, err := d.stdout.Write(d.buf[:i]); err != nil {
+			return 0, err
+		}
+		line := d.buf[i+len(d.tag):]
+		j := bytes.IndexByte(line, '\n')
+		if j < 0 {
+			d.buf = append([]byte{}, d.buf[i:]...)
+			return len(p), nil
+		}
+		if _, err := d.stderr.Write(line[:j+1]); err != nil {
+			return 0, err
+		}
+		d.buf = append([]byte{}, line[j+1:]...)
+	}
+}
+
+// flush writes out held back output once the command has finished.
+func (d *stderrDemux) flush() error {
+	var err error
+	if bytes.HasPrefix(d.buf, d.tag) {
+		_, err = d.stderr.Write(d.buf[len(d.tag):])
+	} else {
+		_, err = d.stdout.Write(d.buf)
+	}
+	d.buf = nil
+	return err
+}
+
+// Run runs command with sh on the remote machine, streaming its output to
+// stdout and stderr, and returns its exit code. The command's stdin is
+// /dev/null.
+func (s *remoteShell) Run(command string, stdout, stderr io.Writer) (int, error) {
+	marker := randomMarker()
+	half := len(marker) / 2
+	fifo := "/tmp/." + strings.ToLower(marker)
+	// Lines written to stderr are tagged by sed through a fifo. The tag is
+	// built from variables so it doesn't appear in the command itself.
+	line := strings.Join([]string{
+		fmt.Sprintf("a='%s' b='%s'", marker[:half], marker[half:]),
+		printMarker(marker, "B\\n"),
+		fmt.Sprintf("mkfifo %s", fifo),
+		fmt.Sprintf(`sed "s/^/${a}${b}S/" < %s & sh -c %s < /dev/null 2> %s`, fifo, shellQuote(command), fifo),
+		"rc=$?",
+		"wait",
+		fmt.Sprintf("rm -f %s", fifo),
+		printMarker(marker, "E%d\\n") + ` "$rc"`,
+	}, "; ")
+	if err := s.write(line + "\n"); err != nil {
+		return 0, err
+	}
+	if err := s.readUntil(marker+"B\n", ioutil.Discard); err != nil {
+		return 0, err
+	}
+	demux := &stderrDemux{stdout: stdout, stderr: stderr, tag: []byte(marker + "S")}
+	if err := s.readUntil(marker+"E", demux); err != nil {
+		return 0, err
+	}
+	if err := demux.flush(); err != nil {
+		return 0, err
+	}
+	var status bytes.Buffer
+	if err := s.readUntil("\n", &status); err != nil {
+		return 0, err
+	}
+	exitCode, err := strconv.Atoi(status.String())
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output from remote shell: %q", status.String())
+	}
+	return exitCode, nil
+}
+
+// Output runs command and returns its output, failing if it exits with a
+// non zero code.
+func (s *remoteShell) Output(command string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	exitCode, err := s.Run(command, &stdout, &stderr)
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%s", message)
+		}
+		return "", fmt.Errorf("command exited with code %d", exitCode)
+	}
+	return stdout.String(), nil
+}
+
+func (s *remoteShell) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	s.write("exit\n")
+	return s.terminate()
+}
+
+// terminate closes the connection without exiting the remote shell first,
+// for connections whose terminal is used for something other than a shell.
+func (s *remoteShell) terminate() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// shellQuote quotes s for use as a single word in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runRemoteCommand runs command on the machine, streaming its output, and
+// returns its exit code, or 255 if it could not be run, like ssh does.
+func runRemoteCommand(machine, command string) int {
+	shell, err := openRemoteShell(machine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 255
+	}
+	defer shell.Close()
+	exitCode, err := shell.Run(command, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 255
+	}
+	return exitCode
+}
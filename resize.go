@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// resizeSizes returns the sizes the machine can be resized to, those of its
+// cloud, and its current size, if it is one of them.
+func resizeSizes(machine map[string]interface{}) ([]wizardOption, wizardOption, error) {
+	cloud, _ := machine["cloud"].(string)
+	if cloud == "" {
+		return nil, wizardOption{}, fmt.Errorf("the cloud of machine %v is unknown", machine["name"])
+	}
+	sizes, err := wizardOptions("size", cloud)
+	if err != nil {
+		return nil, wizardOption{}, err
+	}
+	current, _ := machine["size"].(string)
+	others := []wizardOption{}
+	var size wizardOption
+	for _, option := range sizes {
+		if current != "" && (option.id == current || option.name == current) {
+			size = option
+			continue
+		}
+		others = append(others, option)
+	}
+	return others, size, nil
+}
+
+// findSize returns the size given by name or id.
+func findSize(sizes []wizardOption, ref string) (wizardOption, bool) {
+	for _, size := range sizes {
+		if size.id == ref || size.name == ref {
+			return size, true
+		}
+	}
+	for _, size := range sizes {
+		if strings.EqualFold(size.name, ref) {
+			return size, true
+		}
+	}
+	return wizardOption{}, false
+}
+
+// describeCostDelta shows the hourly price of the sizes and the difference
+// of the monthly cost, where the provider reports prices.
+func describeCostDelta(machine map[string]interface{}, current, size wizardOption) string {
+	from, ok := sizePrice(current.item)
+	if !ok {
+		from, _ = machineCost(machine)
+	}
+	to, ok := sizePrice(size.item)
+	if !ok {
+		return "No cost estimate is available for " + size.name
+	}
+	if from == 0 {
+		return fmt.Sprintf("Cost: $%.4f/hour, about $%.2f/month", to, to*hoursPerMonth)
+	}
+	delta, sign := (to-from)*hoursPerMonth, "+"
+	if delta < 0 {
+		delta, sign = -delta, "-"
+	}
+	return fmt.Sprintf("Cost: $%.4f/hour -> $%.4f/hour, %s$%.2f/month", from, to, sign, delta)
+}
+
+// waitForMachineSize polls the machine until it has the size and is no
+// longer being resized.
+func waitForMachineSize(machine resourceRef, size wizardOption, deadline time.Time) error {
+	for {
+		live, err := lookupResource("machine", machine.id)
+		if err != nil {
+			return err
+		}
+		if live == nil {
+			return fmt.Errorf("machine %s is gone", machine.name)
+		}
+		current, _ := live["size"].(string)
+		state, _ := live["state"].(string)
+		if (current == size.id || current == size.name) && (state == "running" || state == "stopped") {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s to be resized to %s, it is %s", machine.name, size.name, state)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func machineResizeCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "resize MACHINE",
+		Short: "Change the size of a machine",
+		Long: `Change the size of a machine to another size of its cloud. The price of
+both sizes and the difference of the monthly cost are shown before asking
+for confirmation, where the provider reports prices. Without --size, the
+sizes the machine can be resized to are listed.
+
+Some providers only resize stopped machines. With --wait, the command
+returns once the machine has the new size.`,
+		Example: `  mist machine resize web-1
+  mist machine resize web-1 --size m5.large --wait`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: machineAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			machine, err := resolveResource("machine", args[0])
+			if err != nil {
+				logger.Fatal(err)
+			}
+			live, err := lookupResource("machine", machine.id)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if live == nil {
+				logger.Fatalf("Machine %s not found", args[0])
+			}
+			sizes, current, err := resizeSizes(live)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if params.GetString("size") == "" {
+				rows := []interface{}{}
+				for _, size := range sizes {
+					row := map[string]interface{}{"name": size.name, "id": size.id, "cpus": size.item["cpus"], "ram": size.item["ram"]}
+					if price, ok := sizePrice(size.item); ok {
+						row["hourly"] = price
+						row["monthly"] = roundCost(price*hoursPerMonth, 2)
+					}
+					rows = append(rows, row)
+				}
+				columns := []string{"name", "cpus", "ram", "hourly", "monthly"}
+				if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{columns, append([]string{"id"}, columns...), []string{}, []string{}, map[string]string{}}); err != nil {
+					logger.Fatalf("Formatting failed: %s", err.Error())
+				}
+				return
+			}
+			size, ok := findSize(sizes, params.GetString("size"))
+			if !ok {
+				if current.id != "" && (params.GetString("size") == current.id || params.GetString("size") == current.name) {
+					logger.Fatalf("Machine %s already has size %s", args[0], current.name)
+				}
+				logger.Fatalf("Size %s not found in the cloud of %s, run %s machine resize %s to list its sizes", params.GetString("size"), args[0], cli.Root.CommandPath(), args[0])
+			}
+			currentName := current.name
+			if currentName == "" {
+				currentName, _ = live["size"].(string)
+			}
+			fmt.Printf("Size: %s -> %s\n", currentName, sizeLabel(size))
+			fmt.Println(describeCostDelta(live, current, size))
+			if !params.GetBool("yes") {
+				if !term.IsTerminal(int(os.Stdin.Fd())) {
+					logger.Fatal("Refusing to resize without confirmation, use --yes")
+				}
+				if !confirmAction("Resize", 1, "machine") {
+					fmt.Println("Cancelled")
+					return
+				}
+			}
+			if _, _, _, err := MistApiV2ResizeMachine(machine.id, size.id, viper.New()); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			fmt.Printf(" * %s: resize to %s requested\n", machine.name, size.name)
+			if params.GetBool("wait") {
+				if err := waitForMachineSize(machine, size, time.Now().Add(params.GetDuration("timeout"))); err != nil {
+					logger.Fatal(err)
+				}
+				fmt.Printf(" * %s: %s\n", machine.name, size.name)
+			}
+		},
+	}
+	cmd.Flags().String("size", "", "Size to resize to, by name or id")
+	cmd.Flags().BoolP("yes", "y", false, "Resize without asking for confirmation")
+	cmd.Flags().Bool("wait", false, "Wait until the machine has the new size")
+	cmd.Flags().Duration("timeout", 15*time.Minute, "Maximum time to wait with --wait")
+	cmd.RegisterFlagCompletionFunc("size", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		live, err := lookupResource("machine", args[0])
+		if err != nil || live == nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		sizes, _, err := resizeSizes(live)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		names := []string{}
+		for _, size := range sizes {
+			names = append(names, size.name)
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
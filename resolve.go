@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// resolvedCandidates caches the resources of each kind listed to resolve
+// references, for commands resolving many.
+var resolvedCandidates = make(map[string][]resourceRef)
+
+// resolveCandidates returns the resources of the kind, or false if they
+// can't be listed.
+func resolveCandidates(kind string) ([]resourceRef, bool, error) {
+	if candidates, ok := resolvedCandidates[kind]; ok {
+		return candidates, true, nil
+	}
+	list, ok := resourceListControllersMap[kind]
+	if !ok {
+		if list, ok = wizardListControllersMap[kind]; !ok {
+			return nil, false, nil
+		}
+	}
+	params := viper.New()
+	params.Set("only", "id,name")
+	params.Set("limit", 1000)
+	_, decoded, _, err := list(params)
+	if err != nil {
+		return nil, true, err
+	}
+	candidates := []resourceRef{}
+	for _, item := range responseItems(decoded) {
+		id, _ := item["id"].(string)
+		name, _ := item["name"].(string)
+		if id != "" {
+			candidates = append(candidates, resourceRef{name: name, id: id})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].name < candidates[j].name })
+	resolvedCandidates[kind] = candidates
+	return candidates, true, nil
+}
+
+// resolveResource resolves a reference to a resource given by id, name or
+// unique prefix of either. References matching many resources are picked
+// from interactively, or fail listing the candidates otherwise.
+func resolveResource(kind, ref string) (resourceRef, error) {
+	candidates, ok, err := resolveCandidates(kind)
+	if err != nil {
+		return resourceRef{}, err
+	}
+	if !ok {
+		return lookupRef(kind, ref)
+	}
+	matches := []resourceRef{}
+	for _, candidate := range candidates {
+		if candidate.id == ref {
+			return candidate, nil
+		}
+		if candidate.name == ref {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		for _, candidate := range candidates {
+			if strings.HasPrefix(candidate.name, ref) || strings.HasPrefix(candidate.id, ref) {
+				matches = append(matches, candidate)
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		// Listings are capped, so look up what they may have missed.
+		return lookupRef(kind, ref)
+	case 1:
+		return matches[0], nil
+	}
+	return pickResource(kind, ref, matches)
+}
+
+// lookupRef resolves a reference with the API, by name or id.
+func lookupRef(kind, ref string) (resourceRef, error) {
+	if _, ok := resourceGetControllersMap[kind]; !ok {
+		return resourceRef{}, fmt.Errorf("%s %s not found", kind, ref)
+	}
+	live, err := lookupResource(kind, ref)
+	if err != nil {
+		return resourceRef{}, err
+	}
+	if live == nil {
+		return resourceRef{}, fmt.Errorf("%s %s not found", kind, ref)
+	}
+	id, _ := live["id"].(string)
+	name, _ := live["name"].(string)
+	return resourceRef{name: name, id: id}, nil
+}
+
+// pickResource asks which of the resources matching the reference is meant.
+func pickResource(kind, ref string, matches []resourceRef) (resourceRef, error) {
+	labels := []string{}
+	for _, match := range matches {
+		labels = append(labels, fmt.Sprintf("%s (%s)", match.name, match.id))
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return resourceRef{}, fmt.Errorf("%s %s is ambiguous, give the id of one of:\n  %s", kind, ref, strings.Join(labels, "\n  "))
+	}
+	prompt := promptui.Select{
+		Label: fmt.Sprintf("%d %ss match %s", len(matches), kind, ref),
+		Items: labels,
+		Size:  10,
+	}
+	i, _, err := prompt.Run()
+	if err != nil {
+		return resourceRef{}, err
+	}
+	return matches[i], nil
+}
+
+// resolveArg returns the id of the resource the argument refers to, exiting
+// if there is none.
+func resolveArg(kind, ref string) string {
+	resolved, err := resolveResource(kind, ref)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return resolved.id
+}
+
+// initResolveArgs makes the generated commands accept names, ids or unique
+// prefixes for the resources in their arguments, e.g. MACHINE in get
+// machine MACHINE or start machine MACHINE.
+func initResolveArgs() {
+	for _, group := range cli.Root.Commands() {
+		switch group.Name() {
+		case "create", "delete", "download", "generate", "wait":
+			continue
+		}
+		for _, cmd := range group.Commands() {
+			if cmd.Run == nil {
+				continue
+			}
+			kinds := map[int]string{}
+			for i, placeholder := range strings.Fields(cmd.Use)[1:] {
+				kind := strings.ToLower(strings.Trim(placeholder, "[]."))
+				if _, ok := resourceGetControllersMap[kind]; ok {
+					kinds[i] = kind
+				}
+			}
+			if len(kinds) == 0 {
+				continue
+			}
+			run := cmd.Run
+			cmd.Run = func(cmd *cobra.Command, args []string) {
+				for i, kind := range kinds {
+					if i < len(args) {
+						args[i] = resolveArg(kind, args[i])
+					}
+				}
+				run(cmd, args)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+type operationFailure struct {
+	Item  string `json:"item"`
+	Error string `json:"error"`
+}
+
+// operationResult is the per item outcome of a mutating command, written to
+// the file given with --result-file so pipelines can act on it regardless
+// of the output format.
+type operationResult struct {
+	Succeeded []string           `json:"succeeded"`
+	Failed    []operationFailure `json:"failed"`
+	Skipped   []string           `json:"skipped"`
+	ExitCode  int                `json:"exit_code"`
+}
+
+func newOperationResult() *operationResult {
+	return &operationResult{Succeeded: []string{}, Failed: []operationFailure{}, Skipped: []string{}}
+}
+
+func (r *operationResult) succeed(item string) {
+	r.Succeeded = append(r.Succeeded, item)
+}
+
+func (r *operationResult) fail(item string, err error) {
+	r.Failed = append(r.Failed, operationFailure{Item: item, Error: err.Error()})
+}
+
+func (r *operationResult) skip(item string) {
+	r.Skipped = append(r.Skipped, item)
+}
+
+// write saves the result to filename, doing nothing if it is empty. Errors
+// are logged rather than returned, since the result file must not change
+// the outcome of the command.
+func (r *operationResult) write(filename string, exitCode int) {
+	if filename == "" {
+		return
+	}
+	r.ExitCode = exitCode
+	j, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		logger.Printf("Could not marshal result: %s", err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(filename, append(j, '\n'), 0644); err != nil {
+		logger.Printf("Could not write result file: %s", err.Error())
+	}
+}
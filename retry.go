@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	gocontext "context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+const (
+	defaultRequestTimeout = time.Minute
+	defaultRetries        = 3
+	// retryBaseDelay is the delay before the first retry, doubled for every
+	// retry after it up to retryMaxDelay.
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+	// retryAfterMaxDelay caps how long a Retry-After header can make a
+	// request wait.
+	retryAfterMaxDelay = 2 * time.Minute
+)
+
+var (
+	retryRand      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	retryRandMutex sync.Mutex
+)
+
+// retryTransport retries requests which failed in ways that are likely to
+// be temporary, waiting longer before each retry, and times out every
+// attempt on its own.
+type retryTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+	retries int
+}
+
+// idempotentMethods can be sent again after failing mid-way without
+// repeating their effect.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// shouldRetry returns whether a request should be retried after the
+// response or error it got. Throttled and unavailable requests weren't
+// processed, so they are always retried; other server and network errors
+// only for idempotent requests.
+func shouldRetry(method string, resp *http.Response, err error) bool {
+	if err != nil {
+		return idempotentMethods[method]
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		return true
+	case resp.StatusCode >= 500:
+		return idempotentMethods[method]
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before the retry following attempt,
+// counting from 0. Retry-After is honored when the server sends it,
+// otherwise the delay grows exponentially, with jitter so that many
+// clients don't retry all at once.
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if delay > retryAfterMaxDelay {
+				delay = retryAfterMaxDelay
+			}
+			return delay
+		}
+	}
+	delay := retryBaseDelay << uint(attempt)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	retryRandMutex.Lock()
+	defer retryRandMutex.Unlock()
+	return delay/2 + time.Duration(retryRand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter parses a Retry-After header, given either in seconds or
+// as an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// cancelBody cancels the timeout of an attempt once its response has been
+// read.
+type cancelBody struct {
+	io.ReadCloser
+	cancel gocontext.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Keep the body to send it again with every retry.
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := req.Context(), gocontext.CancelFunc(func() {})
+		if t.timeout > 0 {
+			ctx, cancel = gocontext.WithTimeout(ctx, t.timeout)
+		}
+		attemptReq := req.Clone(ctx)
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.next.RoundTrip(attemptReq)
+		if attempt >= t.retries || !shouldRetry(req.Method, resp, err) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelBody{resp.Body, cancel}
+			return resp, nil
+		}
+		delay := retryDelay(attempt, resp)
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// initRetries adds the --request-timeout and --retries flags, applied to
+// every request to Mist by the transport of apiTransport. They can also be
+// set with MIST_REQUEST_TIMEOUT and MIST_RETRIES or in the config file.
+// --timeout is how long the commands waiting for jobs wait, so the timeout
+// of requests is --request-timeout.
+func initRetries() {
+	flags := cli.Root.PersistentFlags()
+	flags.Duration("request-timeout", defaultRequestTimeout, "Maximum time a request to the API may take, 0 for no limit")
+	flags.Int("retries", defaultRetries, "Number of times to retry requests which fail temporarily")
+	viper.BindPFlag("request_timeout", flags.Lookup("request-timeout"))
+	viper.BindPFlag("retries", flags.Lookup("retries"))
+	viper.BindEnv("request_timeout", "MIST_REQUEST_TIMEOUT")
+	viper.BindEnv("retries", "MIST_RETRIES")
+}
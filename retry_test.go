@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	got, ok := parseRetryAfter(date)
+	if !ok || got <= 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %v, %v, want about an hour", date, got, ok)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryAfter := func(value string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{value}}}
+	}
+	tests := []struct {
+		name     string
+		attempt  int
+		resp     *http.Response
+		min, max time.Duration
+	}{
+		{"first retry", 0, nil, retryBaseDelay / 2, retryBaseDelay},
+		{"third retry", 2, nil, 2 * retryBaseDelay, 4 * retryBaseDelay},
+		{"capped", 20, nil, retryMaxDelay / 2, retryMaxDelay},
+		{"shift overflow", 100, nil, retryMaxDelay / 2, retryMaxDelay},
+		{"no Retry-After", 0, &http.Response{Header: http.Header{}}, retryBaseDelay / 2, retryBaseDelay},
+		{"Retry-After", 0, retryAfter("7"), 7 * time.Second, 7 * time.Second},
+		{"Retry-After capped", 0, retryAfter("3600"), retryAfterMaxDelay, retryAfterMaxDelay},
+		{"invalid Retry-After", 1, retryAfter("later"), retryBaseDelay, 2 * retryBaseDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				if got := retryDelay(tt.attempt, tt.resp); got < tt.min || got > tt.max {
+					t.Fatalf("retryDelay(%d) = %v, want between %v and %v", tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	status := func(code int) *http.Response { return &http.Response{StatusCode: code} }
+	tests := []struct {
+		name   string
+		method string
+		resp   *http.Response
+		err    error
+		want   bool
+	}{
+		{"ok", http.MethodGet, status(http.StatusOK), nil, false},
+		{"not found", http.MethodGet, status(http.StatusNotFound), nil, false},
+		{"throttled post", http.MethodPost, status(http.StatusTooManyRequests), nil, true},
+		{"unavailable post", http.MethodPost, status(http.StatusServiceUnavailable), nil, true},
+		{"server error get", http.MethodGet, status(http.StatusInternalServerError), nil, true},
+		{"server error post", http.MethodPost, status(http.StatusBadGateway), nil, false},
+		{"network error delete", http.MethodDelete, nil, errors.New("connection reset"), true},
+		{"network error post", http.MethodPost, nil, errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldRetry(tt.method, tt.resp, tt.err); got != tt.want {
+				t.Errorf("shouldRetry(%s) = %v, want %v", tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		statuses  []int
+		retries   int
+		want      int
+		wantCalls int
+	}{
+		{"success", http.MethodGet, []int{200}, 3, 200, 1},
+		{"throttled then success", http.MethodPost, []int{429, 429, 201}, 3, 201, 3},
+		{"retries exhausted", http.MethodGet, []int{503, 503, 503}, 2, 503, 3},
+		{"post not retried", http.MethodPost, []int{500, 200}, 3, 500, 1},
+		{"no retries", http.MethodGet, []int{503, 200}, 0, 503, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if string(body) != "payload" {
+					t.Errorf("attempt %d got body %q, want it resent", calls+1, body)
+				}
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tt.statuses[calls])
+				calls++
+			}))
+			defer server.Close()
+			client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport, timeout: time.Second, retries: tt.retries}}
+			req, err := http.NewRequest(tt.method, server.URL, strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want || calls != tt.wantCalls {
+				t.Errorf("got status %d after %d calls, want %d after %d", resp.StatusCode, calls, tt.want, tt.wantCalls)
+			}
+		})
+	}
+}
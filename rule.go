@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// ruleOperators maps the operators of --query to those of rule queries.
+var ruleOperators = map[string]string{">": "gt", "<": "lt"}
+
+// rulePeriods are the units of rule intervals, largest first.
+var rulePeriods = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"days", 24 * time.Hour},
+	{"hours", time.Hour},
+	{"minutes", time.Minute},
+	{"seconds", time.Second},
+}
+
+// ruleInterval returns the interval of a rule field, like the window, in
+// the largest unit the duration is a whole number of.
+func ruleInterval(d time.Duration, field string) map[string]interface{} {
+	if d == 0 {
+		return map[string]interface{}{field: 0, "period": "minutes"}
+	}
+	for _, period := range rulePeriods {
+		if d%period.duration == 0 {
+			return map[string]interface{}{field: int(d / period.duration), "period": period.name}
+		}
+	}
+	return map[string]interface{}{field: int(d / time.Second), "period": "seconds"}
+}
+
+// ruleDuration returns the duration of an interval of a rule.
+func ruleDuration(interval interface{}, field string) time.Duration {
+	m, _ := interval.(map[string]interface{})
+	n, _ := strconv.ParseFloat(fmt.Sprintf("%v", m[field]), 64)
+	for _, period := range rulePeriods {
+		if m["period"] == period.name {
+			return time.Duration(n * float64(period.duration))
+		}
+	}
+	return time.Duration(n * float64(time.Minute))
+}
+
+// parseRuleQuery parses a --query, like "cpu > 80", into a rule query.
+func parseRuleQuery(query, aggregation string) (map[string]interface{}, error) {
+	for symbol, operator := range ruleOperators {
+		i := strings.LastIndex(query, symbol)
+		if i < 0 {
+			continue
+		}
+		target := strings.TrimSpace(query[:i])
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(query[i+1:]), 64)
+		if target == "" || err != nil {
+			break
+		}
+		return map[string]interface{}{"target": target, "operator": operator, "threshold": threshold, "aggregation": aggregation}, nil
+	}
+	return nil, fmt.Errorf("invalid query %q, expected METRIC > THRESHOLD or METRIC < THRESHOLD", query)
+}
+
+func addRuleFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("filename", "f", "", "Read the rule from a YAML or JSON file, which the other flags override")
+	cmd.Flags().StringArray("query", []string{}, "Condition of the rule, like \"cpu > 80\", repeat for several which must all hold")
+	cmd.Flags().String("aggregation", "avg", "How the values of --query over the window are aggregated: avg, any or all")
+	cmd.Flags().Duration("window", 5*time.Minute, "Period whose values are checked")
+	cmd.Flags().Duration("frequency", time.Minute, "How often the rule is checked")
+	cmd.Flags().Duration("trigger-after", 0, "How long the conditions must hold before the actions run")
+	cmd.Flags().StringArray("notify", []string{}, "Email to notify when the rule triggers, may be repeated")
+	cmd.Flags().String("machine-action", "", "Action to run on the machines triggering the rule, like stop or reboot")
+	cmd.Flags().StringArray("machine", []string{}, "Machine the rule applies to, may be repeated")
+	cmd.Flags().StringArray("tag", []string{}, "Only apply the rule to resources with this KEY=VALUE tag, may be repeated")
+	cmd.Flags().String("resource-type", "machine", "Kind of resources the rule applies to")
+}
+
+// ruleSpec returns the rule read from --filename, or base, with the fields
+// given with flags set. Only the flags given are used, except when all is
+// set, for new rules.
+func ruleSpec(cmd *cobra.Command, base map[string]interface{}, all bool) (map[string]interface{}, error) {
+	spec := base
+	if filename, _ := cmd.Flags().GetString("filename"); filename != "" {
+		var err error
+		if spec, err = readResourceSpec("rule", filename); err != nil {
+			return nil, err
+		}
+	}
+	set := func(flag string) bool {
+		return cmd.Flags().Changed(flag) || (all && spec[strings.Replace(flag, "-", "_", -1)] == nil)
+	}
+	if cmd.Flags().Changed("query") || (all && spec["queries"] == nil) {
+		aggregation, _ := cmd.Flags().GetString("aggregation")
+		switch aggregation {
+		case "avg", "any", "all":
+		default:
+			return nil, fmt.Errorf("invalid --aggregation %q, expected avg, any or all", aggregation)
+		}
+		queries := []interface{}{}
+		values, _ := cmd.Flags().GetStringArray("query")
+		for _, value := range values {
+			query, err := parseRuleQuery(value, aggregation)
+			if err != nil {
+				return nil, err
+			}
+			queries = append(queries, query)
+		}
+		if len(queries) == 0 {
+			return nil, fmt.Errorf("a rule needs at least one --query")
+		}
+		spec["queries"] = queries
+	}
+	if set("window") {
+		window, _ := cmd.Flags().GetDuration("window")
+		spec["window"] = ruleInterval(window, "start")
+	}
+	if set("frequency") {
+		frequency, _ := cmd.Flags().GetDuration("frequency")
+		spec["frequency"] = ruleInterval(frequency, "every")
+	}
+	if set("trigger-after") {
+		after, _ := cmd.Flags().GetDuration("trigger-after")
+		spec["trigger_after"] = ruleInterval(after, "offset")
+	}
+	if cmd.Flags().Changed("notify") || cmd.Flags().Changed("machine-action") || (all && spec["actions"] == nil) {
+		actions := []interface{}{}
+		if emails, _ := cmd.Flags().GetStringArray("notify"); len(emails) > 0 {
+			actions = append(actions, map[string]interface{}{"action_type": "notification", "emails": emails, "users": []string{}, "teams": []string{}})
+		}
+		if action, _ := cmd.Flags().GetString("machine-action"); action != "" {
+			actions = append(actions, map[string]interface{}{"action_type": "machine_action", "machine_action": action})
+		}
+		if len(actions) == 0 {
+			return nil, fmt.Errorf("a rule needs --notify or --machine-action")
+		}
+		spec["actions"] = actions
+	}
+	if cmd.Flags().Changed("machine") || cmd.Flags().Changed("tag") || (all && spec["selectors"] == nil) {
+		selectors, err := flagSelectors(cmd)
+		if err != nil {
+			return nil, err
+		}
+		spec["selectors"] = selectors
+	}
+	if set("resource-type") {
+		resourceType, _ := cmd.Flags().GetString("resource-type")
+		spec["resource_type"] = resourceType
+	}
+	return spec, nil
+}
+
+func ruleCreateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create an alerting rule",
+		Long: `Create a rule, which notifies or acts when the metrics of resources meet
+its conditions.
+
+The rule is given with flags, or read from a YAML or JSON file with -f, as
+printed by get rule -o yaml, which the flags override. Conditions compare
+a metric, aggregated over --window, to a threshold, and the rule applies
+to the machines given with --machine, those with the tags given with --tag,
+or to all resources of its type.`,
+		Example: `  mist rule create high-cpu --query "cpu > 80" --window 10m --notify ops@example.com
+  mist rule create disk-full --query "disk > 90" --tag env=prod --machine-action stop
+  mist rule create -f rule.yaml my-rule`,
+		Args: cobra.ExactValidArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			spec, err := ruleSpec(cmd, map[string]interface{}{}, true)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			spec["name"] = args[0]
+			if spec["data_type"] == nil {
+				spec["data_type"] = "metrics"
+			}
+			body, err := json.Marshal(spec)
+			if err != nil {
+				logger.Fatalf("Unable to get body: %s", err.Error())
+			}
+			_, decoded, outputOptions, err := MistApiV2AddRule(params, string(body))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	addRuleFlags(cmd)
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func ruleUpdateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "update RULE",
+		Short: "Update an alerting rule",
+		Long: `Update the conditions, actions or resources of a rule. Only the fields
+given with flags, or in the file given with -f, are changed.`,
+		Example: `  mist rule update high-cpu --query "cpu > 90"
+  mist rule update high-cpu --notify ops@example.com --notify oncall@example.com`,
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: completeResourceFlag("rule"),
+		Run: func(cmd *cobra.Command, args []string) {
+			live, err := lookupResource("rule", args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if live == nil {
+				logger.Fatalf("Rule %s not found", args[0])
+			}
+			base := map[string]interface{}{}
+			for _, field := range manifestEditableFields["rule"] {
+				if value, ok := live[field]; ok {
+					base[field] = value
+				}
+			}
+			spec, err := ruleSpec(cmd, base, false)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			body, err := json.Marshal(spec)
+			if err != nil {
+				logger.Fatalf("Unable to get body: %s", err.Error())
+			}
+			id, _ := live["id"].(string)
+			_, decoded, outputOptions, err := MistApiV2EditRule(id, params, string(body))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	addRuleFlags(cmd)
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func ruleToggleCmd(action string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               action + " RULE...",
+		Short:             strings.ToUpper(action[:1]) + action[1:] + " rules",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeResourceFlag("rule"),
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, rule := range args {
+				if _, _, _, err := MistApiV2ToggleRule(rule, action, viper.New()); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf("Rule %s %sd\n", rule, action)
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+// ruleQueryExpression returns the PromQL expression of the value of a rule
+// query over the window. Of the values over the window, any needs one past
+// the threshold and all needs all of them to be.
+func ruleQueryExpression(query map[string]interface{}, window time.Duration) string {
+	target, _ := query["target"].(string)
+	function := "avg_over_time"
+	switch query["aggregation"] {
+	case "any":
+		function = map[interface{}]string{"gt": "max_over_time", "lt": "min_over_time"}[query["operator"]]
+	case "all":
+		function = map[interface{}]string{"gt": "min_over_time", "lt": "max_over_time"}[query["operator"]]
+	}
+	if function == "" {
+		function = "avg_over_time"
+	}
+	return fmt.Sprintf("%s((%s)[%ds:])", function, target, int(window.Seconds()))
+}
+
+// flagSelectors returns the selectors of the machines given with --machine
+// and the tags given with --tag.
+func flagSelectors(cmd *cobra.Command) ([]interface{}, error) {
+	selectors := []interface{}{}
+	if machines, _ := cmd.Flags().GetStringArray("machine"); len(machines) > 0 {
+		refs, err := resolveResources("machine", machines, "")
+		if err != nil {
+			return nil, err
+		}
+		ids := []string{}
+		for _, ref := range refs {
+			ids = append(ids, ref.id)
+		}
+		selectors = append(selectors, map[string]interface{}{"type": "machines", "ids": ids})
+	}
+	if tags, _ := cmd.Flags().GetStringArray("tag"); len(tags) > 0 {
+		include := map[string]interface{}{}
+		for _, tag := range parseTags(strings.Join(tags, ",")) {
+			include[tag.Key] = tag.Value
+		}
+		selectors = append(selectors, map[string]interface{}{"type": "tags", "include": include})
+	}
+	return selectors, nil
+}
+
+// selectorsMatch reports whether the selectors of a rule or schedule match
+// the machine. Machines must match all of them.
+func selectorsMatch(selectors interface{}, machine map[string]interface{}) bool {
+	items, _ := selectors.([]interface{})
+	for _, s := range items {
+		selector, _ := s.(map[string]interface{})
+		switch selector["type"] {
+		case "machines":
+			ids, _ := selector["ids"].([]interface{})
+			found := false
+			for _, id := range ids {
+				if id == machine["id"] {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		case "tags":
+			include, _ := selector["include"].(map[string]interface{})
+			tags := map[string]string{}
+			for _, tag := range resourceTags(machine["tags"]) {
+				tags[tag.Key] = tag.Value
+			}
+			for key, value := range include {
+				if v, ok := tags[key]; !ok || (value != nil && value != "" && fmt.Sprintf("%v", value) != v) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func ruleTestCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "test RULE",
+		Short: "Show whether a rule would trigger now",
+		Long: `Evaluate the conditions of a rule against the current metrics of the
+machines it applies to, showing the value of each condition and whether
+the rule would trigger for each machine. Rules trigger for machines
+meeting all of their conditions.`,
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: completeResourceFlag("rule"),
+		Run: func(cmd *cobra.Command, args []string) {
+			rule, err := lookupResource("rule", args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if rule == nil {
+				logger.Fatalf("Rule %s not found", args[0])
+			}
+			listParams := viper.New()
+			listParams.Set("only", "id,name,tags")
+			listParams.Set("limit", 1000)
+			_, decoded, _, err := MistApiV2ListMachines(listParams)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			machines := map[string]map[string]interface{}{}
+			for _, machine := range responseItems(decoded) {
+				if id, _ := machine["id"].(string); id != "" && selectorsMatch(rule["selectors"], machine) {
+					machines[id] = machine
+				}
+			}
+			window := ruleDuration(rule["window"], "start")
+			if window <= 0 {
+				window = 5 * time.Minute
+			}
+			queries, _ := rule["queries"].([]interface{})
+			met := map[string]int{}
+			rows := []interface{}{}
+			for _, q := range queries {
+				query, _ := q.(map[string]interface{})
+				values, err := machineUsage(ruleQueryExpression(query, window))
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				threshold, _ := strconv.ParseFloat(fmt.Sprintf("%v", query["threshold"]), 64)
+				symbol := map[interface{}]string{"gt": ">", "lt": "<"}[query["operator"]]
+				for id, value := range values {
+					machine, ok := machines[id]
+					if !ok {
+						continue
+					}
+					holds := (symbol == ">" && value > threshold) || (symbol == "<" && value < threshold)
+					if holds {
+						met[id]++
+					}
+					rows = append(rows, map[string]interface{}{
+						"machine":   machine["name"],
+						"condition": fmt.Sprintf("%v %s %v", query["target"], symbol, query["threshold"]),
+						"value":     strconv.FormatFloat(value, 'g', 6, 64),
+						"met":       holds,
+					})
+				}
+			}
+			sort.SliceStable(rows, func(i, j int) bool {
+				return fmt.Sprintf("%v", rows[i].(map[string]interface{})["machine"]) < fmt.Sprintf("%v", rows[j].(map[string]interface{})["machine"])
+			})
+			columns := []string{"machine", "condition", "value", "met"}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+			triggered := []string{}
+			for id, count := range met {
+				if count == len(queries) {
+					name, _ := machines[id]["name"].(string)
+					triggered = append(triggered, name)
+				}
+			}
+			sort.Strings(triggered)
+			if len(triggered) == 0 {
+				fmt.Fprintf(os.Stderr, "Rule %s would not trigger\n", args[0])
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Rule %s would trigger for %s\n", args[0], strings.Join(triggered, ", "))
+		},
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func ruleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rule",
+		Short: "Manage alerting rules",
+		Long: `Create, update, enable, disable and test alerting rules. Rules are listed
+with get rule and deleted with delete rule.`,
+	}
+	cmd.AddCommand(ruleCreateCmd())
+	cmd.AddCommand(ruleUpdateCmd())
+	cmd.AddCommand(ruleToggleCmd("enable"))
+	cmd.AddCommand(ruleToggleCmd("disable"))
+	cmd.AddCommand(ruleTestCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// scheduleTimeLayout is the layout of the times of one off schedules.
+const scheduleTimeLayout = "2006-01-02 15:04:05"
+
+// cronFields are the fields of crontab schedule entries, in the order of
+// cron expressions, with their ranges.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day_of_month", 1, 31},
+	{"month_of_year", 1, 12},
+	{"day_of_week", 0, 7},
+}
+
+// cronSchedule is a parsed cron expression, with the values each field
+// matches.
+type cronSchedule struct {
+	fields [5]map[int]bool
+	// Days match either field when neither is *, as in cron.
+	anyDay bool
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// parseCron parses a cron expression of minute, hour, day of month, month
+// and day of week.
+func parseCron(expression string) (*cronSchedule, error) {
+	parts := strings.Fields(expression)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %q, expected minute, hour, day of month, month and day of week", expression)
+	}
+	c := &cronSchedule{anyDay: parts[2] != "*" && parts[4] != "*"}
+	for i, field := range cronFields {
+		values, err := parseCronField(parts[i], field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", strings.Replace(field.name, "_", " ", -1), err)
+		}
+		c.fields[i] = values
+	}
+	if c.fields[4][7] {
+		c.fields[4][0] = true
+	}
+	return c, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.fields[0][t.Minute()] || !c.fields[1][t.Hour()] || !c.fields[3][int(t.Month())] {
+		return false
+	}
+	dom, dow := c.fields[2][t.Day()], c.fields[4][int(t.Weekday())]
+	if c.anyDay {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first time after t the schedule runs at, or the zero
+// time if it doesn't run within a few years, like on February 30th.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case !c.fields[3][int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matches(t):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// cronEntry returns the crontab schedule entry of a cron expression.
+func cronEntry(expression string) map[string]interface{} {
+	entry := map[string]interface{}{}
+	for i, part := range strings.Fields(expression) {
+		entry[cronFields[i].name] = part
+	}
+	return entry
+}
+
+// entryCron returns the cron expression of a crontab schedule entry.
+func entryCron(entry interface{}) string {
+	m, _ := entry.(map[string]interface{})
+	parts := []string{}
+	for _, field := range cronFields {
+		value := fmt.Sprintf("%v", m[field.name])
+		if m[field.name] == nil || value == "" {
+			value = "*"
+		}
+		parts = append(parts, value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// scheduleRuns returns the next count times the schedule runs at, after
+// now. Interval schedules are counted from their last run, or their start.
+func scheduleRuns(schedule map[string]interface{}, now time.Time, count int) []time.Time {
+	runs := []time.Time{}
+	if enabled, ok := schedule["enabled"].(bool); ok && !enabled {
+		return runs
+	}
+	var expires time.Time
+	if s, ok := schedule["expires"].(string); ok && s != "" {
+		expires, _ = time.Parse(scheduleTimeLayout, s)
+	}
+	if s, ok := schedule["start_after"].(string); ok && s != "" {
+		if start, err := time.Parse(scheduleTimeLayout, s); err == nil && start.After(now) {
+			now = start
+		}
+	}
+	switch schedule["schedule_type"] {
+	case "crontab":
+		c, err := parseCron(entryCron(schedule["schedule_entry"]))
+		if err != nil {
+			return runs
+		}
+		for t := c.next(now); !t.IsZero() && len(runs) < count; t = c.next(t) {
+			runs = append(runs, t)
+		}
+	case "interval":
+		every := ruleDuration(schedule["schedule_entry"], "every")
+		if every <= 0 {
+			return runs
+		}
+		t := now.Add(every)
+		if s, ok := schedule["last_run_at"].(string); ok && s != "" {
+			if last, err := time.Parse(scheduleTimeLayout, s); err == nil {
+				t = last
+				for !t.After(now) {
+					t = t.Add(every)
+				}
+			}
+		}
+		for ; len(runs) < count; t = t.Add(every) {
+			runs = append(runs, t)
+		}
+	case "one_off":
+		if s, ok := schedule["schedule_entry"].(string); ok {
+			if t, err := time.Parse(scheduleTimeLayout, s); err == nil && t.After(now) {
+				runs = append(runs, t)
+			}
+		}
+	}
+	if !expires.IsZero() {
+		for i, t := range runs {
+			if t.After(expires) {
+				return runs[:i]
+			}
+		}
+	}
+	return runs
+}
+
+// describeScheduleEntry returns the schedule entry as a cron expression,
+// interval or time.
+func describeScheduleEntry(schedule map[string]interface{}) string {
+	switch schedule["schedule_type"] {
+	case "crontab":
+		return entryCron(schedule["schedule_entry"])
+	case "interval":
+		return "every " + ruleDuration(schedule["schedule_entry"], "every").String()
+	}
+	return fmt.Sprintf("at %v", schedule["schedule_entry"])
+}
+
+// scheduleMachines returns the names of the machines the selectors match.
+func scheduleMachines(selectors interface{}) ([]string, error) {
+	params := viper.New()
+	params.Set("only", "id,name,tags")
+	params.Set("limit", 1000)
+	_, decoded, _, err := MistApiV2ListMachines(params)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, machine := range responseItems(decoded) {
+		if selectorsMatch(selectors, machine) {
+			name, _ := machine["name"].(string)
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func scheduleCreateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Schedule an action on machines",
+		Long: `Schedule an action, like stopping machines or running a script, on the
+machines given with --machine or those with the tags given with --tag.
+
+It runs on a cron expression with --cron, in UTC, every --every, or once
+--at a time. With --dry-run the machines the schedule would apply to and
+its next runs are shown, without creating it.`,
+		Example: `  mist schedule create stop-at-night --cron "0 22 * * 1-5" --action stop --tag env=dev
+  mist schedule create backup --every 24h --action run_script --script backup --machine db-1
+  mist schedule create cleanup --at 2024-06-01T00:00:00Z --action destroy --machine tmp-1 --dry-run`,
+		Args: cobra.ExactValidArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			schedule := map[string]interface{}{
+				"name":        args[0],
+				"description": params.GetString("description"),
+				"action":      params.GetString("action"),
+				"enabled":     !params.GetBool("disabled"),
+			}
+			given := 0
+			if expression := params.GetString("cron"); expression != "" {
+				if _, err := parseCron(expression); err != nil {
+					logger.Fatal(err)
+				}
+				schedule["schedule_type"] = "crontab"
+				schedule["schedule_entry"] = cronEntry(expression)
+				given++
+			}
+			if every := params.GetDuration("every"); every != 0 {
+				if every < time.Minute {
+					logger.Fatal("--every must be at least 1m")
+				}
+				schedule["schedule_type"] = "interval"
+				schedule["schedule_entry"] = ruleInterval(every, "every")
+				given++
+			}
+			if at := params.GetString("at"); at != "" {
+				t, err := parseTime(at)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				schedule["schedule_type"] = "one_off"
+				schedule["schedule_entry"] = t.UTC().Format(scheduleTimeLayout)
+				given++
+			}
+			if given != 1 {
+				logger.Fatal("Give one of --cron, --every or --at")
+			}
+			if schedule["action"] == "run_script" {
+				script := params.GetString("script")
+				if script == "" {
+					logger.Fatal("--action run_script needs --script")
+				}
+				live, err := lookupResource("script", script)
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				if live == nil {
+					logger.Fatalf("Script %s not found", script)
+				}
+				schedule["script_id"] = live["id"]
+				schedule["params"] = params.GetString("params")
+			}
+			selectors, err := flagSelectors(cmd)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if len(selectors) == 0 {
+				logger.Fatal("Give the machines to schedule the action on with --machine or --tag")
+			}
+			schedule["selectors"] = selectors
+			for _, field := range []string{"start_after", "expires"} {
+				if value := params.GetString(strings.Replace(field, "_", "-", -1)); value != "" {
+					t, err := parseTime(value)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					schedule[field] = t.UTC().Format(scheduleTimeLayout)
+				}
+			}
+			if n := params.GetInt("max-run-count"); n > 0 {
+				schedule["max_run_count"] = n
+			}
+			if params.GetBool("dry-run") {
+				machines, err := scheduleMachines(selectors)
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf("Schedule %s would %s %d machines:\n", args[0], schedule["action"], len(machines))
+				for _, machine := range machines {
+					fmt.Printf("  %s\n", machine)
+				}
+				fmt.Println("Next runs:")
+				for _, t := range scheduleRuns(schedule, time.Now().UTC(), 5) {
+					fmt.Printf("  %s\n", t.Format(time.RFC3339))
+				}
+				return
+			}
+			body, err := json.Marshal(schedule)
+			if err != nil {
+				logger.Fatalf("Unable to get body: %s", err.Error())
+			}
+			_, decoded, outputOptions, err := MistApiV2AddSchedule(params, string(body))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("cron", "", "Run on this cron expression, in UTC, like \"0 22 * * 1-5\"")
+	cmd.Flags().Duration("every", 0, "Run at this interval, like 12h")
+	cmd.Flags().String("at", "", "Run once at this time <rfc3339 | unix_timestamp>")
+	cmd.Flags().String("action", "", "Action to run: start, stop, reboot, destroy or run_script")
+	cmd.Flags().String("script", "", "Script to run with --action run_script")
+	cmd.Flags().String("params", "", "Parameters of the script")
+	cmd.Flags().StringArray("machine", []string{}, "Machine to run the action on, may be repeated")
+	cmd.Flags().StringArray("tag", []string{}, "Run the action on the machines with this KEY=VALUE tag, may be repeated")
+	cmd.Flags().String("description", "", "Description of the schedule")
+	cmd.Flags().Bool("disabled", false, "Create the schedule disabled")
+	cmd.Flags().String("start-after", "", "Don't run before this time <rfc3339 | unix_timestamp>")
+	cmd.Flags().String("expires", "", "Don't run after this time <rfc3339 | unix_timestamp>")
+	cmd.Flags().Int("max-run-count", 0, "Stop after this many runs, 0 for no limit")
+	cmd.Flags().Bool("dry-run", false, "Show the machines the schedule applies to and its next runs, without creating it")
+	cmd.MarkFlagRequired("action")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func scheduleListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List schedules with their next run",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			listParams := viper.New()
+			listParams.Set("search", params.GetString("search"))
+			_, decoded, _, err := MistApiV2ListSchedules(listParams)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			now := time.Now().UTC()
+			rows := []interface{}{}
+			for _, schedule := range responseItems(decoded) {
+				row := map[string]interface{}{
+					"id":       schedule["id"],
+					"name":     schedule["name"],
+					"action":   schedule["action"],
+					"schedule": describeScheduleEntry(schedule),
+					"enabled":  schedule["enabled"],
+				}
+				if runs := scheduleRuns(schedule, now, 1); len(runs) > 0 {
+					row["next_run"] = runs[0].Format(time.RFC3339)
+				}
+				rows = append(rows, row)
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{
+				[]string{"name", "action", "schedule", "enabled", "next_run"},
+				[]string{"id", "name", "action", "schedule", "enabled", "next_run"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("search", "", "Only return results matching search filter")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func scheduleNextCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:               "next SCHEDULE",
+		Short:             "Show the next runs of a schedule and the machines it applies to",
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: completeResourceFlag("schedule"),
+		Run: func(cmd *cobra.Command, args []string) {
+			schedule, err := lookupResource("schedule", args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if schedule == nil {
+				logger.Fatalf("Schedule %s not found", args[0])
+			}
+			machines, err := scheduleMachines(schedule["selectors"])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			fmt.Printf("Schedule %s (%s) runs %v on %d machines:\n", args[0], describeScheduleEntry(schedule), schedule["action"], len(machines))
+			for _, machine := range machines {
+				fmt.Printf("  %s\n", machine)
+			}
+			runs := scheduleRuns(schedule, time.Now().UTC(), params.GetInt("count"))
+			if len(runs) == 0 {
+				fmt.Println("No runs ahead")
+				return
+			}
+			fmt.Println("Next runs:")
+			for _, t := range runs {
+				fmt.Printf("  %s\n", t.Format(time.RFC3339))
+			}
+		},
+	}
+	cmd.Flags().Int("count", 5, "Number of runs to show")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func scheduleDeleteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "delete SCHEDULE...",
+		Short:             "Delete schedules",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeResourceFlag("schedule"),
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, schedule := range args {
+				if _, _, _, err := MistApiV2DeleteSchedule(schedule, viper.New()); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf("Schedule %s deleted\n", schedule)
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func scheduleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schedule",
+		Short: "Schedule actions on machines",
+	}
+	cmd.AddCommand(scheduleCreateCmd())
+	cmd.AddCommand(scheduleListCmd())
+	cmd.AddCommand(scheduleNextCmd())
+	cmd.AddCommand(scheduleDeleteCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// scpChunkSize is the amount of data sent in each command while uploading.
+// Files are sent base64 encoded through the remote terminal, so every chunk
+// is a round trip.
+const scpChunkSize = 48 * 1024
+
+// splitRemotePath splits a MACHINE:PATH argument. Local paths containing a
+// colon can be given as ./path.
+func splitRemotePath(arg string) (string, string, bool) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg, false
+	}
+	i := strings.Index(arg, ":")
+	if i <= 0 {
+		return "", arg, false
+	}
+	return arg[:i], arg[i+1:], true
+}
+
+// transferProgress reports the progress of a transfer on stderr, when it is
+// a terminal.
+type transferProgress struct {
+	name    string
+	total   int64
+	current int64
+	started time.Time
+	shown   time.Time
+	enabled bool
+}
+
+func newTransferProgress(name string, current, total int64, quiet bool) *transferProgress {
+	return &transferProgress{
+		name:    name,
+		total:   total,
+		current: current,
+		started: time.Now(),
+		enabled: !quiet && term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+func (p *transferProgress) add(n int) {
+	p.current += int64(n)
+	if time.Since(p.shown) > 200*time.Millisecond {
+		p.show()
+	}
+}
+
+func (p *transferProgress) show() {
+	if !p.enabled {
+		return
+	}
+	p.shown = time.Now()
+	percent := int64(100)
+	if p.total > 0 {
+		percent = p.current * 100 / p.total
+	}
+	fmt.Fprintf(os.Stderr, "\r%s %3d%% %s/%s", p.name, percent, formatBytes(p.current), formatBytes(p.total))
+}
+
+func (p *transferProgress) finish() {
+	if !p.enabled {
+		return
+	}
+	p.show()
+	fmt.Fprintf(os.Stderr, " %s\n", time.Since(p.started).Round(time.Second))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// remoteFileSize returns the size of a remote file, or -1 if it does not
+// exist.
+func remoteFileSize(shell *remoteShell, path string) (int64, error) {
+	out, err := shell.Output(fmt.Sprintf("if [ -e %[1]s ]; then wc -c < %[1]s; else echo -1; fi", shellQuote(path)))
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not get the size of %s: %q", path, out)
+	}
+	return size, nil
+}
+
+func uploadFile(shell *remoteShell, localPath, remotePath string, resume, quiet bool) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", localPath)
+	}
+	if strings.HasSuffix(remotePath, "/") || remotePath == "" {
+		remotePath += info.Name()
+	}
+	offset := int64(0)
+	if resume {
+		size, err := remoteFileSize(shell, remotePath)
+		if err != nil {
+			return err
+		}
+		if size > info.Size() {
+			return fmt.Errorf("remote file %s is larger than %s, can't resume", remotePath, localPath)
+		}
+		if size > 0 {
+			offset = size
+		}
+	}
+	if offset == 0 {
+		if _, err := shell.Output(": > " + shellQuote(remotePath)); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	progress := newTransferProgress(info.Name(), offset, info.Size(), quiet)
+	buf := make([]byte, scpChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			command := fmt.Sprintf("printf '%%s' '%s' | base64 -d >> %s", base64.StdEncoding.EncodeToString(buf[:n]), shellQuote(remotePath))
+			if _, err := shell.Output(command); err != nil {
+				return fmt.Errorf("upload failed at %s, use --resume to continue: %s", formatBytes(progress.current), err)
+			}
+			progress.add(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	progress.finish()
+	return nil
+}
+
+// progressWriter counts the bytes written through it.
+type progressWriter struct {
+	w        io.Writer
+	progress *transferProgress
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.progress.add(n)
+	return n, err
+}
+
+func downloadFile(shell *remoteShell, remotePath, localPath string, resume, quiet bool) error {
+	size, err := remoteFileSize(shell, remotePath)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("%s: no such file", remotePath)
+	}
+	name := remotePath[strings.LastIndex(remotePath, "/")+1:]
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = strings.TrimSuffix(localPath, string(os.PathSeparator)) + string(os.PathSeparator) + name
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	offset := int64(0)
+	if resume {
+		if info, err := os.Stat(localPath); err == nil {
+			if info.Size() > size {
+				return fmt.Errorf("local file %s is larger than %s, can't resume", localPath, remotePath)
+			}
+			offset = info.Size()
+			flags = os.O_WRONLY | os.O_APPEND
+		}
+	}
+	f, err := os.OpenFile(localPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	progress := newTransferProgress(name, offset, size, quiet)
+	// The file is streamed base64 encoded, since not every byte survives
+	// the terminal, and decoded on the fly.
+	pr, pw := io.Pipe()
+	decoded := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(&progressWriter{f, progress}, base64.NewDecoder(base64.StdEncoding, pr))
+		pr.CloseWithError(err)
+		decoded <- err
+	}()
+	var stderr bytes.Buffer
+	exitCode, err := shell.Run(fmt.Sprintf("tail -c +%d %s | base64", offset+1, shellQuote(remotePath)), pw, &stderr)
+	pw.Close()
+	if decodeErr := <-decoded; err == nil && decodeErr != nil {
+		err = decodeErr
+	}
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("%s", strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return fmt.Errorf("download failed at %s, use --resume to continue: %s", formatBytes(progress.current), err)
+	}
+	progress.finish()
+	return nil
+}
+
+func scpCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "scp SOURCE DESTINATION",
+		Short: "Copy files to and from a machine",
+		Long: `Copy a file to or from a machine over its SSH connection.
+
+One of SOURCE and DESTINATION is a remote path in the form MACHINE:PATH, the
+other a local path. Local paths containing a colon can be given as ./PATH.
+Interrupted transfers can be continued with --resume, which appends to the
+partially transferred file.`,
+		Example: `  mist scp ./backup.tar.gz web-1:/tmp/
+  mist scp web-1:/var/log/syslog .
+  mist scp --resume web-1:/tmp/dump.sql ./dump.sql`,
+		Args: cobra.ExactArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveDefault
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			srcMachine, srcPath, srcRemote := splitRemotePath(args[0])
+			dstMachine, dstPath, dstRemote := splitRemotePath(args[1])
+			if srcRemote == dstRemote {
+				logger.Fatal("Exactly one of SOURCE and DESTINATION must be a remote path in the form MACHINE:PATH")
+			}
+			machine := srcMachine
+			if dstRemote {
+				machine = dstMachine
+			}
+			shell, err := openRemoteShell(machine)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			defer shell.Close()
+			resume := params.GetBool("resume")
+			quiet := params.GetBool("no-progress")
+			if dstRemote {
+				err = uploadFile(shell, srcPath, dstPath, resume, quiet)
+			} else {
+				err = downloadFile(shell, srcPath, dstPath, resume, quiet)
+			}
+			if err != nil {
+				shell.Close()
+				logger.Fatalf("Error copying file: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().Bool("resume", false, "Continue an interrupted transfer")
+	cmd.Flags().Bool("no-progress", false, "Don't report progress")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// copyResult is the outcome of copying a file to a machine. Skipped
+// copies weren't started, as an earlier one failed with --on-error stop.
+type copyResult struct {
+	Machine string
+	Bytes   int64
+	Err     error
+	Skipped bool
+}
+
+// copyToMachine uploads the file to the machine and checks that the remote
+// file has as many bytes as the local one.
+func copyToMachine(machine, localPath, remotePath string, size int64) (int64, error) {
+	shell, err := openRemoteShell(machine)
+	if err != nil {
+		return 0, err
+	}
+	defer shell.Close()
+	if strings.HasSuffix(remotePath, "/") || remotePath == "" {
+		remotePath += filepath.Base(localPath)
+	}
+	if err := uploadFile(shell, localPath, remotePath, false, true); err != nil {
+		return 0, err
+	}
+	copied, err := remoteFileSize(shell, remotePath)
+	if err != nil {
+		return 0, err
+	}
+	if copied != size {
+		return copied, fmt.Errorf("%s has %d bytes, expected %d", remotePath, copied, size)
+	}
+	return copied, nil
+}
+
+// copyToMachines copies the file to every machine, at most parallel at a
+// time. With stopOnError, copies not started once one fails are skipped.
+func copyToMachines(machines []string, localPath, remotePath string, size int64, parallel int, stopOnError bool) []copyResult {
+	var mutex sync.Mutex
+	failed := false
+	results := make([]copyResult, len(machines))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, machine := range machines {
+		wg.Add(1)
+		go func(i int, machine string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			mutex.Lock()
+			skip := stopOnError && failed
+			mutex.Unlock()
+			if skip {
+				results[i] = copyResult{Machine: machine, Skipped: true}
+				return
+			}
+			copied, err := copyToMachine(machine, localPath, remotePath, size)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failed = true
+				fmt.Fprintf(os.Stderr, "%s: error: %s\n", machine, err)
+			} else {
+				fmt.Printf("%s: copied %s\n", machine, formatBytes(copied))
+			}
+			results[i] = copyResult{Machine: machine, Bytes: copied, Err: err}
+		}(i, machine)
+	}
+	wg.Wait()
+	return results
+}
+
+func machineScpMultiCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "scp-multi FILE --to PATH",
+		Short: "Copy a file to many machines",
+		Long: `Copy a local file to the same remote path on many machines concurrently,
+over their SSH connections, and check that every copy has as many bytes as
+the file.
+
+The machines are given with --machines, or selected by tag with --tag or
+with --search using the same query syntax as listings. With --on-error
+stop, copies not started yet when one fails are skipped. The exit code is
+0 if the file was copied to every machine and 1 otherwise.`,
+		Example: `  mist machine scp-multi ./app.conf --to /etc/app/app.conf --machines web-1,web-2
+  mist machine scp-multi ./app.conf --to /etc/app/ --tag role=web --on-error stop`,
+		Args: cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveDefault
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			info, err := os.Stat(args[0])
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if info.IsDir() {
+				logger.Fatalf("%s is a directory", args[0])
+			}
+			onError := params.GetString("on-error")
+			if onError != "stop" && onError != "continue" {
+				logger.Fatalf("Unknown --on-error %s, expected stop or continue", onError)
+			}
+			machines, err := targetMachines(params.GetStringSlice("machines"), params.GetStringSlice("tag"), params.GetString("search"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if len(machines) == 0 {
+				logger.Fatal("No machines to copy the file to, use --machines, --tag or --search")
+			}
+			parallel := parallelism(params)
+			if parallel < 1 {
+				parallel = 1
+			}
+			results := copyToMachines(machines, args[0], params.GetString("to"), info.Size(), parallel, onError == "stop")
+			result := newOperationResult()
+			copied, exitCode := 0, 0
+			for _, r := range results {
+				switch {
+				case r.Skipped:
+					result.skip(r.Machine)
+				case r.Err != nil:
+					result.fail(r.Machine, r.Err)
+					exitCode = 1
+				default:
+					result.succeed(r.Machine)
+					copied++
+				}
+			}
+			fmt.Fprintf(os.Stderr, "Copied to %d of %d machines\n", copied, len(results))
+			for _, failure := range result.Failed {
+				fmt.Fprintf(os.Stderr, " * %s (%s)\n", failure.Item, failure.Error)
+			}
+			if len(result.Skipped) > 0 {
+				fmt.Fprintf(os.Stderr, "Skipped %s\n", strings.Join(result.Skipped, ", "))
+			}
+			result.write(params.GetString("result-file"), exitCode)
+			os.Exit(exitCode)
+		},
+	}
+	cmd.Flags().String("to", "", "Remote path to copy the file to, the file name is appended if it ends with /")
+	cmd.Flags().StringSlice("machines", nil, "Machines to copy the file to, comma separated")
+	cmd.Flags().StringSlice("tag", nil, "Copy to the machines with the tag, as KEY=VALUE")
+	cmd.Flags().String("search", "", "Copy to the machines matching the search query")
+	cmd.Flags().Int("parallel", 10, "Maximum number of machines to copy the file to at the same time")
+	cmd.Flags().String("on-error", "continue", "What to do when a copy fails: stop starting new copies or continue")
+	cmd.Flags().String("result-file", "", "Write a JSON summary of the outcome on every machine to a file")
+	cmd.MarkFlagRequired("to")
+	cmd.RegisterFlagCompletionFunc("machines", completeResourceFlag("machine"))
+	cmd.RegisterFlagCompletionFunc("on-error", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"stop", "continue"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// scriptRunHistoryLimit is the number of script runs remembered per
+// context.
+const scriptRunHistoryLimit = 100
+
+// Script runs are remembered in the cache file, per context, as maps of
+// script, machine, job id and start time, so that their output can be
+// fetched again from their jobs.
+
+func scriptRunsKey() string {
+	return "contexts." + viper.GetString("context") + ".script_runs"
+}
+
+func scriptRuns() []map[string]interface{} {
+	runs := []map[string]interface{}{}
+	items, _ := cli.ClusterCache.Get(scriptRunsKey()).([]interface{})
+	for _, item := range items {
+		if run, ok := normalizeYAML(item).(map[string]interface{}); ok {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+func recordScriptRun(script, machine, job string) {
+	runs := []interface{}{map[string]interface{}{
+		"script":  script,
+		"machine": machine,
+		"job":     job,
+		"started": time.Now().UTC().Format(time.RFC3339),
+	}}
+	for _, run := range scriptRuns() {
+		if len(runs) == scriptRunHistoryLimit {
+			break
+		}
+		runs = append(runs, run)
+	}
+	cli.ClusterCache.Set(scriptRunsKey(), runs)
+	cli.ClusterCache.WriteConfig()
+}
+
+// scriptOutput returns the output of a script run from the logs of its job,
+// and its exit code, which is -1 until the script finishes.
+func scriptOutput(job map[string]interface{}) (string, int) {
+	var output strings.Builder
+	exitCode := -1
+	logs, _ := job["logs"].([]interface{})
+	for _, log := range logs {
+		entry, _ := log.(map[string]interface{})
+		for _, field := range []string{"stdout", "output"} {
+			if s, ok := entry[field].(string); ok {
+				output.WriteString(s)
+			}
+		}
+		if code, ok := entry["exit_code"].(float64); ok {
+			exitCode = int(code)
+		}
+	}
+	return output.String(), exitCode
+}
+
+// followScriptRun polls the job of a script run until it finishes, writing
+// the output as it shows up in the job logs.
+func followScriptRun(jobID string, stdout *prefixWriter, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	written := 0
+	for {
+		resp, decoded, _, err := MistApiV2GetJob(jobID, viper.New())
+		if err != nil && (resp == nil || resp.StatusCode != 404) {
+			return 0, err
+		}
+		if job, ok := decoded["data"].(map[string]interface{}); ok {
+			output, exitCode := scriptOutput(job)
+			if len(output) > written {
+				stdout.Write([]byte(output[written:]))
+				written = len(output)
+			}
+			switch jobStatus(job) {
+			case "failed":
+				if exitCode > 0 {
+					return exitCode, nil
+				}
+				return 0, fmt.Errorf("job %s failed: %s", jobID, transposedValue(job["error"]))
+			case "finished":
+				if exitCode < 0 {
+					exitCode = 0
+				}
+				return exitCode, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("timed out after %s waiting for job %s", timeout, jobID)
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
+
+// runScript starts the script on every machine, at most parallel at a
+// time, and follows the runs, prefixing their output with the name of the
+// machine.
+func runScript(script string, machines []resourceRef, body map[string]interface{}, parallel int, timeout time.Duration) []execResult {
+	width := 0
+	for _, machine := range machines {
+		if len(machine.name) > width {
+			width = len(machine.name)
+		}
+	}
+	var outputMutex sync.Mutex
+	results := make([]execResult, len(machines))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, machine := range machines {
+		wg.Add(1)
+		go func(i int, machine resourceRef) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			prefix := fmt.Sprintf("%-*s | ", width, machine.name)
+			stdout := &prefixWriter{w: os.Stdout, mutex: &outputMutex, prefix: prefix}
+			stderr := &prefixWriter{w: os.Stderr, mutex: &outputMutex, prefix: prefix}
+			exitCode, err := func() (int, error) {
+				request := map[string]interface{}{"machine": machine.id}
+				for k, v := range body {
+					request[k] = v
+				}
+				raw, err := json.Marshal(request)
+				if err != nil {
+					return 0, err
+				}
+				_, decoded, _, err := MistApiV2RunScript(script, viper.New(), string(raw))
+				if err != nil {
+					return 0, err
+				}
+				jobID, _ := decoded["jobId"].(string)
+				if jobID == "" {
+					jobID, _ = decoded["job_id"].(string)
+				}
+				if jobID == "" {
+					return 0, fmt.Errorf("no job was started")
+				}
+				recordJob(jobID)
+				recordScriptRun(script, machine.name, jobID)
+				return followScriptRun(jobID, stdout, timeout)
+			}()
+			stdout.flush()
+			if err != nil {
+				stderr.writeLine([]byte(fmt.Sprintf("error: %s\n", err)))
+			}
+			results[i] = execResult{Machine: machine.name, ExitCode: exitCode, Err: err}
+		}(i, machine)
+	}
+	wg.Wait()
+	return results
+}
+
+// scriptExecType guesses how a script is run from its filename: playbooks
+// with ansible, anything else as an executable.
+func scriptExecType(filename string) string {
+	switch filepath.Ext(filename) {
+	case ".yml", ".yaml":
+		return "ansible"
+	}
+	return "executable"
+}
+
+// addScript uploads the file as an inline script.
+func addScript(params *viper.Viper, name, filename, description, execType string) (map[string]interface{}, cli.CLIOutputOptions, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, cli.CLIOutputOptions{}, err
+	}
+	if execType == "" {
+		execType = scriptExecType(filename)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"name":          name,
+		"description":   description,
+		"script":        string(content),
+		"location_type": "inline",
+		"exec_type":     execType,
+	})
+	if err != nil {
+		return nil, cli.CLIOutputOptions{}, err
+	}
+	_, decoded, outputOptions, err := MistApiV2AddScript(params, string(body))
+	return decoded, outputOptions, err
+}
+
+func scriptUploadCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "upload NAME FILE",
+		Short: "Upload a script",
+		Long: `Upload a script from a file. Files ending with .yml or .yaml are taken for
+Ansible playbooks, and others for executables, unless --exec-type is given.`,
+		Example: "  mist script upload install-nginx ./install-nginx.sh --description 'Install nginx'",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			decoded, outputOptions, err := addScript(params, args[0], args[1], params.GetString("description"), params.GetString("exec-type"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("description", "", "Description of the script")
+	cmd.Flags().String("exec-type", "", "How the script is run, executable or ansible")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func scriptListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List scripts",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			_, decoded, outputOptions, err := MistApiV2ListScripts(params)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("search", "", "Only return results matching search filter")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func scriptEditCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "edit SCRIPT",
+		Short: "Rename a script, or change its description or content",
+		Long: `Rename a script, or change its description or content.
+
+The content of a script can't be changed in place, so with --file the
+script is uploaded anew with the same name and description, and the old
+one deleted. Its id changes, so schedules running it need to be updated.`,
+		Example: `  mist script edit install-nginx --description 'Install and start nginx'
+  mist script edit install-nginx --file ./install-nginx.sh`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFirstArg(completeResourceFlag("script")),
+		Run: func(cmd *cobra.Command, args []string) {
+			if !cmd.Flags().Changed("name") && !cmd.Flags().Changed("description") && !cmd.Flags().Changed("file") {
+				logger.Fatal("Nothing to change, give --name, --description or --file")
+			}
+			live, err := lookupResource("script", args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if live == nil {
+				logger.Fatalf("Script %s not found", args[0])
+			}
+			id, _ := live["id"].(string)
+			name, _ := live["name"].(string)
+			description, _ := live["description"].(string)
+			if cmd.Flags().Changed("name") {
+				name = params.GetString("name")
+			}
+			if cmd.Flags().Changed("description") {
+				description = params.GetString("description")
+			}
+			if filename := params.GetString("file"); filename != "" {
+				execType, _ := live["exec_type"].(string)
+				decoded, outputOptions, err := addScript(viper.New(), name, filename, description, execType)
+				if err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				if _, _, _, err := MistApiV2DeleteScript(id, viper.New()); err != nil {
+					logger.Fatalf("Error deleting the old script %s: %s", id, err.Error())
+				}
+				if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+					logger.Fatalf("Formatting failed: %s", err.Error())
+				}
+				return
+			}
+			editParams := viper.New()
+			editParams.Set("name", name)
+			editParams.Set("description", description)
+			if _, _, _, err := MistApiV2EditScript(id, editParams); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			fmt.Printf("Script %s updated\n", name)
+		},
+	}
+	cmd.Flags().String("name", "", "New name of the script")
+	cmd.Flags().String("description", "", "New description of the script")
+	cmd.Flags().String("file", "", "File with the new content of the script")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func scriptRunCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "run SCRIPT [MACHINE...]",
+		Short: "Run a script on machines",
+		Long: `Run a script on machines and follow its output.
+
+The machines are given by name, or selected with --search using the same
+query syntax as listings. Every line of output is prefixed with the name of
+the machine it came from, and shows up as the jobs of the runs log it. The
+exit code is 0 if the script succeeded on every machine, 1 if it failed on
+any of them and 255 if it could not be run on any of them.
+
+Runs are remembered, so that their output can be shown again with script
+logs.`,
+		Example: `  mist script run install-nginx web-1 web-2
+  mist script run backup --search 'tag:db' --params '--full' --su`,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeFirstArg(completeResourceFlag("script")),
+		Run: func(cmd *cobra.Command, args []string) {
+			machines, err := resolveResources("machine", args[1:], params.GetString("search"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if len(machines) == 0 {
+				logger.Fatal("No machines to run the script on, give machine names or use --search")
+			}
+			body := map[string]interface{}{}
+			if p := params.GetString("params"); p != "" {
+				body["params"] = p
+			}
+			if params.GetBool("su") {
+				body["su"] = true
+			}
+			if env, _ := cmd.Flags().GetStringArray("env"); len(env) > 0 {
+				body["env"] = strings.Join(env, "\n")
+			}
+			parallel := parallelism(params)
+			if parallel < 1 {
+				parallel = 1
+			}
+			results := runScript(args[0], machines, body, parallel, params.GetDuration("timeout"))
+			printExecSummary(results)
+			os.Exit(execExitCode(results))
+		},
+	}
+	cmd.Flags().String("search", "", "Run on the machines matching the search query")
+	cmd.Flags().String("params", "", "Parameters to pass to the script")
+	cmd.Flags().Bool("su", false, "Run the script as root")
+	cmd.Flags().StringArray("env", []string{}, "Environment variable to set, as KEY=VALUE, may be repeated")
+	cmd.Flags().Int("parallel", 10, "Maximum number of machines to run the script on at the same time")
+	cmd.Flags().Duration("timeout", 30*time.Minute, "Maximum time to follow each run")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func scriptLogsCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "logs [JOB]",
+		Short: "List past script runs, or show the output of one",
+		Long: `List the script runs started by mist in the current context, most recent
+first, or show the output of the run of the given job. --script and
+--machine only list the runs of a script or on a machine, and with --save
+the output of the runs listed is written to a file per run in a directory.`,
+		Example: `  mist script logs --script backup
+  mist script logs 4c6a1e0e7e5a4a5fa0f5b8d1f2a3b4c5
+  mist script logs --script backup --save ./backup-logs`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: scriptRunAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 1 {
+				resp, decoded, _, err := MistApiV2GetJob(args[0], viper.New())
+				if err != nil {
+					if resp != nil && resp.StatusCode == 404 {
+						logger.Fatalf("Job %s not found, its logs may have expired", args[0])
+					}
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				job, _ := decoded["data"].(map[string]interface{})
+				output, _ := scriptOutput(job)
+				fmt.Print(output)
+				return
+			}
+			runs := []interface{}{}
+			for _, run := range scriptRuns() {
+				if script := params.GetString("script"); script != "" && run["script"] != script {
+					continue
+				}
+				if machine := params.GetString("machine"); machine != "" && run["machine"] != machine {
+					continue
+				}
+				runs = append(runs, run)
+			}
+			if dir := params.GetString("save"); dir != "" {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					logger.Fatal(err)
+				}
+				for _, r := range runs {
+					run := r.(map[string]interface{})
+					jobID, _ := run["job"].(string)
+					_, decoded, _, err := MistApiV2GetJob(jobID, viper.New())
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Could not get the output of job %s: %s\n", jobID, err)
+						continue
+					}
+					job, _ := decoded["data"].(map[string]interface{})
+					output, _ := scriptOutput(job)
+					filename := filepath.Join(dir, fmt.Sprintf("%v-%v-%s.log", run["script"], run["machine"], jobID))
+					if err := ioutil.WriteFile(filename, []byte(output), 0644); err != nil {
+						logger.Fatal(err)
+					}
+					fmt.Println(filename)
+				}
+				return
+			}
+			columns := []string{"job", "script", "machine", "started"}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": runs}, params, cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("script", "", "Only list the runs of this script")
+	cmd.Flags().String("machine", "", "Only list the runs on this machine")
+	cmd.Flags().String("save", "", "Write the output of the runs listed to files in this directory")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+// scriptRunAutocomplete completes the ids of script runs.
+func scriptRunAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	jobs := []string{}
+	for _, run := range scriptRuns() {
+		if id, ok := run["job"].(string); ok {
+			jobs = append(jobs, fmt.Sprintf("%s\t%v on %v", id, run["script"], run["machine"]))
+		}
+	}
+	return jobs, cobra.ShellCompDirectiveNoFileComp
+}
+
+func scriptCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "script",
+		Short: "Upload, edit and run scripts",
+	}
+	cmd.AddCommand(scriptUploadCmd())
+	cmd.AddCommand(scriptListCmd())
+	cmd.AddCommand(scriptEditCmd())
+	cmd.AddCommand(scriptRunCmd())
+	cmd.AddCommand(scriptLogsCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
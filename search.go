@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// searchKinds parses the --type of search, a comma separated list of kinds
+// of resources, singular or plural. All the kinds get all shows are
+// searched by default.
+func searchKinds(types string) ([]string, error) {
+	if types == "" {
+		return getAllKinds, nil
+	}
+	kinds := []string{}
+	for _, kind := range strings.Split(types, ",") {
+		kind = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(kind)), "s")
+		_, listed := resourceListControllersMap[kind]
+		_, offered := wizardListControllersMap[kind]
+		if !listed && !offered {
+			return nil, fmt.Errorf("can't search %s", kind)
+		}
+		kinds = append(kinds, kind)
+	}
+	return uniqueStrings(kinds), nil
+}
+
+// resourceLink returns the page of the resource in the Mist web UI.
+func resourceLink(server, kind, id string) string {
+	return strings.TrimSuffix(server, "/") + "/" + kind + "s/" + id
+}
+
+func searchCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "search TERM",
+		Short: "Search resources of every kind",
+		Long: `Search the resources of every kind get all shows for the term, or of the
+kinds of --type, and show them in a single table with their kind and a link
+to them in the Mist web UI. The kinds are searched in parallel.
+
+The term is a search query of the API, like with the --search flag of get
+commands, e.g. web or state:running.`,
+		Example: `  mist search web
+  mist search db --type machines,volumes
+  mist search ubuntu --type image -o wide`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			kinds, err := searchKinds(params.GetString("type"))
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if err := setContext(); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			server, err := getValidServer()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			parallel := parallelism(params)
+			if parallel < 1 {
+				logger.Fatal("--parallel must be at least 1")
+			}
+			sections, _ := listSections(kinds, parallel, nil, func(kind string) (map[string]interface{}, cli.CLIOutputOptions, error) {
+				list, ok := resourceListControllersMap[kind]
+				if !ok {
+					list = wizardListControllersMap[kind]
+				}
+				listParams := viper.New()
+				listParams.Set("search", args[0])
+				listParams.Set("limit", params.GetInt("limit"))
+				_, decoded, outputOptions, err := list(listParams)
+				return decoded, outputOptions, err
+			})
+			names := make(referenceNames)
+			rows := []interface{}{}
+			failed := 0
+			for _, section := range sections {
+				if section.err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: could not search %ss: %s\n", section.kind, section.err)
+					failed++
+					continue
+				}
+				items := responseItems(section.decoded)
+				sort.SliceStable(items, func(i, j int) bool {
+					return fmt.Sprint(items[i]["name"]) < fmt.Sprint(items[j]["name"])
+				})
+				for _, item := range items {
+					id, _ := item["id"].(string)
+					cloud := item["cloud"]
+					switch c := cloud.(type) {
+					case map[string]interface{}:
+						cloud = c["name"]
+					case string:
+						cloud = names.lookup("cloud", c)
+					}
+					rows = append(rows, map[string]interface{}{
+						"type":  section.kind,
+						"name":  item["name"],
+						"id":    id,
+						"cloud": cloud,
+						"link":  resourceLink(server, section.kind, id),
+					})
+				}
+			}
+			if failed == len(sections) {
+				logger.Fatalf("Error calling operation: could not search %s", strings.Join(kinds, ", "))
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{
+				[]string{"type", "name", "cloud", "link"},
+				[]string{"type", "name", "id", "cloud", "link"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("type", "", "Only search resources of these kinds, separated by commas")
+	cmd.Flags().Int("limit", 100, "Maximum number of resources of each kind to show")
+	cmd.Flags().Int("parallel", 4, "Maximum number of kinds to search at the same time")
+	cmd.RegisterFlagCompletionFunc("type", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		kinds := append([]string{}, getAllKinds...)
+		for kind := range wizardListControllersMap {
+			kinds = append(kinds, kind)
+		}
+		return uniqueStrings(kinds), cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+)
+
+// configSetting is a setting of the config file, which config set and
+// config edit check before saving it.
+type configSetting struct {
+	description string
+	// defaultValue is shown by config get when the setting isn't set.
+	defaultValue string
+	// parse converts a value given on the command line to the one saved,
+	// failing if it is invalid.
+	parse func(value string) (interface{}, error)
+}
+
+var configSettings = map[string]configSetting{
+	"server":                 {"URL of the Mist API, unless the context sets one", "", parseServerSetting},
+	"output":                 {"Default output format, unless the context sets one", "table", parseOutputSetting},
+	"color":                  {"When to color output: auto, always or never", "auto", parseChoiceSetting("auto", "always", "never")},
+	"cache_ttl":              {"How long responses are cached, 0 disables the cache", defaultCacheTTL.String(), parseDurationSetting},
+	"concurrency":            {"Default of --parallel, the number of requests or machines handled at the same time", "", parseCountSetting(1)},
+	"request_timeout":        {"How long requests to the API may take", "", parseDurationSetting},
+	"retries":                {"Number of times to retry requests which fail temporarily", "", parseCountSetting(0)},
+	"proxy":                  {"HTTP or SOCKS5 proxy to connect through", "", parseProxySetting},
+	"cacert":                 {"PEM file of CA certificates to trust", "", parseFileSetting},
+	"insecure_skip_verify":   {"Don't verify the certificate of the server", "false", parseBoolSetting},
+	"credential_store":       {"Where tokens are kept: keyring or file", "keyring", parseChoiceSetting("keyring", "file")},
+	"hidden_columns":         {"Columns hidden from table output, comma separated", "", parseListSetting},
+	"ssh_keepalive":          {"How often ssh pings shells", defaultKeepalive.String(), parseDurationSetting},
+	"ssh_reconnect":          {"Number of times ssh reconnects lost shells", "", parseCountSetting(0)},
+	"ssh_no_clipboard":       {"Drop OSC 52 clipboard writes of remote terminals", "false", parseBoolSetting},
+	"ssh_no_title":           {"Drop window titles set by remote terminals", "false", parseBoolSetting},
+	"ssh_no_bracketed_paste": {"Don't let remote terminals enable bracketed paste", "false", parseBoolSetting},
+	"update_channel":         {"Release channel of update and version --check: stable or beta", "stable", parseChoiceSetting("stable", "beta")},
+	"self_update":            {"Let update replace mist, false for installs managed by package managers", "true", parseBoolSetting},
+	"plugin_registry":        {"URL of the index plugin install installs plugins from", "", parseURLSetting},
+	"aliases":                {"Command line shortcuts, set with alias set", "", parseAliasesSetting},
+}
+
+func parseServerSetting(value string) (interface{}, error) {
+	if err := validateServerURL(value); err != nil {
+		return nil, fmt.Errorf("invalid server URL %q, it must start with http:// or https://", value)
+	}
+	return value, nil
+}
+
+func parseURLSetting(value string) (interface{}, error) {
+	if err := validateServerURL(value); err != nil {
+		return nil, fmt.Errorf("invalid URL %q, it must start with http:// or https://", value)
+	}
+	return value, nil
+}
+
+func parseOutputSetting(value string) (interface{}, error) {
+	switch value {
+	case "table", "wide", "json", "yaml", "csv", "tsv", "msgpack":
+		return value, nil
+	}
+	for _, prefix := range []string{customColumnsPrefix, goTemplatePrefix, goTemplateFilePrefix} {
+		if strings.HasPrefix(value, prefix) && len(value) > len(prefix) {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown output format %q", value)
+}
+
+func parseChoiceSetting(choices ...string) func(string) (interface{}, error) {
+	return func(value string) (interface{}, error) {
+		for _, choice := range choices {
+			if value == choice {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not one of %s", value, strings.Join(choices, ", "))
+	}
+}
+
+func parseDurationSetting(value string) (interface{}, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("%q is not a duration, like 30s or 5m", value)
+	}
+	return value, nil
+}
+
+func parseCountSetting(min int) func(string) (interface{}, error) {
+	return func(value string) (interface{}, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min {
+			return nil, fmt.Errorf("%q is not a number of at least %d", value, min)
+		}
+		return n, nil
+	}
+}
+
+func parseBoolSetting(value string) (interface{}, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not true or false", value)
+	}
+	return b, nil
+}
+
+func parseProxySetting(value string) (interface{}, error) {
+	if _, err := parseProxyURL(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func parseFileSetting(value string) (interface{}, error) {
+	info, err := os.Stat(value)
+	if err != nil || info.IsDir() {
+		return nil, fmt.Errorf("%s is not a file", value)
+	}
+	if abs, err := filepath.Abs(value); err == nil {
+		value = abs
+	}
+	return value, nil
+}
+
+func parseListSetting(value string) (interface{}, error) {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
+
+// validateConfigSetting checks a setting read from a config file, where it
+// may have any type.
+func validateConfigSetting(key string, value interface{}) error {
+	setting, ok := configSettings[key]
+	if !ok {
+		return nil
+	}
+	switch key {
+	case "hidden_columns":
+		return validateHiddenColumns(value)
+	case "aliases":
+		return validateAliases(value)
+	}
+	switch value.(type) {
+	case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+		return fmt.Errorf("%s must be a single value", key)
+	}
+	if _, err := setting.parse(fmt.Sprint(value)); err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+	return nil
+}
+
+// validateHiddenColumns checks that hidden_columns is a list of columns, or
+// a map from resource types to lists of columns.
+func validateHiddenColumns(value interface{}) error {
+	isList := func(v interface{}) bool {
+		list, ok := v.([]interface{})
+		for _, item := range list {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return ok
+	}
+	if isList(value) {
+		return nil
+	}
+	valid := true
+	switch columns := value.(type) {
+	case map[string]interface{}:
+		for _, v := range columns {
+			valid = valid && isList(v)
+		}
+	case map[interface{}]interface{}:
+		for _, v := range columns {
+			valid = valid && isList(v)
+		}
+	default:
+		valid = false
+	}
+	if !valid {
+		return fmt.Errorf("hidden_columns must be a list of columns, or a map from resource types to lists of columns")
+	}
+	return nil
+}
+
+// parseAliasesSetting refuses setting aliases with config set, which
+// can't tell their names from their expansions.
+func parseAliasesSetting(value string) (interface{}, error) {
+	return nil, fmt.Errorf("use alias set to add aliases")
+}
+
+// validateAliases checks that aliases is a map from names to command lines.
+func validateAliases(value interface{}) error {
+	aliases := map[string]interface{}{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		aliases = v
+	case map[interface{}]interface{}:
+		for name, expansion := range v {
+			aliases[fmt.Sprint(name)] = expansion
+		}
+	default:
+		return fmt.Errorf("aliases must be a map from alias names to command lines")
+	}
+	for name, expansion := range aliases {
+		line, ok := expansion.(string)
+		if !ok {
+			return fmt.Errorf("alias %s must be a command line", name)
+		}
+		if err := checkAlias(name, line); err != nil {
+			return fmt.Errorf("alias %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// parallelism returns the value of --parallel, or the concurrency setting
+// if the flag isn't given.
+func parallelism(params *viper.Viper) int {
+	if !params.IsSet("parallel") && viper.IsSet("concurrency") {
+		return viper.GetInt("concurrency")
+	}
+	return params.GetInt("parallel")
+}
+
+// colorOutput returns whether output is colored, by default when writing to
+// a terminal and NO_COLOR isn't set, unless the color setting says
+// otherwise or --no-color is given.
+func colorOutput(params *viper.Viper) bool {
+	if params.GetBool("no-color") {
+		return false
+	}
+	switch viper.GetString("color") {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return term.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("NO_COLOR") == ""
+}
+
+// configFilePath returns the config file in use, or where it is created,
+// which is config.yaml in ~/.mist.
+func configFilePath() (string, error) {
+	if filename := viper.ConfigFileUsed(); filename != "" {
+		return filename, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".mist", "config.yaml"), nil
+}
+
+// configFileType returns the format of the config file from its extension.
+func configFileType(filename string) string {
+	if ext := strings.TrimPrefix(filepath.Ext(filename), "."); ext != "" {
+		return ext
+	}
+	return "yaml"
+}
+
+// readConfigFile reads only the settings of the config file, without those
+// of flags and the environment, so that they can be written back.
+func readConfigFile(filename string) (*viper.Viper, error) {
+	file := viper.New()
+	file.SetConfigFile(filename)
+	file.SetConfigType(configFileType(filename))
+	file.SetConfigPermissions(0600)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return file, nil
+	}
+	if err := file.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %s", filename, err)
+	}
+	return file, nil
+}
+
+// parseConfig reads and checks the settings of the config file content.
+// Settings mist doesn't know of are only warned about, since they may be
+// for other versions.
+func parseConfig(content []byte, fileType string) (map[string]interface{}, []error) {
+	file := viper.New()
+	file.SetConfigType(fileType)
+	if err := file.ReadConfig(bytes.NewReader(content)); err != nil {
+		return nil, []error{err}
+	}
+	settings := file.AllSettings()
+	errs := []error{}
+	for _, key := range sortedKeys(settings) {
+		if _, ok := configSettings[key]; !ok {
+			fmt.Fprintf(os.Stderr, "Warning: unknown setting %s\n", key)
+			continue
+		}
+		if err := validateConfigSetting(key, settings[key]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return settings, errs
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// redactConfigValue hides secrets in a setting, so that the settings can be
+// shared: settings named like tokens or passwords, and the passwords of
+// URLs.
+func redactConfigValue(key string, value interface{}) interface{} {
+	for _, word := range []string{"token", "password", "secret", "api_key"} {
+		if strings.Contains(strings.ToLower(key), word) {
+			return "REDACTED"
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return u.Redacted()
+			}
+		}
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			redacted[k] = redactConfigValue(k, item)
+		}
+		return redacted
+	}
+	return value
+}
+
+// configSettingKeys returns the names of the settings, sorted.
+func configSettingKeys() []string {
+	keys := make([]string, 0, len(configSettings))
+	for key := range configSettings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configSettingsHelp lists the settings for the help of config set.
+func configSettingsHelp() string {
+	var b strings.Builder
+	for _, key := range configSettingKeys() {
+		fmt.Fprintf(&b, "  %-23s %s\n", key, configSettings[key].description)
+	}
+	return b.String()
+}
+
+// configEditor returns the editor command of VISUAL or EDITOR.
+func configEditor() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if editor := strings.Fields(os.Getenv(env)); len(editor) > 0 {
+			return editor
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"notepad"}
+	}
+	return []string{"vi"}
+}
+
+// editConfigFile opens a copy of the config file in the editor, and saves
+// it once it is valid. Invalid settings are shown, and the copy can be
+// edited again to fix them.
+func editConfigFile(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) == 0 && configFileType(filename) == "yaml" {
+		content = []byte("# Settings of mist, see mist config set --help.\n# server: https://mist.example.com\n# output: table\n")
+	}
+	tmp, err := ioutil.TempFile("", "mist-config-*"+filepath.Ext(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	editor := configEditor()
+	for {
+		cmd := exec.Command(editor[0], append(editor[1:], tmp.Name())...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("editor %s failed: %s", editor[0], err)
+		}
+		edited, err := ioutil.ReadFile(tmp.Name())
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(edited, content) {
+			fmt.Println("Edit cancelled, no changes made")
+			return nil
+		}
+		_, errs := parseConfig(edited, configFileType(filename))
+		if len(errs) == 0 {
+			if err := writePrivateFile(filename, string(edited)); err != nil {
+				return err
+			}
+			fmt.Printf("Config file %s saved\n", filename)
+			return nil
+		}
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+		prompt := promptui.Prompt{
+			Label:     "Edit again",
+			IsConfirm: true,
+		}
+		if _, err := prompt.Run(); err != nil {
+			return fmt.Errorf("config file not changed")
+		}
+	}
+}
+
+func configSetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set KEY VALUE",
+		Short: "Change a setting of the config file",
+		Long: `Change a setting of the config file, after checking its value. Settings
+given with flags or MIST_ environment variables still take precedence.
+
+Settings:
+` + configSettingsHelp(),
+		Example: `  mist config set server https://mist.example.com
+  mist config set output json
+  mist config set cache_ttl 1m
+  mist config set concurrency 8`,
+		Args: cobra.ExactArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) != 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			keys := []string{}
+			for _, key := range configSettingKeys() {
+				keys = append(keys, key+"\t"+configSettings[key].description)
+			}
+			return keys, cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			key := strings.ToLower(args[0])
+			setting, ok := configSettings[key]
+			if !ok {
+				logger.Fatalf("Unknown setting %s, see %s config set --help", args[0], cli.Root.CommandPath())
+			}
+			value, err := setting.parse(args[1])
+			if err != nil {
+				logger.Fatalf("Invalid %s: %s", key, err)
+			}
+			filename, err := configFilePath()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			file, err := readConfigFile(filename)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			file.Set(key, value)
+			if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+				logger.Fatal(err)
+			}
+			if err := file.WriteConfigAs(filename); err != nil {
+				logger.Fatalf("Error saving config file: %s", err.Error())
+			}
+			fmt.Printf("Set %s in %s\n", key, filename)
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func configGetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "get KEY",
+		Short: "Show the value of a setting",
+		Long: `Show the value a setting has, from flags, MIST_ environment variables, the
+config file or its default. Exits with 1 if the setting has no value.`,
+		Example: "  mist config get server",
+		Args:    cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) != 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			return configSettingKeys(), cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			key := strings.ToLower(args[0])
+			value := viper.Get(key)
+			if value == nil || value == "" {
+				if setting, ok := configSettings[key]; ok && setting.defaultValue != "" {
+					value = setting.defaultValue
+				}
+			}
+			switch v := value.(type) {
+			case nil:
+				os.Exit(1)
+			case map[string]interface{}, []interface{}:
+				out, err := yaml.Marshal(v)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				fmt.Print(string(out))
+			default:
+				fmt.Println(v)
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func configViewCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "view",
+		Short: "Show the settings of the config file",
+		Long: `Show the settings of the config file as YAML. With --redact, tokens,
+passwords and the passwords of URLs are hidden, to share the settings.`,
+		Example: "  mist config view --redact",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			filename, err := configFilePath()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			file, err := readConfigFile(filename)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			settings := file.AllSettings()
+			if params.GetBool("redact") {
+				for key, value := range settings {
+					settings[key] = redactConfigValue(key, value)
+				}
+			}
+			if len(settings) == 0 {
+				return
+			}
+			out, err := yaml.Marshal(settings)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			fmt.Print(string(out))
+		},
+	}
+	cmd.Flags().Bool("redact", false, "Hide tokens, passwords and the passwords of URLs")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func configEditCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "edit",
+		Short: "Edit the config file",
+		Long: `Open the config file in the editor of VISUAL or EDITOR, and save it once
+the editor exits, if its settings are valid. Otherwise the errors are
+shown, and it can be edited again.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			filename, err := configFilePath()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if err := editConfigFile(filename); err != nil {
+				logger.Fatal(err)
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// Snapshots created without a name are named after the time they are
+// created at, in UTC, so that they sort by age. Only those are pruned by
+// --keep, never snapshots named by hand.
+const (
+	autoSnapshotPrefix = "mist-"
+	autoSnapshotLayout = "20060102-150405"
+)
+
+// snapshotScheduleMarker ends the crontab lines of snapshot schedules,
+// followed by the context, the id and the name of the machine.
+const snapshotScheduleMarker = "# mist-snapshot"
+
+// snapshotSchedule is a crontab line creating snapshots of a machine.
+type snapshotSchedule struct {
+	cron      string
+	context   string
+	machineID string
+	machine   string
+	keep      int
+}
+
+func (s snapshotSchedule) line() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	command := fmt.Sprintf("%s --context %s snapshot create %s", executable, s.context, s.machineID)
+	if s.keep > 0 {
+		command += fmt.Sprintf(" --keep %d", s.keep)
+	}
+	return fmt.Sprintf("%s %s %s %s %s %s", s.cron, command, snapshotScheduleMarker, s.context, s.machineID, s.machine), nil
+}
+
+// parseSnapshotSchedule parses a crontab line of a snapshot schedule.
+func parseSnapshotSchedule(line string) (snapshotSchedule, bool) {
+	i := strings.Index(line, snapshotScheduleMarker+" ")
+	if i < 0 {
+		return snapshotSchedule{}, false
+	}
+	marker := strings.Fields(line[i+len(snapshotScheduleMarker):])
+	fields := strings.Fields(line[:i])
+	if len(marker) < 3 || len(fields) < len(cronFields) {
+		return snapshotSchedule{}, false
+	}
+	s := snapshotSchedule{
+		cron:      strings.Join(fields[:len(cronFields)], " "),
+		context:   marker[0],
+		machineID: marker[1],
+		machine:   strings.Join(marker[2:], " "),
+	}
+	for j, field := range fields {
+		if field == "--keep" && j+1 < len(fields) {
+			s.keep, _ = strconv.Atoi(fields[j+1])
+		}
+	}
+	return s, true
+}
+
+// readCrontab returns the lines of the crontab of the user.
+func readCrontab() ([]string, error) {
+	if _, err := exec.LookPath("crontab"); err != nil {
+		return nil, fmt.Errorf("snapshot schedules are kept in the crontab of the user, and crontab is not available")
+	}
+	var stderr bytes.Buffer
+	c := exec.Command("crontab", "-l")
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		// Users without a crontab yet
+		if strings.Contains(stderr.String(), "no crontab") {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("could not read the crontab: %s", strings.TrimSpace(stderr.String()))
+	}
+	return strings.Split(strings.TrimRight(string(out), "\n"), "\n"), nil
+}
+
+func writeCrontab(lines []string) error {
+	var stderr bytes.Buffer
+	c := exec.Command("crontab", "-")
+	c.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("could not write the crontab: %s", strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// setSnapshotSchedule replaces the snapshot schedule of the machine in the
+// crontab, or removes it if schedule is nil. It returns whether the machine
+// had one.
+func setSnapshotSchedule(context, machineID string, schedule *snapshotSchedule) (bool, error) {
+	lines, err := readCrontab()
+	if err != nil {
+		return false, err
+	}
+	kept := []string{}
+	found := false
+	for _, line := range lines {
+		if s, ok := parseSnapshotSchedule(line); ok && s.context == context && s.machineID == machineID {
+			found = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if schedule != nil {
+		line, err := schedule.line()
+		if err != nil {
+			return false, err
+		}
+		kept = append(kept, line)
+	}
+	return found, writeCrontab(kept)
+}
+
+// machineSnapshots lists the snapshots of the machine. Only some providers
+// support snapshots, which the API reports as an error.
+func machineSnapshots(machine, machineID string) ([]map[string]interface{}, map[string]interface{}, cli.CLIOutputOptions, error) {
+	_, decoded, outputOptions, err := MistApiV2ListSnapshots(machineID, viper.New())
+	if err != nil {
+		return nil, nil, outputOptions, fmt.Errorf("could not list the snapshots of %s, the provider of its cloud may not support snapshots: %s", machine, err)
+	}
+	return responseItems(decoded), decoded, outputOptions, nil
+}
+
+// pruneSnapshots deletes the oldest snapshots of the machine named after
+// the time they were created at, keeping the newest keep of them.
+func pruneSnapshots(machine, machineID string, keep int) error {
+	snapshots, _, _, err := machineSnapshots(machine, machineID)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, snapshot := range snapshots {
+		name, _ := snapshot["name"].(string)
+		if !strings.HasPrefix(name, autoSnapshotPrefix) {
+			continue
+		}
+		if _, err := time.Parse(autoSnapshotLayout, strings.TrimPrefix(name, autoSnapshotPrefix)); err == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		if _, _, _, err := MistApiV2RemoveSnapshot(machineID, names[0], viper.New()); err != nil {
+			return fmt.Errorf("could not delete snapshot %s: %s", names[0], err)
+		}
+		fmt.Printf("Snapshot %s of %s deleted\n", names[0], machine)
+		names = names[1:]
+	}
+	return nil
+}
+
+func snapshotAutocomplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return machineAutocomplete(cmd, args, toComplete)
+	}
+	resolved, err := resolveResource("machine", args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	snapshots, _, _, err := machineSnapshots(args[0], resolved.id)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, snapshot := range snapshots {
+		if name, ok := snapshot["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+func snapshotCreateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "create MACHINE [NAME]",
+		Short: "Create a snapshot of a machine, now or on a schedule",
+		Long: `Create a snapshot of a machine, where the provider of its cloud supports
+snapshots. Snapshots without a name are named mist-YYYYMMDD-HHMMSS after
+the time they are created at, in UTC.
+
+With --keep, the oldest snapshots named so are deleted after creating one,
+keeping that many of them. Snapshots named by hand are never deleted.
+
+With --schedule, snapshots are created on a cron expression instead, by a
+line added to the crontab of the user, which runs this command with --keep
+if given. There is a schedule per machine, so scheduling a machine again
+replaces its schedule, and snapshot unschedule removes it.`,
+		Example: `  mist snapshot create db-1 before-upgrade
+  mist snapshot create db-1 --keep 7
+  mist snapshot create db-1 --schedule "0 3 * * *" --keep 7`,
+		Args:              cobra.RangeArgs(1, 2),
+		ValidArgsFunction: machineAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			keep := params.GetInt("keep")
+			if keep < 0 {
+				logger.Fatal("--keep can't be negative")
+			}
+			machineID := resolveArg("machine", args[0])
+			if expression := params.GetString("schedule"); expression != "" {
+				if len(args) == 2 {
+					logger.Fatal("Scheduled snapshots are named after the time they are created at, don't give a name with --schedule")
+				}
+				if _, err := parseCron(expression); err != nil {
+					logger.Fatal(err)
+				}
+				if err := setContext(); err != nil {
+					logger.Fatal(err)
+				}
+				context := viper.GetString("context")
+				schedule := snapshotSchedule{cron: expression, context: context, machineID: machineID, machine: args[0], keep: keep}
+				if _, err := setSnapshotSchedule(context, machineID, &schedule); err != nil {
+					logger.Fatal(err)
+				}
+				fmt.Printf("Snapshots of %s scheduled at %q\n", args[0], expression)
+				return
+			}
+			name := autoSnapshotPrefix + time.Now().UTC().Format(autoSnapshotLayout)
+			if len(args) == 2 {
+				name = args[1]
+			}
+			if _, _, _, err := MistApiV2CreateSnapshot(machineID, name, params); err != nil {
+				logger.Fatalf("Could not create a snapshot of %s, the provider of its cloud may not support snapshots: %s", args[0], err)
+			}
+			fmt.Printf("Snapshot %s of %s created\n", name, args[0])
+			if keep > 0 {
+				if err := pruneSnapshots(args[0], machineID, keep); err != nil {
+					logger.Fatal(err)
+				}
+			}
+		},
+	}
+	cmd.Flags().Int("keep", 0, "Delete the oldest snapshots named after their time, keeping this many, 0 to keep all")
+	cmd.Flags().String("schedule", "", "Create snapshots on this cron expression, like \"0 3 * * *\", from the crontab of the user")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func snapshotListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:               "list MACHINE",
+		Short:             "List the snapshots of a machine",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: machineAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			_, decoded, outputOptions, err := machineSnapshots(args[0], resolveArg("machine", args[0]))
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func snapshotRestoreCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:               "restore MACHINE SNAPSHOT",
+		Short:             "Revert a machine to a snapshot",
+		Long:              `Revert a machine to a snapshot, losing the changes made since it was taken.`,
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: snapshotAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			machineID := resolveArg("machine", args[0])
+			if !params.GetBool("yes") && !initConfirm(fmt.Sprintf("Revert %s to snapshot %s, losing the changes since", args[0], args[1])) {
+				return
+			}
+			if _, _, _, err := MistApiV2RevertToSnapshot(machineID, args[1], viper.New()); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			fmt.Printf("Machine %s reverted to snapshot %s\n", args[0], args[1])
+		},
+	}
+	cmd.Flags().BoolP("yes", "y", false, "Revert without asking for confirmation")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func snapshotDeleteCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:               "delete MACHINE SNAPSHOT...",
+		Short:             "Delete snapshots of a machine",
+		Args:              cobra.MinimumNArgs(2),
+		ValidArgsFunction: snapshotAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			machineID := resolveArg("machine", args[0])
+			snapshots := uniqueStrings(args[1:])
+			if !params.GetBool("yes") && !confirmAction("Delete", len(snapshots), "snapshot") {
+				return
+			}
+			for _, snapshot := range snapshots {
+				if _, _, _, err := MistApiV2RemoveSnapshot(machineID, snapshot, viper.New()); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				fmt.Printf("Snapshot %s of %s deleted\n", snapshot, args[0])
+			}
+		},
+	}
+	cmd.Flags().BoolP("yes", "y", false, "Delete without asking for confirmation")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func snapshotSchedulesCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "schedules",
+		Short: "List the snapshot schedules in the crontab",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			lines, err := readCrontab()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			rows := []interface{}{}
+			for _, line := range lines {
+				if s, ok := parseSnapshotSchedule(line); ok {
+					rows = append(rows, map[string]interface{}{"context": s.context, "machine": s.machine, "machine_id": s.machineID, "cron": s.cron, "keep": s.keep})
+				}
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{
+				[]string{"machine", "cron", "keep", "context"},
+				[]string{"machine", "machine_id", "cron", "keep", "context"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func snapshotUnscheduleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "unschedule MACHINE",
+		Short:             "Remove the snapshot schedule of a machine",
+		Long:              `Remove the snapshot schedule of a machine from the crontab. Its snapshots are kept.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: machineAutocomplete,
+		Run: func(cmd *cobra.Command, args []string) {
+			machineID := resolveArg("machine", args[0])
+			if err := setContext(); err != nil {
+				logger.Fatal(err)
+			}
+			found, err := setSnapshotSchedule(viper.GetString("context"), machineID, nil)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if !found {
+				logger.Fatalf("Machine %s has no snapshot schedule", args[0])
+			}
+			fmt.Printf("Snapshot schedule of %s removed\n", args[0])
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func snapshotCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Manage snapshots of machines",
+		Long: `Create, list, restore and delete snapshots of machines, and create them on
+a schedule, where the providers of their clouds support snapshots.`,
+	}
+	cmd.AddCommand(snapshotCreateCmd())
+	cmd.AddCommand(snapshotListCmd())
+	cmd.AddCommand(snapshotRestoreCmd())
+	cmd.AddCommand(snapshotDeleteCmd())
+	cmd.AddCommand(snapshotSchedulesCmd())
+	cmd.AddCommand(snapshotUnscheduleCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
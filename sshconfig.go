@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// hostKeysCommand prints the public host keys of a machine.
+const hostKeysCommand = "cat /etc/ssh/ssh_host_*_key.pub 2>/dev/null"
+
+// sshConfig returns OpenSSH Host stanzas for the hosts, named after them
+// with the prefix. Hosts connect with the identity file of their key in
+// identityDir, which is where key generate and key export put keys, and
+// through the proxy command, if given, which is passed the id of the machine.
+func sshConfig(hosts []inventoryHost, prefix, identityDir, knownHosts, proxyCommand string) string {
+	var b strings.Builder
+	fmt.Fprintln(&b, "# Generated by mist ssh-config, changes will be lost when it is run again.")
+	for _, host := range hosts {
+		// Host patterns are separated by spaces.
+		fmt.Fprintf(&b, "\nHost %s%s\n", prefix, strings.Join(strings.Fields(host.name), "-"))
+		fmt.Fprintf(&b, "  HostName %s\n", host.vars["ansible_host"])
+		if user, ok := host.vars["ansible_user"]; ok {
+			fmt.Fprintf(&b, "  User %s\n", user)
+		}
+		if port, ok := host.vars["ansible_port"]; ok {
+			fmt.Fprintf(&b, "  Port %d\n", port)
+		}
+		if key, ok := host.vars["mist_ssh_key"]; ok {
+			fmt.Fprintf(&b, "  IdentityFile %s\n", sshConfigQuote(filepath.Join(identityDir, fmt.Sprint(key))))
+			fmt.Fprintln(&b, "  IdentitiesOnly yes")
+		}
+		if proxyCommand != "" {
+			fmt.Fprintf(&b, "  ProxyCommand %s %s\n", proxyCommand, host.vars["mist_id"])
+		}
+		if knownHosts != "" {
+			fmt.Fprintf(&b, "  UserKnownHostsFile %s\n", sshConfigQuote(knownHosts))
+		}
+	}
+	return b.String()
+}
+
+// sshConfigQuote quotes values of ssh_config with spaces.
+func sshConfigQuote(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// knownHostsLines returns the known_hosts lines of the host keys of the
+// host, for its IPs and port.
+func knownHostsLines(host inventoryHost, hostKeys string) []string {
+	addresses := []string{}
+	ips := append(append([]string{}, host.vars["public_ips"].([]string)...), host.vars["private_ips"].([]string)...)
+	for _, ip := range ips {
+		if port, ok := host.vars["ansible_port"]; ok && port != 22 {
+			ip = "[" + ip + "]:" + fmt.Sprint(port)
+		}
+		addresses = append(addresses, ip)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(hostKeys, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "ssh-") && !strings.HasPrefix(fields[0], "ecdsa-") {
+			continue
+		}
+		lines = append(lines, strings.Join(addresses, ",")+" "+fields[0]+" "+fields[1])
+	}
+	return lines
+}
+
+// fetchKnownHosts reads the host keys of the hosts over the SSH websocket of
+// Mist, which checks them on its own, at most parallel at a time. Hosts
+// whose keys can't be read are reported and left out.
+func fetchKnownHosts(hosts []inventoryHost, parallel int) string {
+	lines := make([][]string, len(hosts))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host inventoryHost) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			shell, err := openRemoteShell(host.vars["mist_id"].(string))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not read the host keys of %s: %s\n", host.name, err)
+				return
+			}
+			defer shell.Close()
+			hostKeys, err := shell.Output(hostKeysCommand)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not read the host keys of %s: %s\n", host.name, err)
+				return
+			}
+			lines[i] = knownHostsLines(host, hostKeys)
+		}(i, host)
+	}
+	wg.Wait()
+	var b strings.Builder
+	for _, hostLines := range lines {
+		for _, line := range hostLines {
+			fmt.Fprintln(&b, line)
+		}
+	}
+	return b.String()
+}
+
+// writePrivateFile writes a file readable only by the user, creating its
+// directory if needed.
+func writePrivateFile(filename, content string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(content), 0600)
+}
+
+func sshConfigCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "ssh-config",
+		Short: "Generate OpenSSH configuration for machines",
+		Long: `Generate OpenSSH Host stanzas for the machines with IPs, so that ssh, scp
+and rsync connect to them by name. Hosts connect to their first public IP,
+or private IP if they have none, with the user and port of their first key
+association and the key of it in --identity-dir, where key generate and
+key export put keys.
+
+With --gateway, ssh connects through the SSH websocket of Mist with mist
+ssh --stdio, for machines which can only be reached by Mist.
+
+With --known-hosts, the host keys of the machines are read through Mist
+and written to the file, which the stanzas then use to check hosts.
+
+Write the stanzas to a file included by ~/.ssh/config, e.g. by adding
+Include config.d/mist at its top.`,
+		Example: `  mist ssh-config --output ~/.ssh/config.d/mist
+  mist ssh-config --search state:running --prefix mist- --known-hosts ~/.ssh/mist_known_hosts
+  mist ssh-config --gateway --output ~/.ssh/config.d/mist`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			listParams := viper.New()
+			for _, flag := range []string{"cloud", "search"} {
+				if value := params.GetString(flag); value != "" {
+					listParams.Set(flag, value)
+				}
+			}
+			decoded, _, err := listAllPages("machine", MistApiV2ListMachines, listParams)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			hosts := inventoryHosts(responseItems(decoded))
+			identityDir := params.GetString("identity-dir")
+			if identityDir == "" {
+				identityDir = "~/.ssh"
+			}
+			knownHosts := params.GetString("known-hosts")
+			if knownHosts != "" {
+				parallel := parallelism(params)
+				if parallel < 1 {
+					logger.Fatal("--parallel must be at least 1")
+				}
+				if err := writePrivateFile(knownHosts, fetchKnownHosts(hosts, parallel)); err != nil {
+					logger.Fatalf("Could not write the known hosts: %s", err.Error())
+				}
+				if abs, err := filepath.Abs(knownHosts); err == nil {
+					knownHosts = abs
+				}
+			}
+			proxyCommand := ""
+			if params.GetBool("gateway") {
+				executable, err := os.Executable()
+				if err != nil {
+					logger.Fatalf("Could not find the mist executable: %s", err.Error())
+				}
+				proxyCommand = sshConfigQuote(executable) + " ssh --stdio --port %p"
+			}
+			config := sshConfig(hosts, params.GetString("prefix"), identityDir, knownHosts, proxyCommand)
+			filename := params.GetString("output")
+			if filename == "" {
+				fmt.Print(config)
+				return
+			}
+			if err := writePrivateFile(filename, config); err != nil {
+				logger.Fatalf("Could not write the SSH config: %s", err.Error())
+			}
+			fmt.Fprintf(os.Stderr, "Wrote %d hosts to %s\n", len(hosts), filename)
+		},
+	}
+	cmd.Flags().String("cloud", "", "Only include the machines of this cloud")
+	cmd.Flags().String("search", "", "Only include the machines matching this search query, e.g. state:running")
+	cmd.Flags().String("prefix", "", "Prefix of the host names, e.g. mist-")
+	cmd.Flags().String("identity-dir", "", "Directory of the private keys, ~/.ssh by default")
+	cmd.Flags().Bool("gateway", false, "Connect through the SSH websocket of Mist instead of directly")
+	cmd.Flags().String("known-hosts", "", "Read the host keys of the machines and write them to this file")
+	cmd.Flags().Int("parallel", 4, "Maximum number of machines to read the host keys of at the same time")
+	cmd.Flags().String("output", "", "File to write the stanzas to instead of stdout")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/jmespath/go-jmespath"
 	"github.com/pkg/errors"
@@ -60,7 +63,8 @@ var tagSubCommandTpl = `Usage:{{if .Runnable}}
   {{.UseLine}}{{end}}{{if .HasAvailableSubCommands}}
   {{.CommandPath}} [command]{{end}}
 
-  RESOURCE... are resource names seperated by white space.
+  RESOURCE... are resource names seperated by white space. They may be
+  left out when --search selects the resources.
   TAGS are key-value comma seperated values. (e.g. key1=value1,key2){{if .HasExample}}
 
 Examples:
@@ -101,6 +105,22 @@ type tagResourceBody struct {
 	Operations []Operation `json:"operations"`
 }
 
+// parseTags parses tags given as KEY=VALUE pairs, or keys alone, separated
+// by commas.
+func parseTags(stringTags string) []KeyValuePair {
+	tags := []KeyValuePair{}
+	for _, stringTag := range strings.Split(stringTags, ",") {
+		splittedTag := strings.Split(stringTag, "=")
+		kv := KeyValuePair{}
+		kv.Key = splittedTag[0]
+		if len(splittedTag) > 1 {
+			kv.Value = splittedTag[1]
+		}
+		tags = append(tags, kv)
+	}
+	return tags
+}
+
 func tagValidArgsFunction(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 	resourceType := strings.Fields(cmd.Use)[0]
 	params := viper.New()
@@ -116,31 +136,61 @@ func tagValidArgsFunction(cmd *cobra.Command, args []string, toComplete string)
 	return strings.Split(str, ","), cobra.ShellCompDirectiveNoFileComp
 }
 
+// tagArgs requires the tags and, unless --search selects the resources, at
+// least one resource.
+func tagArgs(cmd *cobra.Command, args []string) error {
+	if search, _ := cmd.Flags().GetString("search"); search != "" {
+		return cobra.MinimumNArgs(1)(cmd, args)
+	}
+	return cobra.MinimumNArgs(2)(cmd, args)
+}
+
 func tagRun(cmd *cobra.Command, args []string, params *viper.Viper, tagOperation string) {
 	resourceType := strings.Fields(cmd.Use)[0]
-	resourceNames := args[:len(args)-1]
+	resourceNames := append([]string{}, args[:len(args)-1]...)
 	stringTags := args[len(args)-1]
+	result := newOperationResult()
+	resultFile := params.GetString("result-file")
 	resources := []Resource{}
 	for _, resourceName := range resourceNames {
 		_, decodedResource, _, err := resourceGetControllersMap[resourceType](resourceName, params)
 		rawResourceID, _ := jmespath.Search("data.id", decodedResource)
 		resourceID, ok := rawResourceID.(string)
 		if !ok {
+			if err == nil {
+				err = fmt.Errorf("could not find the id of %s %s", resourceType, resourceName)
+			}
+			result.fail(resourceName, err)
+			for _, skipped := range resourceNames[len(resources)+1:] {
+				result.skip(skipped)
+			}
+			result.write(resultFile, 1)
 			logger.Fatalf("Error parsing resource: %s", err.Error())
 		}
 		resources = append(resources, Resource{ResourceType: resourceType + "s", ResourceID: resourceID})
 	}
-	tags := []KeyValuePair{}
-	for _, stringTag := range strings.Split(stringTags, ",") {
-		splittedTag := strings.Split(stringTag, "=")
-		kv := KeyValuePair{}
-		kv.Key = splittedTag[0]
-		if len(splittedTag) > 1 {
-			kv.Value = splittedTag[1]
+	if search := params.GetString("search"); search != "" {
+		found, err := searchResources(resourceType, search)
+		if err != nil {
+			result.write(resultFile, 1)
+			logger.Fatalf("Error calling operation: %s", err.Error())
+		}
+		seen := make(map[string]bool)
+		for _, resource := range resources {
+			seen[resource.ResourceID] = true
+		}
+		for _, resource := range found {
+			if !seen[resource.id] {
+				seen[resource.id] = true
+				resourceNames = append(resourceNames, resource.name)
+				resources = append(resources, Resource{ResourceType: resourceType + "s", ResourceID: resource.id})
+			}
 		}
-		tags = append(tags, kv)
 	}
-	operations := []Operation{{Operation: tagOperation, Tags: tags, Resources: resources}}
+	if len(resources) == 0 {
+		logger.Fatalf("No %ss given, give resource names or use --search", resourceType)
+	}
+	operations := []Operation{{Operation: tagOperation, Tags: parseTags(stringTags), Resources: resources}}
 	body := tagResourceBody{Operations: operations}
 	rawBody, err := json.Marshal(body)
 	if err != nil {
@@ -148,8 +198,16 @@ func tagRun(cmd *cobra.Command, args []string, params *viper.Viper, tagOperation
 	}
 	_, decodedTag, outputOptions, err := MistApiV2TagResources(params, string(rawBody))
 	if err != nil {
+		for _, resourceName := range resourceNames {
+			result.fail(resourceName, err)
+		}
+		result.write(resultFile, 1)
 		logger.Fatalf("Error calling operation: %s", err.Error())
 	}
+	for _, resourceName := range resourceNames {
+		result.succeed(resourceName)
+	}
+	result.write(resultFile, 0)
 
 	if err := cli.Formatter.Format(decodedTag, params, outputOptions); err != nil {
 		logger.Fatalf("Formatting failed: %s", err.Error())
@@ -183,10 +241,10 @@ func tagCmd() *cobra.Command {
 	for _, resource := range taggableResources {
 		params := viper.New()
 		cmdResource := &cobra.Command{
-			Use:     resource + " RESOURCE... TAGS",
+			Use:     resource + " [RESOURCE...] TAGS",
 			Short:   "Tag " + resource,
 			Aliases: aliasesMap[resource],
-			Args:    cobra.MinimumNArgs(2),
+			Args:    tagArgs,
 			ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 				return tagValidArgsFunction(cmd, args, toComplete)
 			},
@@ -194,6 +252,9 @@ func tagCmd() *cobra.Command {
 				tagRun(cmd, args, params, "add")
 			},
 		}
+		cmdResource.Flags().String("search", "", "Also tag the "+resource+"s matching the search query")
+		cmdResource.Flags().String("result-file", "", "Write a JSON summary of the outcome of every resource to a file")
+		params.BindPFlags(cmdResource.Flags())
 		cmdResource.SetUsageTemplate(tagSubCommandTpl)
 		cmd.AddCommand(cmdResource)
 	}
@@ -210,10 +271,10 @@ func untagCmd() *cobra.Command {
 	for _, resource := range taggableResources {
 		params := viper.New()
 		cmdResource := &cobra.Command{
-			Use:     resource + " RESOURCE... TAGS",
+			Use:     resource + " [RESOURCE...] TAGS",
 			Short:   "Untag " + resource,
 			Aliases: aliasesMap[resource],
-			Args:    cobra.MinimumNArgs(2),
+			Args:    tagArgs,
 			ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 				return tagValidArgsFunction(cmd, args, toComplete)
 			},
@@ -221,12 +282,135 @@ func untagCmd() *cobra.Command {
 				tagRun(cmd, args, params, "remove")
 			},
 		}
+		cmdResource.Flags().String("search", "", "Also untag the "+resource+"s matching the search query")
+		cmdResource.Flags().String("result-file", "", "Write a JSON summary of the outcome of every resource to a file")
+		params.BindPFlags(cmdResource.Flags())
 		cmdResource.SetUsageTemplate(tagSubCommandTpl)
 		cmd.AddCommand(cmdResource)
 	}
 	return cmd
 }
 
+// resourceTags returns the tags of a resource as key-value pairs, whether
+// the API returned them as a map, a list of key/value objects or a list of
+// plain keys.
+func resourceTags(rawTags interface{}) []KeyValuePair {
+	tags := []KeyValuePair{}
+	switch t := rawTags.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			tags = append(tags, KeyValuePair{Key: key, Value: tagValueString(t[key])})
+		}
+	case []interface{}:
+		for _, item := range t {
+			switch tag := item.(type) {
+			case map[string]interface{}:
+				tags = append(tags, KeyValuePair{Key: tagValueString(tag["key"]), Value: tagValueString(tag["value"])})
+			default:
+				tags = append(tags, KeyValuePair{Key: tagValueString(tag)})
+			}
+		}
+	}
+	return tags
+}
+
+func tagValueString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// tagsShowRun fetches the resources one by one, so interrupting it with
+// Ctrl-C shows the tags of those fetched so far.
+func tagsShowRun(cmd *cobra.Command, args []string, params *viper.Viper) {
+	resourceType := strings.Fields(cmd.Use)[0]
+	columns := []string{"key", "value"}
+	if len(args) > 1 {
+		columns = []string{"resource", "key", "value"}
+	}
+	outputOptions := cli.CLIOutputOptions{columns, columns, []string{}, []string{}, map[string]string{}}
+	var mu sync.Mutex
+	rows := []interface{}{}
+	fetched := 0
+	sigc, stop := notifyInterrupt()
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, resourceName := range args {
+			_, decodedResource, _, err := resourceGetControllersMap[resourceType](resourceName, viper.New())
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			name, _ := jmespath.Search("data.name", decodedResource)
+			if name == nil {
+				name = resourceName
+			}
+			rawTags, _ := jmespath.Search("data.tags", decodedResource)
+			mu.Lock()
+			for _, tag := range resourceTags(rawTags) {
+				rows = append(rows, map[string]interface{}{"resource": name, "key": tag.Key, "value": tag.Value})
+			}
+			fetched++
+			mu.Unlock()
+		}
+	}()
+	select {
+	case <-done:
+	case <-sigc:
+		mu.Lock()
+		defer mu.Unlock()
+		note := fmt.Sprintf("showing the tags of %d of %d %ss", fetched, len(args), resourceType)
+		showPartial(map[string]interface{}{"data": append([]interface{}{}, rows...)}, params, outputOptions, note)
+	}
+	data := map[string]interface{}{"data": rows}
+	if err := cli.Formatter.Format(data, params, outputOptions); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+}
+
+func tagsShowCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show",
+		Short: "Show the tags of resources",
+	}
+	cmd.SetErr(os.Stderr)
+	aliasesMap := calculateAliasesMap(taggableResources)
+	for _, resource := range taggableResources {
+		params := viper.New()
+		cmdResource := &cobra.Command{
+			Use:     resource + " RESOURCE...",
+			Short:   "Show the tags of " + resource + "s",
+			Aliases: aliasesMap[resource],
+			Args:    cobra.MinimumNArgs(1),
+			ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+				return tagValidArgsFunction(cmd, args, toComplete)
+			},
+			Run: func(cmd *cobra.Command, args []string) {
+				tagsShowRun(cmd, args, params)
+			},
+		}
+		cmd.AddCommand(cmdResource)
+	}
+	return cmd
+}
+
+func tagsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tags",
+		Short: "Tag operations",
+	}
+	cmd.SetErr(os.Stderr)
+	cmd.AddCommand(tagsShowCmd())
+	return cmd
+}
+
 // MistApiV2TagResources Tag Resources
 func MistApiV2TagResources(params *viper.Viper, body string) (*gentleman.Response, interface{}, cli.CLIOutputOptions, error) {
 	handlerPath := "tag-resources"
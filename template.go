@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+)
+
+// Templates and stacks are only served by the orchestration endpoints of
+// version 1 of the API, which list them as plain arrays.
+
+func orchestrationItems(kind string) ([]map[string]interface{}, error) {
+	items := []map[string]interface{}{}
+	if err := apiV1Get(kind+"s", &items); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return fmt.Sprint(items[i]["name"]) < fmt.Sprint(items[j]["name"])
+	})
+	return items, nil
+}
+
+// lookupOrchestrationItem returns the template or stack given by name or
+// id.
+func lookupOrchestrationItem(kind, name string) (map[string]interface{}, error) {
+	items, err := orchestrationItems(kind)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item["id"] == name {
+			return item, nil
+		}
+	}
+	for _, item := range items {
+		if item["name"] == name {
+			return item, nil
+		}
+	}
+	return nil, fmt.Errorf("%s %s not found", kind, name)
+}
+
+func orchestrationAutocomplete(kind string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		items, err := orchestrationItems(kind)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		names := []string{}
+		for _, item := range items {
+			if name, ok := item["name"].(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// stackInputs returns the inputs of a workflow, read from the --values
+// file and then from every --input KEY=VALUE, which take precedence.
+// Values are parsed as YAML, so numbers and booleans keep their type.
+func stackInputs(cmd *cobra.Command) (map[string]interface{}, error) {
+	inputs := map[string]interface{}{}
+	if filename, _ := cmd.Flags().GetString("values"); filename != "" {
+		values, err := readResourceSpec("stack", filename)
+		if err != nil {
+			return nil, err
+		}
+		inputs = values
+	}
+	pairs, _ := cmd.Flags().GetStringArray("input")
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid input %q, expected KEY=VALUE", pair)
+		}
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(parts[1]), &value); err != nil || value == nil {
+			value = parts[1]
+		}
+		inputs[parts[0]] = normalizeYAML(value)
+	}
+	return inputs, nil
+}
+
+func addStackInputFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("input", []string{}, "Input of the workflow, as KEY=VALUE, may be repeated")
+	cmd.Flags().String("values", "", "YAML or JSON file with the inputs of the workflow, - for stdin")
+}
+
+// stackJob returns the job of the last workflow run on the stack.
+func stackJob(stack map[string]interface{}) string {
+	for _, field := range []string{"job_id", "jobId"} {
+		if id, ok := stack[field].(string); ok && id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// waitForStackJob records the job of a workflow and waits for it with
+// --wait.
+func waitForStackJob(cmd *cobra.Command, jobID string) {
+	if jobID == "" {
+		return
+	}
+	recordJob(jobID)
+	if wait, _ := cmd.Flags().GetBool("wait"); wait {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		if err := waitForJob(jobID, timeout); err != nil {
+			logger.Fatalf("Waiter error: %s", err.Error())
+		}
+	}
+}
+
+func addStackWaitFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("wait", "w", false, "Wait for the workflow to finish")
+	cmd.Flags().Duration("timeout", 30*time.Minute, "Maximum time to wait with --wait")
+}
+
+// followStackLogs writes the log entries of the job of a workflow, and with
+// follow keeps polling for new ones until the workflow finishes.
+func followStackLogs(jobID string, follow bool) error {
+	lw := newLogWriter()
+	written := 0
+	for {
+		resp, decoded, _, err := MistApiV2GetJob(jobID, viper.New())
+		if err != nil && (resp == nil || resp.StatusCode != 404) {
+			return err
+		}
+		job, _ := decoded["data"].(map[string]interface{})
+		logs, _ := job["logs"].([]interface{})
+		for _, entry := range logs[written:] {
+			if event, ok := entry.(map[string]interface{}); ok {
+				if err := lw.write(event); err != nil {
+					return err
+				}
+			}
+		}
+		written = len(logs)
+		if err := lw.flush(); err != nil {
+			return err
+		}
+		if !follow || (job != nil && jobStatus(job) != "running") {
+			return nil
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
+
+func templateListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List templates",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			templates, err := orchestrationItems("template")
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			rows := []interface{}{}
+			for _, template := range templates {
+				rows = append(rows, template)
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{
+				[]string{"name", "exec_type", "description"},
+				[]string{"id", "name", "exec_type", "location_type", "created_at", "description"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func templateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "template",
+		Short: "List orchestration templates",
+	}
+	cmd.AddCommand(templateListCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func stackListCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List stacks with their template and status",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			stacks, err := orchestrationItems("stack")
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			templates, err := orchestrationItems("template")
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			templateNames := map[interface{}]interface{}{}
+			for _, template := range templates {
+				templateNames[template["id"]] = template["name"]
+			}
+			rows := []interface{}{}
+			for _, stack := range stacks {
+				row := map[string]interface{}{}
+				for k, v := range stack {
+					row[k] = v
+				}
+				if name, ok := templateNames[stack["template"]]; ok {
+					row["template"] = name
+				}
+				rows = append(rows, row)
+			}
+			if err := cli.Formatter.Format(map[string]interface{}{"data": rows}, params, cli.CLIOutputOptions{
+				[]string{"name", "template", "status"},
+				[]string{"id", "name", "template", "status", "job_id", "created_at"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func stackDeployCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "deploy NAME",
+		Short: "Deploy a stack from a template",
+		Long: `Create a stack from a template and run its install workflow.
+
+The inputs of the workflow are read from the --values file, a map of
+input names to values, and from every --input KEY=VALUE, which take
+precedence. The workflow runs as a job, which is followed with
+--wait or later with stack logs.`,
+		Example: `  mist stack deploy web --template kubernetes --input workers=3
+  mist stack deploy web --template kubernetes --values ./web.yaml --wait`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			template, err := lookupOrchestrationItem("template", params.GetString("template"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			inputs, err := stackInputs(cmd)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			stack := map[string]interface{}{}
+			if err := apiV1Request("POST", "stacks", map[string]interface{}{
+				"name":        args[0],
+				"description": params.GetString("description"),
+				"template_id": template["id"],
+				"deploy":      true,
+				"inputs":      inputs,
+			}, &stack); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			jobID := stackJob(stack)
+			fmt.Printf("Stack %s deploying from template %v", args[0], template["name"])
+			if jobID != "" {
+				fmt.Printf(", job %s", jobID)
+			}
+			fmt.Println()
+			waitForStackJob(cmd, jobID)
+		},
+	}
+	cmd.Flags().String("template", "", "Template to deploy, by name or id")
+	cmd.Flags().String("description", "", "Description of the stack")
+	addStackInputFlags(cmd)
+	addStackWaitFlags(cmd)
+	cmd.MarkFlagRequired("template")
+	cmd.RegisterFlagCompletionFunc("template", orchestrationAutocomplete("template"))
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func stackStatusCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:               "status STACK",
+		Short:             "Show the status, inputs and outputs of a stack",
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: orchestrationAutocomplete("stack"),
+		Run: func(cmd *cobra.Command, args []string) {
+			stack, err := lookupOrchestrationItem("stack", args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if !isTableOutput() {
+				if err := cli.Formatter.Format(stack, params, cli.CLIOutputOptions{}); err != nil {
+					logger.Fatalf("Formatting failed: %s", err.Error())
+				}
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			for _, field := range []describeField{{"Name", "name", ""}, {"ID", "id", ""}, {"Template", "template", ""}, {"Status", "status", ""}, {"Job", "job_id", ""}, {"Created", "created_at", ""}, {"Error", "error", ""}} {
+				if value, ok := describeFieldValue(field, stack, nil); ok && value != "false" {
+					fmt.Fprintf(w, "%s:\t%s\n", field.Label, value)
+				}
+			}
+			for _, section := range []struct{ label, field string }{{"Inputs", "inputs"}, {"Outputs", "outputs"}} {
+				values, _ := stack[section.field].(map[string]interface{})
+				fmt.Fprintf(w, "%s:\n", section.label)
+				if len(values) == 0 {
+					fmt.Fprintln(w, "  <none>")
+				}
+				keys := []string{}
+				for key := range values {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					fmt.Fprintf(w, "  %s:\t%s\n", key, describeValue(values[key]))
+				}
+			}
+			w.Flush()
+		},
+	}
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func stackLogsCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "logs STACK",
+		Short: "Show the logs of the last workflow run on a stack",
+		Long: `Show the log entries of the job of the last workflow run on a stack, like
+its install or uninstall. With --follow, new entries are shown until the
+workflow finishes. With -o json, entries are written one per line as JSON.`,
+		Example:           "  mist stack logs web --follow",
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: orchestrationAutocomplete("stack"),
+		Run: func(cmd *cobra.Command, args []string) {
+			stack, err := lookupOrchestrationItem("stack", args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			jobID := stackJob(stack)
+			if jobID == "" {
+				logger.Fatalf("Stack %s has no workflow runs", args[0])
+			}
+			if err := followStackLogs(jobID, params.GetBool("follow")); err != nil {
+				logger.Fatalf("Could not read the logs of job %s: %s", jobID, err)
+			}
+		},
+	}
+	cmd.Flags().BoolP("follow", "f", false, "Keep showing new entries until the workflow finishes")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func stackTeardownCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "teardown STACK",
+		Short: "Run the uninstall workflow of a stack and delete it",
+		Long: `Tear a stack down: run its uninstall workflow, with the inputs given as
+for deploy, and delete the stack. A confirmation is asked for before,
+unless --yes is given.`,
+		Example:           "  mist stack teardown web --yes --wait",
+		Args:              cobra.ExactValidArgs(1),
+		ValidArgsFunction: orchestrationAutocomplete("stack"),
+		Run: func(cmd *cobra.Command, args []string) {
+			stack, err := lookupOrchestrationItem("stack", args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			inputs, err := stackInputs(cmd)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if !params.GetBool("yes") {
+				if !term.IsTerminal(int(os.Stdin.Fd())) {
+					logger.Fatal("Refusing to tear down without confirmation, use --yes")
+				}
+				fmt.Printf(" * %v (%v)\n", stack["name"], stack["id"])
+				if !confirmAction("Tear down", 1, "stack") {
+					fmt.Println("Cancelled")
+					return
+				}
+			}
+			response := map[string]interface{}{}
+			if err := apiV1Request("DELETE", fmt.Sprintf("stacks/%v", stack["id"]), map[string]interface{}{"inputs": inputs}, &response); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			jobID := stackJob(response)
+			fmt.Printf("Stack %v tearing down", stack["name"])
+			if jobID != "" {
+				fmt.Printf(", job %s", jobID)
+			}
+			fmt.Println()
+			waitForStackJob(cmd, jobID)
+		},
+	}
+	cmd.Flags().Bool("yes", false, "Tear down without asking for confirmation")
+	addStackInputFlags(cmd)
+	addStackWaitFlags(cmd)
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func stackCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stack",
+		Short: "Deploy, inspect and tear down stacks",
+	}
+	cmd.AddCommand(stackListCmd())
+	cmd.AddCommand(stackDeployCmd())
+	cmd.AddCommand(stackStatusCmd())
+	cmd.AddCommand(stackLogsCmd())
+	cmd.AddCommand(stackTeardownCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
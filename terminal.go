@@ -1,18 +1,12 @@
-// +build !windows
-
 package main
 
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
-	terminal "golang.org/x/term"
 )
 
 type terminalSize struct {
@@ -20,11 +14,22 @@ type terminalSize struct {
 	Width  int `json:"width"`
 }
 
+// rawTerminal puts the terminal in raw mode, and returns the function which
+// restores it.
+func rawTerminal() func() {
+	restore, err := makeTerminalRaw()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return restore
+}
+
 func updateTerminalSize(c *websocket.Conn, writeMutex *sync.Mutex, writeWait time.Duration) error {
-	width, height, err := terminal.GetSize(int(os.Stdin.Fd()))
+	width, height, err := getTerminalSize()
 	if err != nil {
 		return fmt.Errorf("Could not get terminal size %s\n", err)
 	}
+	activeRecorder.resize(width, height)
 	resizeMessage := terminalSize{height, width}
 	resizeMessageBinary, err := json.Marshal(&resizeMessage)
 	if err != nil {
@@ -39,17 +44,3 @@ func updateTerminalSize(c *websocket.Conn, writeMutex *sync.Mutex, writeWait tim
 	}
 	return nil
 }
-
-func handleTerminalResize(c *websocket.Conn, done *chan bool, writeMutex *sync.Mutex, writeWait time.Duration) {
-	defer func() { *done <- true }()
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGWINCH)
-	for {
-		<-sigc
-		err := updateTerminalSize(c, writeMutex, writeWait)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-	}
-}
@@ -0,0 +1,55 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/containerd/console"
+	terminal "golang.org/x/term"
+)
+
+// makeTerminalRaw puts the terminal in raw mode, and returns the function
+// which restores it.
+func makeTerminalRaw() (func(), error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("stdin is not a terminal")
+	}
+	current := console.Current()
+	if err := current.SetRaw(); err != nil {
+		return nil, err
+	}
+	return func() { current.Reset() }, nil
+}
+
+// getTerminalSize returns the width and height of the terminal.
+func getTerminalSize() (int, int, error) {
+	return terminal.GetSize(int(os.Stdin.Fd()))
+}
+
+// watchTerminalSize signals every change of the size of the terminal, with
+// SIGWINCH, until stop is closed.
+func watchTerminalSize(stop <-chan struct{}) <-chan struct{} {
+	resized := make(chan struct{})
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(sigc)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-sigc:
+				select {
+				case resized <- struct{}{}:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return resized
+}
@@ -3,66 +3,114 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
-	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
-	terminal "golang.org/x/term"
+	"golang.org/x/sys/windows"
 )
 
-type terminalSize struct {
-	Height int `json:"height"`
-	Width  int `json:"width"`
-}
+// terminalResizePoll is how often the size of the console is checked, since
+// Windows has no signal for it. Window buffer size events are only read with
+// ReadConsoleInput, which would take the input from the shell.
+const terminalResizePoll = 250 * time.Millisecond
 
-func getTerminalSize() (terminalSize, error) {
-	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
-	if err != nil {
-		return terminalSize{}, fmt.Errorf("Could not get terminal size %s\n", err)
+// makeTerminalRaw switches the console to raw mode with virtual terminal
+// sequences for input and output, as with the remote terminal, and returns
+// the function which restores it. Arrow keys and the like are then sent as
+// escape sequences, and Ctrl-C is sent to the shell. This works with the
+// classic console, PowerShell and Windows Terminal, which hosts shells in a
+// pseudo console. Mintty, as with Git Bash, gives programs pipes instead of a
+// console, so mist must be run through winpty there.
+func makeTerminalRaw() (func(), error) {
+	stdin := windows.Handle(os.Stdin.Fd())
+	var inMode uint32
+	if err := windows.GetConsoleMode(stdin, &inMode); err != nil {
+		return nil, fmt.Errorf("stdin is not a console, run mist with winpty from mintty or Git Bash")
 	}
-	return terminalSize{height, width}, nil
-}
-
-func updateTerminalSize(c *websocket.Conn, writeMutex *sync.Mutex, writeWait time.Duration) error {
-	resizeMessage, err := getTerminalSize()
-	if err != nil {
-		return fmt.Errorf("Could not get terminal size: %s\n", err)
+	stdout := windows.Handle(os.Stdout.Fd())
+	var outMode uint32
+	if err := windows.GetConsoleMode(stdout, &outMode); err != nil {
+		return nil, fmt.Errorf("stdout is not a console, run mist with winpty from mintty or Git Bash")
 	}
-	resizeMessageBinary, err := json.Marshal(&resizeMessage)
-	if err != nil {
-		return fmt.Errorf("Could not marshal resizeMessage %s\n", err)
+	raw := inMode&^(windows.ENABLE_ECHO_INPUT|windows.ENABLE_LINE_INPUT|windows.ENABLE_PROCESSED_INPUT|
+		windows.ENABLE_MOUSE_INPUT|windows.ENABLE_WINDOW_INPUT) | windows.ENABLE_VIRTUAL_TERMINAL_INPUT
+	if err := windows.SetConsoleMode(stdin, raw); err != nil {
+		// Consoles before Windows 10 don't translate keys to sequences.
+		if err := windows.SetConsoleMode(stdin, raw&^windows.ENABLE_VIRTUAL_TERMINAL_INPUT); err != nil {
+			return nil, err
+		}
 	}
-	writeMutex.Lock()
-	c.SetWriteDeadline(time.Now().Add(writeWait))
-	err = c.WriteMessage(websocket.BinaryMessage, append([]byte{1}, resizeMessageBinary...))
-	writeMutex.Unlock()
+	restoreOutput, err := enableTerminalOutput(stdout, outMode)
 	if err != nil {
-		return fmt.Errorf("write: %s", err)
+		windows.SetConsoleMode(stdin, inMode)
+		return nil, fmt.Errorf("the console does not support virtual terminal sequences, which needs Windows 10 or later: %s", err)
+	}
+	// Status lines on stderr use sequences too, if it is the console.
+	stderr := windows.Handle(os.Stderr.Fd())
+	var errMode uint32
+	restoreErrors := func() {}
+	if windows.GetConsoleMode(stderr, &errMode) == nil {
+		if restore, err := enableTerminalOutput(stderr, errMode); err == nil {
+			restoreErrors = restore
+		}
 	}
-	return nil
+	return func() {
+		restoreErrors()
+		restoreOutput()
+		windows.SetConsoleMode(stdin, inMode)
+	}, nil
 }
 
-func handleTerminalResize(c *websocket.Conn, done *chan bool, writeMutex *sync.Mutex, writeWait time.Duration) {
-	defer func() { *done <- true }()
-	oldTerminalSize := terminalSize{}
-	ticker := time.NewTicker(1000 * time.Millisecond)
-	for {
-		<-ticker.C
-		newTerminalSize, err := getTerminalSize()
-		if err != nil {
-			fmt.Println(err)
-			return
+// enableTerminalOutput makes the console interpret virtual terminal
+// sequences written to the handle, and returns the function which restores
+// its mode. Lines are not wrapped before the cursor reaches the next one,
+// as terminals do, where the console supports it.
+func enableTerminalOutput(handle windows.Handle, mode uint32) (func(), error) {
+	vt := mode | windows.ENABLE_PROCESSED_OUTPUT | windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING
+	if err := windows.SetConsoleMode(handle, vt|windows.DISABLE_NEWLINE_AUTO_RETURN); err != nil {
+		if err := windows.SetConsoleMode(handle, vt); err != nil {
+			return nil, err
 		}
-		if newTerminalSize != oldTerminalSize {
-			err := updateTerminalSize(c, writeMutex, writeWait)
-			if err != nil {
-				fmt.Println(err)
+	}
+	return func() { windows.SetConsoleMode(handle, mode) }, nil
+}
+
+// getTerminalSize returns the width and height of the visible window of the
+// console, rather than of its scrollback buffer.
+func getTerminalSize() (int, int, error) {
+	var info windows.ConsoleScreenBufferInfo
+	if err := windows.GetConsoleScreenBufferInfo(windows.Handle(os.Stdout.Fd()), &info); err != nil {
+		return 0, 0, err
+	}
+	return int(info.Window.Right-info.Window.Left) + 1, int(info.Window.Bottom-info.Window.Top) + 1, nil
+}
+
+// watchTerminalSize signals every change of the size of the console, until
+// stop is closed.
+func watchTerminalSize(stop <-chan struct{}) <-chan struct{} {
+	resized := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(terminalResizePoll)
+		defer ticker.Stop()
+		width, height, _ := getTerminalSize()
+		for {
+			select {
+			case <-stop:
 				return
+			case <-ticker.C:
+				w, h, err := getTerminalSize()
+				if err != nil || w == width && h == height {
+					continue
+				}
+				width, height = w, h
+				select {
+				case resized <- struct{}{}:
+				case <-stop:
+					return
+				}
 			}
 		}
-		oldTerminalSize = newTerminalSize
-	}
+	}()
+	return resized
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// timestampPattern matches the start of the timestamps of responses, like
+// 2022-07-15T12:34:56.789Z or 2022-07-15 12:34:56.
+var timestampPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}`)
+
+// timestampLayouts are the layouts timestamps are parsed with. Those
+// without a zone are in UTC, as the API returns them.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// displayTimeLayout is how timestamps are shown with --absolute-time.
+const displayTimeLayout = "2006-01-02 15:04:05 MST"
+
+// parseTimestamp returns the time of a timestamp of a response.
+func parseTimestamp(s string) (time.Time, bool) {
+	if !timestampPattern.MatchString(s) {
+		return time.Time{}, false
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// absoluteTime returns whether times are shown as timestamps rather than
+// relative to now, with --absolute-time or --utc.
+func absoluteTime() bool {
+	absolute, _ := cli.Root.PersistentFlags().GetBool("absolute-time")
+	utc, _ := cli.Root.PersistentFlags().GetBool("utc")
+	return absolute || utc
+}
+
+// displayTime shows the time relative to now, like 3h ago or in 2d, or in
+// local time, or UTC with --utc, with --absolute-time.
+func displayTime(t time.Time) string {
+	if absoluteTime() {
+		if utc, _ := cli.Root.PersistentFlags().GetBool("utc"); utc {
+			return t.UTC().Format(displayTimeLayout)
+		}
+		return t.Local().Format(displayTimeLayout)
+	}
+	d := time.Since(t)
+	switch {
+	case d > -time.Minute && d < time.Minute:
+		return "just now"
+	case d < 0:
+		return "in " + humanDuration(-d)
+	}
+	return humanDuration(d) + " ago"
+}
+
+// localizeTimes returns the value with the timestamps it contains shown
+// for people, leaving the value itself unchanged.
+func localizeTimes(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if t, ok := parseTimestamp(strings.TrimSpace(v)); ok {
+			return displayTime(t)
+		}
+	case map[string]interface{}:
+		localized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			localized[key] = localizeTimes(item)
+		}
+		return localized
+	case []interface{}:
+		localized := make([]interface{}, len(v))
+		for i, item := range v {
+			localized[i] = localizeTimes(item)
+		}
+		return localized
+	case []map[string]interface{}:
+		localized := make([]interface{}, len(v))
+		for i, item := range v {
+			localized[i] = localizeTimes(item)
+		}
+		return localized
+	}
+	return value
+}
+
+// localizedOutput returns whether the output format is read by people, so
+// that its timestamps are localized. Other formats keep the timestamps of
+// the API, for scripts.
+func localizedOutput() bool {
+	return isTableOutput() || strings.HasPrefix(outputFormat(), customColumnsPrefix)
+}
+
+func initTimeDisplay() {
+	cli.Root.PersistentFlags().Bool("utc", false, "Show times in tables as UTC timestamps")
+	cli.Root.PersistentFlags().Bool("absolute-time", false, "Show times in tables as local timestamps, instead of relative to now like 3h ago")
+}
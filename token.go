@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+// tokenExpiryWarning is how long before its expiry a token is reported as
+// about to expire.
+const tokenExpiryWarning = 5 * time.Minute
+
+var (
+	clockSkewMutex sync.Mutex
+	// clockSkew is the difference between the server's clock, as reported
+	// by the Date header of the last response, and the local clock.
+	clockSkew time.Duration
+
+	renewMutex sync.Mutex
+	// renewedToken is the token given at the prompt when the token of the
+	// context expired, so that it is asked for only once.
+	renewedToken string
+)
+
+func serverNow() time.Time {
+	clockSkewMutex.Lock()
+	defer clockSkewMutex.Unlock()
+	return time.Now().Add(clockSkew)
+}
+
+func recordServerDate(header http.Header) {
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return
+	}
+	clockSkewMutex.Lock()
+	clockSkew = time.Until(date)
+	clockSkewMutex.Unlock()
+}
+
+// tokenExpiry returns the expiry embedded in the token if it is a JWT.
+func tokenExpiry(token string) (time.Time, bool) {
+	token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp json.Number `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == "" {
+		return time.Time{}, false
+	}
+	exp, err := claims.Exp.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(exp), 0), true
+}
+
+// checkTokenExpiry returns an error if the token has expired and warns if it
+// is about to, taking into account the skew between the local and the
+// server's clock.
+func checkTokenExpiry(token string) error {
+	expiry, ok := tokenExpiry(token)
+	if !ok {
+		return nil
+	}
+	now := serverNow()
+	if !now.Before(expiry) {
+		return authError{fmt.Errorf("your token expired at %s, use `%s login` to sign in again", expiry.Local().Format(time.RFC1123), cli.Root.CommandPath())}
+	}
+	if expiry.Sub(now) < tokenExpiryWarning {
+		fmt.Fprintf(os.Stderr, "Warning: your token expires at %s\n", expiry.Local().Format(time.RFC1123))
+	}
+	return nil
+}
+
+// renewToken asks for a new token when the token of the context is not
+// valid anymore, if the CLI runs in a terminal, and stores it in the context.
+// Otherwise it returns reason.
+func renewToken(reason error) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return "", reason
+	}
+	renewMutex.Lock()
+	defer renewMutex.Unlock()
+	if renewedToken != "" {
+		return renewedToken, nil
+	}
+	if err := setContext(); err != nil {
+		return "", err
+	}
+	name := viper.GetString("context")
+	server, err := getValidServer()
+	if err != nil {
+		return "", err
+	}
+	server = strings.TrimSuffix(server, "/")
+	fmt.Fprintf(os.Stderr, "Warning: %s\nCreate a new token at %s/my-account/tokens\n", reason, server)
+	token, err := tokenPrompt()
+	if err != nil {
+		return "", reason
+	}
+	if err := verifyToken(server, token); err != nil {
+		return "", err
+	}
+	if id, _ := selectedOrg(); id != "" {
+		orgName, _ := contextOrgs(name)[id]["name"].(string)
+		err = saveOrgToken(name, id, orgName, token)
+	} else {
+		err = saveContextToken(name, server, token)
+	}
+	if err != nil {
+		return "", err
+	}
+	renewedToken = token
+	return token, nil
+}
+
+// validContextToken returns the token of the context, asking for a new one
+// if it has expired.
+func validContextToken() (string, error) {
+	token, err := getContextToken()
+	if err != nil {
+		return "", err
+	}
+	if err := checkTokenExpiry(token); err != nil {
+		return renewToken(err)
+	}
+	return token, nil
+}
+
+// rejectedTokenError explains an authentication failure of a request made
+// with token.
+func rejectedTokenError(token string) error {
+	if expiry, ok := tokenExpiry(token); ok && !serverNow().Before(expiry) {
+		return checkTokenExpiry(token)
+	}
+	return authError{fmt.Errorf("the server rejected the token of context %s, it may have been revoked, use `%s login` to sign in again", viper.GetString("context"), cli.Root.CommandPath())}
+}
+
+// initTokenChecks validates the token of every API request before it is
+// sent, and explains authentication failures caused by expired tokens.
+func initTokenChecks() {
+	cli.Client.UseHandler("before dial", func(ctx *context.Context, h context.Handler) {
+		// Responses served offline don't need a valid token.
+		if offline() {
+			h.Next(ctx)
+			return
+		}
+		authorization := ctx.Request.Header.Get("Authorization")
+		if err := checkTokenExpiry(authorization); err != nil {
+			token, err := renewToken(err)
+			if err != nil {
+				h.Error(ctx, err)
+				return
+			}
+			ctx.Request.Header.Set("Authorization", token)
+		}
+		h.Next(ctx)
+	})
+	cli.Client.UseResponse(func(ctx *context.Context, h context.Handler) {
+		recordServerDate(ctx.Response.Header)
+		if ctx.Response.StatusCode == http.StatusUnauthorized {
+			h.Error(ctx, rejectedTokenError(ctx.Request.Header.Get("Authorization")))
+			return
+		}
+		h.Next(ctx)
+	})
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// topSortKeys maps the keys of top to the columns they sort by.
+var topSortKeys = map[byte]string{'n': "name", 'c': "cpu", 'm': "ram", '$': "cost"}
+
+// topMachine is a row of top.
+type topMachine struct {
+	id      string
+	name    string
+	cloud   string
+	state   string
+	cpu     float64
+	ram     float64
+	monthly float64
+}
+
+// machineUsage returns the values of an instant query by machine id.
+func machineUsage(query string) (map[string]float64, error) {
+	params := viper.New()
+	params.Set("time", fmt.Sprintf("%d", time.Now().Unix()))
+	_, decoded, _, err := MistApiV2GetDatapoints(query, params)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	var response promqlResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return nil, err
+	}
+	usage := make(map[string]float64)
+	for _, item := range response.Data.DataPromql.Result {
+		if len(item.Value) != 2 {
+			continue
+		}
+		s, _ := item.Value[1].(string)
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			usage[item.Metric["machine_id"]] = v
+		}
+	}
+	return usage, nil
+}
+
+// topMachines returns the machines matching the search with their current
+// CPU and RAM usage, which is -1 for machines which aren't monitored.
+func topMachines(search string, names referenceNames) ([]*topMachine, error) {
+	params := viper.New()
+	params.Set("search", search)
+	params.Set("only", "id,name,cloud,state,cost")
+	params.Set("limit", 1000)
+	_, decoded, _, err := MistApiV2ListMachines(params)
+	if err != nil {
+		return nil, err
+	}
+	cpu, err := machineUsage(`100 - avg by (machine_id) (cpu_usage_idle{cpu="cpu-total"})`)
+	if err != nil {
+		return nil, err
+	}
+	ram, err := machineUsage(`avg by (machine_id) (mem_used_percent)`)
+	if err != nil {
+		return nil, err
+	}
+	machines := []*topMachine{}
+	for _, item := range responseItems(decoded) {
+		m := &topMachine{cpu: -1, ram: -1}
+		m.id, _ = item["id"].(string)
+		m.name, _ = item["name"].(string)
+		m.state, _ = item["state"].(string)
+		if cloud, ok := item["cloud"].(string); ok && cloud != "" {
+			m.cloud = names.lookup("cloud", cloud)
+		}
+		if v, ok := cpu[m.id]; ok {
+			m.cpu = v
+		}
+		if v, ok := ram[m.id]; ok {
+			m.ram = v
+		}
+		_, m.monthly = machineCost(item)
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// sortTopMachines sorts by name in ascending order, and by usage and cost
+// in descending order, busiest first.
+func sortTopMachines(machines []*topMachine, by string) {
+	sort.SliceStable(machines, func(i, j int) bool {
+		a, b := machines[i], machines[j]
+		switch by {
+		case "cpu":
+			if a.cpu != b.cpu {
+				return a.cpu > b.cpu
+			}
+		case "ram":
+			if a.ram != b.ram {
+				return a.ram > b.ram
+			}
+		case "cost":
+			if a.monthly != b.monthly {
+				return a.monthly > b.monthly
+			}
+		}
+		return a.name < b.name
+	})
+}
+
+// filterTopMachines returns the machines whose name, cloud or state
+// contains the filter.
+func filterTopMachines(machines []*topMachine, filter string) []*topMachine {
+	if filter == "" {
+		return machines
+	}
+	filtered := []*topMachine{}
+	filter = strings.ToLower(filter)
+	for _, m := range machines {
+		if strings.Contains(strings.ToLower(m.name+" "+m.cloud+" "+m.state), filter) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+func formatUsage(v float64) string {
+	if v < 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", v)
+}
+
+// topScreen is the state of the dashboard of top.
+type topScreen struct {
+	machines []*topMachine
+	sortBy   string
+	filter   string
+	typing   bool
+	selected int
+	updated  time.Time
+	err      error
+}
+
+// render draws the dashboard in the terminal, which is in raw mode, so
+// lines end with \r\n.
+func (s *topScreen) render(width, height int) {
+	rows := filterTopMachines(s.machines, s.filter)
+	if s.selected >= len(rows) {
+		s.selected = len(rows) - 1
+	}
+	if s.selected < 0 {
+		s.selected = 0
+	}
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	status := fmt.Sprintf("%d machines, sorted by %s, updated %s", len(rows), s.sortBy, s.updated.Format("15:04:05"))
+	if s.err != nil {
+		status = "Error: " + s.err.Error()
+	}
+	fmt.Fprintf(&b, "%s\r\n", truncateLine(status, width))
+	if s.typing || s.filter != "" {
+		fmt.Fprintf(&b, "Filter: %s\r\n", s.filter)
+	} else {
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "\033[1m%s\033[0m\r\n", truncateLine(fmt.Sprintf("%-30s %-16s %-12s %7s %7s %10s", "NAME", "CLOUD", "STATE", "CPU%", "RAM%", "MONTHLY"), width))
+	visible := height - 5
+	if visible < 1 {
+		visible = 1
+	}
+	first := 0
+	if s.selected >= visible {
+		first = s.selected - visible + 1
+	}
+	for i := first; i < len(rows) && i < first+visible; i++ {
+		m := rows[i]
+		line := truncateLine(fmt.Sprintf("%-30s %-16s %-12s %7s %7s %10.2f", m.name, m.cloud, m.state, formatUsage(m.cpu), formatUsage(m.ram), m.monthly), width)
+		if i == s.selected {
+			line = "\033[7m" + line + "\033[0m"
+		}
+		fmt.Fprintf(&b, "%s\r\n", line)
+	}
+	fmt.Fprintf(&b, "\033[%d;1H%s", height, truncateLine("q quit  ↑↓ move  n/c/m/$ sort by name/cpu/ram/cost  / filter  r refresh", width))
+	os.Stdout.WriteString(b.String())
+}
+
+func truncateLine(line string, width int) string {
+	if runes := []rune(line); width > 0 && len(runes) > width {
+		return string(runes[:width])
+	}
+	return line
+}
+
+// editInput applies a key press to a line being typed, reporting whether
+// the line was entered with Enter, or dropped with Esc, which clears it.
+func editInput(input string, k []byte) (string, bool, bool) {
+	switch {
+	case len(k) == 1 && (k[0] == '\r' || k[0] == '\n'):
+		return input, true, false
+	case len(k) == 1 && k[0] == 27:
+		return "", false, true
+	case len(k) == 1 && (k[0] == 127 || k[0] == 8):
+		if r := []rune(input); len(r) > 0 {
+			input = string(r[:len(r)-1])
+		}
+	case k[0] >= 32 && k[0] != 127:
+		input += string(k)
+	}
+	return input, false, false
+}
+
+// key handles a key press, returning false to quit.
+func (s *topScreen) key(k []byte) bool {
+	if s.typing {
+		if len(k) == 1 && k[0] == 3 {
+			return false
+		}
+		var entered, dropped bool
+		s.filter, entered, dropped = editInput(s.filter, k)
+		s.typing = !entered && !dropped
+		return true
+	}
+	switch {
+	case string(k) == "\033[A" || string(k) == "k":
+		s.selected--
+	case string(k) == "\033[B" || string(k) == "j":
+		s.selected++
+	case len(k) == 1 && (k[0] == 'q' || k[0] == 3):
+		return false
+	case len(k) == 1 && k[0] == '/':
+		s.typing = true
+	case len(k) == 1 && k[0] == 27:
+		s.filter = ""
+	case len(k) == 1 && topSortKeys[k[0]] != "":
+		s.sortBy = topSortKeys[k[0]]
+		sortTopMachines(s.machines, s.sortBy)
+	}
+	return true
+}
+
+// enterFullScreen switches the terminal to raw mode on the alternate screen,
+// returning the function switching it back.
+func enterFullScreen() func() {
+	restore := rawTerminal()
+	os.Stdout.WriteString("\033[?1049h\033[?25l")
+	return func() {
+		os.Stdout.WriteString("\033[?25h\033[?1049l")
+		restore()
+	}
+}
+
+// keyPresses reads key presses from stdin, one after each signal of next,
+// so that stdin can be handed over in between, like to a shell.
+func keyPresses(next <-chan struct{}) <-chan []byte {
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 16)
+		for range next {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte{}, buf[:n]...)
+		}
+	}()
+	return keys
+}
+
+// screenSize returns the width and height of the terminal.
+func screenSize() (int, int) {
+	if width, height, err := getTerminalSize(); err == nil && width > 0 {
+		return width, height
+	}
+	return 80, 24
+}
+
+// runTop shows the dashboard until q or Ctrl-C is pressed, refreshing the
+// machines every refresh and when r is pressed.
+func runTop(search, sortBy string, refresh time.Duration) {
+	leave := enterFullScreen()
+	defer leave()
+	next := make(chan struct{}, 1)
+	keys := keyPresses(next)
+	next <- struct{}{}
+
+	names := make(referenceNames)
+	s := &topScreen{sortBy: sortBy}
+	update := func() {
+		machines, err := topMachines(search, names)
+		s.err = err
+		if err == nil {
+			sortTopMachines(machines, s.sortBy)
+			s.machines = machines
+			s.updated = time.Now()
+		}
+	}
+	draw := func() {
+		s.render(screenSize())
+	}
+	update()
+	draw()
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case k, ok := <-keys:
+			if !ok || len(k) == 0 {
+				return
+			}
+			if !s.typing && len(k) == 1 && k[0] == 'r' {
+				update()
+			} else if !s.key(k) {
+				return
+			}
+			next <- struct{}{}
+		case <-ticker.C:
+			update()
+		}
+		draw()
+	}
+}
+
+func topCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show a live dashboard of machines by CPU, RAM and cost",
+		Long: `Show a live dashboard of machines with their current CPU and RAM usage,
+from monitoring, and their monthly cost.
+
+Use the arrow keys or j and k to move, n, c, m and $ to sort by name, CPU,
+RAM or cost, / to filter by name, cloud or state, r to refresh and q to
+quit. Machines which aren't monitored show - as their usage.
+
+When not run in a terminal, the machines are listed once.`,
+		Example: `  mist top
+  mist top --sort-by cost --search cloud:aws`,
+		Args: cobra.ExactValidArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			sortBy := params.GetString("sort-by")
+			switch sortBy {
+			case "name", "cpu", "ram", "cost":
+			default:
+				logger.Fatalf("Invalid --sort-by %q, expected name, cpu, ram or cost", sortBy)
+			}
+			if params.GetDuration("refresh") <= 0 {
+				logger.Fatal("--refresh must be positive")
+			}
+			if term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())) && isTableOutput() {
+				runTop(params.GetString("search"), sortBy, params.GetDuration("refresh"))
+				return
+			}
+			machines, err := topMachines(params.GetString("search"), make(referenceNames))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			sortTopMachines(machines, sortBy)
+			rows := []interface{}{}
+			for _, m := range machines {
+				row := map[string]interface{}{"id": m.id, "name": m.name, "cloud": m.cloud, "state": m.state, "monthly": roundCost(m.monthly, 2)}
+				if m.cpu >= 0 {
+					row["cpu"] = roundCost(m.cpu, 1)
+				}
+				if m.ram >= 0 {
+					row["ram"] = roundCost(m.ram, 1)
+				}
+				rows = append(rows, row)
+			}
+			data := map[string]interface{}{"data": rows}
+			if err := cli.Formatter.Format(data, params, cli.CLIOutputOptions{
+				[]string{"name", "cloud", "state", "cpu", "ram", "monthly"},
+				[]string{"id", "name", "cloud", "state", "cpu", "ram", "monthly"},
+				[]string{},
+				[]string{},
+				map[string]string{},
+			}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		},
+	}
+	cmd.Flags().String("sort-by", "cpu", "Sort machines by name, cpu, ram or cost")
+	cmd.Flags().String("search", "", "Only show the machines matching the search query")
+	cmd.Flags().Duration("refresh", 5*time.Second, "How often to refresh the dashboard")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2/context"
+)
+
+var (
+	transportOnce   sync.Once
+	sharedTransport *http.Transport
+	transportErr    error
+)
+
+// tlsConfig returns the TLS settings for connections to Mist, trusting the
+// certificates of --cacert along with those of the system.
+func tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: viper.GetBool("insecure_skip_verify")}
+	cacert := viper.GetString("cacert")
+	if cacert == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(cacert)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the CA certificates: %s", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", cacert)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+// proxyFunc returns the proxy to connect through: --proxy if given, or else
+// the one of the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+// variables, falling back to ALL_PROXY. Proxies may be HTTP or SOCKS5 ones,
+// like socks5://localhost:1080.
+func proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	proxy := viper.GetString("proxy")
+	if proxy == "" {
+		allProxy := os.Getenv("ALL_PROXY")
+		if allProxy == "" {
+			allProxy = os.Getenv("all_proxy")
+		}
+		if allProxy == "" {
+			return http.ProxyFromEnvironment, nil
+		}
+		return func(req *http.Request) (*url.URL, error) {
+			if u, err := http.ProxyFromEnvironment(req); u != nil || err != nil {
+				return u, err
+			}
+			return url.Parse(allProxy)
+		}, nil
+	}
+	u, err := parseProxyURL(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyURL(u), nil
+}
+
+// parseProxyURL validates the proxy setting. Only the schemes the standard
+// transport can dial are accepted.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q, expected a URL like http://proxy:3128 or socks5://proxy:1080", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", u.Scheme)
+}
+
+// httpTransport returns the transport of every request to Mist, going
+// through the proxy and verifying certificates as configured.
+func httpTransport() (*http.Transport, error) {
+	transportOnce.Do(func() {
+		config, err := tlsConfig()
+		if err != nil {
+			transportErr = err
+			return
+		}
+		proxy, err := proxyFunc()
+		if err != nil {
+			transportErr = err
+			return
+		}
+		sharedTransport = http.DefaultTransport.(*http.Transport).Clone()
+		sharedTransport.TLSClientConfig = config
+		sharedTransport.Proxy = proxy
+	})
+	return sharedTransport, transportErr
+}
+
+// apiTransport returns the transport of requests to Mist, which retries
+// temporary failures and times out every attempt after timeout, if not
+// zero.
+func apiTransport(timeout time.Duration) (http.RoundTripper, error) {
+	transport, err := httpTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &retryTransport{
+		next:    transport,
+		timeout: timeout,
+		retries: viper.GetInt("retries"),
+	}, nil
+}
+
+// httpClient returns a client using the configured transport, which times
+// out and retries requests like those of the API client.
+func httpClient() (*http.Client, error) {
+	transport, err := apiTransport(viper.GetDuration("request_timeout"))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// downloadClient returns a client like httpClient for downloads, which may
+// take longer than --request-timeout, so they time out after timeout.
+func downloadClient(timeout time.Duration) (*http.Client, error) {
+	transport, err := apiTransport(0)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// websocketDialer returns a dialer for the websockets of SSH sessions and
+// streams, going through the proxy and verifying certificates like API
+// requests do.
+func websocketDialer() (*websocket.Dialer, error) {
+	transport, err := httpTransport()
+	if err != nil {
+		return nil, err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = transport.Proxy
+	dialer.TLSClientConfig = transport.TLSClientConfig
+	return &dialer, nil
+}
+
+// initTransport adds the --proxy, --cacert and --insecure-skip-verify flags
+// and applies them to API requests. They can also be set with MIST_PROXY,
+// MIST_CACERT and MIST_INSECURE_SKIP_VERIFY or in the config file.
+func initTransport() {
+	flags := cli.Root.PersistentFlags()
+	flags.String("proxy", "", "HTTP or SOCKS5 proxy to connect through, instead of the one of HTTPS_PROXY")
+	flags.String("cacert", "", "PEM file of CA certificates to trust, e.g. of a self-signed Mist installation")
+	flags.Bool("insecure-skip-verify", false, "Don't verify the certificate of the server, which is insecure")
+	viper.BindPFlag("proxy", flags.Lookup("proxy"))
+	viper.BindPFlag("cacert", flags.Lookup("cacert"))
+	viper.BindPFlag("insecure_skip_verify", flags.Lookup("insecure-skip-verify"))
+	viper.BindEnv("proxy", "MIST_PROXY")
+	viper.BindEnv("cacert", "MIST_CACERT")
+	viper.BindEnv("insecure_skip_verify", "MIST_INSECURE_SKIP_VERIFY")
+	cli.Client.UseHandler("before dial", func(ctx *context.Context, h context.Handler) {
+		transport, err := apiTransport(viper.GetDuration("request_timeout"))
+		if err != nil {
+			h.Error(ctx, err)
+			return
+		}
+		ctx.Client.Transport = transport
+		h.Next(ctx)
+	})
+}
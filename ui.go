@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// uiPane is a kind of resource browsed by ui, with the fields shown as its
+// columns.
+type uiPane struct {
+	kind    string
+	columns []string
+}
+
+var uiPanes = []uiPane{
+	{"cloud", []string{"name", "provider", "enabled"}},
+	{"machine", []string{"name", "cloud", "state", "public_ips"}},
+	{"volume", []string{"name", "cloud", "size", "state"}},
+	{"network", []string{"name", "cloud", "cidr"}},
+}
+
+// uiCommands are the commands of the palette, opened with :.
+var uiCommands = []string{"clouds", "machines", "volumes", "networks", "refresh", "ssh", "reboot", "tag TAGS", "untag TAGS", "delete", "quit"}
+
+// uiScreen is the state of the resource browser.
+type uiScreen struct {
+	pane     int
+	items    []map[string]interface{}
+	names    referenceNames
+	selected int
+	filter   string
+	// mode is what is being typed: a filter, a command or tags, or a
+	// confirmation of the pending action.
+	mode    string
+	input   string
+	pending func() (string, error)
+	message string
+}
+
+// load lists the resources of the current pane, sorted by name.
+func (s *uiScreen) load() {
+	params := viper.New()
+	params.Set("limit", 1000)
+	_, decoded, _, err := resourceListControllersMap[uiPanes[s.pane].kind](params)
+	if err != nil {
+		s.items = nil
+		s.message = "Error: " + err.Error()
+		return
+	}
+	s.items = responseItems(decoded)
+	sort.SliceStable(s.items, func(i, j int) bool {
+		a, _ := s.items[i]["name"].(string)
+		b, _ := s.items[j]["name"].(string)
+		return a < b
+	})
+}
+
+// cell returns the value of a column of the resource, with clouds by name.
+func (s *uiScreen) cell(item map[string]interface{}, column string) string {
+	value := item[column]
+	if column == "cloud" {
+		if cloud, ok := value.(string); ok && cloud != "" {
+			return s.names.lookup("cloud", cloud)
+		}
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		values := []string{}
+		for _, e := range v {
+			values = append(values, fmt.Sprintf("%v", e))
+		}
+		return strings.Join(values, ",")
+	case map[string]interface{}:
+		j, _ := json.Marshal(v)
+		return string(j)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// rows returns the resources matching the filter, as rows of cells.
+func (s *uiScreen) rows() ([]map[string]interface{}, [][]string) {
+	items := []map[string]interface{}{}
+	rows := [][]string{}
+	filter := strings.ToLower(s.filter)
+	for _, item := range s.items {
+		row := []string{}
+		for _, column := range uiPanes[s.pane].columns {
+			row = append(row, s.cell(item, column))
+		}
+		if filter != "" && !strings.Contains(strings.ToLower(strings.Join(row, " ")), filter) {
+			continue
+		}
+		items = append(items, item)
+		rows = append(rows, row)
+	}
+	return items, rows
+}
+
+// current returns the selected resource, or nil when there is none.
+func (s *uiScreen) current() map[string]interface{} {
+	items, _ := s.rows()
+	if s.selected < 0 || s.selected >= len(items) {
+		return nil
+	}
+	return items[s.selected]
+}
+
+// render draws the browser in the terminal, which is in raw mode, so lines
+// end with \r\n.
+func (s *uiScreen) render(width, height int) {
+	_, rows := s.rows()
+	if s.selected >= len(rows) {
+		s.selected = len(rows) - 1
+	}
+	if s.selected < 0 {
+		s.selected = 0
+	}
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	tabs := []string{}
+	for i, pane := range uiPanes {
+		tab := fmt.Sprintf(" %d %ss ", i+1, pane.kind)
+		if i == s.pane {
+			tab = "\033[7m" + tab + "\033[0m"
+		}
+		tabs = append(tabs, tab)
+	}
+	fmt.Fprintf(&b, "%s\r\n", strings.Join(tabs, " "))
+	switch s.mode {
+	case "filter":
+		fmt.Fprintf(&b, "/%s\r\n", s.input)
+	case "command":
+		fmt.Fprintf(&b, ":%s\r\n", truncateLine(s.input+"  ("+strings.Join(uiCommands, ", ")+")", width-1))
+	case "tag", "untag":
+		fmt.Fprintf(&b, "%s KEY=VALUE,...: %s\r\n", s.mode, s.input)
+	default:
+		fmt.Fprintf(&b, "%s\r\n", truncateLine(s.message, width))
+	}
+	columns := uiPanes[s.pane].columns
+	widths := make([]int, len(columns))
+	for i, column := range columns {
+		widths[i] = len(column)
+		for _, row := range rows {
+			if n := len([]rune(row[i])); n > widths[i] {
+				widths[i] = n
+			}
+		}
+		if widths[i] > 40 {
+			widths[i] = 40
+		}
+	}
+	line := func(cells []string) string {
+		padded := []string{}
+		for i, cell := range cells {
+			padded = append(padded, fmt.Sprintf("%-*s", widths[i], truncateLine(cell, widths[i])))
+		}
+		return truncateLine(strings.Join(padded, "  "), width)
+	}
+	fmt.Fprintf(&b, "\033[1m%s\033[0m\r\n", line(func() []string {
+		header := []string{}
+		for _, column := range columns {
+			header = append(header, strings.ToUpper(column))
+		}
+		return header
+	}()))
+	visible := height - 4
+	if visible < 1 {
+		visible = 1
+	}
+	first := 0
+	if s.selected >= visible {
+		first = s.selected - visible + 1
+	}
+	for i := first; i < len(rows) && i < first+visible; i++ {
+		l := line(rows[i])
+		if i == s.selected {
+			l = "\033[7m" + l + "\033[0m"
+		}
+		fmt.Fprintf(&b, "%s\r\n", l)
+	}
+	help := "q quit  tab/1-4 pane  ↑↓ move  / filter  : commands  r refresh  t tag  u untag  d delete"
+	if uiPanes[s.pane].kind == "machine" {
+		help += "  s ssh  b reboot"
+	}
+	fmt.Fprintf(&b, "\033[%d;1H%s", height, truncateLine(help, width))
+	os.Stdout.WriteString(b.String())
+}
+
+// confirm asks to confirm the action before running it.
+func (s *uiScreen) confirm(question string, action func() (string, error)) {
+	s.mode = "confirm"
+	s.pending = action
+	s.message = question + " (y/N)"
+}
+
+// switchPane shows the resources of another pane.
+func (s *uiScreen) switchPane(pane int) {
+	s.pane = pane
+	s.selected = 0
+	s.filter = ""
+	s.message = ""
+	s.load()
+}
+
+// command runs a command of the palette, or of its key. It returns false
+// to quit, and true with ssh to open a shell to the selected machine.
+func (s *uiScreen) command(line string) (bool, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true, false
+	}
+	name, args := fields[0], strings.Join(fields[1:], " ")
+	for i, pane := range uiPanes {
+		if name == pane.kind || name == pane.kind+"s" {
+			s.switchPane(i)
+			return true, false
+		}
+	}
+	kind := uiPanes[s.pane].kind
+	item := s.current()
+	var id, resourceName string
+	if item != nil {
+		id, _ = item["id"].(string)
+		resourceName, _ = item["name"].(string)
+	}
+	switch name {
+	case "q", "quit":
+		return false, false
+	case "refresh":
+		s.message = ""
+		s.load()
+		return true, false
+	}
+	if item == nil {
+		s.message = "No " + kind + " selected"
+		return true, false
+	}
+	switch name {
+	case "ssh", "reboot":
+		if kind != "machine" {
+			s.message = name + " only works on machines"
+			return true, false
+		}
+		if name == "ssh" {
+			return true, true
+		}
+		s.confirm(fmt.Sprintf("Reboot machine %s?", resourceName), func() (string, error) {
+			_, _, _, err := MistApiV2RebootMachine(id, viper.New())
+			return "Rebooting machine " + resourceName, err
+		})
+	case "tag", "untag":
+		if args == "" {
+			s.mode = name
+			s.input = ""
+			return true, false
+		}
+		operation := map[string]string{"tag": "add", "untag": "remove"}[name]
+		body, err := json.Marshal(tagResourceBody{Operations: []Operation{{Operation: operation, Tags: parseTags(args), Resources: []Resource{{ResourceType: kind + "s", ResourceID: id}}}}})
+		if err == nil {
+			_, _, _, err = MistApiV2TagResources(viper.New(), string(body))
+		}
+		if err != nil {
+			s.message = "Error: " + err.Error()
+			return true, false
+		}
+		s.message = fmt.Sprintf("%sged %s %s with %s", name, kind, resourceName, args)
+		s.load()
+	case "delete":
+		s.confirm(fmt.Sprintf("Delete %s %s?", kind, resourceName), func() (string, error) {
+			return fmt.Sprintf("Deleted %s %s", kind, resourceName), resourceDeleteControllersMap[kind](id, viper.New())
+		})
+	default:
+		s.message = fmt.Sprintf("Unknown command %q", name)
+	}
+	return true, false
+}
+
+// key handles a key press. It returns false to quit, and true with ssh to
+// open a shell to the selected machine.
+func (s *uiScreen) key(k []byte) (bool, bool) {
+	if len(k) == 1 && k[0] == 3 {
+		return false, false
+	}
+	switch s.mode {
+	case "confirm":
+		s.mode = ""
+		s.message = ""
+		if string(k) == "y" || string(k) == "Y" {
+			message, err := s.pending()
+			if err != nil {
+				message = "Error: " + err.Error()
+			}
+			s.message = message
+			s.load()
+		}
+		s.pending = nil
+		return true, false
+	case "filter":
+		var entered, dropped bool
+		s.input, entered, dropped = editInput(s.input, k)
+		s.filter = s.input
+		if entered || dropped {
+			s.mode = ""
+		}
+		return true, false
+	case "command", "tag", "untag":
+		var entered, dropped bool
+		s.input, entered, dropped = editInput(s.input, k)
+		if dropped {
+			s.mode = ""
+		}
+		if !entered {
+			return true, false
+		}
+		line := s.input
+		if s.mode != "command" {
+			line = s.mode + " " + line
+		}
+		s.mode = ""
+		return s.command(line)
+	}
+	switch {
+	case string(k) == "\033[A" || string(k) == "k":
+		s.selected--
+	case string(k) == "\033[B" || string(k) == "j":
+		s.selected++
+	case string(k) == "\t":
+		s.switchPane((s.pane + 1) % len(uiPanes))
+	case string(k) == "\033[Z":
+		s.switchPane((s.pane + len(uiPanes) - 1) % len(uiPanes))
+	case len(k) == 1 && k[0] >= '1' && int(k[0]-'1') < len(uiPanes):
+		s.switchPane(int(k[0] - '1'))
+	case string(k) == "/":
+		s.mode = "filter"
+		s.input = s.filter
+	case string(k) == ":":
+		s.mode = "command"
+		s.input = ""
+	case string(k) == "\033":
+		s.filter = ""
+	default:
+		if command, ok := map[string]string{"q": "quit", "r": "refresh", "s": "ssh", "b": "reboot", "t": "tag", "u": "untag", "d": "delete"}[string(k)]; ok {
+			return s.command(command)
+		}
+	}
+	return true, false
+}
+
+// runUI shows the resource browser until it is quit. Shells are opened
+// outside of the full screen mode, which is entered again once they exit.
+func runUI() {
+	leave := enterFullScreen()
+	next := make(chan struct{}, 1)
+	keys := keyPresses(next)
+	s := &uiScreen{pane: 1, names: make(referenceNames)}
+	s.load()
+	for {
+		s.render(screenSize())
+		next <- struct{}{}
+		k, ok := <-keys
+		if !ok || len(k) == 0 {
+			break
+		}
+		more, ssh := s.key(k)
+		if !more {
+			break
+		}
+		if ssh {
+			id, _ := s.current()["id"].(string)
+			leave()
+			interactiveShell(id)
+			leave = enterFullScreen()
+		}
+	}
+	leave()
+}
+
+func uiCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ui",
+		Short: "Browse resources interactively",
+		Long: `Browse clouds, machines, volumes and networks in a full screen view.
+
+Switch between them with tab or 1 to 4, move with the arrow keys or j and
+k, and filter with /. The selected resource can be tagged with t, untagged
+with u and deleted with d, and machines can be rebooted with b or connected
+to with s. : opens the command palette, which takes the same actions by
+name, like tag env=dev, as well as the name of a pane and quit.`,
+		Args: cobra.ExactValidArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+				logger.Fatal("ui needs a terminal")
+			}
+			runUI()
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
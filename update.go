@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// Releases are published on GitHub, prereleases like v1.2.3-beta on the
+// beta channel, and their binaries along with their SHA-256 checksums on
+// dl.mist.io, as the CI does.
+const (
+	releasesURL = "https://api.github.com/repos/mistio/mist-cli/releases"
+	downloadURL = "https://dl.mist.io/cli/%s/bin/%s/%s/%s"
+)
+
+var updateChannels = []string{"stable", "beta"}
+
+type release struct {
+	Tag        string `json:"tag_name"`
+	Prerelease bool   `json:"prerelease"`
+	Draft      bool   `json:"draft"`
+	URL        string `json:"html_url"`
+}
+
+// parseVersion splits a version like v1.2.3-beta into its numbers and its
+// prerelease suffix.
+func parseVersion(version string) ([3]int, string, error) {
+	var numbers [3]int
+	version = strings.TrimPrefix(version, "v")
+	version, pre, _ := strings.Cut(version, "-")
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return numbers, "", fmt.Errorf("invalid version %q", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return numbers, "", fmt.Errorf("invalid version %q", version)
+		}
+		numbers[i] = n
+	}
+	return numbers, pre, nil
+}
+
+// compareVersions returns -1, 0 or 1 as version a is older than, the same
+// as or newer than b. Prereleases are older than their release.
+func compareVersions(a, b string) int {
+	an, apre, aerr := parseVersion(a)
+	bn, bpre, berr := parseVersion(b)
+	switch {
+	case aerr != nil && berr != nil:
+		return 0
+	case aerr != nil:
+		return -1
+	case berr != nil:
+		return 1
+	}
+	for i := range an {
+		if an[i] != bn[i] {
+			if an[i] < bn[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case apre == bpre:
+		return 0
+	case apre == "":
+		return 1
+	case bpre == "":
+		return -1
+	case apre < bpre:
+		return -1
+	}
+	return 1
+}
+
+// updateChannel returns the channel given with --channel, or the
+// update_channel setting.
+func updateChannel(params *viper.Viper) (string, error) {
+	channel := params.GetString("channel")
+	if channel == "" {
+		channel = viper.GetString("update_channel")
+	}
+	if channel == "" {
+		channel = "stable"
+	}
+	for _, c := range updateChannels {
+		if c == channel {
+			return channel, nil
+		}
+	}
+	return "", fmt.Errorf("unknown channel %q, expected stable or beta", channel)
+}
+
+// latestRelease returns the newest release of the channel: stable only has
+// releases, beta has prereleases too.
+func latestRelease(channel string) (release, error) {
+	var latest release
+	client, err := httpClient()
+	if err != nil {
+		return latest, err
+	}
+	client.Timeout = 30 * time.Second
+	resp, err := client.Get(releasesURL)
+	if err != nil {
+		return latest, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return latest, fmt.Errorf("could not list releases: %s", resp.Status)
+	}
+	releases := []release{}
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return latest, fmt.Errorf("could not parse releases: %s", err)
+	}
+	for _, r := range releases {
+		if r.Draft || r.Prerelease && channel != "beta" {
+			continue
+		}
+		if _, _, err := parseVersion(r.Tag); err != nil {
+			continue
+		}
+		if latest.Tag == "" || compareVersions(r.Tag, latest.Tag) > 0 {
+			latest = r
+		}
+	}
+	if latest.Tag == "" {
+		return latest, fmt.Errorf("no releases found on the %s channel", channel)
+	}
+	return latest, nil
+}
+
+// download writes the body of the URL to w.
+func download(url string, w io.Writer) error {
+	client, err := downloadClient(10 * time.Minute)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("could not download %s: %s", url, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// replaceExecutable downloads the binary of the release for this system,
+// checks it against its published checksum and replaces the running
+// executable with it, by renaming it over the executable so that mist is
+// never left half written.
+func replaceExecutable(tag string) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return "", err
+	}
+	name := "mist"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	url := fmt.Sprintf(downloadURL, tag, runtime.GOOS, runtime.GOARCH, name)
+	var checksum strings.Builder
+	if err := download(url+".sha256", &checksum); err != nil {
+		return "", err
+	}
+	expected := strings.Fields(checksum.String())
+	if len(expected) == 0 {
+		return "", fmt.Errorf("empty checksum at %s.sha256", url)
+	}
+	dir := filepath.Dir(executable)
+	tmp, err := ioutil.TempFile(dir, ".mist-update-")
+	if err != nil {
+		return "", fmt.Errorf("can't write to %s, run the update as a user who can: %s", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	err = download(url, io.MultiWriter(tmp, hash))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, expected[0]) {
+		return "", fmt.Errorf("checksum of %s is %s, expected %s", url, sum, expected[0])
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return "", err
+	}
+	// Windows doesn't replace running executables, but renames them.
+	if runtime.GOOS == "windows" {
+		old := executable + ".old"
+		os.Remove(old)
+		if err := os.Rename(executable, old); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp.Name(), executable); err != nil {
+		return "", err
+	}
+	return executable, nil
+}
+
+// checkSelfUpdate fails if updates are turned off, like for installs
+// managed by package managers.
+func checkSelfUpdate() {
+	if viper.IsSet("self_update") && !viper.GetBool("self_update") {
+		logger.Fatal("Updates are turned off by the self_update setting, update mist the way it was installed")
+	}
+}
+
+// describeUpdate tells whether the release is newer than this version.
+func describeUpdate(latest release, channel string) (string, bool) {
+	if compareVersions(latest.Tag, cliVersion) <= 0 {
+		return fmt.Sprintf("mist %s is the latest version on the %s channel", cliVersion, channel), false
+	}
+	return fmt.Sprintf("mist %s is available on the %s channel, run %s update to install it\n%s", strings.TrimPrefix(latest.Tag, "v"), channel, cli.Root.CommandPath(), latest.URL), true
+}
+
+func updateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "update",
+		Short: "Update mist to the latest version",
+		Long: `Update mist to the latest release of the channel, stable by default or
+beta to get prereleases too. The binary is checked against its published
+SHA-256 checksum before replacing the running one.
+
+The channel is set with --channel or the update_channel setting. Setting
+self_update to false turns updates off, for installs managed by package
+managers.`,
+		Example: `  mist update
+  mist update --channel beta
+  mist config set update_channel beta`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			checkSelfUpdate()
+			channel, err := updateChannel(params)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			latest, err := latestRelease(channel)
+			if err != nil {
+				logger.Fatalf("Error checking for updates: %s", err)
+			}
+			if compareVersions(latest.Tag, cliVersion) <= 0 && !params.GetBool("force") {
+				fmt.Printf("mist %s is the latest version on the %s channel\n", cliVersion, channel)
+				return
+			}
+			path, err := replaceExecutable(latest.Tag)
+			if err != nil {
+				logger.Fatalf("Error updating mist: %s", err)
+			}
+			fmt.Printf("Updated %s from %s to %s\n", path, cliVersion, strings.TrimPrefix(latest.Tag, "v"))
+		},
+	}
+	cmd.Flags().String("channel", "", "Release channel to update from: stable or beta")
+	cmd.Flags().Bool("force", false, "Install the latest release even if it isn't newer")
+	cmd.RegisterFlagCompletionFunc("channel", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return updateChannels, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// keyValueFlags parses KEY=VALUE flags into a map.
+func keyValueFlags(pairs []string, flag string) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("invalid --%s %q, expected KEY=VALUE", flag, pair)
+		}
+		if len(kv) == 1 {
+			m[kv[0]] = ""
+		} else {
+			m[kv[0]] = kv[1]
+		}
+	}
+	return m, nil
+}
+
+func volumeCreateCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a volume",
+		Long: `Create a volume of --size GB on a cloud. Options specific to the provider,
+like the type of disk, are given with --extra.`,
+		Example: `  mist volume create data --size 100 --cloud aws1 --location us-east-1a
+  mist volume create scratch --size 20 --cloud gce --extra type=pd-ssd --tag env=dev --wait`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if params.GetInt("size") <= 0 {
+				logger.Fatal("--size must be a positive number of GB")
+			}
+			volume := map[string]interface{}{
+				"name":  args[0],
+				"cloud": params.GetString("cloud"),
+				"size":  params.GetInt("size"),
+			}
+			if location := params.GetString("location"); location != "" {
+				volume["location"] = location
+			}
+			tags, _ := cmd.Flags().GetStringArray("tag")
+			extra, _ := cmd.Flags().GetStringArray("extra")
+			for field, pairs := range map[string][]string{"tags": tags, "extra": extra} {
+				if len(pairs) == 0 {
+					continue
+				}
+				m, err := keyValueFlags(pairs, strings.TrimSuffix(field, "s"))
+				if err != nil {
+					logger.Fatal(err)
+				}
+				volume[field] = m
+			}
+			body, err := json.Marshal(volume)
+			if err != nil {
+				logger.Fatalf("Unable to get body: %s", err.Error())
+			}
+			lastJobID = ""
+			_, decoded, outputOptions, err := MistApiV2CreateVolume(params, string(body))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+			if params.GetBool("wait") && lastJobID != "" {
+				if err := waitForJob(lastJobID, params.GetDuration("timeout")); err != nil {
+					logger.Fatalf("Waiter error: %s", err.Error())
+				}
+			}
+		},
+	}
+	cmd.Flags().Int("size", 0, "Size of the volume in GB")
+	cmd.Flags().String("cloud", "", "Cloud to create the volume on")
+	cmd.Flags().String("location", "", "Location to create the volume in")
+	cmd.Flags().StringArray("tag", []string{}, "Tag the volume with KEY=VALUE, may be repeated")
+	cmd.Flags().StringArray("extra", []string{}, "Provider specific KEY=VALUE option, may be repeated")
+	cmd.Flags().BoolP("wait", "w", false, "Wait for the volume to be created")
+	cmd.Flags().Duration("timeout", 15*time.Minute, "Maximum time to wait with --wait")
+	cmd.MarkFlagRequired("size")
+	cmd.MarkFlagRequired("cloud")
+	cmd.SetErr(os.Stderr)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	return cmd
+}
+
+func volumeRenameCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "rename VOLUME NAME",
+		Short:             "Rename a volume",
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeFirstArg(completeResourceFlag("volume")),
+		Run: func(cmd *cobra.Command, args []string) {
+			params := viper.New()
+			params.Set("name", args[1])
+			if _, _, _, err := MistApiV2EditVolume(args[0], params); err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			fmt.Printf("Volume %s renamed to %s\n", args[0], args[1])
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+func volumeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "volume",
+		Aliases: []string{"volumes"},
+		Short:   "Volume operations",
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.AddCommand(volumeCreateCmd())
+	cmd.AddCommand(volumeRenameCmd())
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"golang.org/x/term"
+)
+
+// activeWatcher receives the output of the command being watched instead of
+// the formatter.
+var activeWatcher *watcher
+
+// watcher keeps the last output of a watched command, to tell which
+// resources changed between polls.
+type watcher struct {
+	data          interface{}
+	params        *viper.Viper
+	outputOptions cli.CLIOutputOptions
+	captured      bool
+	items         map[string]map[string]interface{}
+	states        map[string]string
+	order         []string
+}
+
+func (w *watcher) capture(data interface{}, params *viper.Viper, outputOptions cli.CLIOutputOptions) {
+	w.data = data
+	w.params = params
+	w.outputOptions = outputOptions
+	w.captured = true
+}
+
+func watchedItemKey(item map[string]interface{}, i int) string {
+	for _, field := range []string{"id", "name"} {
+		if key, ok := item[field].(string); ok && key != "" {
+			return key
+		}
+	}
+	return strconv.Itoa(i)
+}
+
+// watchedItemState returns what is shown of the resource, so that fields
+// which change on every poll but aren't shown don't count as changes.
+func watchedItemState(item map[string]interface{}, columns []string) string {
+	var state interface{} = item
+	if len(columns) > 0 {
+		values := []interface{}{}
+		for _, column := range columns {
+			value, err := jmespath.Search(column, item)
+			if err != nil {
+				value = item[column]
+			}
+			values = append(values, value)
+		}
+		state = values
+	}
+	j, _ := json.Marshal(state)
+	return string(j)
+}
+
+// update compares the captured output with the previous one and returns the
+// resources which were added, modified or deleted, with an event field
+// telling which.
+func (w *watcher) update() []interface{} {
+	columns := w.outputOptions.WideColumns
+	items := make(map[string]map[string]interface{})
+	states := make(map[string]string)
+	order := []string{}
+	events := []interface{}{}
+	for i, item := range responseItems(w.data) {
+		key := watchedItemKey(item, i)
+		items[key] = item
+		states[key] = watchedItemState(item, columns)
+		order = append(order, key)
+		previous, ok := w.states[key]
+		switch {
+		case !ok:
+			events = append(events, withEvent(item, "ADDED"))
+		case previous != states[key]:
+			events = append(events, withEvent(item, "MODIFIED"))
+		}
+	}
+	for _, key := range w.order {
+		if _, ok := items[key]; !ok {
+			events = append(events, withEvent(w.items[key], "DELETED"))
+		}
+	}
+	w.items, w.states, w.order = items, states, order
+	return events
+}
+
+func withEvent(item map[string]interface{}, event string) map[string]interface{} {
+	copied := map[string]interface{}{"event": event}
+	for k, v := range item {
+		copied[k] = v
+	}
+	return copied
+}
+
+// withEventColumn adds the event column in front of the table columns.
+func withEventColumn(outputOptions cli.CLIOutputOptions) cli.CLIOutputOptions {
+	for _, list := range outputOptionsLists(&outputOptions) {
+		columns, footer := *list[0], *list[1]
+		if len(columns) == 0 {
+			continue
+		}
+		if len(footer) == len(columns) {
+			*list[1] = append([]string{""}, footer...)
+		}
+		*list[0] = append([]string{"event"}, columns...)
+	}
+	return outputOptions
+}
+
+// watch runs the command every interval. In a terminal, tables are redrawn
+// whenever a resource changes. Otherwise the output is printed once, and
+// then only the resources which changed are printed, with an event column.
+func watch(run func(cmd *cobra.Command, args []string), cmd *cobra.Command, args []string, interval time.Duration) {
+	formatter, ok := cli.Formatter.(*outputFormatter)
+	if !ok {
+		logger.Fatal("--watch is not supported with this output")
+	}
+	applyContextOutput()
+	redraw := isTableOutput() && term.IsTerminal(int(os.Stdout.Fd()))
+	w := &watcher{}
+	activeWatcher = w
+	for first := true; ; first = false {
+		w.captured = false
+		run(cmd, args)
+		if !w.captured {
+			logger.Fatal("--watch is only supported for commands showing resources")
+		}
+		events := w.update()
+		var err error
+		switch {
+		case redraw && (first || len(events) > 0):
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("Every %s: %s\t%s\n\n", interval, strings.Join(os.Args, " "), time.Now().Format(time.RFC1123))
+			err = formatter.render(w.data, w.params, w.outputOptions)
+		case first:
+			err = formatter.render(w.data, w.params, w.outputOptions)
+		case len(events) > 0:
+			err = formatter.render(map[string]interface{}{"data": events}, w.params, withEventColumn(w.outputOptions))
+		}
+		if err != nil {
+			logger.Fatalf("Formatting failed: %s", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
+
+// initWatchFlags adds the --watch and --interval flags to the commands
+// showing resources.
+func initWatchFlags() {
+	cmds := []*cobra.Command{}
+	for _, cmd := range cli.Root.Commands() {
+		switch {
+		case cmd.Name() == "get":
+			cmds = append(cmds, cmd.Commands()...)
+		case strings.HasPrefix(cmd.Name(), "list-"):
+			cmds = append(cmds, cmd)
+		}
+	}
+	for _, cmd := range cmds {
+		if cmd.Run == nil || cmd.Flags().Lookup("watch") != nil {
+			continue
+		}
+		if cmd.Flags().ShorthandLookup("w") == nil {
+			cmd.Flags().BoolP("watch", "w", false, "Keep showing the resources, updating them when they change")
+		} else {
+			cmd.Flags().Bool("watch", false, "Keep showing the resources, updating them when they change")
+		}
+		cmd.Flags().Duration("interval", 5*time.Second, "How often to check for changes with --watch")
+		run := cmd.Run
+		cmd.Run = func(cmd *cobra.Command, args []string) {
+			if on, _ := cmd.Flags().GetBool("watch"); !on {
+				run(cmd, args)
+				return
+			}
+			interval, _ := cmd.Flags().GetDuration("interval")
+			if interval <= 0 {
+				logger.Fatal("--interval must be positive")
+			}
+			watch(run, cmd, args, interval)
+		}
+	}
+}
@@ -29,40 +29,187 @@ func readFromRemoteStdout(c *websocket.Conn, done *chan bool, pongWait time.Dura
 			fmt.Println("binary message")
 			return
 		}
-		if _, err := io.Copy(os.Stdout, r); err != nil {
+		if _, err := io.Copy(terminalOutput(), r); err != nil {
 			fmt.Printf("Reading from websocket: %v\n", err)
 			return
 		}
 	}
 }
 
-func writeToRemoteStdin(c *websocket.Conn, done *chan bool, writeMutex *sync.Mutex, writeWait time.Duration) {
+func sendPingMessages(c *websocket.Conn, done *chan bool, writeWait time.Duration, pingPeriod time.Duration) {
 	defer func() { *done <- true }()
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
 	for {
-		var input []byte = make([]byte, 1)
-		os.Stdin.Read(input)
-		writeMutex.Lock()
-		c.SetWriteDeadline(time.Now().Add(writeWait))
-		err := c.WriteMessage(websocket.BinaryMessage, append([]byte{0}, input...))
-		writeMutex.Unlock()
+		select {
+		case <-ticker.C:
+			if err := c.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				fmt.Println("ping:", err)
+				return
+			}
+		}
+	}
+}
+
+// defaultKeepalive is how often shells are pinged to keep them open and
+// notice lost connections.
+const defaultKeepalive = 9 * time.Second
+
+var (
+	terminalInput     = make(chan []byte)
+	terminalInputOnce sync.Once
+)
+
+// startTerminalInput reads stdin a byte at a time for all the connections
+// of the terminal, so that keystrokes are not lost with a lost connection,
+// and at most one is held back once the shell exits.
+func startTerminalInput() {
+	terminalInputOnce.Do(func() {
+		go func() {
+			for {
+				input := make([]byte, 1)
+				n, err := os.Stdin.Read(input)
+				if n > 0 {
+					terminalInput <- input[:n]
+				}
+				if err != nil {
+					close(terminalInput)
+					return
+				}
+			}
+		}()
+	})
+}
+
+// terminalConnection is the terminal attached to the websocket of a remote
+// terminal. It ends when the first of its goroutines does, either because
+// the session ended or because the connection was lost.
+type terminalConnection struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+	done       chan bool
+	stop       chan struct{}
+	mutex      sync.Mutex
+	ended      bool
+	err        error
+}
+
+// finish ends the connection, because the session ended if err is nil or
+// because the connection was lost otherwise.
+func (t *terminalConnection) finish(err error) {
+	t.mutex.Lock()
+	if !t.ended && t.err == nil {
+		t.ended, t.err = err == nil, err
+	}
+	t.mutex.Unlock()
+	t.done <- true
+}
+
+// result returns why the connection was lost, or nil if the session ended.
+func (t *terminalConnection) result() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.ended {
+		return nil
+	}
+	if t.err == nil {
+		return fmt.Errorf("connection lost")
+	}
+	return t.err
+}
+
+func (t *terminalConnection) readOutput(pongWait time.Duration) {
+	t.conn.SetReadDeadline(time.Now().Add(pongWait))
+	t.conn.SetPongHandler(func(string) error { t.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	for {
+		mt, r, err := t.conn.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.finish(nil)
+			return
+		}
 		if err != nil {
-			fmt.Println("write:", err)
+			t.finish(err)
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			t.finish(nil)
+			return
+		}
+		if _, err := io.Copy(terminalOutput(), r); err != nil {
+			t.finish(err)
 			return
 		}
 	}
 }
 
-func sendPingMessages(c *websocket.Conn, done *chan bool, writeWait time.Duration, pingPeriod time.Duration) {
-	defer func() { *done <- true }()
+func (t *terminalConnection) writeInput(writeWait time.Duration) {
+	startTerminalInput()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case input, ok := <-terminalInput:
+			if !ok {
+				t.finish(nil)
+				return
+			}
+			t.writeMutex.Lock()
+			t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := t.conn.WriteMessage(websocket.BinaryMessage, append([]byte{0}, input...))
+			t.writeMutex.Unlock()
+			if err != nil {
+				t.finish(err)
+				return
+			}
+		}
+	}
+}
+
+// resizeTerminal resizes the remote terminal along with the local one.
+func (t *terminalConnection) resizeTerminal(writeWait time.Duration) {
+	for range watchTerminalSize(t.stop) {
+		if err := updateTerminalSize(t.conn, &t.writeMutex, writeWait); err != nil {
+			t.finish(err)
+			return
+		}
+	}
+}
+
+func (t *terminalConnection) sendPings(writeWait, pingPeriod time.Duration) {
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-t.stop:
+			return
 		case <-ticker.C:
-			if err := c.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-				fmt.Println("ping:", err)
+			if err := t.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				t.finish(err)
 				return
 			}
 		}
 	}
 }
+
+// attachConnection attaches the terminal, which must be in raw mode, to the
+// websocket of a remote terminal, pinging it every keepalive. It returns nil
+// once the session ends, or why the connection was lost.
+func attachConnection(c *websocket.Conn, keepalive time.Duration) error {
+	// Time allowed to write a message to the peer.
+	writeWait := 2 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait := keepalive * 10 / 9
+
+	t := &terminalConnection{conn: c, done: make(chan bool, 4), stop: make(chan struct{})}
+	defer close(t.stop)
+	if err := updateTerminalSize(c, &t.writeMutex, writeWait); err != nil {
+		return err
+	}
+	go t.resizeTerminal(writeWait)
+	go t.readOutput(pongWait)
+	go t.writeInput(writeWait)
+	go t.sendPings(writeWait, keepalive)
+	<-t.done
+	return t.result()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// hoursPerMonth is used to estimate monthly costs from hourly prices.
+const hoursPerMonth = 730
+
+// wizardListControllersMap lists the resources offered by the machine
+// wizard for a cloud.
+var wizardListControllersMap = map[string]func(params *viper.Viper) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error){
+	"location": MistApiV2ListLocations,
+	"image":    MistApiV2ListImages,
+	"size":     MistApiV2ListSizes,
+	"network":  MistApiV2ListNetworks,
+}
+
+// wizardOption is a resource which can be selected in the wizard.
+type wizardOption struct {
+	label string
+	id    string
+	name  string
+	item  map[string]interface{}
+}
+
+// wizardOptions returns the resources of the kind, of the cloud if one is
+// given, sorted by name.
+func wizardOptions(kind, cloud string) ([]wizardOption, error) {
+	params := viper.New()
+	params.Set("limit", 1000)
+	if cloud != "" {
+		params.Set("cloud", cloud)
+	}
+	list, ok := wizardListControllersMap[kind]
+	if !ok {
+		list = resourceListControllersMap[kind]
+	}
+	_, decoded, _, err := list(params)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %ss: %s", kind, err)
+	}
+	options := []wizardOption{}
+	for _, item := range responseItems(decoded) {
+		id, _ := item["id"].(string)
+		name, _ := item["name"].(string)
+		if name == "" {
+			name = id
+		}
+		options = append(options, wizardOption{label: name, id: id, name: name, item: item})
+	}
+	sort.SliceStable(options, func(i, j int) bool { return options[i].name < options[j].name })
+	return options, nil
+}
+
+// wizardSelect asks to pick one of the options, which can be filtered by
+// typing /. Optional selections start with a none option, returned as a
+// zero wizardOption. The cursor starts at the first option for which
+// preselect is true.
+func wizardSelect(label string, options []wizardOption, optional bool, preselect func(wizardOption) bool) (wizardOption, error) {
+	if optional {
+		options = append([]wizardOption{{label: "<none>"}}, options...)
+	}
+	if len(options) == 0 {
+		return wizardOption{}, fmt.Errorf("no %ss to choose from", strings.ToLower(label))
+	}
+	labels := []string{}
+	cursor := 0
+	for i, option := range options {
+		labels = append(labels, option.label)
+		if cursor == 0 && preselect != nil && option.id != "" && preselect(option) {
+			cursor = i
+		}
+	}
+	prompt := promptui.Select{
+		Label: label,
+		Items: labels,
+		Size:  10,
+		Searcher: func(input string, index int) bool {
+			return strings.Contains(strings.ToLower(labels[index]), strings.ToLower(strings.TrimSpace(input)))
+		},
+	}
+	i, _, err := prompt.RunCursorAt(cursor, cursor-cursor%10)
+	if err != nil {
+		return wizardOption{}, err
+	}
+	return options[i], nil
+}
+
+// sizePrice returns the hourly price of the size, if the provider reports
+// one.
+func sizePrice(size map[string]interface{}) (float64, bool) {
+	for _, path := range []string{"extra.price", "extra.price_hourly", "price"} {
+		value, err := jmespath.Search(path, size)
+		if err != nil {
+			continue
+		}
+		switch v := value.(type) {
+		case float64:
+			return v, v > 0
+		case string:
+			var price float64
+			if _, err := fmt.Sscanf(v, "%g", &price); err == nil && price > 0 {
+				return price, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// sizeLabel shows the size with its CPUs, RAM and price where known.
+func sizeLabel(option wizardOption) string {
+	details := []string{}
+	if cpus, ok := option.item["cpus"].(float64); ok && cpus > 0 {
+		details = append(details, fmt.Sprintf("%g CPUs", cpus))
+	}
+	if ram, ok := option.item["ram"].(float64); ok && ram > 0 {
+		details = append(details, fmt.Sprintf("%g MB RAM", ram))
+	}
+	if price, ok := sizePrice(option.item); ok {
+		details = append(details, fmt.Sprintf("$%.4f/hour", price))
+	}
+	if len(details) == 0 {
+		return option.name
+	}
+	return option.name + " (" + strings.Join(details, ", ") + ")"
+}
+
+// machineSpec is the request built by the wizard, in the order the fields
+// are shown in the equivalent command.
+type machineSpec struct {
+	fields        yaml.MapSlice
+	cloudInitFile string
+}
+
+func (s *machineSpec) set(key string, value interface{}) {
+	s.fields = append(s.fields, yaml.MapItem{Key: key, Value: value})
+}
+
+// body returns the JSON request body.
+func (s *machineSpec) body() (string, error) {
+	body := make(map[string]interface{})
+	for _, field := range s.fields {
+		body[field.Key.(string)] = field.Value
+	}
+	j, err := json.Marshal(body)
+	return string(j), err
+}
+
+// command returns the non-interactive command creating the same machine.
+// The cloud-init script is read from its file, as the wizard did.
+func (s *machineSpec) command() string {
+	args := []string{}
+	for _, field := range s.fields {
+		key := field.Key.(string)
+		switch value := field.Value.(type) {
+		case []interface{}:
+			for _, item := range value {
+				args = append(args, fmt.Sprintf("%s[]: %v", key, item))
+			}
+		default:
+			if key == "cloudinit" {
+				value = "@" + s.cloudInitFile
+			}
+			args = append(args, fmt.Sprintf("%s: %v", key, value))
+		}
+	}
+	return cli.Root.CommandPath() + " create machine " + shellQuote(strings.Join(args, ", "))
+}
+
+// manifest returns the manifest entry creating the same machine with
+// apply.
+func (s *machineSpec) manifest() (string, error) {
+	r := &manifestResource{Kind: "machine", Spec: make(map[string]interface{})}
+	for _, field := range s.fields {
+		if field.Key == "name" {
+			r.Name = field.Value.(string)
+			continue
+		}
+		r.Spec[field.Key.(string)] = field.Value
+	}
+	lines, err := resourceYAML(r, r.Spec)
+	return strings.Join(lines, "\n"), err
+}
+
+// machineWizard asks for the machine to create step by step, and returns
+// its request.
+func machineWizard() (*machineSpec, error) {
+	spec := &machineSpec{}
+	namePrompt := promptui.Prompt{
+		Label: "Name",
+		Validate: func(input string) error {
+			if strings.TrimSpace(input) == "" {
+				return fmt.Errorf("the name can't be empty")
+			}
+			return nil
+		},
+	}
+	name, err := namePrompt.Run()
+	if err != nil {
+		return nil, err
+	}
+	spec.set("name", strings.TrimSpace(name))
+
+	clouds, err := wizardOptions("cloud", "")
+	if err != nil {
+		return nil, err
+	}
+	for i, cloud := range clouds {
+		if provider, _ := cloud.item["provider"].(string); provider != "" {
+			clouds[i].label += " (" + provider + ")"
+		}
+	}
+	cloud, err := wizardSelect("Cloud", clouds, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	spec.set("cloud", cloud.name)
+
+	locations, err := wizardOptions("location", cloud.id)
+	if err != nil {
+		return nil, err
+	}
+	if len(locations) > 0 {
+		location, err := wizardSelect("Location", locations, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		spec.set("location", location.id)
+	}
+
+	images, err := wizardOptions("image", cloud.id)
+	if err != nil {
+		return nil, err
+	}
+	starred := starredImages()
+	for i := range images {
+		if imageStarred(images[i].item, starred) {
+			images[i].label = "* " + images[i].label
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return imageStarred(images[i].item, starred) && !imageStarred(images[j].item, starred)
+	})
+	image, err := wizardSelect("Image", images, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	spec.set("image", image.id)
+
+	sizes, err := wizardOptions("size", cloud.id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sizes {
+		sizes[i].label = sizeLabel(sizes[i])
+	}
+	size, err := wizardSelect("Size", sizes, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	spec.set("size", size.id)
+
+	networks, err := wizardOptions("network", cloud.id)
+	if err != nil {
+		return nil, err
+	}
+	if len(networks) > 0 {
+		network, err := wizardSelect("Network", networks, true, nil)
+		if err != nil {
+			return nil, err
+		}
+		if network.id != "" {
+			spec.set("networks", []interface{}{network.name})
+		}
+	}
+
+	keys, err := wizardOptions("key", "")
+	if err != nil {
+		return nil, err
+	}
+	key, err := wizardSelect("Key", keys, true, func(option wizardOption) bool {
+		isDefault, _ := option.item["default"].(bool)
+		return isDefault
+	})
+	if err != nil {
+		return nil, err
+	}
+	if key.id != "" {
+		spec.set("key", key.name)
+	}
+
+	cloudInitPrompt := promptui.Prompt{
+		Label: "Cloud-init file (empty for none)",
+		Validate: func(input string) error {
+			if input = strings.TrimSpace(input); input == "" {
+				return nil
+			}
+			if _, err := os.Stat(input); err != nil {
+				return fmt.Errorf("can't read %s", input)
+			}
+			return nil
+		},
+	}
+	cloudInitFile, err := cloudInitPrompt.Run()
+	if err != nil {
+		return nil, err
+	}
+	if cloudInitFile = strings.TrimSpace(cloudInitFile); cloudInitFile != "" {
+		cloudInit, err := ioutil.ReadFile(cloudInitFile)
+		if err != nil {
+			return nil, err
+		}
+		spec.set("cloudinit", string(cloudInit))
+		spec.cloudInitFile = cloudInitFile
+	}
+
+	if price, ok := sizePrice(size.item); ok {
+		fmt.Printf("\nEstimated cost: $%.4f/hour, about $%.2f/month\n", price, price*hoursPerMonth)
+	} else {
+		fmt.Println("\nNo cost estimate is available for this size")
+	}
+	return spec, nil
+}
+
+// createMachineInteractive runs the wizard, prints the equivalent command
+// and manifest, and creates the machine once confirmed.
+func createMachineInteractive(cmd *cobra.Command) {
+	spec, err := machineWizard()
+	if err == promptui.ErrInterrupt || err == promptui.ErrEOF {
+		fmt.Println("Cancelled")
+		return
+	}
+	if err != nil {
+		logger.Fatalf("Error calling operation: %s", err.Error())
+	}
+	manifest, err := spec.manifest()
+	if err != nil {
+		logger.Fatalf("Error calling operation: %s", err.Error())
+	}
+	fmt.Printf("\nTo create this machine again without prompts, run:\n\n  %s\n\n", spec.command())
+	fmt.Printf("or add it to a manifest for apply:\n\n%s\n\n", manifest)
+	if !confirmAction("Create", 1, "machine") {
+		fmt.Println("Cancelled")
+		return
+	}
+	body, err := spec.body()
+	if err != nil {
+		logger.Fatalf("Unable to get body: %s", err.Error())
+	}
+	createMachine(cmd, body)
+}